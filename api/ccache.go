@@ -65,13 +65,18 @@ func (s *Server) ccacheDelete(ctx *middleware.Context, req models.CCacheDelete)
 				res.AddError(err)
 				code = http.StatusBadRequest
 			} else {
-				query, err := tagquery.NewQuery(expressions, 0)
+				query, err := tagquery.NewQuery(expressions, 0, 0)
 				if err != nil {
 					res.AddError(err)
 					code = http.StatusInternalServerError
 				} else {
-					nodes := s.MetricIndex.FindByTag(req.OrgId, query)
-					toClear = append(toClear, nodes...)
+					nodes, err := s.MetricIndex.FindByTag(ctx.Req.Context(), req.OrgId, query)
+					if err != nil {
+						res.AddError(err)
+						code = http.StatusBadRequest
+					} else {
+						toClear = append(toClear, nodes...)
+					}
 				}
 			}
 		}
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -149,7 +148,11 @@ func (s *Server) indexTagDetails(ctx *middleware.Context, req models.IndexTagDet
 		return
 	}
 
-	values := s.MetricIndex.TagDetails(req.OrgId, req.Tag, re)
+	values, err := s.MetricIndex.TagDetails(ctx.Req.Context(), req.OrgId, req.Tag, re)
+	if err != nil {
+		response.Write(ctx, tagQueryError(err))
+		return
+	}
 	response.Write(ctx, response.NewMsgp(200, &models.IndexTagDetailsResp{Values: values}))
 }
 
@@ -201,18 +204,23 @@ func (s *Server) indexAutoCompleteTags(ctx *middleware.Context, req models.Index
 		return
 	}
 
-	expressions := req.Expr
-	if len(req.Prefix) > 0 {
-		expressions = append(expressions, "__tag^="+req.Prefix)
+	expressions, err := tagquery.ParseExpressions(req.Expr)
+	if err != nil {
+		response.Write(ctx, tagQueryError(err))
+		return
 	}
 
-	query, err := tagquery.NewQueryFromStrings(expressions, 0)
+	query, err := tagquery.NewAutoCompleteTagsQuery(req.Prefix, expressions, req.Limit)
 	if err != nil {
-		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		response.Write(ctx, tagQueryError(err))
 		return
 	}
 
-	tags := s.MetricIndex.FindTagsWithQuery(req.OrgId, req.Prefix, query, req.Limit)
+	tags, err := s.MetricIndex.FindTagsWithQuery(ctx.Req.Context(), req.OrgId, req.Prefix, query, query.Limit)
+	if err != nil {
+		response.Write(ctx, tagQueryError(err))
+		return
+	}
 	response.Write(ctx, response.NewMsgp(200, models.StringList(tags)))
 	return
 }
@@ -232,18 +240,23 @@ func (s *Server) indexAutoCompleteTagValues(ctx *middleware.Context, req models.
 		return
 	}
 
-	expressions := req.Expr
-	if len(req.Prefix) > 0 {
-		expressions = append(expressions, req.Tag+"^="+req.Prefix)
+	expressions, err := tagquery.ParseExpressions(req.Expr)
+	if err != nil {
+		response.Write(ctx, tagQueryError(err))
+		return
 	}
 
-	query, err := tagquery.NewQueryFromStrings(expressions, 0)
+	query, err := tagquery.NewAutoCompleteValuesQuery(req.Tag, req.Prefix, expressions, req.Limit)
 	if err != nil {
-		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		response.Write(ctx, tagQueryError(err))
 		return
 	}
 
-	tags := s.MetricIndex.FindTagValuesWithQuery(req.OrgId, req.Tag, req.Prefix, query, req.Limit)
+	tags, err := s.MetricIndex.FindTagValuesWithQuery(ctx.Req.Context(), req.OrgId, req.Tag, req.Prefix, query, query.Limit)
+	if err != nil {
+		response.Write(ctx, tagQueryError(err))
+		return
+	}
 	response.Write(ctx, response.NewMsgp(200, models.StringList(tags)))
 }
 
@@ -265,25 +278,21 @@ func (s *Server) indexTagDelSeries(ctx *middleware.Context, request models.Index
 		}
 
 		expressions := make(tagquery.Expressions, len(tags))
-		builder := strings.Builder{}
 		for i := range tags {
-			tags[i].StringIntoWriter(&builder)
-
-			expressions[i], err = tagquery.ParseExpression(builder.String())
+			expressions[i], err = tagquery.NewExpressionEqual(tags[i].Key, tags[i].Value)
 			if err != nil {
 				response.Write(ctx, response.WrapErrorForTagDB(err))
 				return
 			}
-			builder.Reset()
 		}
 
-		query, err := tagquery.NewQuery(expressions, 0)
+		query, err := tagquery.NewQuery(expressions, 0, 0)
 		if err != nil {
 			response.Write(ctx, response.WrapErrorForTagDB(err))
 			return
 		}
 
-		deleted, err := s.MetricIndex.DeleteTagged(request.OrgId, query)
+		deleted, err := s.MetricIndex.DeleteTagged(ctx.Req.Context(), request.OrgId, query)
 		if err != nil {
 			response.Write(ctx, response.WrapErrorForTagDB(err))
 			return
@@ -303,11 +312,15 @@ func (s *Server) IndexTagTerms(ctx *middleware.Context, req models.IndexTagTerms
 
 	query, err := tagquery.NewQueryFromStrings(req.Expr, 0)
 	if err != nil {
-		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		response.Write(ctx, tagQueryError(err))
 		return
 	}
 
-	total, terms := s.MetricIndex.FindTerms(req.OrgId, req.Tags, query)
+	total, terms, err := s.MetricIndex.FindTerms(ctx.Req.Context(), req.OrgId, req.Tags, query)
+	if err != nil {
+		response.Write(ctx, tagQueryError(err))
+		return
+	}
 
 	response.Write(ctx, response.NewMsgp(200, &models.GraphiteTagTermsResp{TotalSeries: total, Terms: terms}))
 }
@@ -322,12 +335,20 @@ func (s *Server) indexFindByTag(ctx *middleware.Context, req models.IndexFindByT
 
 	query, err := tagquery.NewQueryFromStrings(req.Expr, req.From)
 	if err != nil {
-		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		response.Write(ctx, tagQueryError(err))
 		return
 	}
 
-	metrics := s.MetricIndex.FindByTag(req.OrgId, query)
-	response.Write(ctx, response.NewMsgp(200, &models.IndexFindByTagResp{Metrics: metrics}))
+	if req.TraceFilters {
+		query.Trace = tagquery.NewQueryTrace()
+	}
+
+	metrics, err := s.MetricIndex.FindByTag(ctx.Req.Context(), req.OrgId, query)
+	if err != nil {
+		response.Write(ctx, tagQueryError(err))
+		return
+	}
+	response.Write(ctx, response.NewMsgp(200, &models.IndexFindByTagResp{Metrics: metrics, Trace: query.Trace.Expressions()}))
 }
 
 // IndexGet returns a msgp encoded schema.MetricDefinition
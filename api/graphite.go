@@ -689,7 +689,7 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 			if err != nil {
 				return nil, meta, err
 			}
-			series, err = s.clusterFindByTag(ctx, orgId, exprs, int64(r.From), maxSeriesPerReq-int(reqs.cnt), false)
+			series, err = s.clusterFindByTag(ctx, orgId, exprs, int64(r.From), maxSeriesPerReq-int(reqs.cnt), false, nil)
 		} else {
 			series, err = s.findSeries(ctx, orgId, []string{r.Query}, int64(r.From))
 		}
@@ -942,7 +942,7 @@ func (s *Server) graphiteTagFindSeries(ctx *middleware.Context, request models.G
 
 	expressions, err := tagquery.ParseExpressions(request.Expr)
 	if err != nil {
-		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		response.Write(ctx, tagQueryError(err))
 		return
 	}
 
@@ -955,12 +955,21 @@ func (s *Server) graphiteTagFindSeries(ctx *middleware.Context, request models.G
 		isSoftLimit = false
 	}
 
-	series, err := s.clusterFindByTag(reqCtx, ctx.OrgId, expressions, request.From, limit, isSoftLimit)
+	var trace models.GraphiteTagFindSeriesTrace
+	if request.TraceFilters {
+		trace = make(models.GraphiteTagFindSeriesTrace)
+	}
+
+	series, err := s.clusterFindByTag(reqCtx, ctx.OrgId, expressions, request.From, limit, isSoftLimit, trace)
 	if err != nil {
 		response.Write(ctx, response.WrapError(err))
 		return
 	}
 
+	for peer, traces := range trace {
+		log.Infof("HTTP tags/findSeries filter trace of %q on %s: %s", request.Expr, peer, tagquery.FormatExpressionTraces(traces))
+	}
+
 	select {
 	case <-reqCtx.Done():
 		//request canceled
@@ -976,7 +985,7 @@ func (s *Server) graphiteTagFindSeries(ctx *middleware.Context, request models.G
 
 	switch request.Format {
 	case "lastts-json":
-		retval := models.GraphiteTagFindSeriesLastTsResp{Warnings: warnings}
+		retval := models.GraphiteTagFindSeriesLastTsResp{Warnings: warnings, Trace: trace}
 		retval.Series = make([]models.SeriesLastTs, 0, len(series))
 		for _, serie := range series {
 			var lastUpdate int64
@@ -999,7 +1008,7 @@ func (s *Server) graphiteTagFindSeries(ctx *middleware.Context, request models.G
 		}
 
 		if request.Meta == true {
-			retval := models.GraphiteTagFindSeriesMetaResp{Series: seriesNames, Warnings: warnings}
+			retval := models.GraphiteTagFindSeriesMetaResp{Series: seriesNames, Warnings: warnings, Trace: trace}
 			response.Write(ctx, response.NewJson(200, retval, ""))
 		} else {
 			response.Write(ctx, response.NewJson(200, seriesNames, ""))
@@ -1009,8 +1018,9 @@ func (s *Server) graphiteTagFindSeries(ctx *middleware.Context, request models.G
 
 // clusterFindByTag returns the Series matching the given expressions.
 // If maxSeries is > 0, it specifies a limit which will truncate the resultset (if softLimit is true) or return an error otherwise.
-func (s *Server) clusterFindByTag(ctx context.Context, orgId uint32, expressions tagquery.Expressions, from int64, maxSeries int, softLimit bool) ([]Series, error) {
-	data := models.IndexFindByTag{OrgId: orgId, Expr: expressions.Strings(), From: from}
+// If trace is not nil the peers trace the filters of the query, their traces get added to it by peer name
+func (s *Server) clusterFindByTag(ctx context.Context, orgId uint32, expressions tagquery.Expressions, from int64, maxSeries int, softLimit bool, trace models.GraphiteTagFindSeriesTrace) ([]Series, error) {
+	data := models.IndexFindByTag{OrgId: orgId, Expr: expressions.Strings(), From: from, TraceFilters: trace != nil}
 	newCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	responseChan, errorChan := s.peerQuerySpeculativeChan(newCtx, data, "clusterFindByTag", "/index/find_by_tag")
@@ -1023,6 +1033,9 @@ func (s *Server) clusterFindByTag(ctx context.Context, orgId uint32, expressions
 		if err != nil {
 			return nil, err
 		}
+		if trace != nil {
+			trace[r.peer.GetName()] = resp.Trace
+		}
 
 		// Only check if maxSeriesPerReq > 0 (meaning enabled) or soft-limited
 		checkSeriesLimit := maxSeriesPerReq > 0 || softLimit
@@ -1261,25 +1274,21 @@ func (s *Server) graphiteTagDelSeries(ctx *middleware.Context, request models.Gr
 			}
 
 			expressions := make(tagquery.Expressions, len(tags))
-			builder := strings.Builder{}
 			for i := range tags {
-				tags[i].StringIntoWriter(&builder)
-
-				expressions[i], err = tagquery.ParseExpression(builder.String())
+				expressions[i], err = tagquery.NewExpressionEqual(tags[i].Key, tags[i].Value)
 				if err != nil {
 					response.Write(ctx, response.WrapErrorForTagDB(err))
 					return
 				}
-				builder.Reset()
 			}
 
-			query, err := tagquery.NewQuery(expressions, 0)
+			query, err := tagquery.NewQuery(expressions, 0, 0)
 			if err != nil {
 				response.Write(ctx, response.WrapErrorForTagDB(err))
 				return
 			}
 
-			deleted, err := s.MetricIndex.DeleteTagged(ctx.OrgId, query)
+			deleted, err := s.MetricIndex.DeleteTagged(ctx.Req.Context(), ctx.OrgId, query)
 			if err != nil {
 				response.Write(ctx, response.WrapErrorForTagDB(err))
 				return
@@ -1385,7 +1394,7 @@ func (s *Server) metaTagRecordUpsert(ctx *middleware.Context, upsertRequest mode
 
 	record, err := tagquery.ParseMetaTagRecord(upsertRequest.MetaTags, upsertRequest.Expressions)
 	if err != nil {
-		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		response.Write(ctx, tagQueryError(err))
 		return
 	}
 
@@ -1404,10 +1413,15 @@ func (s *Server) metaTagRecordSwap(ctx *middleware.Context, swapRequest models.M
 		return
 	}
 
+	// a swap can contain thousands of records, their regular expressions only get compiled
+	// once they get evaluated, instead of all of them up front
+	parseOptions := tagquery.DefaultParseOptions()
+	parseOptions.LazyRegexCompilation = true
+
 	var err error
 	metaTagRecords := make([]tagquery.MetaTagRecord, len(swapRequest.Records))
 	for i, rawRecord := range swapRequest.Records {
-		metaTagRecords[i], err = tagquery.ParseMetaTagRecord(rawRecord.MetaTags, rawRecord.Expressions)
+		metaTagRecords[i], err = tagquery.ParseMetaTagRecordWithOptions(rawRecord.MetaTags, rawRecord.Expressions, parseOptions)
 		if err != nil {
 			response.Write(ctx, response.Errorf(http.StatusBadRequest, "Error when parsing record %d: %s", i, err))
 			return
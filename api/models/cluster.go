@@ -1,6 +1,7 @@
 package models
 
 import (
+	"github.com/grafana/metrictank/expr/tagquery"
 	"github.com/grafana/metrictank/idx"
 )
 
@@ -47,6 +48,9 @@ type IndexTagDetailsResp struct {
 //go:generate msgp
 type IndexFindByTagResp struct {
 	Metrics []idx.Node `json:"metrics"`
+
+	// Trace is only set if the request asked for it, see IndexFindByTag.TraceFilters
+	Trace []tagquery.ExpressionTrace `json:"trace,omitempty"`
 }
 
 //go:generate msgp
@@ -3,6 +3,7 @@ package models
 // Code generated by github.com/tinylib/msgp DO NOT EDIT.
 
 import (
+	"github.com/grafana/metrictank/expr/tagquery"
 	"github.com/grafana/metrictank/idx"
 	"github.com/tinylib/msgp/msgp"
 )
@@ -365,6 +366,25 @@ func (z *IndexFindByTagResp) DecodeMsg(dc *msgp.Reader) (err error) {
 					return
 				}
 			}
+		case "Trace":
+			var zb0003 uint32
+			zb0003, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "Trace")
+				return
+			}
+			if cap(z.Trace) >= int(zb0003) {
+				z.Trace = (z.Trace)[:zb0003]
+			} else {
+				z.Trace = make([]tagquery.ExpressionTrace, zb0003)
+			}
+			for za0002 := range z.Trace {
+				err = z.Trace[za0002].DecodeMsg(dc)
+				if err != nil {
+					err = msgp.WrapError(err, "Trace", za0002)
+					return
+				}
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -378,9 +398,9 @@ func (z *IndexFindByTagResp) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *IndexFindByTagResp) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 1
+	// map header, size 2
 	// write "Metrics"
-	err = en.Append(0x81, 0xa7, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73)
+	err = en.Append(0x82, 0xa7, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73)
 	if err != nil {
 		return
 	}
@@ -396,15 +416,32 @@ func (z *IndexFindByTagResp) EncodeMsg(en *msgp.Writer) (err error) {
 			return
 		}
 	}
+	// write "Trace"
+	err = en.Append(0xa5, 0x54, 0x72, 0x61, 0x63, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Trace)))
+	if err != nil {
+		err = msgp.WrapError(err, "Trace")
+		return
+	}
+	for za0002 := range z.Trace {
+		err = z.Trace[za0002].EncodeMsg(en)
+		if err != nil {
+			err = msgp.WrapError(err, "Trace", za0002)
+			return
+		}
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *IndexFindByTagResp) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 1
+	// map header, size 2
 	// string "Metrics"
-	o = append(o, 0x81, 0xa7, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73)
+	o = append(o, 0x82, 0xa7, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73)
 	o = msgp.AppendArrayHeader(o, uint32(len(z.Metrics)))
 	for za0001 := range z.Metrics {
 		o, err = z.Metrics[za0001].MarshalMsg(o)
@@ -413,6 +450,16 @@ func (z *IndexFindByTagResp) MarshalMsg(b []byte) (o []byte, err error) {
 			return
 		}
 	}
+	// string "Trace"
+	o = append(o, 0xa5, 0x54, 0x72, 0x61, 0x63, 0x65)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.Trace)))
+	for za0002 := range z.Trace {
+		o, err = z.Trace[za0002].MarshalMsg(o)
+		if err != nil {
+			err = msgp.WrapError(err, "Trace", za0002)
+			return
+		}
+	}
 	return
 }
 
@@ -453,6 +500,25 @@ func (z *IndexFindByTagResp) UnmarshalMsg(bts []byte) (o []byte, err error) {
 					return
 				}
 			}
+		case "Trace":
+			var zb0003 uint32
+			zb0003, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Trace")
+				return
+			}
+			if cap(z.Trace) >= int(zb0003) {
+				z.Trace = (z.Trace)[:zb0003]
+			} else {
+				z.Trace = make([]tagquery.ExpressionTrace, zb0003)
+			}
+			for za0002 := range z.Trace {
+				bts, err = z.Trace[za0002].UnmarshalMsg(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Trace", za0002)
+					return
+				}
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -471,6 +537,10 @@ func (z *IndexFindByTagResp) Msgsize() (s int) {
 	for za0001 := range z.Metrics {
 		s += z.Metrics[za0001].Msgsize()
 	}
+	s += 6 + msgp.ArrayHeaderSize
+	for za0002 := range z.Trace {
+		s += z.Trace[za0002].Msgsize()
+	}
 	return
 }
 
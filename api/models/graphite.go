@@ -7,6 +7,7 @@ import (
 	"strconv"
 
 	"github.com/go-macaron/binding"
+	"github.com/grafana/metrictank/expr/tagquery"
 	"github.com/grafana/metrictank/idx"
 	pickle "github.com/kisielk/og-rek"
 	opentracing "github.com/opentracing/opentracing-go"
@@ -28,6 +29,7 @@ import (
 //msgp:ignore GraphiteTagFindSeriesResp
 //msgp:ignore GraphiteTagFindSeriesLastTsResp
 //msgp:ignore GraphiteTagFindSeriesMetaResp
+//msgp:ignore GraphiteTagFindSeriesTrace
 //msgp:ignore GraphiteTagResp
 //msgp:ignore GraphiteTags
 //msgp:ignore GraphiteTagsResp
@@ -126,8 +128,16 @@ type GraphiteTagFindSeries struct {
 	Format string   `json:"format" form:"format" binding:"In(,series-json,lastts-json);Default(series-json)"`
 	Limit  int      `json:"limit" binding:"Default(0)"`
 	Meta   bool     `json:"meta" binding:"Default(false)"`
+
+	// TraceFilters makes the peers trace the filters of the query, the traces get logged and
+	// returned with the responses which have fields besides the series
+	TraceFilters bool `json:"traceFilters" form:"traceFilters" binding:"Default(false)"`
 }
 
+// GraphiteTagFindSeriesTrace holds the traces of the filters of a tag query by the name of the
+// peer which executed it
+type GraphiteTagFindSeriesTrace map[string][]tagquery.ExpressionTrace
+
 type GraphiteTagFindSeriesResp struct {
 	Series []string `json:"series"`
 }
@@ -138,13 +148,15 @@ type SeriesLastTs struct {
 }
 
 type GraphiteTagFindSeriesLastTsResp struct {
-	Series   []SeriesLastTs `json:"series"`
-	Warnings []string       `json:"warnings,omitempty"`
+	Series   []SeriesLastTs             `json:"series"`
+	Warnings []string                   `json:"warnings,omitempty"`
+	Trace    GraphiteTagFindSeriesTrace `json:"trace,omitempty"`
 }
 
 type GraphiteTagFindSeriesMetaResp struct {
-	Series   []string `json:"series"`
-	Warnings []string `json:"warnings,omitempty"`
+	Series   []string                   `json:"series"`
+	Warnings []string                   `json:"warnings,omitempty"`
+	Trace    GraphiteTagFindSeriesTrace `json:"trace,omitempty"`
 }
 
 type GraphiteTagDelSeries struct {
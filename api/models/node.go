@@ -43,6 +43,9 @@ type IndexFindByTag struct {
 	OrgId uint32   `json:"orgId" binding:"Required"`
 	Expr  []string `json:"expressions"`
 	From  int64    `json:"from"`
+
+	// TraceFilters requests the traces of the filters of the query to be returned with the result
+	TraceFilters bool `json:"traceFilters"`
 }
 
 func (t IndexFindByTag) Trace(span opentracing.Span) {
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/expr/tagquery"
+)
+
+// tagQueryError returns the response to an error which occurred while parsing the
+// expressions of a tag query. invalid expressions are the fault of the client, all
+// other errors get the status code they specify, or 500 if they don't
+func tagQueryError(err error) *response.ErrorResp {
+	if errors.Is(err, tagquery.ErrInvalidExpression) {
+		return response.NewError(http.StatusBadRequest, err.Error())
+	}
+	return response.WrapError(err)
+}
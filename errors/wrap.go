@@ -0,0 +1,71 @@
+package errors
+
+import (
+	"reflect"
+)
+
+// Unwrap, Is and As follow the semantics of the functions of the same names in the
+// standard library's errors package, which are not available in all the Go versions
+// we build with. Errors which implement "Unwrap() error" or "Is(error) bool" work
+// with both implementations.
+
+// Unwrap returns the result of calling the Unwrap method on err, if err's type has one.
+// Otherwise it returns nil
+func Unwrap(err error) error {
+	u, ok := err.(interface{ Unwrap() error })
+	if !ok {
+		return nil
+	}
+	return u.Unwrap()
+}
+
+// Is reports whether any error in err's chain matches target. An error matches the
+// target if it is equal to it, or if it has a method "Is(error) bool" which returns
+// true for it
+func Is(err, target error) bool {
+	if target == nil {
+		return err == target
+	}
+
+	comparable := reflect.TypeOf(target).Comparable()
+	for err != nil {
+		if comparable && err == target {
+			return true
+		}
+		if x, ok := err.(interface{ Is(error) bool }); ok && x.Is(target) {
+			return true
+		}
+		err = Unwrap(err)
+	}
+	return false
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// As finds the first error in err's chain which is assignable to the value pointed to
+// by target, if there is one it sets target to that error and returns true.
+// As panics if target is not a non-nil pointer to a type implementing error or to an
+// interface type
+func As(err error, target interface{}) bool {
+	if target == nil {
+		panic("errors: target cannot be nil")
+	}
+	val := reflect.ValueOf(target)
+	typ := val.Type()
+	if typ.Kind() != reflect.Ptr || val.IsNil() {
+		panic("errors: target must be a non-nil pointer")
+	}
+	targetType := typ.Elem()
+	if targetType.Kind() != reflect.Interface && !targetType.Implements(errorType) {
+		panic("errors: *target must be interface or implement error")
+	}
+
+	for err != nil {
+		if reflect.TypeOf(err).AssignableTo(targetType) {
+			val.Elem().Set(reflect.ValueOf(err))
+			return true
+		}
+		err = Unwrap(err)
+	}
+	return false
+}
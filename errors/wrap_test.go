@@ -0,0 +1,78 @@
+package errors
+
+import (
+	"fmt"
+	"testing"
+)
+
+type wrapped struct {
+	msg string
+	err error
+}
+
+func (w wrapped) Error() string {
+	return w.msg + ": " + w.err.Error()
+}
+
+func (w wrapped) Unwrap() error {
+	return w.err
+}
+
+type class struct {
+	err error
+}
+
+func (c class) Error() string {
+	return c.err.Error()
+}
+
+func (c class) Is(target error) bool {
+	return target == errClass
+}
+
+var errSentinel = NewBadRequest("sentinel")
+var errClass = NewBadRequest("class")
+
+func TestIs(t *testing.T) {
+	testCases := []struct {
+		err    error
+		target error
+		expect bool
+	}{
+		{err: errSentinel, target: errSentinel, expect: true},
+		{err: wrapped{"a", errSentinel}, target: errSentinel, expect: true},
+		{err: wrapped{"a", wrapped{"b", errSentinel}}, target: errSentinel, expect: true},
+		{err: wrapped{"a", NewBadRequest("other")}, target: errSentinel, expect: false},
+		{err: class{errSentinel}, target: errClass, expect: true},
+		{err: wrapped{"a", class{errSentinel}}, target: errClass, expect: true},
+		{err: fmt.Errorf("sentinel"), target: errSentinel, expect: false},
+		{err: nil, target: errSentinel, expect: false},
+		{err: nil, target: nil, expect: true},
+	}
+
+	for i, tc := range testCases {
+		if res := Is(tc.err, tc.target); res != tc.expect {
+			t.Fatalf("TC %d: Expected Is(%v, %v) to return %t", i, tc.err, tc.target, tc.expect)
+		}
+	}
+}
+
+func TestAs(t *testing.T) {
+	var res class
+	if !As(wrapped{"a", class{errSentinel}}, &res) {
+		t.Fatalf("Expected to find the class error in the chain")
+	}
+	if res.err != errSentinel {
+		t.Fatalf("Expected the target to be set to the class error, got %v", res)
+	}
+
+	var badRequest BadRequest
+	if As(wrapped{"a", NewInternal("internal")}, &badRequest) {
+		t.Fatalf("Expected not to find a BadRequest in the chain, got %v", badRequest)
+	}
+
+	var coder interface{ Code() int }
+	if !As(wrapped{"a", errSentinel}, &coder) || coder.Code() != 400 {
+		t.Fatalf("Expected to find the error implementing Code() in the chain, got %v", coder)
+	}
+}
@@ -0,0 +1,111 @@
+package tagquery
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// filterSelectivity is what FilterBatchAdaptive observes about a filter while sampling
+type filterSelectivity struct {
+	fails    uint64
+	duration time.Duration
+}
+
+// FilterBatchAdaptive is like FilterBatch, but it orders the filters by how effective they are
+// on the given metrics. It runs the first sampleSize metrics through all of the filters,
+// measuring how often each of them fails a metric and how long it takes. The remaining metrics
+// then get run through the filters in the order of the most failures per time spent first, so
+// the filters which reject most metrics cheaply save the others from being evaluated.
+// The decisions are the same as the ones of FilterBatch, because combining them with
+// CombineAnd doesn't depend on their order. Only the number of times each filter gets called
+// differs, including the regex executions counted by a RegexBudget.
+// If sampleSize is < 1 it is FilterBatchCheckInterval. If there are no more metrics than that,
+// or fewer than two filters, FilterBatchAdaptive is the same as FilterBatch
+func (f MetricDefinitionFilters) FilterBatchAdaptive(ctx context.Context, defs []MetricDefinitionLike, defaults []FilterDecision, sampleSize int) ([]FilterDecision, error) {
+	if sampleSize < 1 {
+		sampleSize = FilterBatchCheckInterval
+	}
+	if len(f) < 2 || len(defs) <= sampleSize {
+		return f.FilterBatch(ctx, defs, defaults)
+	}
+
+	budget := RegexBudgetFromContext(ctx)
+	res := make([]FilterDecision, len(defs))
+	selectivity := make([]filterSelectivity, len(f))
+	filters, filterDefaults := f, defaults
+
+	for i := range defs {
+		if i%FilterBatchCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := budget.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		if i < sampleSize {
+			res[i] = f.sampleFilterAnd(defs[i].Id, defs[i].Name, defs[i].Tags, defaults, selectivity)
+			if i == sampleSize-1 {
+				filters, filterDefaults = f.orderBySelectivity(defaults, selectivity)
+			}
+			continue
+		}
+		res[i] = filters.filterAndWithDefaults(defs[i].Id, defs[i].Name, defs[i].Tags, filterDefaults)
+	}
+	return res, nil
+}
+
+// sampleFilterAnd is like filterAndWithDefaults, but it runs the metric through all filters
+// and adds their failures and the time they took to the given selectivity
+func (f MetricDefinitionFilters) sampleFilterAnd(id schema.MKey, name string, tags []string, defaults []FilterDecision, selectivity []filterSelectivity) FilterDecision {
+	res := Pass
+	for i, filter := range f {
+		start := time.Now()
+		decision := filter(id, name, tags)
+		selectivity[i].duration += time.Since(start)
+
+		if decision == None && defaults != nil {
+			decision = defaults[i]
+		}
+		if decision == Fail {
+			selectivity[i].fails++
+		}
+		res = CombineAnd(res, decision)
+	}
+	return res
+}
+
+// orderBySelectivity returns the filters and their defaults sorted by the observed failures
+// per time spent, descending. filters with the same ratio keep their order
+func (f MetricDefinitionFilters) orderBySelectivity(defaults []FilterDecision, selectivity []filterSelectivity) (MetricDefinitionFilters, []FilterDecision) {
+	order := make([]int, len(f))
+	for i := range order {
+		order[i] = i
+	}
+
+	// a filter which is faster than the resolution of the clock would take no time at all,
+	// adding a nanosecond keeps the ratios finite
+	ratio := func(i int) float64 {
+		return float64(selectivity[i].fails) / float64(selectivity[i].duration+time.Nanosecond)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return ratio(order[a]) > ratio(order[b])
+	})
+
+	filters := make(MetricDefinitionFilters, len(f))
+	var filterDefaults []FilterDecision
+	if defaults != nil {
+		filterDefaults = make([]FilterDecision, len(defaults))
+	}
+	for i, j := range order {
+		filters[i] = f[j]
+		if defaults != nil {
+			filterDefaults[i] = defaults[j]
+		}
+	}
+	return filters, filterDefaults
+}
@@ -0,0 +1,144 @@
+package tagquery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// getSkewedDefs returns metrics of which 95% have the tag "env=prod", the others "env=dev",
+// and 99% have the tag "dc=us-east", the others "dc=eu-west"
+func getSkewedDefs(count int) []MetricDefinitionLike {
+	defs := make([]MetricDefinitionLike, count)
+	for i := range defs {
+		dc, env := "us-east", "prod"
+		if i%100 == 0 {
+			dc = "eu-west"
+		}
+		if i%20 == 0 {
+			env = "dev"
+		}
+		defs[i] = MetricDefinitionLike{
+			Name: fmt.Sprintf("some.metric.%d", i),
+			Tags: []string{"dc=" + dc, "env=" + env, fmt.Sprintf("host=web-%d", i%50)},
+		}
+	}
+	return defs
+}
+
+// getSkewedFilters returns the filters of expressions which are in the worst order for the
+// metrics of getSkewedDefs: the expensive regex passes nearly every metric, and the cheap
+// expressions at the end fail most of them
+func getSkewedFilters(t testing.TB) (MetricDefinitionFilters, []FilterDecision) {
+	expressions, err := ParseExpressions([]string{"host=~.*-[a-z]*[0-9]+$", "dc^=us-", "env^=de"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	return expressions.GetMetricDefinitionFilters(nil, nil)
+}
+
+func TestFilterBatchAdaptive(t *testing.T) {
+	filters, defaultDecisions := getSkewedFilters(t)
+	defs := getSkewedDefs(2000)
+
+	expect, err := filters.FilterBatch(context.Background(), defs, defaultDecisions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// the decisions don't depend on the order of the filters
+	for _, sampleSize := range []int{0, 1, 10, 100, 1999, 2000, 5000} {
+		res, err := filters.FilterBatchAdaptive(context.Background(), defs, defaultDecisions, sampleSize)
+		if err != nil {
+			t.Fatalf("Unexpected error with sample size %d: %s", sampleSize, err)
+		}
+		if !reflect.DeepEqual(res, expect) {
+			t.Fatalf("Expected the same decisions as FilterBatch with sample size %d", sampleSize)
+		}
+	}
+
+	// without defaults None stays None
+	undecided := MetricDefinitionFilters{
+		func(_ schema.MKey, _ string, _ []string) FilterDecision { return None },
+		func(_ schema.MKey, _ string, _ []string) FilterDecision { return Pass },
+	}
+	res, err := undecided.FilterBatchAdaptive(context.Background(), defs[:20], nil, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i := range res {
+		if res[i] != None {
+			t.Fatalf("Expected decision None without defaults, got %s", res[i])
+		}
+	}
+}
+
+func TestFilterBatchAdaptiveCancellation(t *testing.T) {
+	filters, defaultDecisions := getSkewedFilters(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := filters.FilterBatchAdaptive(ctx, getSkewedDefs(1000), defaultDecisions, 10); err != context.Canceled {
+		t.Fatalf("Expected the error %q, got %v", context.Canceled, err)
+	}
+}
+
+func TestOrderBySelectivity(t *testing.T) {
+	filters := make(MetricDefinitionFilters, 4)
+	for i := range filters {
+		decision := FilterDecision(i)
+		filters[i] = func(_ schema.MKey, _ string, _ []string) FilterDecision { return decision }
+	}
+	defaults := []FilterDecision{Pass, Fail, None, Pass}
+
+	selectivity := []filterSelectivity{
+		{fails: 1, duration: time.Microsecond},
+		{fails: 10, duration: time.Microsecond},
+		{fails: 10, duration: 20 * time.Microsecond},
+		{fails: 0, duration: 0},
+	}
+
+	// the filter with the most failures per time comes first, ties keep their order
+	ordered, orderedDefaults := filters.orderBySelectivity(defaults, selectivity)
+	expect := []int{1, 0, 2, 3}
+	for i, j := range expect {
+		if ordered[i](schema.MKey{}, "", nil) != FilterDecision(j) || orderedDefaults[i] != defaults[j] {
+			t.Fatalf("Expected filter %d at position %d", j, i)
+		}
+	}
+
+	if _, orderedDefaults := filters.orderBySelectivity(nil, selectivity); orderedDefaults != nil {
+		t.Fatalf("Expected no defaults, got %v", orderedDefaults)
+	}
+}
+
+func benchmarkFilterBatchSkewed(b *testing.B, adaptive bool) {
+	filters, defaultDecisions := getSkewedFilters(b)
+	defs := getSkewedDefs(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if adaptive {
+			_, err = filters.FilterBatchAdaptive(context.Background(), defs, defaultDecisions, 0)
+		} else {
+			_, err = filters.FilterBatch(context.Background(), defs, defaultDecisions)
+		}
+		if err != nil {
+			b.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func BenchmarkFilterBatchSkewed(b *testing.B) {
+	benchmarkFilterBatchSkewed(b, false)
+}
+
+func BenchmarkFilterBatchAdaptiveSkewed(b *testing.B) {
+	benchmarkFilterBatchSkewed(b, true)
+}
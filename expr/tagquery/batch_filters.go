@@ -0,0 +1,163 @@
+package tagquery
+
+import (
+	"context"
+	"math/bits"
+)
+
+// BatchFilters holds the filters of a list of expressions for filtering batches of metrics.
+// Unlike with the MetricDefinitionFilters, the filters of the expressions which only look at
+// the tags of their key don't each scan all the tags of a metric to find them. The tags of a
+// metric get grouped by key once, and every such filter only gets passed the group of its key
+type BatchFilters struct {
+	filters  MetricDefinitionFilters
+	defaults []FilterDecision
+
+	// slots has one entry per filter, the index of the group of tags which gets passed to it,
+	// or -1 if the filter needs all the tags
+	slots []int
+
+	// keys are the keys of the expressions which only look at one tag, the index of a key is
+	// the one of its group. it is nil if there are fewer than two such expressions, then
+	// grouping the tags wouldn't save anything and FilterBatch is the same as the one of the
+	// MetricDefinitionFilters
+	keys []string
+
+	// slotsByFirstByte has the bits of the groups of the keys starting with each byte set, so
+	// the tags of which the first byte isn't the one of any of the keys get skipped without
+	// comparing them to the keys
+	slotsByFirstByte [256]uint8
+}
+
+// GetBatchFilters returns the BatchFilters of the expressions, their filters are the same as
+// the ones returned by GetMetricDefinitionFiltersWithBudget. The budget is optional
+func (e Expressions) GetBatchFilters(lookup IdTagLookup, propertyLookup IdPropertyLookup, budget *RegexBudget) *BatchFilters {
+	filters, defaults := e.GetMetricDefinitionFiltersWithBudget(lookup, propertyLookup, budget)
+	res := &BatchFilters{
+		filters:  filters,
+		defaults: defaults,
+		slots:    make([]int, len(filters)),
+	}
+
+	// with a MATCH_NONE expression there is only its filter, which doesn't look at the tags
+	if len(filters) != len(e) {
+		res.slots[0] = -1
+		return res
+	}
+
+	singleTagFilters := 0
+	for i, expression := range e {
+		res.slots[i] = -1
+		if !looksAtSingleTag(expression) {
+			continue
+		}
+		singleTagFilters++
+		res.slots[i] = res.keySlot(expression.GetKey())
+	}
+
+	if singleTagFilters < 2 {
+		res.keys = nil
+		for i := range res.slots {
+			res.slots[i] = -1
+		}
+	}
+	return res
+}
+
+// keySlot returns the index of the group of the given key, adding it if it's not there yet.
+// the number of groups is limited to the number of bits of slotsByFirstByte, the filters of
+// the keys beyond that and of the empty key get passed all tags, so it returns -1 for them
+func (b *BatchFilters) keySlot(key string) int {
+	for slot := range b.keys {
+		if b.keys[slot] == key {
+			return slot
+		}
+	}
+	if len(key) == 0 || len(b.keys) == 8 {
+		return -1
+	}
+	b.keys = append(b.keys, key)
+	b.slotsByFirstByte[key[0]] |= 1 << uint(len(b.keys)-1)
+	return len(b.keys) - 1
+}
+
+// MetricDefinitionFilters returns the filters and their default decisions, like
+// Expressions.GetMetricDefinitionFilters does. They take all the tags of a metric, so
+// they can be used by callers which don't filter batches
+func (b *BatchFilters) MetricDefinitionFilters() (MetricDefinitionFilters, []FilterDecision) {
+	return b.filters, b.defaults
+}
+
+// FilterBatch runs each of the given metrics through the filters and returns their decisions,
+// they are the same as the ones of MetricDefinitionFilters.FilterBatch with the default
+// decisions. The tags of a metric only get grouped by key once a filter needs its group, so
+// the metrics which already get failed by a filter that looks at all of them or at the name
+// don't pay for it. The context and its RegexBudget get checked like FilterBatch does
+func (b *BatchFilters) FilterBatch(ctx context.Context, defs []MetricDefinitionLike) ([]FilterDecision, error) {
+	if b.keys == nil {
+		return b.filters.FilterBatch(ctx, defs, b.defaults)
+	}
+
+	budget := RegexBudgetFromContext(ctx)
+	res := make([]FilterDecision, len(defs))
+	groups := make([][]string, len(b.keys))
+	for i := range defs {
+		if i%FilterBatchCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := budget.Err(); err != nil {
+				return nil, err
+			}
+		}
+		res[i] = b.filterAnd(&defs[i], groups)
+	}
+	return res, nil
+}
+
+// filterAnd is like MetricDefinitionFilters.filterAndWithDefaults, but it passes the filters
+// which look at a single tag only the group of tags of their key. the given groups get reused
+// for every metric, so grouping the tags doesn't allocate once they have grown large enough
+func (b *BatchFilters) filterAnd(def *MetricDefinitionLike, groups [][]string) FilterDecision {
+	grouped := false
+	res := Pass
+	for i, filter := range b.filters {
+		tags := def.Tags
+		if slot := b.slots[i]; slot >= 0 {
+			if !grouped {
+				b.groupTags(def.Tags, groups)
+				grouped = true
+			}
+			tags = groups[slot]
+		}
+
+		decision := filter(def.Id, def.Name, tags)
+		if decision == None {
+			decision = b.defaults[i]
+		}
+		if res = CombineAnd(res, decision); res == Fail {
+			return Fail
+		}
+	}
+	return res
+}
+
+// groupTags puts each of the given tags which has one of the keys of the filters into the
+// group of its key, replacing the previous content of the groups
+func (b *BatchFilters) groupTags(tags []string, groups [][]string) {
+	for slot := range groups {
+		groups[slot] = groups[slot][:0]
+	}
+	for _, tag := range tags {
+		if len(tag) == 0 {
+			continue
+		}
+		for slots := b.slotsByFirstByte[tag[0]]; slots != 0; slots &= slots - 1 {
+			slot := bits.TrailingZeros8(slots)
+			if tagHasKey(tag, b.keys[slot]) {
+				groups[slot] = append(groups[slot], tag)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package tagquery
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// tagLookupOf returns an IdTagLookup which looks up the tags of the given metrics, like the
+// lookups of an index do
+func tagLookupOf(defs []MetricDefinitionLike) IdTagLookup {
+	tags := make(map[schema.MKey]map[string]struct{}, len(defs))
+	for _, def := range defs {
+		tags[def.Id] = make(map[string]struct{}, len(def.Tags))
+		for _, tag := range def.Tags {
+			tags[def.Id][tag] = struct{}{}
+		}
+	}
+	return func(id schema.MKey, key, value string) bool {
+		_, ok := tags[id][key+"="+value]
+		return ok
+	}
+}
+
+var manyTagKeys = []string{
+	"dc", "az", "env", "host", "rack", "team", "tier", "zone", "owner", "stage", "region", "shard", "service", "cluster", "version",
+	"instance", "job", "app", "os", "arch", "kernel", "role", "pool", "node", "pod", "namespace", "container", "image", "cpu", "disk",
+}
+
+// getManyTagDefs returns metrics with a tag "<key>=<key>-<n % 10>" for each of manyTagKeys in
+// random order, except for every 10th metric which lacks the key at its index % len(manyTagKeys)
+func getManyTagDefs(count int) []MetricDefinitionLike {
+	r := rand.New(rand.NewSource(1))
+	defs := make([]MetricDefinitionLike, count)
+	for i := range defs {
+		tags := make([]string, 0, len(manyTagKeys))
+		for j, key := range manyTagKeys {
+			if i%10 == 0 && j == i%len(manyTagKeys) {
+				continue
+			}
+			tags = append(tags, fmt.Sprintf("%s=%s-%d", key, key, i%10))
+		}
+		r.Shuffle(len(tags), func(a, b int) { tags[a], tags[b] = tags[b], tags[a] })
+		defs[i] = MetricDefinitionLike{Id: schema.MKey{Key: [16]byte{byte(i), byte(i >> 8), byte(i >> 16)}}, Name: fmt.Sprintf("some.metric.%d", i), Tags: tags}
+	}
+	return defs
+}
+
+// manyTagsQuery consists of 5 expressions on the tags of getManyTagDefs, most of which pass
+var manyTagsQuery = []string{"disk=~disk-[0-8]", "image^=image-", "container!=container-3", "namespace=~.*-[0-9]$", "pod|=pod-1|pod-2|pod-4|pod-5|pod-6|pod-7|pod-8"}
+
+func TestBatchFilters(t *testing.T) {
+	defer func(metaTagSupport bool) { MetaTagSupport = metaTagSupport }(MetaTagSupport)
+	for _, MetaTagSupport = range []bool{false, true} {
+		testBatchFilters(t)
+	}
+}
+
+func testBatchFilters(t *testing.T) {
+	defs := getManyTagDefs(500)
+	defs = append(defs,
+		MetricDefinitionLike{Id: schema.MKey{Key: [16]byte{1}}, Name: "a", Tags: []string{"dc=dc-3", "dc=other", "disk=disk-1"}},
+		MetricDefinitionLike{Id: schema.MKey{Key: [16]byte{2}}, Name: "b", Tags: []string{"dc", "disk=disk-1"}},
+		MetricDefinitionLike{Id: schema.MKey{Key: [16]byte{3}}, Name: "c"},
+	)
+	lookup := tagLookupOf(defs)
+
+	queries := [][]string{
+		manyTagsQuery,
+		{"dc=dc-3", "dc!=other", "az=", "name=~some\\..*[0-9]"},
+		{"dc=~dc-[1-3]", "__tag^=dis", "env!=env-0"},
+		{"dc=dc-3", "disk=disk-1"},
+		{"dc^=dc-", "name!=a"},
+		// only the tags of the first 8 keys get grouped, the other filters get all tags
+		{"dc^=dc", "az^=az", "env^=env", "host^=host", "rack^=rack", "team^=team", "tier^=tier", "zone^=zone", "owner^=owner", "stage^=stage-1"},
+		{"a_key_which_is_longer_than_the_longest_key_index_of_the_bitmask_of_key_lengths=x", "a_key_which_is_longer_than_the_longest_key_index=x", "dc=dc-1"},
+	}
+
+	for _, query := range queries {
+		expressions, err := ParseExpressions(query)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+
+		filters, defaults := expressions.GetMetricDefinitionFiltersWithBudget(lookup, nil, nil)
+		expect, err := filters.FilterBatch(context.Background(), defs, defaults)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		batchFilters := expressions.GetBatchFilters(lookup, nil, nil)
+		res, err := batchFilters.FilterBatch(context.Background(), defs)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(res, expect) {
+			t.Fatalf("Expected the decisions of the batch filters of %v with meta tag support %t to be the same as the ones of the metric definition filters", query, MetaTagSupport)
+		}
+
+		if adapted, adaptedDefaults := batchFilters.MetricDefinitionFilters(); len(adapted) != len(filters) || !reflect.DeepEqual(adaptedDefaults, defaults) {
+			t.Fatalf("Expected the batch filters of %v to return the metric definition filters", query)
+		}
+	}
+}
+
+func TestBatchFiltersDontGroupForSingleTagFilter(t *testing.T) {
+	testCases := []struct {
+		expressions []string
+		grouped     bool
+	}{
+		{expressions: []string{"dc=dc-1", "name=a"}, grouped: false},
+		{expressions: []string{"dc=dc-1", "__tag=az"}, grouped: false},
+		{expressions: []string{"dc=dc-1", "dc!=x"}, grouped: true},
+		{expressions: []string{"dc=dc-1", "az!=x", "name=a"}, grouped: true},
+		{expressions: []string{"dc=dc-1", "az!=x", "rack!=~.*"}, grouped: false},
+	}
+
+	for _, tc := range testCases {
+		expressions, err := ParseExpressions(tc.expressions)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		if res := expressions.GetBatchFilters(nil, nil, nil).keys != nil; res != tc.grouped {
+			t.Fatalf("Expected the tags to be grouped for %v: %t, got %t", tc.expressions, tc.grouped, res)
+		}
+	}
+}
+
+func TestBatchFiltersWithMatchNone(t *testing.T) {
+	defs := getManyTagDefs(100)
+	expressions, err := ParseExpressions([]string{"dc=dc-1", "az!=x", "rack!=~.*"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	res, err := expressions.GetBatchFilters(tagLookupOf(defs), nil, nil).FilterBatch(context.Background(), defs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i := range res {
+		if res[i] != Fail {
+			t.Fatalf("Expected metric %d to fail, got %s", i, res[i])
+		}
+	}
+}
+
+func TestBatchFiltersCancellation(t *testing.T) {
+	expressions, err := ParseExpressions(manyTagsQuery)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	defs := getManyTagDefs(10)
+	if _, err := expressions.GetBatchFilters(tagLookupOf(defs), nil, nil).FilterBatch(ctx, defs); err != context.Canceled {
+		t.Fatalf("Expected the error %q, got %v", context.Canceled, err)
+	}
+}
+
+func benchmarkFilterBatchManyTags(b *testing.B, grouped bool) {
+	expressions, err := ParseExpressions(manyTagsQuery)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+	defs := getManyTagDefs(10000)
+	batchFilters := expressions.GetBatchFilters(tagLookupOf(defs), nil, nil)
+	filters, defaults := batchFilters.MetricDefinitionFilters()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if grouped {
+			_, err = batchFilters.FilterBatch(context.Background(), defs)
+		} else {
+			_, err = filters.FilterBatch(context.Background(), defs, defaults)
+		}
+		if err != nil {
+			b.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func BenchmarkFilterBatch5Expressions30Tags(b *testing.B) {
+	benchmarkFilterBatchManyTags(b, false)
+}
+
+func BenchmarkBatchFilters5Expressions30Tags(b *testing.B) {
+	benchmarkFilterBatchManyTags(b, true)
+}
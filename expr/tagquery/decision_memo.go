@@ -0,0 +1,98 @@
+package tagquery
+
+import (
+	"sync"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// DecisionMemo memoizes the decisions of the filters of expressions on metrics, keyed by the
+// expression and the id of the metric. It is meant to be scoped to one query, during which the
+// same metrics get evaluated against the same expressions repeatedly, f.e. once for every meta
+// tag record that shares an expression. The memo holds up to a fixed number of decisions, once
+// it is full the filters keep evaluating the metrics which aren't in it yet. There is no need
+// to evict anything, because the memo gets dropped together with its query.
+// A metric is identified by its id, so the filters which share a memo must only be passed
+// metrics with distinct ids, and they must have been built with the same lookups.
+// It is safe for concurrent use
+type DecisionMemo struct {
+	maxEntries int
+
+	sync.RWMutex
+	fingerprints map[string]uint32
+	decisions    map[decisionMemoKey]FilterDecision
+}
+
+// decisionMemoKey identifies a memoized decision. the expressions are identified by the index
+// of their canonical string in the memo, so the string doesn't need to get hashed on
+// every lookup
+type decisionMemoKey struct {
+	fingerprint uint32
+	id          schema.MKey
+}
+
+// NewDecisionMemo returns a DecisionMemo which holds up to maxEntries decisions
+func NewDecisionMemo(maxEntries int) *DecisionMemo {
+	return &DecisionMemo{
+		maxEntries:   maxEntries,
+		fingerprints: make(map[string]uint32),
+		decisions:    make(map[decisionMemoKey]FilterDecision),
+	}
+}
+
+// Len returns the number of memoized decisions
+func (m *DecisionMemo) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.decisions)
+}
+
+// fingerprint returns the number which identifies the expression with the given canonical
+// string in the memo, see canonicalExpressionString. expressions with the same canonical
+// string are equivalent, so they always make the same decisions
+func (m *DecisionMemo) fingerprint(expression string) uint32 {
+	m.Lock()
+	defer m.Unlock()
+	fingerprint, ok := m.fingerprints[expression]
+	if !ok {
+		fingerprint = uint32(len(m.fingerprints))
+		m.fingerprints[expression] = fingerprint
+	}
+	return fingerprint
+}
+
+// Filter returns a filter which makes the same decisions as the given filter of the given
+// expression, but it looks them up in the memo before evaluating the filter, and it adds the
+// decisions of the metrics which are not memoized yet. Metrics with the zero id don't get
+// memoized, because they can't be told apart. If the memo is nil it returns the given filter
+func (m *DecisionMemo) Filter(expression Expression, filter MetricDefinitionFilter) MetricDefinitionFilter {
+	if m == nil || m.maxEntries <= 0 {
+		return filter
+	}
+
+	fingerprint := m.fingerprint(canonicalExpressionString(expression))
+	return func(id schema.MKey, name string, tags []string) FilterDecision {
+		if id == (schema.MKey{}) {
+			return filter(id, name, tags)
+		}
+
+		key := decisionMemoKey{fingerprint: fingerprint, id: id}
+		m.RLock()
+		decision, ok := m.decisions[key]
+		full := len(m.decisions) >= m.maxEntries
+		m.RUnlock()
+		if ok {
+			return decision
+		}
+
+		decision = filter(id, name, tags)
+		if !full {
+			m.Lock()
+			if len(m.decisions) < m.maxEntries {
+				m.decisions[key] = decision
+			}
+			m.Unlock()
+		}
+		return decision
+	}
+}
@@ -0,0 +1,160 @@
+package tagquery
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+func testMKey(i int) schema.MKey {
+	return schema.MKey{Key: schema.Key{byte(i), byte(i >> 8), byte(i >> 16), 1}, Org: 1}
+}
+
+func TestDecisionMemo(t *testing.T) {
+	expression, err := ParseExpression("dc=~us-.*1")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	var evaluations uint32
+	filter := func(id schema.MKey, name string, tags []string) FilterDecision {
+		atomic.AddUint32(&evaluations, 1)
+		return expression.GetMetricDefinitionFilter(nil)(id, name, tags)
+	}
+
+	testCases := []struct {
+		maxEntries        int
+		expectEvaluations uint32
+		expectLen         int
+	}{
+		{maxEntries: 100, expectEvaluations: 10, expectLen: 10},
+		// once the memo is full the metrics which aren't in it get evaluated every time
+		{maxEntries: 5, expectEvaluations: 10 + 3*5, expectLen: 5},
+		{maxEntries: 0, expectEvaluations: 40, expectLen: 0},
+	}
+
+	for i, tc := range testCases {
+		evaluations = 0
+		memo := NewDecisionMemo(tc.maxEntries)
+
+		// two filters of the same expression share the memoized decisions
+		filters := []MetricDefinitionFilter{memo.Filter(expression, filter), memo.Filter(expression, filter)}
+		for round := 0; round < 4; round++ {
+			for j := 0; j < 10; j++ {
+				tags := []string{fmt.Sprintf("dc=us-east-%d", j)}
+				expect := Fail
+				if j == 1 {
+					expect = Pass
+				}
+				if res := filters[round%2](testMKey(j), "a.b", tags); res != expect {
+					t.Fatalf("TC %d: Expected decision %s for %v, got %s", i, expect, tags, res)
+				}
+			}
+		}
+		if evaluations != tc.expectEvaluations || memo.Len() != tc.expectLen {
+			t.Fatalf("TC %d: Expected %d evaluations and %d memoized decisions, got %d and %d", i, tc.expectEvaluations, tc.expectLen, evaluations, memo.Len())
+		}
+	}
+}
+
+func TestDecisionMemoSeparatesExpressions(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"dc=~us-.*1", "dc=~us-.*2"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	memo := NewDecisionMemo(100)
+	tags := []string{"dc=us-east-1"}
+	first := memo.Filter(expressions[0], expressions[0].GetMetricDefinitionFilter(nil))
+	second := memo.Filter(expressions[1], expressions[1].GetMetricDefinitionFilter(nil))
+	if res := first(testMKey(1), "a.b", tags); res != Pass {
+		t.Fatalf("Expected %q to pass, got %s", expressions.Strings()[0], res)
+	}
+	if res := second(testMKey(1), "a.b", tags); res != Fail {
+		t.Fatalf("Expected %q to fail, got %s", expressions.Strings()[1], res)
+	}
+
+	// metrics without id can't be told apart, so they don't get memoized
+	if res := first(schema.MKey{}, "a.b", []string{"dc=us-east-2"}); res != Fail || memo.Len() != 2 {
+		t.Fatalf("Expected metrics without id to not get memoized, got decision %s and %d memoized decisions", res, memo.Len())
+	}
+}
+
+func TestMetaTagRecordFilterWithMemo(t *testing.T) {
+	records := make([]MetaTagRecord, 3)
+	for i := range records {
+		record, err := ParseMetaTagRecord([]string{fmt.Sprintf("meta=%d", i)}, []string{"dc=~us-.*1", fmt.Sprintf("host=~web-%d.*", i)})
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		records[i] = record
+	}
+
+	memo := NewDecisionMemo(100)
+	tags := []string{"dc=us-east-1", "host=web-1"}
+	for i := range records {
+		memoized := records[i].GetMetricDefinitionFilterWithMemo(nil, memo)(testMKey(1), "a.b", tags)
+		if expect := records[i].GetMetricDefinitionFilter(nil)(testMKey(1), "a.b", tags); memoized != expect {
+			t.Fatalf("Expected the memoized filter of record %d to return %s, got %s", i, expect, memoized)
+		}
+	}
+
+	// the records share the decision of their first expression
+	if memo.Len() != 4 {
+		t.Fatalf("Expected 4 memoized decisions, got %d", memo.Len())
+	}
+}
+
+// benchmarkMetaRecordFilters runs 10k metrics through the filters of 500 meta records, which
+// share 50 distinct expressions. the records filter the metrics one batch after another, so the
+// values of a metric have long been evicted from the match caches by the time the next record
+// with the same expression looks at it again
+func benchmarkMetaRecordFilters(b *testing.B, memoize bool) {
+	distinct := make([]string, 50)
+	for i := range distinct {
+		distinct[i] = fmt.Sprintf("key%d=~val.*%d", i%10, i)
+	}
+	records := make([]MetaTagRecord, 500)
+	for i := range records {
+		record, err := ParseMetaTagRecord([]string{fmt.Sprintf("meta=%d", i)}, []string{distinct[i%50], distinct[(i*7+3)%50]})
+		if err != nil {
+			b.Fatalf("Unexpected parsing error: %s", err)
+		}
+		records[i] = record
+	}
+
+	defs := make([]MetricDefinitionLike, 10000)
+	for i := range defs {
+		defs[i].Id = testMKey(i)
+		defs[i].Name = "some.metric"
+		for j := 0; j < 10; j++ {
+			defs[i].Tags = append(defs[i].Tags, fmt.Sprintf("key%d=value%d", j, i*10+j))
+		}
+	}
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var memo *DecisionMemo
+		if memoize {
+			memo = NewDecisionMemo(len(distinct) * len(defs))
+		}
+		for i := range records {
+			filters := MetricDefinitionFilters{records[i].GetMetricDefinitionFilterWithMemo(nil, memo)}
+			if _, err := filters.FilterBatch(ctx, defs, nil); err != nil {
+				b.Fatalf("Unexpected error: %s", err)
+			}
+		}
+	}
+}
+func BenchmarkMetaRecordFiltersWithoutDecisionMemo(b *testing.B) {
+	benchmarkMetaRecordFilters(b, false)
+}
+
+func BenchmarkMetaRecordFiltersWithDecisionMemo(b *testing.B) {
+	benchmarkMetaRecordFilters(b, true)
+}
@@ -0,0 +1,121 @@
+package tagquery
+
+import (
+	"sync"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// Enricher computes the meta tags which a set of meta tag records assigns to a metric.
+// The filters of the records get built once when the Enricher is instantiated, so
+// evaluating a metric only needs to run them.
+// It is safe for concurrent use
+type Enricher struct {
+	records    []MetaTagRecord
+	evaluators sync.Pool
+}
+
+// enricherEvaluator holds the filters of all the records of an Enricher, together with
+// the tags of the metric they currently get evaluated against. the IdTagLookup of the
+// filters looks at these tags, so an evaluator must only be used by one goroutine at a time
+type enricherEvaluator struct {
+	tags    Tags
+	filters []MetricDefinitionTagsFilter
+}
+
+// NewEnricher instantiates an Enricher from the given meta tag records,
+// records without meta tags get ignored because they can't add anything
+func NewEnricher(records []MetaTagRecord) *Enricher {
+	e := &Enricher{
+		records: make([]MetaTagRecord, 0, len(records)),
+	}
+	for _, record := range records {
+		if record.HasMetaTags() {
+			e.records = append(e.records, record)
+		}
+	}
+	e.evaluators.New = func() interface{} {
+		return e.newEvaluator()
+	}
+	return e
+}
+
+// newEvaluator builds the filters of all the records with a lookup that checks
+// the tags which are currently set on the returned evaluator
+func (e *Enricher) newEvaluator() *enricherEvaluator {
+	ev := &enricherEvaluator{
+		filters: make([]MetricDefinitionTagsFilter, len(e.records)),
+	}
+	lookup := func(_ schema.MKey, key, value string) bool {
+		for _, tag := range ev.tags {
+			if tag.Key == key && tag.Value == value {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range e.records {
+		ev.filters[i] = recordTagsFilter(e.records[i].Expressions, lookup)
+	}
+	return ev
+}
+
+// recordTagsFilter returns a filter which decides whether a metric satisfies all the
+// given expressions. the meta tags of a record get evaluated against all the tags of
+// a metric, so if an expression can't come to a decision its default decision applies
+func recordTagsFilter(expressions Expressions, lookup IdTagLookup) MetricDefinitionTagsFilter {
+	filters := make([]MetricDefinitionTagsFilter, len(expressions))
+	defaultDecisions := make([]FilterDecision, len(expressions))
+	for i, expression := range expressions {
+		filters[i] = expression.GetMetricDefinitionTagsFilter(lookup)
+		defaultDecisions[i] = expression.GetDefaultDecision()
+	}
+
+	return func(id schema.MKey, name string, tags Tags) FilterDecision {
+		for i := range filters {
+			decision := filters[i](id, name, tags)
+			if decision == None {
+				decision = defaultDecisions[i]
+			}
+			if decision != Pass {
+				return Fail
+			}
+		}
+		return Pass
+	}
+}
+
+// Enrich returns the meta tags which the records of the Enricher assign to the metric
+// with the given name and tags, the tags are in the form "key=value".
+// The result is sorted and deduplicated, if no record matches it is nil
+func (e *Enricher) Enrich(name string, tags []string) []Tag {
+	if len(e.records) == 0 {
+		return nil
+	}
+
+	ev := e.evaluators.Get().(*enricherEvaluator)
+	ev.tags = SplitTags(tags)
+
+	var res Tags
+	for i := range ev.filters {
+		if ev.filters[i](schema.MKey{}, name, ev.tags) == Pass {
+			res = append(res, e.records[i].MetaTags...)
+		}
+	}
+
+	ev.tags = nil
+	e.evaluators.Put(ev)
+
+	if len(res) == 0 {
+		return nil
+	}
+
+	res.Sort()
+	deduplicated := res[:1]
+	for _, tag := range res[1:] {
+		if tag != deduplicated[len(deduplicated)-1] {
+			deduplicated = append(deduplicated, tag)
+		}
+	}
+	return deduplicated
+}
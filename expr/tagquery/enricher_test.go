@@ -0,0 +1,165 @@
+package tagquery
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func parseTestMetaTagRecords(t testing.TB, records [][2][]string) []MetaTagRecord {
+	res := make([]MetaTagRecord, len(records))
+	for i, record := range records {
+		var err error
+		res[i], err = ParseMetaTagRecord(record[0], record[1])
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing meta tag record %v: %s", record, err)
+		}
+	}
+	return res
+}
+
+func testEnricher(t *testing.T) {
+	records := parseTestMetaTagRecords(t, [][2][]string{
+		{[]string{"dc=us-east"}, []string{"region=us-east-1"}},
+		{[]string{"tier=web"}, []string{"host=~web-[0-9]+", "region!=eu-west-1"}},
+		{[]string{"internal=true"}, []string{"a!=x", "b=y"}},
+		{[]string{"legacy=true"}, []string{"name^=old."}},
+		{[]string{"monitored=false"}, []string{"region=us-east-1", "monitor="}},
+		{[]string{"dc=us-east", "provider=aws"}, []string{"region=~us-.*"}},
+		{[]string{}, []string{"region=us-east-1"}},
+	})
+	enricher := NewEnricher(records)
+
+	type testCase struct {
+		name     string
+		tags     []string
+		expected []Tag
+	}
+
+	testCases := []testCase{
+		{
+			name: "metric",
+			tags: []string{"region=us-east-1"},
+			expected: []Tag{
+				{Key: "dc", Value: "us-east"},
+				{Key: "monitored", Value: "false"},
+				{Key: "provider", Value: "aws"},
+			},
+		}, {
+			name: "metric",
+			tags: []string{"host=web-1", "region=eu-west-1", "monitor=yes"},
+		}, {
+			name: "metric",
+			tags: []string{"host=web-1", "monitor=yes"},
+			expected: []Tag{
+				{Key: "tier", Value: "web"},
+			},
+		}, {
+			name: "metric",
+			tags: []string{"b=y", "monitor=yes"},
+			expected: []Tag{
+				{Key: "internal", Value: "true"},
+			},
+		}, {
+			name: "metric",
+			tags: []string{"a=x", "b=y", "monitor=yes"},
+		}, {
+			name: "old.metric",
+			tags: []string{"monitor=yes"},
+			expected: []Tag{
+				{Key: "legacy", Value: "true"},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		res := enricher.Enrich(tc.name, tc.tags)
+		if !reflect.DeepEqual(res, tc.expected) {
+			t.Fatalf("TC %d: Expected meta tags %v for metric %s;%v, got %v", i, tc.expected, tc.name, tc.tags, res)
+		}
+	}
+}
+
+func TestEnricherWithMetaTagSupport(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = true
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	testEnricher(t)
+}
+
+func TestEnricherWithoutMetaTagSupport(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	testEnricher(t)
+}
+
+func TestEnricherWithoutRecords(t *testing.T) {
+	enricher := NewEnricher(nil)
+	if res := enricher.Enrich("metric", []string{"a=b"}); res != nil {
+		t.Fatalf("Expected no meta tags, got %v", res)
+	}
+}
+
+func TestEnricherConcurrentUse(t *testing.T) {
+	records := make([][2][]string, 100)
+	for i := range records {
+		records[i] = [2][]string{
+			{fmt.Sprintf("group=%d", i%10)},
+			{fmt.Sprintf("host=host%d", i)},
+		}
+	}
+	enricher := NewEnricher(parseTestMetaTagRecords(t, records))
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 10)
+	for worker := 0; worker < 10; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := worker; i < len(records); i += 10 {
+				expected := []Tag{{Key: "group", Value: fmt.Sprintf("%d", i%10)}}
+				res := enricher.Enrich("metric", []string{fmt.Sprintf("host=host%d", i)})
+				if !reflect.DeepEqual(res, expected) {
+					errCh <- fmt.Errorf("Expected meta tags %v for host%d, got %v", expected, i, res)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkEnricher(b *testing.B, recordCount int) {
+	records := make([][2][]string, recordCount)
+	for i := range records {
+		records[i] = [2][]string{
+			{fmt.Sprintf("meta%d=value", i)},
+			{fmt.Sprintf("host=~host%d[0-9]*", i), fmt.Sprintf("dc!=dc%d", i%5)},
+		}
+	}
+	enricher := NewEnricher(parseTestMetaTagRecords(b, records))
+	tags := []string{"host=host1", "dc=dc3", "region=us-east-1", "env=prod"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enricher.Enrich("some.metric.name", tags)
+	}
+}
+
+func BenchmarkEnricher100Records(b *testing.B) {
+	benchmarkEnricher(b, 100)
+}
+
+func BenchmarkEnricher500Records(b *testing.B) {
+	benchmarkEnricher(b, 500)
+}
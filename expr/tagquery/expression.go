@@ -1,14 +1,20 @@
 package tagquery
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"regexp/syntax"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/cespare/xxhash"
+	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/schema"
 )
 
@@ -22,35 +28,260 @@ func (i InvalidExpressionError) Code() int {
 	return http.StatusBadRequest
 }
 
+func (i InvalidExpressionError) Is(target error) bool {
+	return isParseError(target)
+}
+
 type Expressions []Expression
 
 //ParseExpressions parses a list of graphite tag expressions (as used by the `seriesByTag` function).
 //tag expression definitions: https://graphite.readthedocs.io/en/latest/tags.html#querying
 //seriesBytTag documentation: https://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.seriesByTag
 //Some possible tag expressions are: "status=200", "path!=/", "name=~cpu\..*" (`name` is  a special tag which is automatically applied to the metric name).
+//Additionally the non-standard operators "|=" and "!|=" are supported to match one, or none, of a set of values, f.e. "host|=a|b|c",
+//the numeric comparison operators ">", ">=", "<" and "<=", f.e. "shard>=32", a "<" or ">" which is followed by another operator is part of the key, and a "\<" or "\>" always is,
+//"*=" to match a glob pattern, f.e. "host*=web*db?",
+//"!^=" to exclude values with a prefix, f.e. "host!^=web-",
+//and "__tag=~<key pattern>:<operator><value>" to require a tag with a matching key of which the value satisfies
+//the condition, f.e. "__tag=~dc_.*:=us-east". The special key "__any_tag" requires at least one of a set of tags
+//to be present, f.e. "__any_tag=rack|cage". The operator "=?" matches a value or the absence of the tag, f.e. "tier=?frontend".
+//The reserved keys "__lastUpdate__" and "__interval__" can be used with the comparison operators to filter by the
+//according properties of the metrics, f.e. "__lastUpdate__>=-1h" or "__interval__<=10s".
+//A "~" directly after "=" marks a regular expression, so a value of a non-regex expression which starts with "~"
+//must be escaped as "\~", f.e. "status=\~ok". In "status=~~ok" the second "~" is part of the pattern.
+//Likewise a value following "=" which starts with "?" must be escaped as "\?", f.e. "status=\?".
 func ParseExpressions(expressions []string) (Expressions, error) {
+	return ParseExpressionsWithOptions(expressions, defaultParseOptions)
+}
+
+// ParseExpressionsWithOptions is the same as ParseExpressions, but it takes options to control the parser
+func ParseExpressionsWithOptions(expressions []string, opts ParseOptions) (Expressions, error) {
+	if err := opts.QueryLimits.checkStrings(expressions); err != nil {
+		return nil, err
+	}
+
 	res := make(Expressions, len(expressions))
 	for i := range expressions {
-		expression, err := ParseExpression(expressions[i])
+		expression, err := parseExpression(expressions[i], &opts)
 		if err != nil {
 			return nil, err
 		}
 		res[i] = expression
 	}
+
+	if err := opts.QueryLimits.checkRegexExpressions(res); err != nil {
+		return nil, err
+	}
+
+	if opts.Dedup {
+		res = res.Dedup()
+	}
+
 	return res, nil
 }
 
+// MatchesTags evaluates all expressions against a metric with the given tags,
+// see Expression.MatchesTags, and combines their decisions with CombineAnd
+func (e Expressions) MatchesTags(tags map[string]string) FilterDecision {
+	res := Pass
+	for _, expression := range e {
+		if res = CombineAnd(res, expression.MatchesTags(tags)); res == Fail {
+			return Fail
+		}
+	}
+	return res
+}
+
+// GetMetricDefinitionFilters returns the filters of the expressions, in the same order as the
+// expressions, together with their default decisions. if propertyLookup is not nil then the
+// filters of the expressions on pseudo tags get obtained via GetMetricPropertyFilter, otherwise
+// they can't come to a decision.
+// If one of the expressions is a MATCH_NONE expression no metric can satisfy all of them, then
+// only the filter of that expression gets returned, so the filters of the others never get
+// evaluated. See MatchNoneExpression
+func (e Expressions) GetMetricDefinitionFilters(lookup IdTagLookup, propertyLookup IdPropertyLookup) (MetricDefinitionFilters, []FilterDecision) {
+	return e.GetMetricDefinitionFiltersWithStats(lookup, propertyLookup, nil)
+}
+
+// GetMetricDefinitionFiltersWithStats is like GetMetricDefinitionFilters, but if collector is not
+// nil the filters populate the ExpressionStats of their expressions in it. The collector must have
+// been created from the same expressions. Without collector the filters are not instrumented at all
+func (e Expressions) GetMetricDefinitionFiltersWithStats(lookup IdTagLookup, propertyLookup IdPropertyLookup, collector *StatsCollector) (MetricDefinitionFilters, []FilterDecision) {
+	return e.getMetricDefinitionFilters(lookup, propertyLookup, collector, nil, false)
+}
+
+// GetMetricDefinitionFiltersWithBudget is like GetMetricDefinitionFilters, but the filters count
+// their regular expression executions in the given budget, which should be shared by all filters of
+// one query. The filters keep working once the budget is exceeded, it is up to the caller to check
+// it, f.e. by passing a context with the budget to FilterBatch
+func (e Expressions) GetMetricDefinitionFiltersWithBudget(lookup IdTagLookup, propertyLookup IdPropertyLookup, budget *RegexBudget) (MetricDefinitionFilters, []FilterDecision) {
+	return e.getMetricDefinitionFilters(lookup, propertyLookup, nil, budget, false)
+}
+
+// GetMetricDefinitionFiltersForSortedTags is like GetMetricDefinitionFiltersWithBudget, but the
+// filters require the tags passed to them to be sorted, like the index keeps the tags of its metric
+// definitions. The filters of the expressions which look at the value of one tag find that tag by
+// binary search instead of scanning all tags, the filters of the expressions which operate on the
+// tag keys still look at all of them. The budget is optional
+func (e Expressions) GetMetricDefinitionFiltersForSortedTags(lookup IdTagLookup, propertyLookup IdPropertyLookup, budget *RegexBudget) (MetricDefinitionFilters, []FilterDecision) {
+	return e.getMetricDefinitionFilters(lookup, propertyLookup, nil, budget, true)
+}
+
+// GetMetricDefinitionFiltersForSortedTagsWithStats is like GetMetricDefinitionFiltersForSortedTags,
+// but if collector is not nil the filters populate the ExpressionStats of their expressions in it,
+// like the ones of GetMetricDefinitionFiltersWithStats. The budget and the collector are optional
+func (e Expressions) GetMetricDefinitionFiltersForSortedTagsWithStats(lookup IdTagLookup, propertyLookup IdPropertyLookup, budget *RegexBudget, collector *StatsCollector) (MetricDefinitionFilters, []FilterDecision) {
+	return e.getMetricDefinitionFilters(lookup, propertyLookup, collector, budget, true)
+}
+
+// getMetricDefinitionFilters implements GetMetricDefinitionFiltersWithStats,
+// GetMetricDefinitionFiltersWithBudget and the GetMetricDefinitionFiltersForSortedTags
+// variants, the collector and the budget are optional
+func (e Expressions) getMetricDefinitionFilters(lookup IdTagLookup, propertyLookup IdPropertyLookup, collector *StatsCollector, budget *RegexBudget, sortedTags bool) (MetricDefinitionFilters, []FilterDecision) {
+	if i := e.matchNoneIndex(); i >= 0 {
+		filter := e[i].GetMetricDefinitionFilter(lookup)
+		if collector != nil {
+			filter = instrumentFilter(filter, &collector.stats[i])
+		}
+		return MetricDefinitionFilters{filter}, []FilterDecision{Fail}
+	}
+
+	filters := make(MetricDefinitionFilters, len(e))
+	defaultDecisions := make([]FilterDecision, len(e))
+	for i, expression := range e {
+		instrumentation := filterInstrumentation{budget: budget}
+		if collector != nil {
+			instrumentation.stats = &collector.stats[i]
+		}
+
+		if propertyExpression, ok := expression.(MetricPropertyExpression); ok && propertyLookup != nil {
+			filters[i] = propertyExpression.GetMetricPropertyFilter(propertyLookup)
+		} else if instrumentedExpression, ok := expression.(instrumentedExpression); ok {
+			filters[i] = instrumentedExpression.getInstrumentedMetricDefinitionFilter(instrumentation)
+		} else {
+			filters[i] = expression.GetMetricDefinitionFilter(lookup)
+		}
+		if sortedTags && looksAtSingleTag(expression) {
+			filters[i] = filterSortedTagsOfKey(filters[i], expression.GetKey())
+		}
+		if collector != nil {
+			filters[i] = instrumentFilter(filters[i], instrumentation.stats)
+		}
+		defaultDecisions[i] = expression.GetDefaultDecision()
+	}
+	return filters, defaultDecisions
+}
+
+// GetMetricDefinitionFilter returns a filter which decides whether a metric satisfies all the
+// expressions, see GetMetricDefinitionFilters. if the filter of an expression can't come to a
+// decision then the default decision of the expression applies, so it never returns None.
+// the filters get evaluated in the order of the expressions
+func (e Expressions) GetMetricDefinitionFilter(lookup IdTagLookup, propertyLookup IdPropertyLookup) MetricDefinitionFilter {
+	return e.GetMetricDefinitionFilterWithMemo(lookup, propertyLookup, nil)
+}
+
+// GetMetricDefinitionFilterWithMemo is like GetMetricDefinitionFilter, but the decisions of the
+// filters of the expressions get memoized in the given memo, see DecisionMemo. The memo is optional
+func (e Expressions) GetMetricDefinitionFilterWithMemo(lookup IdTagLookup, propertyLookup IdPropertyLookup, memo *DecisionMemo) MetricDefinitionFilter {
+	filters, defaultDecisions := e.GetMetricDefinitionFilters(lookup, propertyLookup)
+
+	// with a MATCH_NONE expression there is only its filter, which is cheaper than a lookup
+	if memo != nil && len(filters) == len(e) {
+		for i := range filters {
+			filters[i] = memo.Filter(e[i], filters[i])
+		}
+	}
+	return filterAndDecideWithDefaults(filters, defaultDecisions)
+}
+
+// filterAndDecideWithDefaults returns a filter which runs a metric through the given filters and
+// combines their decisions with DecideWithDefaults. It stops at the first filter which decides
+// Fail, or which returns None while its default decision is Fail, because DecideWithDefaults
+// returns Fail regardless of the decisions of the remaining filters. The decisions get collected
+// on the stack, unless there are more than maxStackDecisions filters
+func filterAndDecideWithDefaults(filters MetricDefinitionFilters, defaults []FilterDecision) MetricDefinitionFilter {
+	return func(id schema.MKey, name string, tags []string) FilterDecision {
+		var buf [maxStackDecisions]FilterDecision
+		decisions := buf[:0]
+		for i, filter := range filters {
+			decision := filter(id, name, tags)
+			decisions = append(decisions, decision)
+			if decision == Fail || (decision == None && defaults[i] == Fail) {
+				break
+			}
+		}
+		return DecideWithDefaults(decisions, defaults[:len(decisions)])
+	}
+}
+
+// maxStackDecisions is the number of decisions which filterAndDecideWithDefaults collects
+// without allocating, queries rarely have more expressions than that
+const maxStackDecisions = 16
+
+// MatchesMetric returns whether a metric with the given name and tags
+// satisfies all the expressions, see Expression.MatchesMetric
+func (e Expressions) MatchesMetric(name string, tags Tags) bool {
+	for _, expression := range e {
+		if !expression.MatchesMetric(name, tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// Strings returns the string representations of the expressions. They all get written into one
+// buffer which the returned strings are parts of, so the number of allocations doesn't grow with
+// the number of expressions. Keeping one of the strings keeps the whole buffer in memory
 func (e Expressions) Strings() []string {
+	size := 0
+	for i := range e {
+		size += expressionSizeHint(e[i])
+	}
+
 	builder := strings.Builder{}
-	res := make([]string, len(e))
+	builder.Grow(size)
+	ends := make([]int, len(e))
 	for i := range e {
 		e[i].StringIntoWriter(&builder)
-		res[i] = builder.String()
-		builder.Reset()
+		ends[i] = builder.Len()
+	}
+
+	all := builder.String()
+	res := make([]string, len(e))
+	start := 0
+	for i, end := range ends {
+		res[i] = all[start:end]
+		start = end
 	}
 	return res
 }
 
+// String returns the expressions joined by ";", which is a character that neither keys
+// nor values can contain. ParseQuery accepts the result
+func (e Expressions) String() string {
+	size := 0
+	for i := range e {
+		size += expressionSizeHint(e[i]) + 1
+	}
+
+	builder := strings.Builder{}
+	builder.Grow(size)
+	for i := range e {
+		if i > 0 {
+			builder.WriteString(";")
+		}
+		e[i].StringIntoWriter(&builder)
+	}
+	return builder.String()
+}
+
+// expressionSizeHint returns the expected length of the string representation of the given
+// expression, it includes room for the longest operator and for its key being written as tag
+// value of "__tag=", which are both rare enough to not be worth calculating their exact size
+func expressionSizeHint(e Expression) int {
+	return len(e.GetKey()) + len(e.GetValue()) + len("__tag!=~") + 1
+}
+
 func (e Expressions) Sort() {
 	sort.Slice(e, func(i, j int) bool {
 		if e[i].GetKey() == e[j].GetKey() {
@@ -63,20 +294,652 @@ func (e Expressions) Sort() {
 	})
 }
 
+// Clone returns a deep copy of the expressions, the returned slice and the expressions
+// in it can be modified without affecting the original ones. see Expression.Clone()
+func (e Expressions) Clone() Expressions {
+	if e == nil {
+		return nil
+	}
+
+	res := make(Expressions, len(e))
+	for i := range e {
+		res[i] = e[i].Clone()
+	}
+	return res
+}
+
+// ByOperator returns the expressions which use the given operator
+func (e Expressions) ByOperator(operator ExpressionOperator) Expressions {
+	return e.filter(func(expression Expression) bool {
+		return expression.GetOperator() == operator
+	})
+}
+
+// WithRe returns the expressions which evaluate a regular expression, see usesRegex
+func (e Expressions) WithRe() Expressions {
+	return e.filter(usesRegex)
+}
+
+// OnTag returns the expressions which operate on the tag keys, see Expression.OperatesOnTag
+func (e Expressions) OnTag() Expressions {
+	return e.filter(func(expression Expression) bool {
+		return expression.OperatesOnTag()
+	})
+}
+
+// InvolvedTagKeys returns the sorted and deduplicated tag keys which the expressions look at,
+// this includes "name" if an expression applies to the metric name. The expressions which
+// operate on the tag keys by a pattern or a prefix, f.e. "__tag=~a.*", can involve any key,
+// they don't return a key but they set involvesTagNames. The keys of "__any_tag" are
+// returned, while the pseudo tags "__lastUpdate__" and "__interval__" aren't tag keys
+func (e Expressions) InvolvedTagKeys() ([]string, bool) {
+	involvesTagNames := false
+	keys := make(map[string]struct{})
+	for _, expression := range e {
+		switch expression.GetOperator() {
+		case MATCH_TAG, PREFIX_TAG, TAG_VALUE:
+			involvesTagNames = true
+			continue
+		case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL:
+			if isPseudoTag(expression.GetKey()) {
+				continue
+			}
+		}
+
+		if hasAnyTag, ok := expression.(*expressionHasAnyTag); ok {
+			for key := range hasAnyTag.keys {
+				keys[key] = struct{}{}
+			}
+			continue
+		}
+
+		// f.e. "__tag=~.*" doesn't get parsed as MATCH_TAG, because it matches all metrics
+		if expression.GetKey() == "__tag" {
+			involvesTagNames = true
+			continue
+		}
+
+		keys[expression.GetKey()] = struct{}{}
+	}
+
+	res := make([]string, 0, len(keys))
+	for key := range keys {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+
+	return res, involvesTagNames
+}
+
+// Without returns the expressions except the one at the given index, which must be valid.
+// Like the other helpers to select expressions it returns a new slice, so appending to
+// the result does not modify the original expressions
+func (e Expressions) Without(index int) Expressions {
+	res := make(Expressions, 0, len(e)-1)
+	res = append(res, e[:index]...)
+	return append(res, e[index+1:]...)
+}
+
+// filter returns a new slice of the expressions which satisfy the given function
+func (e Expressions) filter(keep func(Expression) bool) Expressions {
+	var res Expressions
+	for _, expression := range e {
+		if keep(expression) {
+			res = append(res, expression)
+		}
+	}
+	return res
+}
+
+// MatchNoneExpression returns the first MATCH_NONE expression and true, if there is one. Then no
+// metric can satisfy all the expressions, regardless of the other ones
+func (e Expressions) MatchNoneExpression() (Expression, bool) {
+	if i := e.matchNoneIndex(); i >= 0 {
+		return e[i], true
+	}
+	return nil, false
+}
+
+// matchNoneIndex returns the index of the first MATCH_NONE expression, or -1 if there is none
+func (e Expressions) matchNoneIndex() int {
+	for i, expression := range e {
+		if expression.GetOperator() == MATCH_NONE {
+			return i
+		}
+	}
+	return -1
+}
+
+// SortByFilterOrder sorts the expressions by their estimated cost, see Expression.GetCost, so the
+// cheapest expressions get evaluated first when they are used as filters. Expressions with the same
+// cost keep their relative order. MATCH_NONE expressions always come first, regardless of the
+// costs, because no other expression needs to be evaluated once one of them failed a metric
+func (e Expressions) SortByFilterOrder() {
+	sort.SliceStable(e, func(i, j int) bool {
+		if before, ok := matchNoneFirst(e[i], e[j]); ok {
+			return before
+		}
+		return e[i].GetCost() < e[j].GetCost()
+	})
+}
+
+// matchNoneFirst returns whether a sorts before b and true if exactly one of them is a MATCH_NONE
+// expression, otherwise their order is up to the caller
+func matchNoneFirst(a, b Expression) (bool, bool) {
+	aNone, bNone := a.GetOperator() == MATCH_NONE, b.GetOperator() == MATCH_NONE
+	if aNone == bNone {
+		return false, false
+	}
+	return aNone, true
+}
+
+// SortByFilterOrderWithEstimator is like SortByFilterOrder, but expressions with the same operator
+// cost get sorted by their estimated cardinality first, lowest first, and only then by their cost.
+// F.e. out of "dc=us-east" and "host=web-0042" the host expression fails for more metrics, so
+// evaluating it first saves the evaluation of the dc expression for those. Expressions with
+// different operator costs keep the order of SortByFilterOrder, and so do those with the same
+// estimate and cost. MATCH_NONE expressions come first like in SortByFilterOrder. Without estimator
+// the result is the same as the one of SortByFilterOrder
+func (e Expressions) SortByFilterOrderWithEstimator(estimator CardinalityEstimator) {
+	if estimator == nil {
+		e.SortByFilterOrder()
+		return
+	}
+
+	estimates := make([]uint64, len(e))
+	for i, expression := range e {
+		estimates[i] = estimator.Estimate(expression.GetKey(), expression.GetValue(), expression.GetOperator())
+	}
+	sort.Stable(expressionsByEstimate{expressions: e, estimates: estimates})
+}
+
+// expressionsByEstimate sorts expressions by their operator cost, then by their estimated
+// cardinality and then by their cost, see SortByFilterOrderWithEstimator
+type expressionsByEstimate struct {
+	expressions Expressions
+	estimates   []uint64
+}
+
+func (e expressionsByEstimate) Len() int {
+	return len(e.expressions)
+}
+
+func (e expressionsByEstimate) Less(i, j int) bool {
+	a, b := e.expressions[i], e.expressions[j]
+	if before, ok := matchNoneFirst(a, b); ok {
+		return before
+	}
+	if a.GetOperatorCost() != b.GetOperatorCost() {
+		return a.GetOperatorCost() < b.GetOperatorCost()
+	}
+	if e.estimates[i] != e.estimates[j] {
+		return e.estimates[i] < e.estimates[j]
+	}
+	return a.GetCost() < b.GetCost()
+}
+
+func (e expressionsByEstimate) Swap(i, j int) {
+	e.expressions[i], e.expressions[j] = e.expressions[j], e.expressions[i]
+	e.estimates[i], e.estimates[j] = e.estimates[j], e.estimates[i]
+}
+
+// CardinalityEstimator estimates how many metrics match an expression with the given key, value
+// and operator, f.e. based on the sizes of the tag index. The estimates only need to be comparable
+// to each other, they don't need to be accurate
+type CardinalityEstimator interface {
+	Estimate(key, value string, operator ExpressionOperator) uint64
+}
+
+// Partition splits the expressions into the initial expression, which is used to look up the
+// candidate metrics in the index, and the filters, which get applied to the candidates. The
+// expressions get sorted by SortByFilterOrder, so the initial expression is the cheapest one
+// which requires a non-empty value. If there are several of those with the same cost, an
+// expression on the metric name is preferred, then the one with the longest literal value and
+// then the first one, f.e. out of "dc^=us-east" and "name^=cpu" the name expression gets
+// chosen. The original slice is not modified.
+// If no expression can be used as initial expression ErrNoInitialExpression is returned
+func (e Expressions) Partition() (Expression, Expressions, error) {
+	return e.PartitionWithEstimator(nil)
+}
+
+// PartitionWithEstimator is like Partition, but if there are multiple candidates for the initial
+// expression with the same cost it picks the one with the lowest estimated cardinality. F.e. out of
+// "dc=us-east" and "host=web-0042" the host expression is a much better start, because it matches
+// far fewer metrics. The candidates with the same estimate get chosen like Partition does, see
+// findInitialExpressionWithEstimator. Without estimator the result is the same as the one of Partition
+func (e Expressions) PartitionWithEstimator(estimator CardinalityEstimator) (Expression, Expressions, error) {
+	ordered := make(Expressions, len(e))
+	copy(ordered, e)
+	ordered.SortByFilterOrder()
+
+	initial := ordered.findInitialExpressionWithEstimator(estimator)
+	if initial < 0 {
+		return nil, nil, ErrNoInitialExpression
+	}
+	return ordered[initial], ordered.Without(initial), nil
+}
+
+// PartitionOrdered is like Partition, but it keeps the order of the given expressions instead of
+// sorting them by SortByFilterOrder. It is useful for callers which order the expressions by more
+// than their cost, f.e. the index also takes the cardinality of the expressions into account
+func (e Expressions) PartitionOrdered() (Expression, Expressions, error) {
+	initial := e.findInitialExpression()
+	if initial < 0 {
+		return nil, nil, ErrNoInitialExpression
+	}
+	return e[initial], e.Without(initial), nil
+}
+
+// findInitialExpression returns the index of the first expression which can be used to look up
+// the initial set of candidate metrics, or -1 if there is none.
+// Every tag query has at least one expression which requires a non-empty value according to:
+// https://graphite.readthedocs.io/en/latest/tags.html#querying
+func (e Expressions) findInitialExpression() int {
+	for i, expression := range e {
+		if expression.RequiresNonEmptyValue() {
+			return i
+		}
+	}
+	return -1
+}
+
+// findInitialExpressionWithEstimator is like findInitialExpression, but it chooses among the
+// expressions which require a non-empty value and have the same cost as the first one of them.
+// The candidates get compared by these rules, each rule only applies if the previous ones
+// consider two candidates equal:
+//   - the lower estimated cardinality wins, if the estimator is not nil
+//   - an expression on the metric name wins, because the name index is the most selective one.
+//     an EQUAL on the name is already cheaper than the other EQUALs, see expressionEqual.GetCost
+//   - the longer literal value of an EQUAL or PREFIX expression wins, because longer literals
+//     tend to match fewer metrics. the values of the other operators count as empty
+//   - the earlier expression wins
+func (e Expressions) findInitialExpressionWithEstimator(estimator CardinalityEstimator) int {
+	initial := e.findInitialExpression()
+	if initial < 0 {
+		return initial
+	}
+
+	cost := e[initial].GetCost()
+	var lowest uint64
+	if estimator != nil {
+		lowest = estimator.Estimate(e[initial].GetKey(), e[initial].GetValue(), e[initial].GetOperator())
+	}
+	for i := initial + 1; i < len(e); i++ {
+		if e[i].GetCost() != cost || !e[i].RequiresNonEmptyValue() {
+			continue
+		}
+
+		var estimate uint64
+		if estimator != nil {
+			estimate = estimator.Estimate(e[i].GetKey(), e[i].GetValue(), e[i].GetOperator())
+		}
+		if estimate != lowest {
+			if estimate < lowest {
+				initial, lowest = i, estimate
+			}
+			continue
+		}
+
+		if isName, initialIsName := e[i].GetKey() == "name", e[initial].GetKey() == "name"; isName != initialIsName {
+			if isName {
+				initial = i
+			}
+			continue
+		}
+
+		if literalLength(e[i]) > literalLength(e[initial]) {
+			initial = i
+		}
+	}
+	return initial
+}
+
+// literalLength returns the length of the literal value of EQUAL and PREFIX expressions,
+// the values of the other operators aren't literals that get looked up, so they count as 0
+func literalLength(e Expression) int {
+	switch e.GetOperator() {
+	case EQUAL, PREFIX:
+		return len(e.GetValue())
+	}
+	return 0
+}
+
+// canonicalOperatorOrder is the fixed order of the operators which SortByCanonicalOrder uses,
+// it must never change, because the canonical form of Expressions is used to identify them.
+// operators which get added in the future must be appended at the end
+var canonicalOperatorOrder = []ExpressionOperator{
+	EQUAL,
+	NOT_EQUAL,
+	MATCH,
+	MATCH_TAG,
+	NOT_MATCH,
+	PREFIX,
+	PREFIX_TAG,
+	HAS_TAG,
+	NOT_HAS_TAG,
+	MATCH_ALL,
+	MATCH_NONE,
+	EQUAL_ANY,
+	NOT_EQUAL_ANY,
+	GREATER,
+	GREATER_EQUAL,
+	LESS,
+	LESS_EQUAL,
+	WILDCARD,
+	NOT_PREFIX,
+	TAG_VALUE,
+	HAS_ANY_TAG,
+	EQUAL_OR_ABSENT,
+}
+
+// canonicalOperatorRank maps each operator to its position in canonicalOperatorOrder
+var canonicalOperatorRank = func() map[ExpressionOperator]int {
+	res := make(map[ExpressionOperator]int, len(canonicalOperatorOrder))
+	for i, operator := range canonicalOperatorOrder {
+		res[operator] = i
+	}
+	return res
+}()
+
+// SortByCanonicalOrder sorts the expressions by operator, key and value. The operators are
+// ordered according to canonicalOperatorOrder, which is fixed, so unlike the order by cost
+// used when executing a query the canonical order never changes.
+func (e Expressions) SortByCanonicalOrder() {
+	sort.SliceStable(e, func(i, j int) bool {
+		if e[i].GetOperator() != e[j].GetOperator() {
+			return canonicalOperatorRank[e[i].GetOperator()] < canonicalOperatorRank[e[j].GetOperator()]
+		}
+		if e[i].GetKey() != e[j].GetKey() {
+			return e[i].GetKey() < e[j].GetKey()
+		}
+		return e[i].GetValue() < e[j].GetValue()
+	})
+}
+
+// Normalize returns the canonical form of the expressions, the original slice is not modified.
+// Regex values get stripped of their redundant anchoring and regular expressions which can be
+// evaluated without a regex get translated into the cheaper equivalent expressions, the same way
+// as the parser does it. MATCH_ALL and MATCH_NONE expressions get reset to their default values,
+// because those don't change what they match. Then duplicates are removed and the result is sorted by SortByCanonicalOrder.
+// The canonical form is what should be used to identify a set of expressions, f.e. when hashing them
+func (e Expressions) Normalize() Expressions {
+	res := make(Expressions, len(e))
+	for i, expression := range e {
+		res[i] = normalizeExpression(expression)
+	}
+	res = res.unique()
+	res.SortByCanonicalOrder()
+	return res
+}
+
+// CanonicalString returns the string representation of the canonical form of the expressions,
+// see Normalize. Regular expressions are represented by their simplified syntax trees, the way
+// IsEquivalentTo compares them, and the expressions are sorted by their representation.
+// It is the input of Hash and is mostly useful to debug unexpected hash values
+func (e Expressions) CanonicalString() string {
+	normalized := e.Normalize()
+	res := make([]string, len(normalized))
+	for i, expression := range normalized {
+		res[i] = canonicalExpressionString(expression)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ";")
+}
+
+// canonicalExpressionString returns the string representation of the given expression, with
+// the pattern of regex expressions replaced by their simplified syntax tree. Expressions which
+// are equivalent according to IsEquivalentTo result in the same string
+func canonicalExpressionString(expression Expression) string {
+	builder := strings.Builder{}
+	builder.Grow(expressionSizeHint(expression))
+
+	switch expression.GetOperator() {
+	case MATCH, NOT_MATCH, MATCH_TAG:
+		if re, ok := canonicalRegex(expression.GetValue()); ok {
+			if expression.GetOperator() == MATCH_TAG {
+				builder.WriteString("__tag")
+			} else {
+				builder.WriteString(expression.GetKey())
+			}
+			expression.GetOperator().StringIntoWriter(&builder)
+
+			// the anchoring gets added by the parser, leaving it out keeps the result parseable
+			if re.Op == syntax.OpConcat && len(re.Sub) > 1 && re.Sub[0].Op == syntax.OpBeginText {
+				unanchored := *re
+				unanchored.Sub = re.Sub[1:]
+				re = &unanchored
+			}
+			builder.WriteString(re.String())
+			return builder.String()
+		}
+	}
+
+	expression.StringIntoWriter(&builder)
+	return builder.String()
+}
+
+// Hash returns a hash of the canonical form of the expressions. Expressions which are equal
+// according to Equal are guaranteed to result in the same hash within the same process, the
+// hash should not be persisted because the canonical form may change between versions
+func (e Expressions) Hash() uint64 {
+	return xxhash.Sum64String(e.CanonicalString())
+}
+
+// normalizeExpression returns the normalized form of the given expression, which is
+// either the given expression itself or a new one which is equivalent to it
+func normalizeExpression(expression Expression) Expression {
+	var operator ExpressionOperator
+	switch expression.GetOperator() {
+	case MATCH, MATCH_TAG:
+		operator = MATCH
+	case NOT_MATCH:
+		operator = NOT_MATCH
+	case MATCH_ALL:
+		// the value and the original operator don't change what they match
+		return NewMatchAllExpression(expression.GetKey())
+	case MATCH_NONE:
+		return NewMatchNoneExpression(expression.GetKey())
+	default:
+		return expression
+	}
+
+	value := normalizeRegexValue(expression.GetValue())
+	if value == expression.GetValue() {
+		// the parser has already applied all possible optimizations
+		return expression
+	}
+
+	normalized, err := newExpressionFromValues(expression.GetKey(), operator, value)
+	if err != nil {
+		// the value can't be normalized, so we keep it as it is
+		return expression
+	}
+	return normalized
+}
+
+// Dedup removes expressions which are equivalent to a previous expression according to
+// IsEquivalentTo, the relative order of the remaining expressions is preserved. The underlying array gets modified,
+// the returned slice must be used instead of the original one
+func (e Expressions) Dedup() Expressions {
+	res := e[:0]
+EXPRESSIONS:
+	for _, expression := range e {
+		for _, kept := range res {
+			if kept.IsEquivalentTo(expression) {
+				continue EXPRESSIONS
+			}
+		}
+		res = append(res, expression)
+	}
+
+	// remove references to the dropped expressions
+	for i := len(res); i < len(e); i++ {
+		e[i] = nil
+	}
+
+	return res
+}
+
+// Equal returns true if both lists contain the same expressions, it is insensitive to the order
+// of the expressions and to duplicates. The expressions get compared with IsEquivalentTo, so f.e.
+// regex values which only differ by the anchoring, which the parser adds anyway, are considered equal
 func (e Expressions) Equal(other Expressions) bool {
-	if len(e) != len(other) {
+	// the common case is that both lists are equal and in the same order
+	if len(e) == len(other) {
+		sameOrder := true
+		for i, expression := range e {
+			if !expression.IsEquivalentTo(other[i]) {
+				sameOrder = false
+				break
+			}
+		}
+		if sameOrder {
+			return true
+		}
+	}
+
+	uniqueE, uniqueOther := e.unique(), other.unique()
+	if len(uniqueE) != len(uniqueOther) {
 		return false
 	}
 
-	for i, expression := range e {
-		if !expression.Equals(other[i]) {
+	histogram := make(map[ExpressionOperator]int)
+	for i := range uniqueE {
+		histogram[uniqueE[i].GetOperator()]++
+		histogram[uniqueOther[i].GetOperator()]--
+	}
+	for _, count := range histogram {
+		if count != 0 {
 			return false
 		}
 	}
 
+	// both lists are free of duplicates and have the same length, so if each expression
+	// of one list is present in the other one they contain the same expressions
+EXPRESSIONS:
+	for _, expression := range uniqueE {
+		for _, otherExpression := range uniqueOther {
+			if expression.IsEquivalentTo(otherExpression) {
+				continue EXPRESSIONS
+			}
+		}
+		return false
+	}
+
 	return true
 }
 
+// unique returns the expressions without duplicates, unlike Dedup it does not
+// modify the underlying array
+func (e Expressions) unique() Expressions {
+	res := make(Expressions, 0, len(e))
+EXPRESSIONS:
+	for _, expression := range e {
+		for _, kept := range res {
+			if kept.IsEquivalentTo(expression) {
+				continue EXPRESSIONS
+			}
+		}
+		res = append(res, expression)
+	}
+	return res
+}
+
+// regexIsEquivalentTo implements IsEquivalentTo for the expressions which evaluate their value as
+// regular expression. if the patterns aren't equal as strings, their simplified syntax trees get
+// compared. equivalent patterns can still have different syntax trees, f.e. "a|b" and "[ab]",
+// so this can return false negatives, but never false positives
+func regexIsEquivalentTo(e, other Expression) bool {
+	if e.Equals(other) {
+		return true
+	}
+	if e.GetKey() != other.GetKey() || e.GetOperator() != other.GetOperator() {
+		return false
+	}
+
+	re, ok := canonicalRegex(e.GetValue())
+	if !ok {
+		return false
+	}
+	otherRe, ok := canonicalRegex(other.GetValue())
+	if !ok {
+		return false
+	}
+	return re.Equal(otherRe)
+}
+
+// canonicalRegex parses the given pattern, anchored like by the parser, and returns its simplified
+// syntax tree without capture groups, because they don't change what the pattern matches. adjacent
+// literals get merged, so f.e. "(a)(b)" and "ab" result in the same tree. the returned bool is false
+// if the pattern can't be parsed
+func canonicalRegex(pattern string) (*syntax.Regexp, bool) {
+	re, err := syntax.Parse("^(?:"+normalizeRegexValue(pattern)+")", syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	return canonicalRegexNode(re.Simplify()), true
+}
+
+// canonicalRegexNode removes the capture groups from the given node and its children, it
+// flattens nested concatenations and merges adjacent literals with the same flags
+func canonicalRegexNode(re *syntax.Regexp) *syntax.Regexp {
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+
+	for i := range re.Sub {
+		re.Sub[i] = canonicalRegexNode(re.Sub[i])
+	}
+
+	if re.Op != syntax.OpConcat {
+		return re
+	}
+
+	sub := make([]*syntax.Regexp, 0, len(re.Sub))
+	for _, node := range re.Sub {
+		nodes := []*syntax.Regexp{node}
+		if node.Op == syntax.OpConcat {
+			nodes = node.Sub
+		}
+		for _, node := range nodes {
+			if last := len(sub) - 1; last >= 0 && node.Op == syntax.OpLiteral && sub[last].Op == syntax.OpLiteral && sub[last].Flags == node.Flags {
+				merged := *sub[last]
+				merged.Rune = append(append([]rune{}, sub[last].Rune...), node.Rune...)
+				sub[last] = &merged
+				continue
+			}
+			sub = append(sub, node)
+		}
+	}
+
+	if len(sub) == 1 {
+		return sub[0]
+	}
+	re.Sub = sub
+	return re
+}
+
+// normalizeRegexValue removes the anchoring from the given pattern, because the parser
+// anchors all patterns at the beginning anyway. f.e. "^b" and "^(?:b)" both result in "b"
+func normalizeRegexValue(value string) string {
+	for {
+		if strings.HasPrefix(value, "^(?:") && strings.HasSuffix(value, ")") {
+			// the inner part must be a valid pattern on its own, otherwise the
+			// parentheses don't belong together, f.e. "^(?:a)|(?:b)"
+			inner := value[4 : len(value)-1]
+			if _, err := syntax.Parse(inner, syntax.Perl); err == nil {
+				value = inner
+				continue
+			}
+		}
+		if strings.HasPrefix(value, "^") {
+			value = value[1:]
+			continue
+		}
+		return value
+	}
+}
+
 // MarshalJSON satisfies the json.Marshaler interface
 // it is used by the api endpoint /metaTags to list the meta tag records
 func (e Expressions) MarshalJSON() ([]byte, error) {
@@ -111,6 +974,18 @@ type Expression interface {
 	// or false otherwise
 	Equals(Expression) bool
 
+	// IsEquivalentTo returns true if the other expression is known to match the same metrics. It
+	// compares the operators and the keys, expressions with regular expressions compare the
+	// simplified syntax trees of their patterns. It can return false negatives, because the
+	// equivalence of regular expressions can't be decided in general, but never false positives
+	IsEquivalentTo(other Expression) bool
+
+	// Clone returns a copy of the expression which is independent of the original one.
+	// Compiled regular expressions are shared between the copies, because *regexp.Regexp
+	// is safe for concurrent use. The filters and match caches which the regex operators
+	// memoize are not shared, the copy builds its own on its first GetMetricDefinitionFilter
+	Clone() Expression
+
 	// GetDefaultDecision defines what decision should be made if the filter has not come to a conclusive
 	// decision based on a single index. When looking at more than one tag index in order of decreasing
 	// priority to decide whether a metric should be part of the final result set, some operators and metric
@@ -167,6 +1042,14 @@ type Expression interface {
 	// estimate and will never be accurate.
 	GetOperatorCost() uint32
 
+	// GetCost returns the estimated cost of evaluating this expression, it is used to decide the order
+	// in which the expressions of a query get evaluated. It refines GetOperatorCost, so expressions
+	// with different operator costs always have their costs in the same order, but the cost of an
+	// expression also accounts for its properties. F.e. regular expressions with a long literal
+	// prefix are cheaper than complex ones, "name=" is cheaper than other = expressions and
+	// expressions which need to look at the tag keys are more expensive than others
+	GetCost() uint32
+
 	// OperatesOnTag returns whether this expression operators on the tag key
 	// (if not, it operates on the value).
 	// Expressions such has expressionHasTag, expressionMatchTag, expressionPrefixTag would return true,
@@ -193,6 +1076,11 @@ type Expression interface {
 	// value of OperatesOnTag(), then it returns whether the given string satisfies this expression
 	Matches(string) bool
 
+	// FilterValues takes a set of strings which should either be tag keys or values depending on
+	// the return value of OperatesOnTag(), then it returns the ones which satisfy this expression
+	// in no particular order. It is equivalent to calling Matches() on each of them, but cheaper
+	FilterValues(values map[string]struct{}) []string
+
 	// MatchesExactly returns a bool to indicate whether the key / value of this expression (depending
 	// on OperatesOnTag()) needs to be an exact match with the key / value of the metrics it evaluates
 	// F.e:
@@ -206,24 +1094,128 @@ type Expression interface {
 
 	// GetMetricDefinitionFilter returns a MetricDefinitionFilter
 	// The MetricDefinitionFilter takes a metric definition, looks at its tags and returns a decision
-	// regarding this query expression applied to its tags
+	// regarding this query expression applied to its tags.
+	// The expressions which don't use the lookup may return the same filter on every call, so
+	// repeated queries reuse its caches. Such filters live as long as the expression, so whatever
+	// they cache must be bounded, and they must be safe for concurrent use
 	GetMetricDefinitionFilter(lookup IdTagLookup) MetricDefinitionFilter
 
+	// GetMetricDefinitionTagsFilter returns a MetricDefinitionTagsFilter, which makes the same
+	// decisions as the MetricDefinitionFilter returned by GetMetricDefinitionFilter, but it takes
+	// the tags already split into keys and values, so it can compare the keys directly
+	GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter
+
+	// MatchesTags evaluates the expression against a metric with the given tags, the name of the
+	// metric is the value of the tag "name". It makes the same decision as the MetricDefinitionFilter
+	// would make if its lookup found exactly the given tags
+	MatchesTags(tags map[string]string) FilterDecision
+
+	// MatchesMetric returns whether a metric with the given name and tags satisfies the expression,
+	// if the filter of the expression can't come to a decision its default decision applies.
+	// Meta tags are not taken into account
+	MatchesMetric(name string, tags Tags) bool
+
+	// GetMetaRecordFilter returns a MetaRecordFilter, which evaluates the expression against the
+	// meta tags of a meta record in the same way as the meta tag index does it: the meta tags are
+	// passed into Matches() like the tags of the tag index, so negating operators aren't applied.
+	// Meta records can't assign the name of a metric, so meta tags with the key "name" are ignored.
+	// Unlike the filters of metric definitions its decision doesn't need a default decision,
+	// None means that the record doesn't assign any tag which the expression looks at, so it can't
+	// affect whether a metric satisfies the expression
+	GetMetaRecordFilter() MetaRecordFilter
+
 	// StringIntoWriter takes a string writer and writes a representation of this expression into it
+	// the written representation can be parsed by ParseExpression() into an equal expression again
 	StringIntoWriter(writer io.Writer)
 }
 
+// LiteralAlternativesExpression is implemented by expressions which may be satisfied by a finite
+// set of literal values, f.e. "a=~(b|c)$". Instead of evaluating Matches() on every value of the
+// key, the index can then look up each of the values directly
+type LiteralAlternativesExpression interface {
+	Expression
+
+	// LiteralAlternatives returns the set of values which satisfy the expression, if the
+	// returned bool is false the expression can't be reduced to a set of values
+	LiteralAlternatives() ([]string, bool)
+}
+
+// IndexablePrefixExpression is implemented by the regex expressions of which all matching values
+// start with a literal prefix, f.e. "name=~servers\.prod\..*\.cpu". The index can skip all values
+// which don't have the prefix without evaluating the expression
+type IndexablePrefixExpression interface {
+	Expression
+
+	// IndexablePrefix returns the prefix which every matching value starts with, it is empty if
+	// the pattern doesn't have one. If the returned bool is true every value which has the prefix
+	// satisfies the expression, otherwise the expression still needs to be evaluated on them
+	IndexablePrefix() (string, bool)
+}
+
+// BytesMatcher is implemented by the expressions which can evaluate a value that's held as a
+// byte slice, f.e. by an index keyed by []byte, without converting it to a string first
+type BytesMatcher interface {
+	Expression
+
+	// MatchesBytes returns the same as Matches called with the value converted to a string,
+	// it doesn't allocate
+	MatchesBytes(value []byte) bool
+}
+
+// ValueMatcher is implemented by the expressions which are a predicate over the values of the
+// key GetKey(), f.e. "a!=b" or "a=~b.*c". This allows an index which maps each value to the
+// ids of the metrics having it to select the values first and then combine their id sets,
+// instead of evaluating a MetricDefinitionFilter on every metric.
+// The predicate only answers whether a value satisfies the expression, it doesn't know about
+// the presence of the tag. F.e. "a!=b" also matches metrics without the tag "a", those need to
+// be handled by the caller according to GetDefaultDecision(). The expressions which operate on
+// the tag keys don't implement it
+type ValueMatcher interface {
+	Expression
+
+	// MatchValue returns whether the given value of the key satisfies the expression
+	MatchValue(value string) bool
+
+	// MatchAllValues returns true if every possible value of the key satisfies the expression,
+	// then the caller doesn't need to call MatchValue at all
+	MatchAllValues() bool
+}
+
 // ParseExpression returns an expression that's been generated from the given
 // string, in case of an error the error gets returned as the second value
 func ParseExpression(expr string) (Expression, error) {
+	return parseExpression(expr, &defaultParseOptions)
+}
+
+// ParseExpressionWithOptions is the same as ParseExpression, but it takes options to control the parser
+func ParseExpressionWithOptions(expr string, opts ParseOptions) (Expression, error) {
+	return parseExpression(expr, &opts)
+}
+
+func parseExpression(expr string, opts *ParseOptions) (Expression, error) {
+	if !opts.AllowInvalidCharacters {
+		if err := checkCharacters(expr); err != nil {
+			return nil, err
+		}
+	}
+
 	var pos int
-	prefix, regex, not := false, false, false
+	prefix, regex, not, anyOf := false, false, false, false
+	greater, less, orEqual, wildcard := false, false, false, false
+	orAbsent := false
+	escapedKey := false
 	resCommon := expressionCommon{}
 
 	// scan up to operator to get key
 FIND_OPERATOR:
 	for ; pos < len(expr); pos++ {
 		switch expr[pos] {
+		case '\\':
+			// an escaped character of the key never starts the operator, see escapeKey
+			if pos+1 < len(expr) && strings.IndexByte(keyEscapedChars, expr[pos+1]) >= 0 {
+				escapedKey = true
+				pos++
+			}
 		case '=':
 			break FIND_OPERATOR
 		case '!':
@@ -232,6 +1224,30 @@ FIND_OPERATOR:
 		case '^':
 			prefix = true
 			break FIND_OPERATOR
+		case '|':
+			// "|=" is the operator, a "|" which is not followed by "=" is part of the key
+			if pos+1 < len(expr) && expr[pos+1] == '=' {
+				anyOf = true
+				break FIND_OPERATOR
+			}
+		case '*':
+			// "*=" is the operator, a "*" which is not followed by "=" is part of the key
+			if pos+1 < len(expr) && expr[pos+1] == '=' {
+				wildcard = true
+				break FIND_OPERATOR
+			}
+		case '>':
+			// ">" and ">=" are only the operator if no other operator follows, otherwise the
+			// ">" is part of the key, because the keys of the ingested tags may contain it
+			if isComparisonValue(expr[pos+1:]) {
+				greater = true
+				break FIND_OPERATOR
+			}
+		case '<':
+			if isComparisonValue(expr[pos+1:]) {
+				less = true
+				break FIND_OPERATOR
+			}
 		case ';':
 			return nil, InvalidExpressionError(expr)
 		}
@@ -242,31 +1258,69 @@ FIND_OPERATOR:
 		return nil, InvalidExpressionError(expr)
 	}
 
-	resCommon.key = expr[:pos]
-	err := validateQueryExpressionTagKey(resCommon.key)
+	var err error
+	resCommon.key, err = opts.handleWhitespace(expr, expr[:pos], "key")
+	if err != nil {
+		return nil, err
+	}
+	if escapedKey {
+		resCommon.key = unescapeKey(resCommon.key)
+	}
+	if len(resCommon.key) == 0 {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	err = validateQueryExpressionTagKey(resCommon.key, opts.KeyValidation)
 	if err != nil {
-		return nil, fmt.Errorf("Error when validating key \"%s\" of expression \"%s\": %s", resCommon.key, expr, err.Error())
+		return nil, InvalidKeyError{Expression: expr, Key: resCommon.key, Err: err}
 	}
 
-	// shift over the !/^ characters
-	if not || prefix {
+	// shift over the !/^/|/*/>/< characters
+	if not || prefix || anyOf || wildcard || greater || less {
 		pos++
 	}
 
-	if len(expr) <= pos || expr[pos] != '=' {
-		return nil, InvalidExpressionError(expr)
+	// "!|=" is the negated version of "|="
+	if not && len(expr) > pos && expr[pos] == '|' {
+		anyOf = true
+		pos++
+	}
+
+	// "!^=" is the negated version of "^="
+	if not && len(expr) > pos && expr[pos] == '^' {
+		prefix = true
+		pos++
 	}
-	pos++
 
-	if len(expr) > pos && expr[pos] == '~' {
-		// ^=~ is not a valid operator
-		if prefix {
+	if greater || less {
+		// the comparison operators may, but don't have to, be followed by "="
+		if len(expr) > pos && expr[pos] == '=' {
+			orEqual = true
+			pos++
+		}
+	} else {
+		if len(expr) <= pos || expr[pos] != '=' {
 			return nil, InvalidExpressionError(expr)
 		}
+		pos++
+	}
+
+	if !greater && !less && len(expr) > pos && expr[pos] == '~' {
+		// ^=~, |=~ and *=~ are not valid operators
+		if prefix || anyOf || wildcard {
+			return nil, UnsupportedOperatorError(expr)
+		}
 		regex = true
 		pos++
 	}
 
+	// "=?" is the operator to match a value or the absence of the tag
+	plainEqual := !not && !prefix && !anyOf && !wildcard && !greater && !less && !regex
+	if plainEqual && len(expr) > pos && expr[pos] == '?' {
+		orAbsent = true
+		pos++
+	}
+
 	valuePos := pos
 	for ; pos < len(expr); pos++ {
 		// disallow ; in value
@@ -274,35 +1328,82 @@ FIND_OPERATOR:
 			return nil, InvalidExpressionError(expr)
 		}
 	}
-	resCommon.value = expr[valuePos:]
-	var originalOperator, effectiveOperator ExpressionOperator
+	resCommon.value, err = opts.handleValueWhitespace(expr, expr[valuePos:], anyOf || resCommon.key == anyTagKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// a leading "~" of a value can be escaped as "\~" to not be interpreted as the regex marker,
+	// after "=" the same applies to a leading "?" which would be interpreted as the operator "=?"
+	if plainEqual && !orAbsent {
+		resCommon.value = unescapeEqualValue(resCommon.value)
+	} else if !regex {
+		resCommon.value = unescapeValue(resCommon.value)
+	}
+	var originalOperator ExpressionOperator
 
 	// decide what operator this expression uses, based on the operator
 	// itself, but ignoring other factors like f.e. an empty value
 	if not {
 		if regex {
 			originalOperator = NOT_MATCH
+		} else if anyOf {
+			originalOperator = NOT_EQUAL_ANY
+		} else if prefix {
+			originalOperator = NOT_PREFIX
 		} else {
 			originalOperator = NOT_EQUAL
 		}
 	} else {
 		if prefix {
 			originalOperator = PREFIX
+		} else if greater {
+			if orEqual {
+				originalOperator = GREATER_EQUAL
+			} else {
+				originalOperator = GREATER
+			}
+		} else if less {
+			if orEqual {
+				originalOperator = LESS_EQUAL
+			} else {
+				originalOperator = LESS
+			}
+		} else if anyOf {
+			originalOperator = EQUAL_ANY
+		} else if wildcard {
+			originalOperator = WILDCARD
 		} else if regex {
 			originalOperator = MATCH
+		} else if orAbsent {
+			originalOperator = EQUAL_OR_ABSENT
 		} else {
 			originalOperator = EQUAL
 		}
 	}
 
-	effectiveOperator = originalOperator
+	return newExpression(resCommon, originalOperator, opts, expr)
+}
+
+// newExpression instantiates an expression from its key, its operator and its value,
+// which has already been unescaped. the given operator must be one which can be written
+// in an expression string, newExpression decides which expression it translates into,
+// based on the special keys, the value and the possible optimizations.
+// expr is only used for error messages
+func newExpression(resCommon expressionCommon, originalOperator ExpressionOperator, opts *ParseOptions, expr string) (Expression, error) {
+	effectiveOperator := originalOperator
 
 	// special key to match on tag instead of a value
 	// update the operator decision accordingly
 	if resCommon.key == "__tag" {
+		if opts.DisableTagKey {
+			return nil, TagKeyNotAllowedError(expr)
+		}
+
 		// currently ! (not) queries on tags are not supported
 		// and unlike normal queries a value must be set
-		if not {
+		switch originalOperator {
+		case NOT_EQUAL, NOT_MATCH, NOT_PREFIX, NOT_EQUAL_ANY:
 			return nil, InvalidExpressionError(expr)
 		}
 
@@ -316,6 +1417,9 @@ FIND_OPERATOR:
 		case MATCH:
 			if len(resCommon.value) == 0 {
 				effectiveOperator = MATCH_ALL
+			} else if _, _, ok := splitTagValuePattern(resCommon.value); ok {
+				// "__tag=~<key pattern>:<operator><value>"
+				effectiveOperator = TAG_VALUE
 			} else {
 				effectiveOperator = MATCH_TAG
 			}
@@ -328,9 +1432,23 @@ FIND_OPERATOR:
 			resCommon.key = resCommon.value
 			resCommon.value = ""
 			effectiveOperator = HAS_TAG
+		case EQUAL_ANY, WILDCARD, GREATER, GREATER_EQUAL, LESS, LESS_EQUAL, EQUAL_OR_ABSENT:
+			return nil, InvalidExpressionError(expr)
+		}
+	}
+
+	// special key to check for the presence of any of a set of tags,
+	// f.e. "__any_tag=rack|cage". only "=" is supported and a value must be set
+	if resCommon.key == anyTagKey {
+		if effectiveOperator != EQUAL || len(resCommon.value) == 0 {
+			return nil, InvalidExpressionError(expr)
 		}
+		effectiveOperator = HAS_ANY_TAG
 	}
 
+	// the expressions of the same key all share one copy of it
+	resCommon.key = internKey(resCommon.key)
+
 	// check for special case of an empty value and
 	// update chosen operator accordingly
 	if len(resCommon.value) == 0 {
@@ -345,17 +1463,57 @@ FIND_OPERATOR:
 			effectiveOperator = MATCH_NONE
 		case PREFIX:
 			effectiveOperator = MATCH_ALL
+		case NOT_PREFIX:
+			effectiveOperator = MATCH_NONE
+		case WILDCARD:
+			effectiveOperator = NOT_HAS_TAG
+		case EQUAL_OR_ABSENT:
+			// tags can't have empty values, so only the absence of the tag can match
+			effectiveOperator = NOT_HAS_TAG
 		}
 	}
 
+	if !opts.operatorIsAllowed(effectiveOperator) {
+		return nil, OperatorNotAllowedError{Expression: expr, Operator: effectiveOperator}
+	}
+
+	// the reserved keys __lastUpdate__ and __interval__ only support the comparison operators
+	if isPseudoTag(resCommon.key) {
+		return newExpressionPseudoTag(resCommon, effectiveOperator, expr)
+	}
+
+	switch effectiveOperator {
+	case TAG_VALUE:
+		return newExpressionTagValue(resCommon, opts, expr)
+	case HAS_ANY_TAG:
+		return newExpressionHasAnyTag(resCommon, opts, expr)
+	case EQUAL_OR_ABSENT:
+		return &expressionEqualOrAbsent{expressionCommon: resCommon}, nil
+	case EQUAL_ANY:
+		return newExpressionEqualAny(resCommon, expr)
+	case NOT_EQUAL_ANY:
+		return newExpressionNotEqualAny(resCommon, expr)
+	case WILDCARD:
+		return newExpressionWildcard(resCommon, expr)
+	case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL:
+		return newExpressionCompare(resCommon, effectiveOperator, expr)
+	}
+
 	if effectiveOperator == MATCH || effectiveOperator == MATCH_TAG || effectiveOperator == NOT_MATCH {
-		if len(resCommon.value) > 0 && resCommon.value[0] != '^' {
-			resCommon.value = "^(?:" + resCommon.value + ")"
+		// the value is kept as it has been given, the regular expression
+		// gets anchored at the beginning by wrapping it into "^(?:...)".
+		// the value must be a valid pattern on its own, otherwise it could
+		// break out of the wrapping group, f.e. "a)|(b".
+		// the value only gets parsed once, all the checks below use the parsed form
+		parsed, err := syntax.Parse(resCommon.value, syntax.Perl)
+		if err != nil {
+			return nil, BadRegexError{Expression: expr, Err: err}
 		}
+		pattern, parsedPattern := anchorPattern(resCommon.value, parsed)
 
 		// no need to run regular expressions that match any string
 		// so we update the operator to MATCH_ALL/NONE
-		if resCommon.value == "^(?:.*)" || resCommon.value == "^.*" || resCommon.value == "^(.*)" {
+		if resCommon.value == ".*" || resCommon.value == "^(?:.*)" || resCommon.value == "^.*" || resCommon.value == "^(.*)" {
 			switch effectiveOperator {
 			case MATCH:
 				return &expressionMatchAll{expressionCommon: resCommon, originalOperator: originalOperator}, nil
@@ -366,25 +1524,70 @@ FIND_OPERATOR:
 			}
 		}
 
-		valueRe, err := regexp.Compile(resCommon.value)
+		// a regular expression that matches any non-empty string is equivalent to
+		// checking whether the tag is present, because tags can't have empty values
+		if resCommon.value == ".+" || resCommon.value == "^(?:.+)" || resCommon.value == "^.+" || resCommon.value == "^(.+)" {
+			switch effectiveOperator {
+			case MATCH:
+				return &expressionHasTag{expressionCommon: expressionCommon{key: resCommon.key}}, nil
+			case NOT_MATCH:
+				return &expressionNotHasTag{expressionCommon: expressionCommon{key: resCommon.key}}, nil
+			}
+		}
+
+		// the value of a fully anchored pattern is stored in its anchored form, so it
+		// doesn't depend on the options when the expression gets parsed again
+		if opts.FullyAnchoredRegex {
+			resCommon.value = "^(?:" + resCommon.value + ")$"
+			parsed, err = syntax.Parse(resCommon.value, syntax.Perl)
+			if err != nil {
+				return nil, BadRegexError{Expression: expr, Err: err}
+			}
+			pattern, parsedPattern = resCommon.value, parsed
+		}
+
+		// a pattern which only consists of a literal that's anchored at both ends doesn't
+		// need a regular expression, a simple comparison is equivalent and cheaper.
+		// note that patterns are only anchored at the beginning by default, so "a=~b"
+		// is not equivalent to "a=b", but "a=~b$" is.
+		if literal, endAnchored, ok := literalOfParsedPattern(parsedPattern); ok && endAnchored && isValidLiteralValue(literal) {
+			switch effectiveOperator {
+			case MATCH:
+				return &expressionEqual{expressionCommon: expressionCommon{key: resCommon.key, value: literal}}, nil
+			case NOT_MATCH:
+				return &expressionNotEqual{expressionCommon: expressionCommon{key: resCommon.key, value: literal}}, nil
+			}
+		}
+
+		// a pattern which consists of a literal followed by ".*" is equivalent to a prefix
+		if literal, ok := prefixOfPattern(parsedPattern); ok && isValidLiteralValue(literal) {
+			switch effectiveOperator {
+			case MATCH:
+				return &expressionPrefix{expressionCommon: expressionCommon{key: resCommon.key, value: literal}}, nil
+			case NOT_MATCH:
+				return &expressionNotPrefix{expressionCommon: expressionCommon{key: resCommon.key, value: literal}}, nil
+			case MATCH_TAG:
+				return &expressionPrefixTag{expressionCommon: expressionCommon{key: resCommon.key, value: literal}}, nil
+			}
+		}
+
+		err = opts.RegexLimits.checkParsed(expr, resCommon.value, parsed)
 		if err != nil {
 			return nil, err
 		}
 
-		// check for special case when regular expression matches
-		// empty value and update operator accordingly
-		matchesEmpty := valueRe.MatchString("")
+		resCommonRe, err := newExpressionCommonRe(resCommon, pattern, parsed, opts.MatchCacheSize, opts.LazyRegexCompilation)
+		if err != nil {
+			return nil, BadRegexError{Expression: expr, Err: err}
+		}
 
 		switch effectiveOperator {
 		case MATCH:
-			return &expressionMatch{expressionCommonRe: expressionCommonRe{expressionCommon: resCommon, valueRe: valueRe, matchesEmpty: matchesEmpty}}, nil
+			return newExpressionMatch(resCommonRe), nil
 		case NOT_MATCH:
-			return &expressionNotMatch{expressionCommonRe: expressionCommonRe{expressionCommon: resCommon, valueRe: valueRe, matchesEmpty: matchesEmpty}}, nil
+			return &expressionNotMatch{expressionCommonRe: resCommonRe}, nil
 		case MATCH_TAG:
-			if matchesEmpty {
-				return nil, InvalidExpressionError(expr)
-			}
-			return &expressionMatchTag{expressionCommonRe: expressionCommonRe{expressionCommon: resCommon, valueRe: valueRe, matchesEmpty: matchesEmpty}}, nil
+			return &expressionMatchTag{expressionCommonRe: resCommonRe}, nil
 		}
 	} else {
 		switch effectiveOperator {
@@ -394,6 +1597,8 @@ FIND_OPERATOR:
 			return &expressionNotEqual{expressionCommon: resCommon}, nil
 		case PREFIX:
 			return &expressionPrefix{expressionCommon: resCommon}, nil
+		case NOT_PREFIX:
+			return &expressionNotPrefix{expressionCommon: resCommon}, nil
 		case HAS_TAG:
 			return &expressionHasTag{expressionCommon: resCommon}, nil
 		case NOT_HAS_TAG:
@@ -407,12 +1612,341 @@ FIND_OPERATOR:
 		}
 	}
 
-	return nil, fmt.Errorf("ParseExpression: Invalid operator in expression %s", expr)
+	return nil, UnsupportedOperatorError(expr)
+}
+
+// newExpressionFromValues is used by the exported expression constructors, it instantiates an
+// expression from the given key, operator and value without parsing an expression string.
+// the value is taken as it is, it must not be escaped. all the validations of the parser
+// with the default options are applied, so the result is the same as if the expression
+// had been parsed from its string representation
+func newExpressionFromValues(key string, operator ExpressionOperator, value string) (Expression, error) {
+	// only used for error messages
+	var builder strings.Builder
+	builder.WriteString(escapeKey(key))
+	operator.StringIntoWriter(&builder)
+	switch {
+	case operator == EQUAL:
+		builder.WriteString(escapeEqualValue(value))
+	case operator.UsesRegex():
+		builder.WriteString(value)
+	default:
+		builder.WriteString(escapeValue(value))
+	}
+	expr := builder.String()
+
+	opts := &defaultParseOptions
+	if !opts.AllowInvalidCharacters {
+		if err := checkCharacters(expr); err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.IndexByte(key, ';') >= 0 || strings.IndexByte(value, ';') >= 0 {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	var err error
+	if key, err = opts.handleWhitespace(expr, key, "key"); err != nil {
+		return nil, err
+	}
+	if value, err = opts.handleValueWhitespace(expr, value, operator == EQUAL_ANY || operator == NOT_EQUAL_ANY || key == anyTagKey); err != nil {
+		return nil, err
+	}
+
+	if err := validateQueryExpressionTagKey(key, opts.KeyValidation); err != nil {
+		return nil, InvalidKeyError{Expression: expr, Key: key, Err: err}
+	}
+
+	return newExpression(expressionCommon{key: key, value: value}, operator, opts, expr)
 }
 
 // MetricDefinitionFilter takes a metric name together with its tags and returns a FilterDecision
 type MetricDefinitionFilter func(id schema.MKey, name string, tags []string) FilterDecision
 
+// MetricDefinitionTagsFilter is the same as MetricDefinitionFilter, but it takes the tags as Tags.
+// when evaluating multiple filters against a metric the tags only need to get split once, by SplitTags
+type MetricDefinitionTagsFilter func(id schema.MKey, name string, tags Tags) FilterDecision
+
+// MetaRecordFilter takes the meta tags of a meta record and returns a FilterDecision,
+// see Expression.GetMetaRecordFilter
+type MetaRecordFilter func(metaTags Tags) FilterDecision
+
+// ignoreTags turns a MetricDefinitionFilter, which doesn't look at the tags, into a MetricDefinitionTagsFilter
+func ignoreTags(filter MetricDefinitionFilter) MetricDefinitionTagsFilter {
+	return func(id schema.MKey, name string, _ Tags) FilterDecision {
+		return filter(id, name, nil)
+	}
+}
+
+// decisionIfTagIsAbsent returns the decision of the given expression for a metric which doesn't have
+// the tag it is looking for. with meta tag support the tag might still get added by a meta record
+func decisionIfTagIsAbsent(e Expression) FilterDecision {
+	if MetaTagSupport {
+		return None
+	}
+	return e.GetDefaultDecision()
+}
+
+// matchesTagValue implements MatchesTags for the expressions which look at the value of the tag with their key
+func matchesTagValue(e Expression, tags map[string]string) FilterDecision {
+	value, ok := tags[e.GetKey()]
+	if !ok && e.GetKey() != "name" {
+		return decisionIfTagIsAbsent(e)
+	}
+
+	if e.Matches(value) {
+		return Pass
+	}
+	return Fail
+}
+
+// matchesMetric implements MatchesMetric by evaluating the MetricDefinitionTagsFilter of the
+// given expression with a lookup that finds the given tags
+func matchesMetric(e Expression, name string, tags Tags) bool {
+	lookup := func(_ schema.MKey, key, value string) bool {
+		for _, tag := range tags {
+			if tag.Key == key && tag.Value == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	decision := e.GetMetricDefinitionTagsFilter(lookup)(schema.MKey{}, name, tags)
+	if decision == None {
+		decision = e.GetDefaultDecision()
+	}
+	return decision == Pass
+}
+
+// matchesTagKey implements MatchesTags for the expressions which look at the tag keys,
+// every metric has a name so the key "name" is always considered
+func matchesTagKey(e Expression, tags map[string]string) FilterDecision {
+	if e.Matches("name") {
+		return Pass
+	}
+
+	for key := range tags {
+		if e.Matches(key) {
+			return Pass
+		}
+	}
+
+	return decisionIfTagIsAbsent(e)
+}
+
+// metaRecordFilterByValue implements GetMetaRecordFilter for the expressions which look at the
+// value of the tag with their key. it fails if the record assigns the key, but with values which
+// don't satisfy the expression
+func metaRecordFilterByValue(e Expression) MetaRecordFilter {
+	key := e.GetKey()
+	if key == "name" {
+		return func(_ Tags) FilterDecision { return None }
+	}
+
+	return func(metaTags Tags) FilterDecision {
+		res := None
+		for _, tag := range metaTags {
+			if tag.Key != key {
+				continue
+			}
+			if e.Matches(tag.Value) {
+				return Pass
+			}
+			res = Fail
+		}
+		return res
+	}
+}
+
+// metaRecordFilterByKey implements GetMetaRecordFilter for the expressions which look at the
+// tag keys. it fails if the record assigns tags, but none of them satisfies the expression
+func metaRecordFilterByKey(e Expression) MetaRecordFilter {
+	return func(metaTags Tags) FilterDecision {
+		res := None
+		for _, tag := range metaTags {
+			if tag.Key == "name" {
+				continue
+			}
+			if e.Matches(tag.Key) {
+				return Pass
+			}
+			res = Fail
+		}
+		return res
+	}
+}
+
+// looksAtSingleTag returns true if the filter of the given expression only looks at the tags
+// which have the key of the expression. the expressions on the metric name and on pseudo tags
+// don't look at the tags at all, the ones which operate on tag keys look at all of them
+func looksAtSingleTag(e Expression) bool {
+	if e.OperatesOnTag() || e.GetKey() == "name" {
+		return false
+	}
+	_, ok := e.(MetricPropertyExpression)
+	return !ok
+}
+
+// filterSortedTagsOfKey returns a filter which passes the given filter only those of the tags
+// that have the given key. the tags passed to the returned filter must be sorted, see
+// sortedTagsOfKey
+func filterSortedTagsOfKey(filter MetricDefinitionFilter, key string) MetricDefinitionFilter {
+	return func(id schema.MKey, name string, tags []string) FilterDecision {
+		return filter(id, name, sortedTagsOfKey(tags, key))
+	}
+}
+
+// MetricDefinitionFilters is a list of filters of which the decisions can be combined
+type MetricDefinitionFilters []MetricDefinitionFilter
+
+// FilterAnd runs the given metric through the filters and combines their decisions with CombineAnd:
+// if any filter returns Fail the result is Fail, if all filters return Pass the result is Pass,
+// otherwise it is None. It stops at the first Fail, because no later filter can change the result.
+// Without filters the result is Pass
+func (f MetricDefinitionFilters) FilterAnd(id schema.MKey, name string, tags []string) FilterDecision {
+	res := Pass
+	for _, filter := range f {
+		if res = CombineAnd(res, filter(id, name, tags)); res == Fail {
+			return Fail
+		}
+	}
+	return res
+}
+
+// FilterOr runs the given metric through the filters and combines their decisions with CombineOr:
+// if any filter returns Pass the result is Pass, if all filters return Fail the result is Fail,
+// otherwise it is None. It stops at the first Pass, because no later filter can change the result.
+// Without filters the result is Fail
+func (f MetricDefinitionFilters) FilterOr(id schema.MKey, name string, tags []string) FilterDecision {
+	res := Fail
+	for _, filter := range f {
+		if res = CombineOr(res, filter(id, name, tags)); res == Pass {
+			return Pass
+		}
+	}
+	return res
+}
+
+// MetricDefinitionLike holds the properties of a metric which MetricDefinitionFilters look at
+type MetricDefinitionLike struct {
+	Id   schema.MKey
+	Name string
+	Tags []string
+}
+
+// FilterBatchCheckInterval is the number of metrics which FilterBatch filters between two
+// checks whether its context has been canceled
+const FilterBatchCheckInterval = 256
+
+// FilterBatch runs each of the given metrics through the filters like FilterAnd, but if a filter
+// returns None the decision at the same index of defaults applies. Without defaults None stays
+// None. The returned decisions are in the same order as the metrics.
+// The context gets checked every FilterBatchCheckInterval metrics, once it is done FilterBatch
+// stops and returns the error of the context. If the context carries a RegexBudget, see
+// ContextWithRegexBudget, it also stops with ErrRegexBudgetExceeded once that is exceeded
+func (f MetricDefinitionFilters) FilterBatch(ctx context.Context, defs []MetricDefinitionLike, defaults []FilterDecision) ([]FilterDecision, error) {
+	budget := RegexBudgetFromContext(ctx)
+	res := make([]FilterDecision, len(defs))
+	for i := range defs {
+		if i%FilterBatchCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := budget.Err(); err != nil {
+				return nil, err
+			}
+		}
+		res[i] = f.filterAndWithDefaults(defs[i].Id, defs[i].Name, defs[i].Tags, defaults)
+	}
+	return res, nil
+}
+
+// FilterBatchParallel is like FilterBatch, but the given number of workers run the metrics
+// through the filters concurrently. Each worker repeatedly takes the next chunk of
+// FilterBatchCheckInterval metrics and writes their decisions into the same part of the
+// returned slice, so the decisions are in the same order as the metrics and no worker needs to
+// allocate anything per chunk. If workers is < 1 the number of workers is runtime.GOMAXPROCS(0).
+// Before each chunk the worker checks the context and its RegexBudget like FilterBatch does,
+// once one of them is done all workers stop and the first error gets returned.
+// The filters must be safe for concurrent use, the filters of the Expressions are
+func (f MetricDefinitionFilters) FilterBatchParallel(ctx context.Context, defs []MetricDefinitionLike, defaults []FilterDecision, workers int) ([]FilterDecision, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	chunks := (len(defs) + FilterBatchCheckInterval - 1) / FilterBatchCheckInterval
+	if workers > chunks {
+		workers = chunks
+	}
+	if workers <= 1 {
+		return f.FilterBatch(ctx, defs, defaults)
+	}
+
+	budget := RegexBudgetFromContext(ctx)
+	res := make([]FilterDecision, len(defs))
+
+	var nextChunk int64
+	var stopped int32
+	var errOnce sync.Once
+	var firstErr error
+	stop := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		atomic.StoreInt32(&stopped, 1)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stopped) == 0 {
+				chunk := int(atomic.AddInt64(&nextChunk, 1) - 1)
+				if chunk >= chunks {
+					return
+				}
+				if err := ctx.Err(); err != nil {
+					stop(err)
+					return
+				}
+				if err := budget.Err(); err != nil {
+					stop(err)
+					return
+				}
+
+				start := chunk * FilterBatchCheckInterval
+				end := minInt(start+FilterBatchCheckInterval, len(defs))
+				for j := start; j < end; j++ {
+					res[j] = f.filterAndWithDefaults(defs[j].Id, defs[j].Name, defs[j].Tags, defaults)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return res, nil
+}
+
+// filterAndWithDefaults is like FilterAnd, but it replaces a None decision of a filter with
+// the decision at the same index of defaults, if defaults is not nil. The result is the one of
+// DecideWithDefaults on the decisions of the filters, it only stops earlier
+func (f MetricDefinitionFilters) filterAndWithDefaults(id schema.MKey, name string, tags []string, defaults []FilterDecision) FilterDecision {
+	res := Pass
+	for i, filter := range f {
+		decision := filter(id, name, tags)
+		if decision == None && defaults != nil {
+			decision = defaults[i]
+		}
+		if res = CombineAnd(res, decision); res == Fail {
+			return Fail
+		}
+	}
+	return res
+}
+
 type FilterDecision uint8
 
 const (
@@ -421,46 +1955,241 @@ const (
 	Pass                       // the filter has passed
 )
 
+func (d FilterDecision) String() string {
+	switch d {
+	case None:
+		return "none"
+	case Fail:
+		return "fail"
+	case Pass:
+		return "pass"
+	}
+	return fmt.Sprintf("FilterDecision(%d)", uint8(d))
+}
+
+// CombineAnd combines the decisions of two filters which both need to pass:
+//
+//	a    \ b | None | Fail | Pass
+//	---------+------+------+-----
+//	None     | None | Fail | None
+//	Fail     | Fail | Fail | Fail
+//	Pass     | None | Fail | Pass
+//
+// Fail wins over everything, Pass is only returned if both decisions are Pass
+func CombineAnd(a, b FilterDecision) FilterDecision {
+	if a == Fail || b == Fail {
+		return Fail
+	}
+	if a == Pass && b == Pass {
+		return Pass
+	}
+	return None
+}
+
+// CombineOr combines the decisions of two filters of which at least one needs to pass:
+//
+//	a    \ b | None | Fail | Pass
+//	---------+------+------+-----
+//	None     | None | None | Pass
+//	Fail     | None | Fail | Pass
+//	Pass     | Pass | Pass | Pass
+//
+// Pass wins over everything, Fail is only returned if both decisions are Fail
+func CombineOr(a, b FilterDecision) FilterDecision {
+	if a == Pass || b == Pass {
+		return Pass
+	}
+	if a == Fail && b == Fail {
+		return Fail
+	}
+	return None
+}
+
+// DecideWithDefaults combines the decisions of filters which all need to pass, after replacing
+// each None with the decision at the same index of defaults. Defaults must either be nil, then
+// None stays None, or have one entry per decision. The precedence is:
+//
+//  1. if any decision is Fail, or is None and its default is Fail, the result is Fail
+//  2. otherwise if all the decisions are Pass, or None with the default Pass, the result is Pass
+//  3. otherwise the result is None
+//
+// The defaults need to get applied to each decision before they are combined. Applying one of
+// them to the combined decision instead would let a Pass default hide a Fail default, f.e.
+// [Pass, None] with the defaults [Pass, Fail] is Fail. Without decisions the result is Pass
+func DecideWithDefaults(decisions []FilterDecision, defaults []FilterDecision) FilterDecision {
+	res := Pass
+	for i, decision := range decisions {
+		if decision == None && defaults != nil {
+			decision = defaults[i]
+		}
+		if decision == Fail {
+			return Fail
+		}
+		if decision != Pass {
+			res = None
+		}
+	}
+	return res
+}
+
+// isComparisonValue returns true if the given rest of an expression, which follows a "<" or
+// ">", is the value of a comparison operator, which means that the "<" or ">" is the operator.
+// every other operator contains a "=", so if the rest contains one then the "<" or ">" is part
+// of the key. the "=" of ">=" and "<=" doesn't count, because it is part of the operator
+func isComparisonValue(rest string) bool {
+	if len(rest) > 0 && rest[0] == '=' {
+		rest = rest[1:]
+	}
+	return strings.IndexByte(rest, '=') < 0
+}
+
 type ExpressionOperator uint16
 
 const (
-	EQUAL       ExpressionOperator = iota // =
-	NOT_EQUAL                             // !=
-	MATCH                                 // =~        regular expression
-	MATCH_TAG                             // __tag=~   relies on special key __tag. non-standard, required for `/metrics/tags` requests with "filter"
-	NOT_MATCH                             // !=~
-	PREFIX                                // ^=        exact prefix, not regex. non-standard, required for auto complete of tag values
-	PREFIX_TAG                            // __tag^=   exact prefix with tag. non-standard, required for auto complete of tag keys
-	HAS_TAG                               // <tag>!="" specified tag must be present
-	NOT_HAS_TAG                           // <tag>="" specified tag must not be present
-	MATCH_ALL                             // special case of expression that matches every metric (f.e. key=.*)
-	MATCH_NONE                            // special case of expression that matches no metric (f.e. key!=.*)
+	EQUAL           ExpressionOperator = iota // =
+	NOT_EQUAL                                 // !=
+	MATCH                                     // =~        regular expression
+	MATCH_TAG                                 // __tag=~   relies on special key __tag. non-standard, required for `/metrics/tags` requests with "filter"
+	NOT_MATCH                                 // !=~
+	PREFIX                                    // ^=        exact prefix, not regex. non-standard, required for auto complete of tag values
+	PREFIX_TAG                                // __tag^=   exact prefix with tag. non-standard, required for auto complete of tag keys
+	HAS_TAG                                   // <tag>!="" specified tag must be present
+	NOT_HAS_TAG                               // <tag>="" specified tag must not be present
+	MATCH_ALL                                 // special case of expression that matches every metric (f.e. key=.*)
+	MATCH_NONE                                // special case of expression that matches no metric (f.e. key!=.*)
+	EQUAL_ANY                                 // |=        value must be exactly one of a "|" separated set of values. non-standard
+	NOT_EQUAL_ANY                             // !|=       value must not be any of a "|" separated set of values. non-standard
+	GREATER                                   // >         value must be numerically greater. non-standard
+	GREATER_EQUAL                             // >=        value must be numerically greater or equal. non-standard
+	LESS                                      // <         value must be numerically less. non-standard
+	LESS_EQUAL                                // <=        value must be numerically less or equal. non-standard
+	WILDCARD                                  // *=        glob pattern with the wildcards * and ?. non-standard
+	NOT_PREFIX                                // !^=       value must not have the given prefix. non-standard
+	TAG_VALUE                                 // __tag=~<key pattern>:<operator><value> a tag with a matching key must satisfy the value condition. non-standard
+	HAS_ANY_TAG                               // __any_tag=<tag>|<tag> at least one of the specified tags must be present. non-standard
+	EQUAL_OR_ABSENT                           // =?        value must be equal or the tag must not be present. non-standard
 )
 
+// UsesRegex returns true if expressions with this operator evaluate a regular expression
+func (o ExpressionOperator) UsesRegex() bool {
+	return o == MATCH || o == NOT_MATCH || o == MATCH_TAG || o == TAG_VALUE
+}
+
+// operatorNames maps each ExpressionOperator to its unambiguous name
+var operatorNames = [...]string{
+	EQUAL:           "EQUAL",
+	NOT_EQUAL:       "NOT_EQUAL",
+	MATCH:           "MATCH",
+	MATCH_TAG:       "MATCH_TAG",
+	NOT_MATCH:       "NOT_MATCH",
+	PREFIX:          "PREFIX",
+	PREFIX_TAG:      "PREFIX_TAG",
+	HAS_TAG:         "HAS_TAG",
+	NOT_HAS_TAG:     "NOT_HAS_TAG",
+	MATCH_ALL:       "MATCH_ALL",
+	MATCH_NONE:      "MATCH_NONE",
+	EQUAL_ANY:       "EQUAL_ANY",
+	NOT_EQUAL_ANY:   "NOT_EQUAL_ANY",
+	GREATER:         "GREATER",
+	GREATER_EQUAL:   "GREATER_EQUAL",
+	LESS:            "LESS",
+	LESS_EQUAL:      "LESS_EQUAL",
+	WILDCARD:        "WILDCARD",
+	NOT_PREFIX:      "NOT_PREFIX",
+	TAG_VALUE:       "TAG_VALUE",
+	HAS_ANY_TAG:     "HAS_ANY_TAG",
+	EQUAL_OR_ABSENT: "EQUAL_OR_ABSENT",
+}
+
+// String returns the name of the operator, f.e. "NOT_MATCH". Unlike StringIntoWriter,
+// which writes the syntax token, the name is unique for each operator.
+// Unknown operators are returned as "ExpressionOperator(<number>)"
+func (o ExpressionOperator) String() string {
+	if int(o) < len(operatorNames) {
+		return operatorNames[o]
+	}
+	return fmt.Sprintf("ExpressionOperator(%d)", o)
+}
+
+// ParseOperator is the inverse of ExpressionOperator.String, it returns the
+// operator with the given name or an error if there is no such operator
+func ParseOperator(name string) (ExpressionOperator, error) {
+	for o, operatorName := range operatorNames {
+		if operatorName == name {
+			return ExpressionOperator(o), nil
+		}
+	}
+	return 0, errors.NewBadRequestf("Unknown expression operator: %s", name)
+}
+
+// MarshalText satisfies the encoding.TextMarshaler interface, it is also used by the JSON encoding.
+// the text of an operator is its name in lower case, f.e. "not_match". these names are part of the
+// api responses, so they must never change. unknown operators result in an error
+func (o ExpressionOperator) MarshalText() ([]byte, error) {
+	if int(o) >= len(operatorNames) {
+		return nil, fmt.Errorf("Unknown expression operator: %d", o)
+	}
+	return []byte(strings.ToLower(operatorNames[o])), nil
+}
+
+// UnmarshalText satisfies the encoding.TextUnmarshaler interface, it is the inverse of MarshalText
+func (o *ExpressionOperator) UnmarshalText(text []byte) error {
+	name := string(text)
+	for operator, operatorName := range operatorNames {
+		if strings.ToLower(operatorName) == name {
+			*o = ExpressionOperator(operator)
+			return nil
+		}
+	}
+	return errors.NewBadRequestf("Unknown expression operator: %s", name)
+}
+
 func (o ExpressionOperator) StringIntoWriter(writer io.Writer) {
 	switch o {
 	case EQUAL:
-		writer.Write([]byte("="))
+		io.WriteString(writer, "=")
 	case NOT_EQUAL:
-		writer.Write([]byte("!="))
+		io.WriteString(writer, "!=")
 	case MATCH:
-		writer.Write([]byte("=~"))
+		io.WriteString(writer, "=~")
 	case MATCH_TAG:
-		writer.Write([]byte("=~"))
+		io.WriteString(writer, "=~")
 	case NOT_MATCH:
-		writer.Write([]byte("!=~"))
+		io.WriteString(writer, "!=~")
 	case PREFIX:
-		writer.Write([]byte("^="))
+		io.WriteString(writer, "^=")
 	case PREFIX_TAG:
-		writer.Write([]byte("^="))
+		io.WriteString(writer, "^=")
 	case HAS_TAG:
-		writer.Write([]byte("!="))
+		io.WriteString(writer, "!=")
 	case NOT_HAS_TAG:
-		writer.Write([]byte("="))
+		io.WriteString(writer, "=")
 	case MATCH_ALL:
-		writer.Write([]byte("="))
+		io.WriteString(writer, "=")
 	case MATCH_NONE:
-		writer.Write([]byte("!="))
+		io.WriteString(writer, "!=")
+	case EQUAL_ANY:
+		io.WriteString(writer, "|=")
+	case NOT_EQUAL_ANY:
+		io.WriteString(writer, "!|=")
+	case GREATER:
+		io.WriteString(writer, ">")
+	case GREATER_EQUAL:
+		io.WriteString(writer, ">=")
+	case LESS:
+		io.WriteString(writer, "<")
+	case LESS_EQUAL:
+		io.WriteString(writer, "<=")
+	case WILDCARD:
+		io.WriteString(writer, "*=")
+	case NOT_PREFIX:
+		io.WriteString(writer, "!^=")
+	case TAG_VALUE:
+		io.WriteString(writer, "=~")
+	case HAS_ANY_TAG:
+		io.WriteString(writer, "=")
+	case EQUAL_OR_ABSENT:
+		io.WriteString(writer, "=?")
 	}
 }
 
@@ -484,71 +2213,138 @@ func ParseSeriesByTagExpression(seriesByTagQuery string) (Expressions, error) {
 	return parseTagExpressions(seriesByTagQuery[startPos:endPos])
 }
 
+// parseTagExpressions parses the arguments of a `seriesByTag` call the way they always have
+// been parsed by ParseSeriesByTagExpression, a backslash inside the quotes is kept as it is and
+// can't escape anything, so f.e. 'name=~a\\' is the pattern "a\\"
 func parseTagExpressions(expressions string) (Expressions, error) {
+	args, err := splitSeriesByTagArgs(expressions, false)
+	if err != nil {
+		return nil, err
+	}
 
-	// expressionStartEndPos is a list of positions where expressions start and end inside the expressions string
-	var expressionStartPos int
-	var needComma, insideExpression, requiresNonEmptyValue bool
-	var quoteChar byte
+	return parseSeriesByTagArgs(args, false)
+}
 
-	// this might allocate a bit more than we need if a tag or value contains ,
-	// it's still better than having to grow the slice though
-	results := make(Expressions, 0, strings.Count(expressions, ",")+1)
+// ParseSeriesByTagCall takes a raw `seriesByTag` call, such as "seriesByTag('name=cpu', \"dc=~us.*\")",
+// splits it into its arguments and parses them via ParseSeriesByTagArgs
+func ParseSeriesByTagCall(raw string) (Expressions, error) {
+	raw = strings.TrimSpace(raw)
+	if !IsSeriesByTagExpression(raw) {
+		return nil, errors.NewBadRequestf("Not a seriesByTag call: %s", raw)
+	}
 
-	for i := 0; i < len(expressions); i++ {
-		char := expressions[i]
-		if insideExpression {
-			// checking for closing quote
-			if char == quoteChar {
-				insideExpression = false
-				needComma = true
-				expression, err := ParseExpression(expressions[expressionStartPos:i])
-				if err != nil {
-					return nil, err
-				}
+	args, err := splitSeriesByTagArgs(raw[len(seriesByTagIdent) : len(raw)-1], true)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSeriesByTagArgs(args)
+}
 
-				requiresNonEmptyValue = requiresNonEmptyValue || expression.RequiresNonEmptyValue()
+// ParseSeriesByTagArgs takes the arguments of a `seriesByTag` call, each of them still quoted
+// by either single or double quotes, it strips the quotes and parses each argument into an
+// expression. Inside the quotes a quote character of the same type and the backslash itself
+// can be escaped with "\", so a value ending in a backslash can be written as 'a=b\\'. Other
+// backslashes are kept as they are, f.e. 'c=~\d'.
+// Errors identify the position of the argument which could not be parsed, starting with 1,
+// if the expression of an argument is invalid the error is a SeriesByTagArgError.
+// Just like with a `seriesByTag` call, at least one expression must require a non-empty value.
+func ParseSeriesByTagArgs(args []string) (Expressions, error) {
+	return parseSeriesByTagArgs(args, true)
+}
 
-				results = append(results, expression)
-				continue
-			}
-		} else {
-			// outside an expression spaces are ignored
-			if char == ' ' {
-				continue
+// parseSeriesByTagArgs implements ParseSeriesByTagArgs, if escapes is false a backslash
+// doesn't escape anything, see parseTagExpressions
+func parseSeriesByTagArgs(args []string, escapes bool) (Expressions, error) {
+	res := make(Expressions, 0, len(args))
+	requiresNonEmptyValue := false
+
+	for i := range args {
+		arg := strings.TrimSpace(args[i])
+		if len(arg) < 2 || (arg[0] != '\'' && arg[0] != '"') || arg[len(arg)-1] != arg[0] {
+			return nil, errors.NewBadRequestf("Argument %d of seriesByTag is not quoted: %s", i+1, args[i])
+		}
+
+		quoteChar := arg[0]
+		quoted := arg[1 : len(arg)-1]
+		var builder strings.Builder
+		builder.Grow(len(quoted))
+		for pos := 0; pos < len(quoted); pos++ {
+			// an escaped quote or backslash gets unescaped, an unescaped quote means that
+			// the argument consists of multiple quoted strings
+			if escapes && isSeriesByTagEscape(quoted[pos:], quoteChar) {
+				pos++
+			} else if quoted[pos] == quoteChar {
+				return nil, errors.NewBadRequestf("Argument %d of seriesByTag has unexpected quotes, missing comma?: %s", i+1, args[i])
 			}
+			builder.WriteByte(quoted[pos])
+		}
+		value := builder.String()
 
-			if char == '\'' || char == '"' {
-				if needComma {
-					return nil, fmt.Errorf("Missing comma between quotes: %s", expressions)
-				}
+		expression, err := ParseExpression(value)
+		if err != nil {
+			return nil, SeriesByTagArgError{Arg: i + 1, Err: err}
+		}
+
+		requiresNonEmptyValue = requiresNonEmptyValue || expression.RequiresNonEmptyValue()
+		res = append(res, expression)
+	}
+
+	if !requiresNonEmptyValue {
+		return nil, errors.NewBadRequestf("At least one expression must require a non-empty value")
+	}
+
+	return res, nil
+}
+
+// isSeriesByTagEscape returns true if the given rest of a quoted argument starts with a
+// backslash which escapes the following quote character or backslash
+func isSeriesByTagEscape(rest string, quoteChar byte) bool {
+	return len(rest) > 1 && rest[0] == '\\' && (rest[1] == quoteChar || rest[1] == '\\')
+}
+
+// splitSeriesByTagArgs takes the argument string of a `seriesByTag` call and splits it by
+// commas which are not inside quotes. The returned arguments still have their quotes.
+// If escapes is true an escaped quote character or backslash is skipped over, so an escaped
+// quote doesn't end the quotes, see ParseSeriesByTagArgs.
+// A single trailing comma is allowed.
+func splitSeriesByTagArgs(args string, escapes bool) ([]string, error) {
+	var res []string
+	var quoteChar byte
+	argStart := 0
 
-				insideExpression = true
-				quoteChar = char
-				expressionStartPos = i + 1
+	for i := 0; i < len(args); i++ {
+		char := args[i]
+		if quoteChar != 0 {
+			if escapes && isSeriesByTagEscape(args[i:], quoteChar) {
+				i++
 				continue
 			}
-
-			if char == ',' {
-				if needComma {
-					needComma = false
-					continue
-				} else {
-					return nil, fmt.Errorf("Too many commas between quotes: %s", expressions)
-				}
+			if char == quoteChar {
+				quoteChar = 0
 			}
+			continue
+		}
 
-			return nil, fmt.Errorf("Invalid character outside quotes '%c': %s", char, expressions)
+		switch char {
+		case '\'', '"':
+			quoteChar = char
+		case ',':
+			if len(strings.TrimSpace(args[argStart:i])) == 0 {
+				return nil, errors.NewBadRequestf("Argument %d of seriesByTag is empty: %s", len(res)+1, args)
+			}
+			res = append(res, args[argStart:i])
+			argStart = i + 1
 		}
 	}
 
-	if insideExpression {
-		return nil, fmt.Errorf("Unclosed quotes in string: %s", expressions)
+	if quoteChar != 0 {
+		return nil, errors.NewBadRequestf("Unclosed quotes in string: %s", args)
 	}
 
-	if !requiresNonEmptyValue {
-		return nil, fmt.Errorf("At least one expression must require a non-empty value")
+	if len(strings.TrimSpace(args[argStart:])) > 0 {
+		res = append(res, args[argStart:])
 	}
 
-	return results, nil
+	return res, nil
 }
@@ -0,0 +1,137 @@
+package tagquery
+
+import (
+	"encoding/binary"
+
+	"github.com/grafana/metrictank/errors"
+)
+
+// expressionsBinaryVersion is the version of the binary representation of Expressions,
+// it has to be increased whenever the layout or the meaning of its fields changes
+const expressionsBinaryVersion = 1
+
+// MarshalBinary satisfies the encoding.BinaryMarshaler interface. The layout is:
+//
+//	version (1 byte)
+//	number of expressions (uvarint)
+//	per expression:
+//	  operator (1 byte)
+//	  original operator of MATCH_ALL / MATCH_NONE, otherwise 0 (1 byte)
+//	  length of the key (uvarint), key
+//	  length of the value (uvarint), value
+//
+// like the msgp encoding it is based on expressionsWire, so decoding the expressions doesn't
+// require parsing them again
+func (e Expressions) MarshalBinary() ([]byte, error) {
+	wire := e.toWire()
+
+	size := 1 + binary.MaxVarintLen64
+	for _, expr := range wire.Expressions {
+		size += 2 + 2*binary.MaxVarintLen64 + len(expr.Key) + len(expr.Value)
+	}
+
+	res := make([]byte, 0, size)
+	res = append(res, expressionsBinaryVersion)
+	res = appendUvarint(res, uint64(len(wire.Expressions)))
+	for _, expr := range wire.Expressions {
+		if expr.Operator > 0xff || expr.OriginalOperator > 0xff {
+			return nil, errors.NewBadRequestf("Operator of expression %q can't be encoded in one byte", expr.Key)
+		}
+		res = append(res, byte(expr.Operator), byte(expr.OriginalOperator))
+		res = appendUvarint(res, uint64(len(expr.Key)))
+		res = append(res, expr.Key...)
+		res = appendUvarint(res, uint64(len(expr.Value)))
+		res = append(res, expr.Value...)
+	}
+
+	return res, nil
+}
+
+// UnmarshalBinary satisfies the encoding.BinaryUnmarshaler interface, it decodes the layout
+// written by MarshalBinary. Regular expressions get compiled and validated again, so the data
+// doesn't need to be trusted
+func (e *Expressions) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.NewBadRequest("Encoded expressions are empty")
+	}
+	if data[0] != expressionsBinaryVersion {
+		return errors.NewBadRequestf("Unsupported version of encoded expressions: %d", data[0])
+	}
+	data = data[1:]
+
+	count, data, err := readUvarint(data, "number of expressions")
+	if err != nil {
+		return err
+	}
+
+	// each expression takes at least 4 bytes, this prevents huge allocations
+	// because of a corrupted count
+	if count > uint64(len(data)/4) {
+		return errors.NewBadRequestf("Encoded expressions are truncated: expected %d expressions in %d bytes", count, len(data))
+	}
+
+	wire := expressionsWire{
+		Version:     expressionsWireVersion,
+		Expressions: make([]expressionWire, count),
+	}
+	for i := range wire.Expressions {
+		if len(data) < 2 {
+			return errors.NewBadRequestf("Encoded expressions are truncated: missing operator of expression %d", i)
+		}
+		wire.Expressions[i].Operator = uint16(data[0])
+		wire.Expressions[i].OriginalOperator = uint16(data[1])
+		data = data[2:]
+
+		wire.Expressions[i].Key, data, err = readBinaryString(data, "key", i)
+		if err != nil {
+			return err
+		}
+		wire.Expressions[i].Value, data, err = readBinaryString(data, "value", i)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(data) > 0 {
+		return errors.NewBadRequestf("Encoded expressions have %d unexpected trailing bytes", len(data))
+	}
+
+	res, err := wire.toExpressions()
+	if err != nil {
+		return err
+	}
+	*e = res
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// readUvarint reads a uvarint from the beginning of data and returns it with the remaining data,
+// the description of the value is used in the error message
+func readUvarint(data []byte, description string) (uint64, []byte, error) {
+	v, n := binary.Uvarint(data)
+	if n == 0 {
+		return 0, nil, errors.NewBadRequestf("Encoded expressions are truncated: missing %s", description)
+	}
+	if n < 0 {
+		return 0, nil, errors.NewBadRequestf("Encoded expressions are invalid: %s overflows", description)
+	}
+	return v, data[n:], nil
+}
+
+// readBinaryString reads a length-prefixed string from the beginning of data and returns it
+// with the remaining data, field and index are used in the error messages
+func readBinaryString(data []byte, field string, i int) (string, []byte, error) {
+	length, data, err := readUvarint(data, "length of "+field)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(data)) {
+		return "", nil, errors.NewBadRequestf("Encoded expressions are truncated: %s of expression %d has %d bytes, only %d remaining", field, i, length, len(data))
+	}
+	return string(data[:length]), data[length:], nil
+}
@@ -0,0 +1,147 @@
+package tagquery
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestExpressionsBinaryRoundTrip(t *testing.T) {
+	in, err := ParseExpressions(wireTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	encoded, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+
+	var out Expressions
+	if err := out.UnmarshalBinary(encoded); err != nil {
+		t.Fatalf("Unexpected error when unmarshaling: %s", err)
+	}
+	if !in.Equal(out) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", in.Strings(), out.Strings())
+	}
+
+	// the order and the original operators of MATCH_ALL / MATCH_NONE are preserved
+	inStrings, outStrings := in.Strings(), out.Strings()
+	for i := range in {
+		if inStrings[i] != outStrings[i] || in[i].GetOperator() != out[i].GetOperator() {
+			t.Fatalf("Expected decoded expression %d to be %q, got %q", i, inStrings[i], outStrings[i])
+		}
+		for _, value := range []string{"", "b", "bc", "5", "us-east"} {
+			if in[i].Matches(value) != out[i].Matches(value) {
+				t.Fatalf("Expected decoded expression %q to match %q like the original", inStrings[i], value)
+			}
+		}
+	}
+
+	// empty expressions round-trip as well
+	encoded, err = Expressions{}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+	if err := out.UnmarshalBinary(encoded); err != nil || len(out) != 0 {
+		t.Fatalf("Expected empty expressions, got %v (error: %v)", out.Strings(), err)
+	}
+}
+
+func TestExpressionsBinaryInvalid(t *testing.T) {
+	in, err := ParseExpressions([]string{"a=b", "c=~d.*"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	encoded, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+
+	var out Expressions
+
+	// every truncation of valid data must be rejected
+	for i := 0; i < len(encoded); i++ {
+		if err := out.UnmarshalBinary(encoded[:i]); err == nil {
+			t.Fatalf("Expected an error when unmarshaling the first %d of %d bytes, but got none", i, len(encoded))
+		}
+	}
+
+	type testCase struct {
+		name string
+		data []byte
+	}
+
+	unknownVersion := append([]byte{}, encoded...)
+	unknownVersion[0] = expressionsBinaryVersion + 1
+
+	testCases := []testCase{
+		{
+			name: "unknown version",
+			data: unknownVersion,
+		}, {
+			name: "trailing bytes",
+			data: append(append([]byte{}, encoded...), 0),
+		}, {
+			name: "too many expressions",
+			data: []byte{expressionsBinaryVersion, 0xff, 0xff, 0xff, 0xff, 0x0f, 0, 0, 0, 0},
+		}, {
+			name: "unknown operator",
+			data: []byte{expressionsBinaryVersion, 1, 0xff, 0, 1, 'a', 1, 'b'},
+		}, {
+			name: "invalid regex",
+			data: []byte{expressionsBinaryVersion, 1, byte(MATCH), 0, 1, 'a', 2, '(', 'b'},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := out.UnmarshalBinary(tc.data); err == nil {
+				t.Fatalf("Expected an error, but got none")
+			}
+		})
+	}
+}
+
+// TestExpressionsBinaryUnmarshalRandom makes sure that unmarshaling random or corrupted
+// data returns an error instead of panicking
+func TestExpressionsBinaryUnmarshalRandom(t *testing.T) {
+	in, err := ParseExpressions(wireTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	valid, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+
+	seed := time.Now().UnixNano()
+	random := rand.New(rand.NewSource(seed))
+
+	unmarshal := func(data []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("Unmarshaling %v panicked (seed %d): %v", data, seed, r)
+			}
+		}()
+		var out Expressions
+		out.UnmarshalBinary(data)
+	}
+
+	for i := 0; i < 10000; i++ {
+		// random bytes, starting with the right version so they get decoded further
+		data := make([]byte, random.Intn(64))
+		random.Read(data)
+		if len(data) > 0 {
+			data[0] = expressionsBinaryVersion
+		}
+		unmarshal(data)
+
+		// valid data with a few bytes replaced by random ones
+		data = append(data[:0], valid...)
+		for j := random.Intn(4); j >= 0; j-- {
+			data[random.Intn(len(data))] = byte(random.Intn(256))
+		}
+		unmarshal(data)
+	}
+}
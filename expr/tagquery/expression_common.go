@@ -1,6 +1,12 @@
 package tagquery
 
-import "regexp"
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
 
 type expressionCommon struct {
 	key   string
@@ -35,9 +41,877 @@ func (e *expressionCommon) MatchesExactly() bool {
 }
 
 // expressionCommonRe is an extended version of expressionCommon with additional
-// properties for operators that use regular expressions
+// properties for operators that use regular expressions.
+// large numbers of parsed expressions get retained, f.e. by the meta records and the parse
+// caches, so it only keeps what the filters need. the small fields are grouped at the end to
+// not waste space on padding
 type expressionCommonRe struct {
 	expressionCommon
-	valueRe      *regexp.Regexp
+
+	// valueRe is the compiled pattern, it is nil if the compilation is deferred to lazyRe.
+	// use getValueRe to access it
+	valueRe *regexp.Regexp
+	lazyRe  *lazyRegexp
+
+	// memo holds the match cache and the filter which get built once and then reused. the
+	// queries sharing the parsed expression share it, but its clones get their own. see filterMemo
+	memo *filterMemo
+
+	// the literal which every matching value starts with, see literalPrefixOfPattern
+	literalPrefix string
+
+	// simple evaluates the pattern without the regular expression, if it has one of the
+	// simple shapes supported by simpleMatcher
+	simple simpleMatcher
+
+	// the size of the match caches of the filters, see ParseOptions.MatchCacheSize
+	matchCacheSize int32
+
 	matchesEmpty bool
+
+	// whether matching is equivalent to checking for the literalPrefix
+	prefixComplete bool
+
+	// whether the value is anchored at the beginning by itself, otherwise the compiled
+	// pattern wraps it into "^(?:...)", see anchorPattern
+	anchored bool
+}
+
+// filterMemo holds what the filters of a regex expression get built from once, so repeated
+// queries with the same parsed expression reuse the warmed match cache instead of starting
+// with an empty one every time. the expression is immutable after parsing, so the memoized
+// results stay valid as long as it lives
+type filterMemo struct {
+	cacheOnce sync.Once
+	cache     *matchCache
+
+	// the filters depend on MetaTagSupport, so there is one for each setting of it
+	filterOnce [2]sync.Once
+	filters    [2]MetricDefinitionFilter
+}
+
+// newExpressionCommonRe returns the expressionCommonRe of a regex expression with the given
+// pattern, which must be the value anchored at the beginning by anchorPattern, and the parsed
+// value. It computes
+// whether the pattern matches the empty value, f.e. "tag=~.*" also matches metrics without
+// "tag", and the literal prefix of the pattern, see literalPrefixOfPattern. The default
+// decisions, RequiresNonEmptyValue and the filters only read these, so none of them runs the
+// regular expression against the empty value.
+// If lazy is true the pattern only gets compiled once the regular expression is needed the
+// first time, see ParseOptions.LazyRegexCompilation. The literals which the expression keeps
+// share the storage of its value if possible, see shareWithPattern
+func newExpressionCommonRe(common expressionCommon, pattern string, parsed *syntax.Regexp, matchCacheSize int, lazy bool) (expressionCommonRe, error) {
+	literalPrefix, prefixComplete := literalPrefixOfPattern(parsed)
+	res := expressionCommonRe{
+		expressionCommon: common,
+		matchesEmpty:     matchesEmpty(parsed),
+		matchCacheSize:   int32(matchCacheSize),
+		literalPrefix:    shareWithPattern(literalPrefix, common.value),
+		prefixComplete:   prefixComplete,
+		anchored:         pattern == common.value,
+		simple:           newSimpleMatcher(common.value, parsed),
+		memo:             &filterMemo{},
+	}
+
+	// the lazily compiled pattern doesn't get kept, it is obtained from the value again
+	// when it gets compiled
+	if lazy {
+		res.lazyRe = &lazyRegexp{}
+		return res, nil
+	}
+
+	var err error
+	res.valueRe, err = compileRegex(pattern)
+	return res, err
+}
+
+// getValueRe returns the compiled pattern, compiling it first if that has been deferred
+func (e *expressionCommonRe) getValueRe() *regexp.Regexp {
+	if e.valueRe != nil {
+		return e.valueRe
+	}
+	return e.lazyRe.get(e.value, e.anchored)
+}
+
+// matchString returns whether the given value matches the pattern. patterns of a simple
+// shape get evaluated without running the regular expression, see simpleMatcher
+func (e *expressionCommonRe) matchString(value string) bool {
+	if e.simple.kind != simpleMatcherNone {
+		return e.simple.match(value)
+	}
+	return e.getValueRe().MatchString(value)
+}
+
+// matchBytes is the same as matchString, but it takes the value as a byte slice
+func (e *expressionCommonRe) matchBytes(value []byte) bool {
+	if e.simple.kind != simpleMatcherNone {
+		return e.simple.matchBytes(value)
+	}
+	return e.getValueRe().Match(value)
+}
+
+// matchStringInstrumented is the same as matchString, but it reports the regex executions
+// to the given instrumentation
+func (e *expressionCommonRe) matchStringInstrumented(value string, instrumentation filterInstrumentation) bool {
+	if e.simple.kind != simpleMatcherNone {
+		return e.simple.match(value)
+	}
+	instrumentation.regexExecution()
+	return e.getValueRe().MatchString(value)
+}
+
+// filterValues returns the values of the given set for which matches returns true
+func filterValues(values map[string]struct{}, matches func(string) bool) []string {
+	var res []string
+	for value := range values {
+		if matches(value) {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
+// filterValuesExcept returns all values of the given set except the given one
+func filterValuesExcept(values map[string]struct{}, except string) []string {
+	res := make([]string, 0, len(values))
+	for value := range values {
+		if value != except {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
+// filterValuesByRegex returns the values of the given set which match the regular expression,
+// or which don't match it if invert is true. the values of a set are unique, so caching the
+// results like the MetricDefinitionFilters do wouldn't help
+func (e *expressionCommonRe) filterValuesByRegex(values map[string]struct{}, invert bool) []string {
+	var res []string
+	for value := range values {
+		if e.matchString(value) != invert {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
+// getCachedMatcher returns a function which matches the given value against the regular
+// expression. values which don't start with the literal prefix of the pattern get rejected
+// without looking at the caches, see literalPrefixOfPattern. to reduce regex matching it caches the results for up to 2 * the match cache
+// size values, evicting the least recently used ones once it is full, see matchCache.
+// the match cache size is the one of the parse options, or the package default set by
+// SetMatchCacheSize, at the time getCachedMatcher gets called the first time.
+// the cache gets created once per expression and is shared by all the functions returned by
+// getCachedMatcher, see getMatchCache. values which are not in it get looked up in the shared
+// match cache, if it is enabled, before executing the regular expression, see
+// SetSharedMatchCacheSize. once the cache gets bypassed because of its low hit ratio neither of
+// the caches gets used anymore, see SetMatchCacheBypass. the cache lookups, bypasses and regex
+// executions get reported to the given instrumentation. patterns of a simple shape don't need
+// any of that, see simpleMatcher
+func (e *expressionCommonRe) getCachedMatcher(instrumentation filterInstrumentation) func(value string) bool {
+	// patterns of a simple shape are cheaper to evaluate than to look up in a cache
+	if e.simple.kind != simpleMatcherNone {
+		return e.simple.match
+	}
+
+	cache := e.getMatchCache()
+	valueRe := e.getValueRe()
+	sharedGet, sharedAdd := getSharedMatcher(e.value, valueRe)
+	prefix, prefixComplete := e.literalPrefix, e.prefixComplete
+
+	return func(value string) bool {
+		// values which don't start with the literal prefix of the pattern can't match,
+		// if the pattern consists of nothing but the prefix all the others do
+		if !strings.HasPrefix(value, prefix) {
+			return false
+		}
+		if prefixComplete {
+			return true
+		}
+
+		// the values of the expression rarely repeat, so looking them up and adding them to the
+		// caches would only cost time and memory
+		if cache.isBypassed() {
+			instrumentation.cacheBypass()
+			instrumentation.regexExecution()
+			return valueRe.MatchString(value)
+		}
+
+		// reduce regex matching by looking up cached results, the cache of the filter
+		// gets checked first because its lookups don't need to take a lock
+		if match, ok := cache.get(value); ok {
+			instrumentation.cacheHit()
+			return match
+		}
+
+		if sharedGet != nil {
+			if match, ok := sharedGet(value); ok {
+				instrumentation.cacheHit()
+				cache.add(value, match)
+				return match
+			}
+		}
+
+		instrumentation.cacheMiss()
+		instrumentation.regexExecution()
+		match := valueRe.MatchString(value)
+		cache.add(value, match)
+		if sharedAdd != nil {
+			sharedAdd(value, match)
+		}
+		return match
+	}
+}
+
+// getMatchCache returns the match cache of the expression, creating it on the first call. the
+// matches and non-matches used to be cached separately with the match cache size each, so the
+// combined cache can hold the same total number of values. the byte limit of SetMatchCacheMaxBytes
+// and the bypass of SetMatchCacheBypass apply to the combined cache
+func (e *expressionCommonRe) getMatchCache() *matchCache {
+	size := int(e.matchCacheSize)
+	if size == 0 {
+		size = GetMatchCacheSize()
+	}
+	maxBytes := int64(GetMatchCacheMaxBytes())
+	bypassMinMisses, bypassMinHitRatio := GetMatchCacheBypass()
+	if e.memo == nil {
+		return newMatchCacheWithMaxBytes(2*size, maxBytes).withBypass(bypassMinMisses, bypassMinHitRatio)
+	}
+
+	e.memo.cacheOnce.Do(func() {
+		e.memo.cache = newMatchCacheWithMaxBytes(2*size, maxBytes).withBypass(bypassMinMisses, bypassMinHitRatio)
+	})
+	return e.memo.cache
+}
+
+// memoizeFilter returns the filter built by the given function on the first call for the
+// current setting of MetaTagSupport, and the same filter on all later calls for it. it must
+// only be used for the uninstrumented filters, which don't depend on the lookup either
+func (e *expressionCommonRe) memoizeFilter(build func() MetricDefinitionFilter) MetricDefinitionFilter {
+	if e.memo == nil {
+		return build()
+	}
+
+	i := 0
+	if MetaTagSupport {
+		i = 1
+	}
+	e.memo.filterOnce[i].Do(func() {
+		e.memo.filters[i] = build()
+	})
+	return e.memo.filters[i]
+}
+
+// literalPrefixOfPattern returns the literal which every value matching the given parsed
+// pattern starts with, and true if matching the pattern is equivalent to checking whether a
+// value has that prefix, like regexp.Regexp.LiteralPrefix does for unanchored patterns.
+// the compiled valueRe is anchored at the beginning, which hides the prefix from LiteralPrefix,
+// so the prefix gets obtained from the parsed pattern instead.
+// utf8.RuneError is not taken as a literal, because it also matches invalid UTF-8
+func literalPrefixOfPattern(re *syntax.Regexp) (string, bool) {
+	nodes, _ := trimBeginText(flattenConcat(re, nil))
+
+	var builder strings.Builder
+	for i, node := range nodes {
+		if node.Op != syntax.OpLiteral || node.Flags&syntax.FoldCase != 0 {
+			return builder.String(), false
+		}
+		for _, r := range node.Rune {
+			if r == utf8.RuneError {
+				return builder.String(), false
+			}
+			builder.WriteRune(r)
+		}
+		if i == len(nodes)-1 {
+			return builder.String(), true
+		}
+	}
+	return builder.String(), false
+}
+
+// shareWithPattern returns the given literal, which has been built from the parsed form of the
+// given pattern, as a substring of the pattern if it appears in it. the pattern is kept by the
+// expression anyway, so the literal doesn't take extra memory then
+func shareWithPattern(literal, pattern string) string {
+	if i := strings.Index(pattern, literal); i >= 0 {
+		return pattern[i : i+len(literal)]
+	}
+	return literal
+}
+
+// matchesEmpty returns whether the given parsed pattern matches the empty value. the empty
+// value only has one position, so all the assertions of the pattern get evaluated at the
+// beginning and the end of the text at once. this doesn't need the compiled pattern, which
+// may not exist yet, see ParseOptions.LazyRegexCompilation
+func matchesEmpty(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpNoWordBoundary, syntax.OpStar, syntax.OpQuest:
+		return true
+	case syntax.OpCapture, syntax.OpPlus:
+		return matchesEmpty(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min == 0 || matchesEmpty(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !matchesEmpty(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if matchesEmpty(sub) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// literals, character classes, word boundaries and OpNoMatch
+	return false
+}
+
+// bytesHavePrefix returns whether the given value starts with the given prefix. unlike
+// bytes.HasPrefix it takes the prefix as a string, converting the compared part of the value
+// for the comparison doesn't allocate
+func bytesHavePrefix(value []byte, prefix string) bool {
+	return len(value) >= len(prefix) && string(value[:len(prefix)]) == prefix
+}
+
+// tagValueOf returns the value of the given tag of the form "key=value" and true,
+// if the tag has the given key. otherwise it returns false.
+// it compares in place, so the filters don't need to build the string "key=" to look for a tag
+func tagValueOf(tag, key string) (string, bool) {
+	if len(tag) <= len(key) || tag[len(key)] != '=' || tag[:len(key)] != key {
+		return "", false
+	}
+	return tag[len(key)+1:], true
+}
+
+// tagIsBeforeKey returns true if the given tag of the form "key=value" sorts before all the
+// tags which have the given key, that is if it is less than "key=". it compares in place, just
+// like tagValueOf
+func tagIsBeforeKey(tag, key string) bool {
+	if len(tag) <= len(key) {
+		return tag <= key
+	}
+	if tagKey := tag[:len(key)]; tagKey != key {
+		return tagKey < key
+	}
+	return tag[len(key)] < '='
+}
+
+// sortedTagsOfKey returns the part of the given sorted tags which have the given key. the tags
+// with the same key are next to each other, so it binary searches to the first one and stops
+// at the first tag which doesn't have the key
+func sortedTagsOfKey(tags []string, key string) []string {
+	// like sort.Search, but without calling a closure for every comparison
+	start, end := 0, len(tags)
+	for start < end {
+		middle := int(uint(start+end) >> 1)
+		if tagIsBeforeKey(tags[middle], key) {
+			start = middle + 1
+		} else {
+			end = middle
+		}
+	}
+
+	end = start
+	for end < len(tags) && tagHasKey(tags[end], key) {
+		end++
+	}
+	return tags[start:end]
+}
+
+// tagHasKey returns true if the given tag of the form "key=value" has the given key
+func tagHasKey(tag, key string) bool {
+	_, ok := tagValueOf(tag, key)
+	return ok
+}
+
+// costPrecision is the factor by which the operator cost gets multiplied to obtain the cost of
+// an expression, see Expression.GetCost(). the properties of an expression can adjust its cost
+// within the range [operator cost * costPrecision, (operator cost + 1) * costPrecision), this
+// way the order of expressions with different operator costs is never changed
+const costPrecision = 100
+
+// defaultCost returns the cost of an expression which has no properties that adjust it
+func defaultCost(operatorCost uint32) uint32 {
+	return operatorCost*costPrecision + costPrecision/2
+}
+
+// tagCost returns the cost of an expression which operates on the tag keys, it is the
+// highest cost within the range of the operator cost, because to evaluate such an
+// expression all the keys of the index need to be looked at
+func tagCost(operatorCost uint32) uint32 {
+	return operatorCost*costPrecision + costPrecision - 1
+}
+
+// regexCost returns the cost of a regex expression, based on the complexity of its pattern.
+// a long literal prefix makes it cheaper, because most values can be rejected by comparing
+// the prefix, a large compiled program makes it more expensive
+func (e *expressionCommonRe) regexCost(operatorCost uint32) uint32 {
+	adjustment := int(costPrecision / 2)
+
+	re, err := syntax.Parse(e.value, syntax.Perl)
+	if err == nil {
+		nodes := flattenConcat(re, nil)
+		nodes, _ = trimBeginText(nodes)
+
+		prefixLength := 0
+		for _, node := range nodes {
+			if node.Op != syntax.OpLiteral || node.Flags&syntax.FoldCase != 0 {
+				break
+			}
+			prefixLength += len(node.Rune)
+		}
+
+		if prog, err := syntax.Compile(re.Simplify()); err == nil {
+			adjustment += minInt(len(prog.Inst), 40) - minInt(prefixLength*4, 40)
+		}
+	}
+
+	return operatorCost*costPrecision + uint32(adjustment)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// keyNeedsTagPrefix returns true if the given key can't be written in the form
+// "<key><operator><value>" without being misinterpreted when parsing it again,
+// because it contains characters which would be considered part of an operator.
+// Such keys can only result from expressions in the form "__tag=<key>", so they
+// need to get serialized in that same form.
+func keyNeedsTagPrefix(key string) bool {
+	return key == "__tag" || strings.ContainsAny(key, "=!^<>")
+}
+
+// keyEscapedChars are the characters which get escaped with a backslash in the key of a
+// serialized expression, see escapeKey
+const keyEscapedChars = `\|*<>`
+
+// escapeKey escapes the key of an expression, so it doesn't get misinterpreted when parsing
+// the serialized expression again. a key which ends with "|" or "*" would otherwise merge with
+// the following "=" into the operator "|=" or "*=", f.e. "a|" with the operator "=" and the value
+// "b" gets written as "a\|=b" instead of "a|=b", and a "<" or ">" in the key could be taken for a
+// comparison operator. the key only gets escaped if that is necessary, then every backslash, "|",
+// "*", "<" and ">" in it gets a backslash, so the keys of other expressions get written as they
+// are. unescapeKey reverses this
+func escapeKey(key string) string {
+	if !keyNeedsEscaping(key) {
+		return key
+	}
+
+	builder := strings.Builder{}
+	builder.Grow(2 * len(key))
+	for i := 0; i < len(key); i++ {
+		if strings.IndexByte(keyEscapedChars, key[i]) >= 0 {
+			builder.WriteByte('\\')
+		}
+		builder.WriteByte(key[i])
+	}
+	return builder.String()
+}
+
+// keyNeedsEscaping returns true if the given key ends with one of the characters which can
+// start an operator or with a backslash, which would escape the first character of the operator,
+// if it contains a "<" or ">", or if it contains a backslash which would be taken for an escape
+func keyNeedsEscaping(key string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	if strings.IndexByte(keyEscapedChars, key[len(key)-1]) >= 0 || strings.ContainsAny(key, "<>") {
+		return true
+	}
+	for i := 0; i+1 < len(key); i++ {
+		if key[i] == '\\' && strings.IndexByte(keyEscapedChars, key[i+1]) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeKey removes the backslashes which escape one of the keyEscapedChars, see escapeKey.
+// other backslashes are kept, because they are valid characters of a key
+func unescapeKey(key string) string {
+	builder := strings.Builder{}
+	builder.Grow(len(key))
+	for i := 0; i < len(key); i++ {
+		if key[i] == '\\' && i+1 < len(key) && strings.IndexByte(keyEscapedChars, key[i+1]) >= 0 {
+			i++
+		}
+		builder.WriteByte(key[i])
+	}
+	return builder.String()
+}
+
+// escapeValue escapes a leading "~" in the value of an expression which doesn't use a regular
+// expression, so it doesn't get mistaken for the regex marker when parsing it again.
+// "~abc" becomes "\~abc". a value which already looks like an escaped "~" gets another backslash,
+// so "\~abc" becomes "\\~abc". unescapeValue reverses this
+func escapeValue(value string) string {
+	return escapeMarker(value, "~")
+}
+
+// unescapeValue removes one backslash from a value which starts with
+// one or more backslashes followed by "~", see escapeValue
+func unescapeValue(value string) string {
+	return unescapeMarker(value, "~")
+}
+
+// escapeEqualValue is the same as escapeValue, but for values following the operator "=",
+// where a leading "?" would also be mistaken for the marker of the operator "=?"
+func escapeEqualValue(value string) string {
+	return escapeMarker(value, "~?")
+}
+
+// unescapeEqualValue reverses escapeEqualValue
+func unescapeEqualValue(value string) string {
+	return unescapeMarker(value, "~?")
+}
+
+// startsWithMarker returns true if the given value, after skipping
+// leading backslashes, starts with one of the given marker characters
+func startsWithMarker(value, markers string) bool {
+	trimmed := strings.TrimLeft(value, "\\")
+	return len(trimmed) > 0 && strings.IndexByte(markers, trimmed[0]) >= 0
+}
+
+func escapeMarker(value, markers string) string {
+	if startsWithMarker(value, markers) {
+		return "\\" + value
+	}
+	return value
+}
+
+func unescapeMarker(value, markers string) string {
+	if len(value) > 1 && value[0] == '\\' && startsWithMarker(value, markers) {
+		return value[1:]
+	}
+	return value
+}
+
+// literalOfPattern checks whether the given pattern, which must be anchored at the beginning,
+// only consists of a literal string. If it does, it returns the literal, a bool indicating
+// whether the pattern is also anchored at the end, and true. Otherwise the last bool is false.
+func literalOfPattern(pattern string) (string, bool, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false, false
+	}
+	return literalOfParsedPattern(re)
+}
+
+// literalOfParsedPattern is the same as literalOfPattern, but it takes the parsed pattern
+func literalOfParsedPattern(re *syntax.Regexp) (string, bool, bool) {
+	nodes, ok := trimBeginText(flattenConcat(re, nil))
+	if !ok {
+		return "", false, false
+	}
+
+	endAnchored := false
+	for len(nodes) > 0 && nodes[len(nodes)-1].Op == syntax.OpEndText {
+		endAnchored = true
+		nodes = nodes[:len(nodes)-1]
+	}
+
+	var builder strings.Builder
+	for _, node := range nodes {
+		if node.Op != syntax.OpLiteral || node.Flags&syntax.FoldCase != 0 {
+			return "", false, false
+		}
+		builder.WriteString(string(node.Rune))
+	}
+
+	return builder.String(), endAnchored, true
+}
+
+// literalAlternativesOfPattern checks whether the given pattern, which gets anchored at the
+// beginning like by the parser, only consists of an alternation of literals which is anchored
+// at the end, f.e. "(a01|a02)$" or "^(?:a01$|a02$)". If it does, it returns the deduplicated
+// literals and true. The alternatives get split before parsing them, because the regex parser
+// factors out common prefixes and would turn "a01|a02" into "a0[12]". So quantifiers and
+// character classes are rejected, while escaped characters are accepted as literals
+func literalAlternativesOfPattern(pattern string) ([]string, bool) {
+	literals, endAnchored, ok := splitLiteralAlternatives(pattern)
+	if !ok || !endAnchored {
+		return nil, false
+	}
+	return literals, true
+}
+
+// literalPrefixAlternativesOfPattern is the same as literalAlternativesOfPattern, but for
+// alternations of literals which are not anchored at the end, f.e. "a01|a02". Every value
+// starting with one of the returned literals matches the pattern
+func literalPrefixAlternativesOfPattern(pattern string) ([]string, bool) {
+	literals, endAnchored, ok := splitLiteralAlternatives(pattern)
+	if !ok || endAnchored {
+		return nil, false
+	}
+	return literals, true
+}
+
+// splitLiteralAlternatives splits the given pattern into the literals of its alternation, see
+// literalAlternativesOfPattern. It returns the deduplicated literals, whether they are anchored
+// at the end, and true. If the pattern is not an alternation of literals, or only some of them
+// are anchored at the end, the last bool is false
+func splitLiteralAlternatives(pattern string) ([]string, bool, bool) {
+	pattern = strings.TrimLeft(pattern, "^")
+
+	groupEndAnchored := false
+	for {
+		inner, endAnchored, ok := unwrapGroup(pattern)
+		if !ok {
+			break
+		}
+		pattern = strings.TrimLeft(inner, "^")
+		groupEndAnchored = groupEndAnchored || endAnchored
+	}
+
+	alternatives, ok := splitAlternation(pattern)
+	if !ok || len(alternatives) < 2 {
+		return nil, false, false
+	}
+
+	endAnchored := groupEndAnchored
+	res := make([]string, 0, len(alternatives))
+	seen := make(map[string]struct{}, len(alternatives))
+	for i, alternative := range alternatives {
+		// flags like in "a(?i)|b" also apply to the following alternatives
+		if strings.Contains(strings.Replace(alternative, "(?:", "", -1), "(?") {
+			return nil, false, false
+		}
+		alternative = "^(?:" + alternative + ")"
+		if groupEndAnchored {
+			alternative += "$"
+		}
+		literal, literalEndAnchored, ok := literalOfPattern(alternative)
+		if !ok || !isValidLiteralValue(literal) {
+			return nil, false, false
+		}
+		// without an anchoring group the first alternative decides for all of them
+		if i == 0 {
+			endAnchored = literalEndAnchored
+		} else if literalEndAnchored != endAnchored {
+			return nil, false, false
+		}
+		if _, ok := seen[literal]; ok {
+			continue
+		}
+		seen[literal] = struct{}{}
+		res = append(res, literal)
+	}
+
+	return res, endAnchored, true
+}
+
+// unwrapGroup checks whether the given pattern consists of one group, optionally
+// followed by "$". If it does, it returns the content of the group, a bool which
+// indicates whether the "$" is present, and true. Groups with flags or names are
+// not unwrapped, because their content alone would have a different meaning
+func unwrapGroup(pattern string) (string, bool, bool) {
+	if len(pattern) < 2 || pattern[0] != '(' {
+		return "", false, false
+	}
+
+	end := closingParenthesis(pattern)
+	if end < 0 {
+		return "", false, false
+	}
+	endAnchored := false
+	switch pattern[end+1:] {
+	case "":
+	case "$":
+		endAnchored = true
+	default:
+		return "", false, false
+	}
+
+	inner := pattern[1:end]
+	if strings.HasPrefix(inner, "?:") {
+		inner = inner[2:]
+	} else if strings.HasPrefix(inner, "?") {
+		return "", false, false
+	}
+
+	return inner, endAnchored, true
+}
+
+// closingParenthesis returns the position of the parenthesis which closes the one at
+// the beginning of the given pattern, or -1 if it isn't closed
+func closingParenthesis(pattern string) int {
+	depth := 0
+	res := -1
+	scanPattern(pattern, func(i int, c byte) bool {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				res = i
+				return false
+			}
+		}
+		return true
+	})
+	return res
+}
+
+// splitAlternation splits the given pattern at the "|" which are neither escaped, nor inside
+// a group or a character class. The returned bool is false if the parentheses are unbalanced
+func splitAlternation(pattern string) ([]string, bool) {
+	var res []string
+	depth, start := 0, 0
+	scanPattern(pattern, func(i int, c byte) bool {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '|':
+			if depth == 0 {
+				res = append(res, pattern[start:i])
+				start = i + 1
+			}
+		}
+		return depth >= 0
+	})
+	if depth != 0 {
+		return nil, false
+	}
+	return append(res, pattern[start:]), true
+}
+
+// scanPattern calls the given function with each byte of the pattern and its position,
+// skipping escaped characters and the content of character classes. it stops when the
+// function returns false
+func scanPattern(pattern string, f func(int, byte) bool) {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+			continue
+		case '[':
+			// a "]" right after the opening "[" or "[^" is part of the class
+			i++
+			if i < len(pattern) && pattern[i] == '^' {
+				i++
+			}
+			if i < len(pattern) && pattern[i] == ']' {
+				i++
+			}
+			for i < len(pattern) && pattern[i] != ']' {
+				if pattern[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			continue
+		}
+		if !f(i, pattern[i]) {
+			return
+		}
+	}
+}
+
+// prefixOfPattern checks whether the given parsed pattern, which must be anchored at the
+// beginning, consists of a literal string followed by ".*" and nothing else. If it does, the
+// pattern is equivalent to checking whether a value has the literal as prefix, so it returns
+// the literal and true. Otherwise the returned bool is false.
+func prefixOfPattern(re *syntax.Regexp) (string, bool) {
+	nodes, ok := trimBeginText(flattenConcat(re, nil))
+	if !ok || len(nodes) == 0 {
+		return "", false
+	}
+
+	// the last node must be ".*", because the pattern is not anchored at the end
+	// it doesn't matter whether "." matches new lines or not.
+	// ".+" is not accepted because it additionally requires a non-empty suffix
+	last := nodes[len(nodes)-1]
+	if last.Op != syntax.OpStar || (last.Sub[0].Op != syntax.OpAnyCharNotNL && last.Sub[0].Op != syntax.OpAnyChar) {
+		return "", false
+	}
+
+	var builder strings.Builder
+	for _, node := range nodes[:len(nodes)-1] {
+		if node.Op != syntax.OpLiteral || node.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		builder.WriteString(string(node.Rune))
+	}
+
+	return builder.String(), true
+}
+
+// flattenConcat appends the nodes of the given parsed pattern to res, unwrapping
+// concatenations and capture groups
+func flattenConcat(re *syntax.Regexp, res []*syntax.Regexp) []*syntax.Regexp {
+	switch re.Op {
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			res = flattenConcat(sub, res)
+		}
+	case syntax.OpCapture:
+		res = flattenConcat(re.Sub[0], res)
+	default:
+		res = append(res, re)
+	}
+	return res
+}
+
+// anchorPattern returns the given regex value anchored at the beginning, like the parser
+// anchors the patterns of the regex operators, together with its parsed form. parsed must
+// be the parsed value. A value which already starts with "^" is returned as it is, only
+// the other ones get wrapped into "^(?:...)"
+func anchorPattern(value string, parsed *syntax.Regexp) (string, *syntax.Regexp) {
+	if isAnchoredAtBeginning(parsed) {
+		return value, parsed
+	}
+	return "^(?:" + value + ")", &syntax.Regexp{
+		Op:    syntax.OpConcat,
+		Flags: parsed.Flags,
+		Sub:   []*syntax.Regexp{{Op: syntax.OpBeginText, Flags: parsed.Flags}, parsed},
+	}
+}
+
+// isAnchoredAtBeginning returns true if every match of the given parsed pattern starts with "^".
+// a "^" inside an alternation or a repetition is not followed, f.e. "^a|b" is not anchored
+func isAnchoredAtBeginning(re *syntax.Regexp) bool {
+	for {
+		switch re.Op {
+		case syntax.OpBeginText:
+			return true
+		case syntax.OpConcat:
+			if len(re.Sub) == 0 {
+				return false
+			}
+			re = re.Sub[0]
+		case syntax.OpCapture:
+			re = re.Sub[0]
+		default:
+			return false
+		}
+	}
+}
+
+// trimBeginText removes the leading "^" anchors from the given nodes, the returned bool
+// is false if there were none
+func trimBeginText(nodes []*syntax.Regexp) ([]*syntax.Regexp, bool) {
+	i := 0
+	for i < len(nodes) && nodes[i].Op == syntax.OpBeginText {
+		i++
+	}
+	return nodes[i:], i > 0
+}
+
+// isValidLiteralValue returns true if the given literal can be used as the value of an
+// expression which compares values literally, without changing its meaning when the
+// expression gets serialized and parsed again
+func isValidLiteralValue(literal string) bool {
+	return len(literal) > 0 && !strings.ContainsRune(literal, ';')
 }
@@ -0,0 +1,228 @@
+package tagquery
+
+import (
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/schema"
+)
+
+// expressionCompare implements the numeric comparison operators GREATER, GREATER_EQUAL,
+// LESS and LESS_EQUAL. Tag values which can't be parsed as a number never satisfy it.
+type expressionCompare struct {
+	expressionCommon
+	operator ExpressionOperator
+
+	// if the value of the expression is an integer we keep it as such in valueInt,
+	// this allows us to compare integers without losing precision
+	valueIsInt   bool
+	valueInt     int64
+	valueFloat64 float64
+}
+
+// newExpressionCompare takes an expressionCommon and one of the comparison operators,
+// it parses the value of the expressionCommon as a number and returns an error if
+// that is not possible.
+func newExpressionCompare(resCommon expressionCommon, operator ExpressionOperator, expr string) (Expression, error) {
+	res := expressionCompare{expressionCommon: resCommon, operator: operator}
+
+	var err error
+	res.valueInt, err = strconv.ParseInt(resCommon.value, 10, 64)
+	if err == nil {
+		res.valueIsInt = true
+		res.valueFloat64 = float64(res.valueInt)
+		return &res, nil
+	}
+
+	res.valueFloat64, err = strconv.ParseFloat(resCommon.value, 64)
+	if err != nil || math.IsNaN(res.valueFloat64) {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	return &res, nil
+}
+
+// NewExpressionCompare returns an expression which compares the values of the tag with the given key
+// against the given number, using one of the operators GREATER, GREATER_EQUAL, LESS or LESS_EQUAL.
+// f.e. NewExpressionCompare("shard", GREATER_EQUAL, "32") is equivalent to parsing "shard>=32".
+// it can also be used with the reserved keys "__lastUpdate__" and "__interval__"
+func NewExpressionCompare(key string, operator ExpressionOperator, value string) (Expression, error) {
+	switch operator {
+	case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL:
+	default:
+		return nil, errors.NewBadRequestf("Operator %s is not a comparison operator", operator)
+	}
+	return newExpressionFromValues(key, operator, value)
+}
+
+func (e *expressionCompare) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionCompare) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionCompare) Clone() Expression {
+	res := *e
+	return &res
+}
+
+func (e *expressionCompare) GetDefaultDecision() FilterDecision {
+	return Fail
+}
+
+func (e *expressionCompare) GetOperator() ExpressionOperator {
+	return e.operator
+}
+
+func (e *expressionCompare) GetOperatorCost() uint32 {
+	return 8
+}
+
+func (e *expressionCompare) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
+func (e *expressionCompare) Matches(value string) bool {
+	var cmp int
+
+	if e.valueIsInt {
+		// fast path, if both sides are integers we don't need to parse a float
+		if valueInt, err := strconv.ParseInt(value, 10, 64); err == nil {
+			cmp = compareInt64(valueInt, e.valueInt)
+			return e.evaluate(cmp)
+		}
+	}
+
+	valueFloat64, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+
+	// NaN can't be compared to anything
+	if math.IsNaN(valueFloat64) {
+		return false
+	}
+
+	switch {
+	case valueFloat64 < e.valueFloat64:
+		cmp = -1
+	case valueFloat64 > e.valueFloat64:
+		cmp = 1
+	}
+
+	return e.evaluate(cmp)
+}
+
+func (e *expressionCompare) FilterValues(values map[string]struct{}) []string {
+	return filterValues(values, e.Matches)
+}
+
+// evaluate takes the result of comparing a value with the value of this expression
+// (-1 if less, 0 if equal, 1 if greater) and decides whether it satisfies the operator
+func (e *expressionCompare) evaluate(cmp int) bool {
+	switch e.operator {
+	case GREATER:
+		return cmp > 0
+	case GREATER_EQUAL:
+		return cmp >= 0
+	case LESS:
+		return cmp < 0
+	case LESS_EQUAL:
+		return cmp <= 0
+	}
+	return false
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func (e *expressionCompare) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	if e.key == "name" {
+		return func(_ schema.MKey, name string, _ []string) FilterDecision {
+			if e.Matches(name) {
+				return Pass
+			}
+			return Fail
+		}
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
+		for _, tag := range tags {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes.
+			// if its value is not numeric then it can't satisfy the expression,
+			// so we return Fail
+			if e.Matches(value) {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionCompare) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if e.Matches(tag.Value) {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionCompare) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionCompare) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionCompare) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
+func (e *expressionCompare) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, escapeKey(e.key))
+	e.operator.StringIntoWriter(writer)
+	io.WriteString(writer, e.value)
+}
@@ -2,7 +2,6 @@ package tagquery
 
 import (
 	"io"
-	"strings"
 
 	"github.com/grafana/metrictank/schema"
 )
@@ -11,10 +10,26 @@ type expressionEqual struct {
 	expressionCommon
 }
 
+// NewExpressionEqual returns an expression which matches metrics that have the tag
+// with the given key and value, it is equivalent to parsing "<key>=<value>".
+// the value is taken literally, it must not be escaped
+func NewExpressionEqual(key, value string) (Expression, error) {
+	return newExpressionFromValues(key, EQUAL, value)
+}
+
 func (e *expressionEqual) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+func (e *expressionEqual) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionEqual) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionEqual) GetDefaultDecision() FilterDecision {
 	return Fail
 }
@@ -27,10 +42,37 @@ func (e *expressionEqual) GetOperatorCost() uint32 {
 	return 1
 }
 
+func (e *expressionEqual) GetCost() uint32 {
+	if e.key == "name" {
+		// metric names are nearly unique, so this is the most selective expression
+		return e.GetOperatorCost() * costPrecision
+	}
+	return defaultCost(e.GetOperatorCost())
+}
+
 func (e *expressionEqual) Matches(value string) bool {
 	return value == e.value
 }
 
+func (e *expressionEqual) MatchesBytes(value []byte) bool {
+	return string(value) == e.value
+}
+
+func (e *expressionEqual) MatchValue(value string) bool {
+	return value == e.value
+}
+
+func (e *expressionEqual) MatchAllValues() bool {
+	return false
+}
+
+func (e *expressionEqual) FilterValues(values map[string]struct{}) []string {
+	if _, ok := values[e.value]; ok {
+		return []string{e.value}
+	}
+	return nil
+}
+
 func (e *expressionEqual) MatchesExactly() bool {
 	return true
 }
@@ -59,7 +101,6 @@ func (e *expressionEqual) GetMetricDefinitionFilter(lookup IdTagLookup) MetricDe
 		}
 	}
 
-	prefix := e.key + "="
 	return func(id schema.MKey, _ string, tags []string) FilterDecision {
 		if lookup(id, e.key, e.value) {
 			return Pass
@@ -68,7 +109,7 @@ func (e *expressionEqual) GetMetricDefinitionFilter(lookup IdTagLookup) MetricDe
 		for _, tag := range tags {
 			// the tag is set, but it has a different value,
 			// no need to keep looking at other indexes
-			if strings.HasPrefix(tag, prefix) {
+			if tagHasKey(tag, e.key) {
 				return Fail
 			}
 		}
@@ -77,8 +118,43 @@ func (e *expressionEqual) GetMetricDefinitionFilter(lookup IdTagLookup) MetricDe
 	}
 }
 
+func (e *expressionEqual) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" || !MetaTagSupport {
+		// these filters don't look at the tags
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	return func(id schema.MKey, _ string, tags Tags) FilterDecision {
+		if lookup(id, e.key, e.value) {
+			return Pass
+		}
+
+		for _, tag := range tags {
+			// the tag is set, but it has a different value,
+			// no need to keep looking at other indexes
+			if tag.Key == e.key {
+				return Fail
+			}
+		}
+
+		return None
+	}
+}
+
+func (e *expressionEqual) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionEqual) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionEqual) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
 func (e *expressionEqual) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
-	writer.Write([]byte("="))
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "=")
+	io.WriteString(writer, escapeEqualValue(e.value))
 }
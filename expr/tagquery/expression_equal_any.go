@@ -0,0 +1,226 @@
+package tagquery
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/schema"
+)
+
+type expressionEqualAny struct {
+	expressionCommon
+	values map[string]struct{}
+}
+
+// newExpressionEqualAny takes an expressionCommon of which the value is a "|" separated
+// list of values and it instantiates an expressionEqualAny from it.
+func newExpressionEqualAny(resCommon expressionCommon, expr string) (Expression, error) {
+	values, ok := parseValueSet(&resCommon)
+	if !ok {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	return &expressionEqualAny{expressionCommon: resCommon, values: values}, nil
+}
+
+// NewExpressionEqualAny returns an expression which matches metrics that have the tag with the given
+// key and one of the given values, it is equivalent to parsing "<key>|=<value1>|<value2>|..."
+func NewExpressionEqualAny(key string, values []string) (Expression, error) {
+	value, err := joinValueSet(values)
+	if err != nil {
+		return nil, err
+	}
+	return newExpressionFromValues(key, EQUAL_ANY, value)
+}
+
+// parseValueSet splits the value of the given expressionCommon by "|" and returns the
+// resulting values as a set. The value of the given expressionCommon gets replaced
+// with the sorted and deduplicated list of values, so it is in a normalized form,
+// which makes the comparison of two expressions order-insensitive.
+// The returned bool is false if the value is empty or contains an empty element,
+// because no tag can have an empty value.
+func parseValueSet(resCommon *expressionCommon) (map[string]struct{}, bool) {
+	if len(resCommon.value) == 0 {
+		return nil, false
+	}
+
+	values := strings.Split(resCommon.value, "|")
+	sort.Strings(values)
+
+	res := make(map[string]struct{}, len(values))
+	unique := values[:0]
+	for i := range values {
+		if len(values[i]) == 0 {
+			return nil, false
+		}
+		if _, ok := res[values[i]]; ok {
+			continue
+		}
+		res[values[i]] = struct{}{}
+		unique = append(unique, values[i])
+	}
+
+	resCommon.value = strings.Join(unique, "|")
+
+	return res, true
+}
+
+// cloneValueSet returns a copy of a set of values returned by parseValueSet
+func cloneValueSet(values map[string]struct{}) map[string]struct{} {
+	res := make(map[string]struct{}, len(values))
+	for value := range values {
+		res[value] = struct{}{}
+	}
+	return res
+}
+
+// joinValueSet joins the given values into the "|" separated form used by the value
+// of expressions with a set of values, a value which contains a "|" results in an error
+func joinValueSet(values []string) (string, error) {
+	for _, value := range values {
+		if strings.IndexByte(value, '|') >= 0 {
+			return "", errors.NewBadRequestf("Value of value set must not contain \"|\": %s", value)
+		}
+	}
+	return strings.Join(values, "|"), nil
+}
+
+func (e *expressionEqualAny) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionEqualAny) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionEqualAny) Clone() Expression {
+	res := *e
+	res.values = cloneValueSet(e.values)
+	return &res
+}
+
+func (e *expressionEqualAny) GetDefaultDecision() FilterDecision {
+	return Fail
+}
+
+func (e *expressionEqualAny) GetOperator() ExpressionOperator {
+	return EQUAL_ANY
+}
+
+func (e *expressionEqualAny) GetOperatorCost() uint32 {
+	return 2
+}
+
+func (e *expressionEqualAny) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
+func (e *expressionEqualAny) Matches(value string) bool {
+	_, ok := e.values[value]
+	return ok
+}
+
+func (e *expressionEqualAny) MatchesBytes(value []byte) bool {
+	_, ok := e.values[string(value)]
+	return ok
+}
+
+// LiteralAlternatives returns the values of the expression, which are sorted and unique
+func (e *expressionEqualAny) LiteralAlternatives() ([]string, bool) {
+	return strings.Split(e.value, "|"), true
+}
+
+func (e *expressionEqualAny) FilterValues(values map[string]struct{}) []string {
+	// iterate over the smaller one of the two sets
+	if len(values) < len(e.values) {
+		return filterValues(values, e.Matches)
+	}
+
+	var res []string
+	for value := range e.values {
+		if _, ok := values[value]; ok {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
+func (e *expressionEqualAny) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	if e.key == "name" {
+		return func(_ schema.MKey, name string, _ []string) FilterDecision {
+			if _, ok := e.values[name]; ok {
+				return Pass
+			}
+			return Fail
+		}
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
+		for _, tag := range tags {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if _, ok := e.values[value]; ok {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionEqualAny) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if _, ok := e.values[tag.Value]; ok {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionEqualAny) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionEqualAny) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionEqualAny) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
+func (e *expressionEqualAny) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "|=")
+	io.WriteString(writer, escapeValue(e.value))
+}
@@ -0,0 +1,149 @@
+package tagquery
+
+import (
+	"io"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// expressionEqualOrAbsent passes metrics which either have the tag with the given value,
+// or which don't have the tag at all. f.e. "tier=?frontend"
+type expressionEqualOrAbsent struct {
+	expressionCommon
+}
+
+// NewExpressionEqualOrAbsent returns an expression which matches metrics of which the tag
+// with the given key has the given value, as well as metrics which don't have that tag
+func NewExpressionEqualOrAbsent(key, value string) (Expression, error) {
+	return newExpressionFromValues(key, EQUAL_OR_ABSENT, value)
+}
+
+func (e *expressionEqualOrAbsent) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionEqualOrAbsent) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionEqualOrAbsent) Clone() Expression {
+	res := *e
+	return &res
+}
+
+func (e *expressionEqualOrAbsent) GetDefaultDecision() FilterDecision {
+	// a metric which does not have the tag passes
+	return Pass
+}
+
+func (e *expressionEqualOrAbsent) GetOperator() ExpressionOperator {
+	return EQUAL_OR_ABSENT
+}
+
+func (e *expressionEqualOrAbsent) GetOperatorCost() uint32 {
+	return 2
+}
+
+func (e *expressionEqualOrAbsent) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
+func (e *expressionEqualOrAbsent) RequiresNonEmptyValue() bool {
+	return false
+}
+
+func (e *expressionEqualOrAbsent) ResultIsSmallerWhenInverted() bool {
+	// same as with !=, the set of meta records assigning the tag with
+	// a different value decides whether a metric fails
+	return true
+}
+
+func (e *expressionEqualOrAbsent) Matches(value string) bool {
+	return value == e.value
+}
+
+func (e *expressionEqualOrAbsent) FilterValues(values map[string]struct{}) []string {
+	if _, ok := values[e.value]; ok {
+		return []string{e.value}
+	}
+	return nil
+}
+
+func (e *expressionEqualOrAbsent) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	if e.key == "name" {
+		// every metric has a name, so it can't be absent
+		return func(_ schema.MKey, name string, _ []string) FilterDecision {
+			if schema.SanitizeNameAsTagValue(name) == e.value {
+				return Pass
+			}
+			return Fail
+		}
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Pass
+	}
+
+	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
+		for _, tag := range tags {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if value == e.value {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionEqualOrAbsent) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Pass
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if tag.Value == e.value {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionEqualOrAbsent) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionEqualOrAbsent) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionEqualOrAbsent) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
+func (e *expressionEqualOrAbsent) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "=?")
+	io.WriteString(writer, escapeValue(e.value))
+}
@@ -0,0 +1,115 @@
+package tagquery
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/metrictank/errors"
+)
+
+// the errors returned by ParseExpression and ParseExpressions can be classified by
+// checking them with errors.Is against these values. all of them satisfy
+// ErrInvalidExpression, the others describe the reason in more detail
+var (
+	ErrInvalidExpression   = errors.NewBadRequest("invalid expression")
+	ErrInvalidKey          = errors.NewBadRequest("invalid key")
+	ErrUnsupportedOperator = errors.NewBadRequest("unsupported operator")
+	ErrBadRegex            = errors.NewBadRequest("invalid regular expression")
+)
+
+// isParseError returns true if target is ErrInvalidExpression or one of the given classes,
+// it's used to implement the Is methods of the parse errors
+func isParseError(target error, classes ...error) bool {
+	if target == ErrInvalidExpression {
+		return true
+	}
+	for _, class := range classes {
+		if target == class {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidKeyError is returned when the key of an expression fails the validation of the
+// configured KeyValidationMode
+type InvalidKeyError struct {
+	Expression string
+	Key        string
+	Err        error
+}
+
+func (i InvalidKeyError) Error() string {
+	return fmt.Sprintf("Error when validating key \"%s\" of expression \"%s\": %s", i.Key, i.Expression, i.Err.Error())
+}
+
+func (i InvalidKeyError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (i InvalidKeyError) Unwrap() error {
+	return i.Err
+}
+
+func (i InvalidKeyError) Is(target error) bool {
+	return isParseError(target, ErrInvalidKey)
+}
+
+// BadRegexError is returned when the pattern of an expression is not a valid regular
+// expression, the error of the regexp package can be obtained with errors.Unwrap
+type BadRegexError struct {
+	Expression string
+	Err        error
+}
+
+func (b BadRegexError) Error() string {
+	return fmt.Sprintf("Invalid expression: %s, %s", b.Expression, b.Err.Error())
+}
+
+func (b BadRegexError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (b BadRegexError) Unwrap() error {
+	return b.Err
+}
+
+func (b BadRegexError) Is(target error) bool {
+	return isParseError(target, ErrBadRegex)
+}
+
+// UnsupportedOperatorError is returned when an expression uses an operator which doesn't
+// exist, or which isn't supported in combination with the key of the expression
+type UnsupportedOperatorError string
+
+func (u UnsupportedOperatorError) Error() string {
+	return fmt.Sprintf("Invalid expression: %s, unsupported operator", string(u))
+}
+
+func (u UnsupportedOperatorError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (u UnsupportedOperatorError) Is(target error) bool {
+	return isParseError(target, ErrUnsupportedOperator)
+}
+
+// SeriesByTagArgError is returned by ParseSeriesByTagArgs when one of the arguments can't be
+// parsed into an expression. Arg is the position of that argument, starting with 1, the error
+// of the parser can be obtained with errors.Unwrap
+type SeriesByTagArgError struct {
+	Arg int
+	Err error
+}
+
+func (s SeriesByTagArgError) Error() string {
+	return fmt.Sprintf("Argument %d of seriesByTag is invalid: %s", s.Arg, s.Err.Error())
+}
+
+func (s SeriesByTagArgError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (s SeriesByTagArgError) Unwrap() error {
+	return s.Err
+}
@@ -0,0 +1,106 @@
+package tagquery
+
+import (
+	"regexp/syntax"
+	"testing"
+
+	"github.com/grafana/metrictank/errors"
+)
+
+func TestParseExpressionErrorClasses(t *testing.T) {
+	restrictedOpts := DefaultParseOptions()
+	restrictedOpts.AllowedOperators = StandardOperators()
+	restrictedOpts.DisableTagKey = true
+	restrictedOpts.RegexLimits.MaxLength = 10
+
+	strictOpts := DefaultParseOptions()
+	strictOpts.KeyValidation = KeyValidationStrict
+
+	testCases := []struct {
+		expression string
+		opts       ParseOptions
+		classes    []error
+	}{
+		{expression: "abc", opts: defaultParseOptions},
+		{expression: "=abc", opts: defaultParseOptions},
+		{expression: "a;b=c", opts: defaultParseOptions},
+		{expression: "a\tb=c", opts: defaultParseOptions},
+		{expression: "a=b ", opts: defaultParseOptions},
+		{expression: "a@b=c", opts: strictOpts, classes: []error{ErrInvalidKey}},
+		{expression: " a=b", opts: defaultParseOptions, classes: []error{ErrInvalidKey}},
+		{expression: "__any_tag=a|b@c", opts: strictOpts, classes: []error{ErrInvalidKey}},
+		{expression: "__tag=abc", opts: restrictedOpts, classes: []error{ErrInvalidKey}},
+		{expression: "a^=~b", opts: defaultParseOptions, classes: []error{ErrUnsupportedOperator}},
+		{expression: "__interval__=10", opts: defaultParseOptions, classes: []error{ErrUnsupportedOperator}},
+		{expression: "a*=b*", opts: restrictedOpts, classes: []error{ErrUnsupportedOperator}},
+		{expression: "a=~(b", opts: defaultParseOptions, classes: []error{ErrBadRegex}},
+		{expression: "a!=~b[", opts: defaultParseOptions, classes: []error{ErrBadRegex}},
+		{expression: "__tag=~(a:=b", opts: defaultParseOptions, classes: []error{ErrBadRegex}},
+		{expression: "a=~b.*c.*d.*e.*f", opts: restrictedOpts, classes: []error{ErrBadRegex}},
+	}
+
+	allClasses := []error{ErrInvalidKey, ErrUnsupportedOperator, ErrBadRegex}
+	for _, tc := range testCases {
+		_, err := ParseExpressionWithOptions(tc.expression, tc.opts)
+		if err == nil {
+			t.Fatalf("Expected an error when parsing %q", tc.expression)
+		}
+		if !errors.Is(err, ErrInvalidExpression) {
+			t.Fatalf("Expected the error of %q to be an ErrInvalidExpression, got %T: %s", tc.expression, err, err)
+		}
+		if coder, ok := err.(interface{ Code() int }); !ok || coder.Code() != 400 {
+			t.Fatalf("Expected the error of %q to have the status code 400, got %T: %s", tc.expression, err, err)
+		}
+
+	CLASSES:
+		for _, class := range allClasses {
+			for _, expected := range tc.classes {
+				if class == expected {
+					if !errors.Is(err, class) {
+						t.Fatalf("Expected the error of %q to be an %s, got %T: %s", tc.expression, class, err, err)
+					}
+					continue CLASSES
+				}
+			}
+			if errors.Is(err, class) {
+				t.Fatalf("Expected the error of %q not to be an %s, got %T: %s", tc.expression, class, err, err)
+			}
+		}
+	}
+}
+
+func TestBadRegexErrorWrapsRegexpError(t *testing.T) {
+	_, err := ParseExpressions([]string{"a=b", "c=~(d"})
+	var badRegex BadRegexError
+	if !errors.As(err, &badRegex) {
+		t.Fatalf("Expected a BadRegexError, got %T: %s", err, err)
+	}
+	if badRegex.Expression != "c=~(d" {
+		t.Fatalf("Expected the error to refer to the expression \"c=~(d\", got %q", badRegex.Expression)
+	}
+
+	var syntaxErr *syntax.Error
+	if !errors.As(err, &syntaxErr) || syntaxErr.Code != syntax.ErrMissingParen {
+		t.Fatalf("Expected the error to wrap the syntax error of the regexp package, got %v", errors.Unwrap(err))
+	}
+
+	if msg, expect := err.Error(), "Invalid expression: c=~(d, "+syntaxErr.Error(); msg != expect {
+		t.Fatalf("Expected error message %q, got %q", expect, msg)
+	}
+}
+
+func TestInvalidKeyErrorKeepsDetail(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.KeyValidation = KeyValidationStrict
+	_, err := ParseExpressionWithOptions("a@b=c", opts)
+	var keyErr InvalidKeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("Expected an InvalidKeyError, got %T: %s", err, err)
+	}
+	if keyErr.Key != "a@b" || keyErr.Expression != "a@b=c" || keyErr.Err == nil {
+		t.Fatalf("Unexpected InvalidKeyError: %+v", keyErr)
+	}
+	if errors.Unwrap(err) != keyErr.Err {
+		t.Fatalf("Expected the InvalidKeyError to wrap the validation error")
+	}
+}
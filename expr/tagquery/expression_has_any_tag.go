@@ -0,0 +1,162 @@
+package tagquery
+
+import (
+	"io"
+	"strings"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// anyTagKey is the special key of the expression which checks for the presence of any of a set of tags
+const anyTagKey = "__any_tag"
+
+// expressionHasAnyTag passes metrics which have at least one of a "|" separated set of tags,
+// f.e. "__any_tag=rack|cage". it operates on the tag keys, so it has no key of its own and
+// GetKey() returns an empty string, while GetValue() returns the normalized set of tag keys
+type expressionHasAnyTag struct {
+	expressionCommon
+	keys map[string]struct{}
+}
+
+// newExpressionHasAnyTag takes an expressionCommon of which the value is a "|" separated
+// list of tag keys and it instantiates an expressionHasAnyTag from it
+func newExpressionHasAnyTag(resCommon expressionCommon, opts *ParseOptions, expr string) (Expression, error) {
+	resCommon.key = ""
+	keys, ok := parseValueSet(&resCommon)
+	if !ok {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	for key := range keys {
+		if err := validateQueryExpressionTagKey(key, opts.KeyValidation); err != nil {
+			return nil, InvalidKeyError{Expression: expr, Key: key, Err: err}
+		}
+	}
+
+	return &expressionHasAnyTag{expressionCommon: resCommon, keys: keys}, nil
+}
+
+// NewExpressionHasAnyTag returns an expression which matches metrics that have at least
+// one of the tags with the given keys, it is equivalent to parsing "__any_tag=<key1>|<key2>|..."
+func NewExpressionHasAnyTag(keys []string) (Expression, error) {
+	value, err := joinValueSet(keys)
+	if err != nil {
+		return nil, err
+	}
+	return newExpressionFromValues(anyTagKey, EQUAL, value)
+}
+
+func (e *expressionHasAnyTag) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionHasAnyTag) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionHasAnyTag) Clone() Expression {
+	res := *e
+	res.keys = cloneValueSet(e.keys)
+	return &res
+}
+
+func (e *expressionHasAnyTag) GetDefaultDecision() FilterDecision {
+	return Fail
+}
+
+func (e *expressionHasAnyTag) GetOperator() ExpressionOperator {
+	return HAS_ANY_TAG
+}
+
+func (e *expressionHasAnyTag) GetOperatorCost() uint32 {
+	return 12
+}
+
+func (e *expressionHasAnyTag) GetCost() uint32 {
+	return tagCost(e.GetOperatorCost())
+}
+
+func (e *expressionHasAnyTag) OperatesOnTag() bool {
+	return true
+}
+
+func (e *expressionHasAnyTag) RequiresNonEmptyValue() bool {
+	// the ids of the metrics would need to be collected from multiple
+	// tags of the index, so it can't be used as the initial expression
+	return false
+}
+
+func (e *expressionHasAnyTag) Matches(tag string) bool {
+	_, ok := e.keys[tag]
+	return ok
+}
+
+func (e *expressionHasAnyTag) FilterValues(values map[string]struct{}) []string {
+	return filterValues(values, e.Matches)
+}
+
+func (e *expressionHasAnyTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	if _, ok := e.keys["name"]; ok {
+		// every metric has a tag name, so we can always return Pass
+		return func(_ schema.MKey, _ string, _ []string) FilterDecision { return Pass }
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
+		for _, tag := range tags {
+			pos := strings.IndexByte(tag, '=')
+			if pos < 0 {
+				continue
+			}
+
+			if _, ok := e.keys[tag[:pos]]; ok {
+				return Pass
+			}
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionHasAnyTag) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if _, ok := e.keys["name"]; ok {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if _, ok := e.keys[tag.Key]; ok {
+				return Pass
+			}
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionHasAnyTag) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagKey(e, tags)
+}
+
+func (e *expressionHasAnyTag) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionHasAnyTag) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByKey(e)
+}
+
+func (e *expressionHasAnyTag) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, anyTagKey)
+	io.WriteString(writer, "=")
+	io.WriteString(writer, escapeEqualValue(e.value))
+}
@@ -2,7 +2,6 @@ package tagquery
 
 import (
 	"io"
-	"strings"
 
 	"github.com/grafana/metrictank/schema"
 )
@@ -11,10 +10,25 @@ type expressionHasTag struct {
 	expressionCommon
 }
 
+// NewExpressionHasTag returns an expression which matches metrics that have
+// the tag with the given key, it is equivalent to parsing "<key>!="
+func NewExpressionHasTag(key string) (Expression, error) {
+	return newExpressionFromValues(key, NOT_EQUAL, "")
+}
+
 func (e *expressionHasTag) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+func (e *expressionHasTag) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionHasTag) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionHasTag) GetDefaultDecision() FilterDecision {
 	return Fail
 }
@@ -27,6 +41,10 @@ func (e *expressionHasTag) GetOperatorCost() uint32 {
 	return 10
 }
 
+func (e *expressionHasTag) GetCost() uint32 {
+	return tagCost(e.GetOperatorCost())
+}
+
 func (e *expressionHasTag) OperatesOnTag() bool {
 	return true
 }
@@ -35,6 +53,13 @@ func (e *expressionHasTag) Matches(value string) bool {
 	return value == e.key
 }
 
+func (e *expressionHasTag) FilterValues(values map[string]struct{}) []string {
+	if _, ok := values[e.key]; ok {
+		return []string{e.key}
+	}
+	return nil
+}
+
 func (e *expressionHasTag) MatchesExactly() bool {
 	return true
 }
@@ -49,10 +74,9 @@ func (e *expressionHasTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefini
 		resultIfTagIsAbsent = Fail
 	}
 
-	matchPrefix := e.key + "="
 	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
 		for _, tag := range tags {
-			if strings.HasPrefix(tag, matchPrefix) {
+			if tagHasKey(tag, e.key) {
 				return Pass
 			}
 		}
@@ -61,7 +85,49 @@ func (e *expressionHasTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefini
 	}
 }
 
+func (e *expressionHasTag) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key == e.key {
+				return Pass
+			}
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionHasTag) MatchesTags(tags map[string]string) FilterDecision {
+	if _, ok := tags[e.key]; ok || e.key == "name" {
+		return Pass
+	}
+	return decisionIfTagIsAbsent(e)
+}
+
+func (e *expressionHasTag) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionHasTag) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByKey(e)
+}
+
 func (e *expressionHasTag) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
-	writer.Write([]byte("!="))
+	if keyNeedsTagPrefix(e.key) {
+		io.WriteString(writer, "__tag=")
+		io.WriteString(writer, escapeEqualValue(e.key))
+		return
+	}
+
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "!=")
 }
@@ -3,18 +3,47 @@ package tagquery
 import (
 	"io"
 	"strings"
-	"sync"
-	"sync/atomic"
 
 	"github.com/grafana/metrictank/schema"
 )
 
 type expressionMatch struct {
 	expressionCommonRe
+
+	// literals is only set if the pattern is an alternation of literals, see LiteralAlternatives
+	literals []string
+}
+
+// newExpressionMatch instantiates an expressionMatch from the given expressionCommonRe and
+// checks once whether its pattern can be reduced to a set of literals
+func newExpressionMatch(resCommonRe expressionCommonRe) *expressionMatch {
+	res := &expressionMatch{expressionCommonRe: resCommonRe}
+	res.literals, _ = literalAlternativesOfPattern(res.value)
+	return res
 }
 
+// NewExpressionMatch returns an expression which matches metrics that have the tag with the given
+// key and a value matching the given pattern, it is equivalent to parsing "<key>=~<pattern>".
+// like in the parser the pattern gets anchored at the beginning, and if it can be evaluated
+// without a regular expression an equivalent expression with a cheaper operator is returned
+func NewExpressionMatch(key, pattern string) (Expression, error) {
+	return newExpressionFromValues(key, MATCH, pattern)
+}
+
+// Equals compares the patterns without their anchoring at the beginning, because the parser
+// anchors them anyway, f.e. "a=~b.*" equals "a=~^b.*" and "a=~^(?:b.*)"
 func (e *expressionMatch) Equals(other Expression) bool {
-	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && normalizeRegexValue(e.value) == normalizeRegexValue(other.GetValue())
+}
+
+func (e *expressionMatch) IsEquivalentTo(other Expression) bool {
+	return regexIsEquivalentTo(e, other)
+}
+
+func (e *expressionMatch) Clone() Expression {
+	res := *e
+	res.memo = &filterMemo{}
+	return &res
 }
 
 func (e *expressionMatch) GetDefaultDecision() FilterDecision {
@@ -38,15 +67,53 @@ func (e *expressionMatch) GetOperatorCost() uint32 {
 	return 10
 }
 
+func (e *expressionMatch) GetCost() uint32 {
+	return e.regexCost(e.GetOperatorCost())
+}
+
 func (e *expressionMatch) RequiresNonEmptyValue() bool {
 	return !e.matchesEmpty
 }
 
+// LiteralAlternatives returns the literals if the pattern is an alternation of literals
+// which is anchored at the end, see literalAlternativesOfPattern
+func (e *expressionMatch) LiteralAlternatives() ([]string, bool) {
+	return e.literals, e.literals != nil
+}
+
+// IndexablePrefix returns the literal prefix of the pattern, see literalPrefixOfPattern
+func (e *expressionMatch) IndexablePrefix() (string, bool) {
+	return e.literalPrefix, e.prefixComplete
+}
+
 func (e *expressionMatch) Matches(value string) bool {
-	return e.valueRe.MatchString(value)
+	return e.matchString(value)
+}
+
+func (e *expressionMatch) MatchesBytes(value []byte) bool {
+	return e.matchBytes(value)
+}
+
+func (e *expressionMatch) MatchValue(value string) bool {
+	return e.matchString(value)
+}
+
+func (e *expressionMatch) MatchAllValues() bool {
+	return false
 }
 
+func (e *expressionMatch) FilterValues(values map[string]struct{}) []string {
+	return e.filterValuesByRegex(values, false)
+}
+
+// GetMetricDefinitionFilter returns the same filter on every call, see memoizeFilter
 func (e *expressionMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	return e.memoizeFilter(func() MetricDefinitionFilter {
+		return e.getInstrumentedMetricDefinitionFilter(filterInstrumentation{})
+	})
+}
+
+func (e *expressionMatch) getInstrumentedMetricDefinitionFilter(instrumentation filterInstrumentation) MetricDefinitionFilter {
 	if e.key == "name" {
 		if e.value == "" {
 			// silly query, always fails
@@ -54,7 +121,12 @@ func (e *expressionMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinit
 		}
 
 		return func(_ schema.MKey, name string, _ []string) FilterDecision {
-			if e.valueRe.MatchString(schema.SanitizeNameAsTagValue(name)) {
+			name = schema.SanitizeNameAsTagValue(name)
+			// names without the literal prefix of the pattern can't match
+			if !strings.HasPrefix(name, e.literalPrefix) {
+				return Fail
+			}
+			if e.matchStringInstrumented(name, instrumentation) {
 				return Pass
 			} else {
 				return Fail
@@ -64,41 +136,48 @@ func (e *expressionMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinit
 
 	resultIfTagIsAbsent := None
 	if !MetaTagSupport {
-		resultIfTagIsAbsent = Fail
+		resultIfTagIsAbsent = e.GetDefaultDecision()
 	}
 
-	prefix := e.key + "="
-	var matchCache, missCache sync.Map
-	var currentMatchCacheSize, currentMissCacheSize int32
+	matches := e.getCachedMatcher(instrumentation)
 	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
 		for _, tag := range tags {
-			if !strings.HasPrefix(tag, prefix) {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
 				continue
 			}
 
-			value := tag[len(prefix):]
-
-			// reduce regex matching by looking up cached non-matches
-			if _, ok := missCache.Load(value); ok {
-				return Fail
-			}
-
-			// reduce regex matching by looking up cached matches
-			if _, ok := matchCache.Load(value); ok {
+			// the tag is set, so no need to keep looking at other indexes
+			if matches(value) {
 				return Pass
 			}
+			return Fail
+		}
 
-			if e.valueRe.MatchString(value) {
-				if atomic.LoadInt32(&currentMatchCacheSize) < int32(MatchCacheSize) {
-					matchCache.Store(value, struct{}{})
-					atomic.AddInt32(&currentMatchCacheSize, 1)
-				}
-				return Pass
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionMatch) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = e.GetDefaultDecision()
+	}
+
+	matches := e.getCachedMatcher(filterInstrumentation{})
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
 			}
 
-			if atomic.LoadInt32(&currentMissCacheSize) < int32(MatchCacheSize) {
-				missCache.Store(value, struct{}{})
-				atomic.AddInt32(&currentMissCacheSize, 1)
+			// the tag is set, so no need to keep looking at other indexes
+			if matches(tag.Value) {
+				return Pass
 			}
 			return Fail
 		}
@@ -107,8 +186,20 @@ func (e *expressionMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinit
 	}
 }
 
+func (e *expressionMatch) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionMatch) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionMatch) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
 func (e *expressionMatch) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
-	writer.Write([]byte("=~"))
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "=~")
+	io.WriteString(writer, e.value)
 }
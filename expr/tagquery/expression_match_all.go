@@ -12,10 +12,27 @@ type expressionMatchAll struct {
 	originalOperator ExpressionOperator
 }
 
+// NewMatchAllExpression returns an expression which matches every metric,
+// it is equivalent to the expression "<key>=~.*"
+func NewMatchAllExpression(key string) Expression {
+	return &expressionMatchAll{expressionCommon: expressionCommon{key: key, value: ".*"}, originalOperator: MATCH}
+}
+
 func (e *expressionMatchAll) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+// IsEquivalentTo ignores the value, because it doesn't change what the expression matches,
+// f.e. "a=~.*" and "a=~^.*"
+func (e *expressionMatchAll) IsEquivalentTo(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator()
+}
+
+func (e *expressionMatchAll) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionMatchAll) GetDefaultDecision() FilterDecision {
 	return Pass
 }
@@ -36,6 +53,10 @@ func (e *expressionMatchAll) GetOperatorCost() uint32 {
 	return 50
 }
 
+func (e *expressionMatchAll) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
 func (e *expressionMatchAll) RequiresNonEmptyValue() bool {
 	return false
 }
@@ -48,12 +69,44 @@ func (e *expressionMatchAll) Matches(value string) bool {
 	return true
 }
 
+func (e *expressionMatchAll) MatchValue(_ string) bool {
+	return true
+}
+
+func (e *expressionMatchAll) MatchAllValues() bool {
+	return true
+}
+
+func (e *expressionMatchAll) FilterValues(values map[string]struct{}) []string {
+	res := make([]string, 0, len(values))
+	for value := range values {
+		res = append(res, value)
+	}
+	return res
+}
+
 func (e *expressionMatchAll) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
 	return func(_ schema.MKey, _ string, _ []string) FilterDecision { return Pass }
 }
 
+func (e *expressionMatchAll) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+}
+
+func (e *expressionMatchAll) MatchesTags(_ map[string]string) FilterDecision {
+	return Pass
+}
+
+func (e *expressionMatchAll) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionMatchAll) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
 func (e *expressionMatchAll) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
+	io.WriteString(writer, escapeKey(e.key))
 	e.originalOperator.StringIntoWriter(writer)
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, e.value)
 }
@@ -12,10 +12,27 @@ type expressionMatchNone struct {
 	originalOperator ExpressionOperator
 }
 
+// NewMatchNoneExpression returns an expression which matches no metric,
+// it is equivalent to the expression "<key>!=~.*"
+func NewMatchNoneExpression(key string) Expression {
+	return &expressionMatchNone{expressionCommon: expressionCommon{key: key, value: ".*"}, originalOperator: NOT_MATCH}
+}
+
 func (e *expressionMatchNone) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+// IsEquivalentTo ignores the value, because it doesn't change what the expression matches,
+// f.e. "a=~.*" and "a=~^.*"
+func (e *expressionMatchNone) IsEquivalentTo(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator()
+}
+
+func (e *expressionMatchNone) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionMatchNone) GetDefaultDecision() FilterDecision {
 	return Fail
 }
@@ -36,6 +53,10 @@ func (e *expressionMatchNone) GetOperatorCost() uint32 {
 	return 0
 }
 
+func (e *expressionMatchNone) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
 func (e *expressionMatchNone) RequiresNonEmptyValue() bool {
 	return true
 }
@@ -44,12 +65,40 @@ func (e *expressionMatchNone) Matches(value string) bool {
 	return false
 }
 
+func (e *expressionMatchNone) MatchValue(_ string) bool {
+	return false
+}
+
+func (e *expressionMatchNone) MatchAllValues() bool {
+	return false
+}
+
+func (e *expressionMatchNone) FilterValues(_ map[string]struct{}) []string {
+	return nil
+}
+
 func (e *expressionMatchNone) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
 	return func(_ schema.MKey, _ string, _ []string) FilterDecision { return Fail }
 }
 
+func (e *expressionMatchNone) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+}
+
+func (e *expressionMatchNone) MatchesTags(_ map[string]string) FilterDecision {
+	return Fail
+}
+
+func (e *expressionMatchNone) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionMatchNone) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
 func (e *expressionMatchNone) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
+	io.WriteString(writer, escapeKey(e.key))
 	e.originalOperator.StringIntoWriter(writer)
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, e.value)
 }
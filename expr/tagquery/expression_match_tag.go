@@ -3,8 +3,6 @@ package tagquery
 import (
 	"io"
 	"strings"
-	"sync"
-	"sync/atomic"
 
 	"github.com/grafana/metrictank/schema"
 )
@@ -13,11 +11,35 @@ type expressionMatchTag struct {
 	expressionCommonRe
 }
 
+// NewExpressionMatchTag returns an expression which matches metrics that have a tag of
+// which the key matches the given pattern, it is equivalent to parsing "__tag=~<pattern>"
+func NewExpressionMatchTag(pattern string) (Expression, error) {
+	return newExpressionFromValues("__tag", MATCH, pattern)
+}
+
+// Equals compares the patterns without their anchoring at the beginning, because the parser
+// anchors them anyway, f.e. "a=~b.*" equals "a=~^b.*" and "a=~^(?:b.*)"
 func (e *expressionMatchTag) Equals(other Expression) bool {
-	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && normalizeRegexValue(e.value) == normalizeRegexValue(other.GetValue())
+}
+
+func (e *expressionMatchTag) IsEquivalentTo(other Expression) bool {
+	return regexIsEquivalentTo(e, other)
+}
+
+func (e *expressionMatchTag) Clone() Expression {
+	res := *e
+	res.memo = &filterMemo{}
+	return &res
 }
 
 func (e *expressionMatchTag) GetDefaultDecision() FilterDecision {
+	// if the pattern matches "" then a metric which does not have any
+	// matching tag should also be part of the result set, same as with
+	// the operator =~
+	if e.matchesEmpty {
+		return Pass
+	}
 	return Fail
 }
 
@@ -29,6 +51,10 @@ func (e *expressionMatchTag) GetOperatorCost() uint32 {
 	return 20
 }
 
+func (e *expressionMatchTag) GetCost() uint32 {
+	return e.regexCost(e.GetOperatorCost())
+}
+
 func (e *expressionMatchTag) OperatesOnTag() bool {
 	return true
 }
@@ -37,60 +63,93 @@ func (e *expressionMatchTag) RequiresNonEmptyValue() bool {
 	return !e.matchesEmpty
 }
 
+// IndexablePrefix returns the literal prefix of the pattern, see literalPrefixOfPattern
+func (e *expressionMatchTag) IndexablePrefix() (string, bool) {
+	return e.literalPrefix, e.prefixComplete
+}
+
 func (e *expressionMatchTag) Matches(tag string) bool {
-	return e.valueRe.MatchString(tag)
+	return e.matchString(tag)
 }
 
+func (e *expressionMatchTag) MatchesBytes(tag []byte) bool {
+	return e.matchBytes(tag)
+}
+
+func (e *expressionMatchTag) FilterValues(values map[string]struct{}) []string {
+	return e.filterValuesByRegex(values, false)
+}
+
+// GetMetricDefinitionFilter returns the same filter on every call, see memoizeFilter
 func (e *expressionMatchTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
-	if e.valueRe.Match([]byte("name")) {
+	return e.memoizeFilter(func() MetricDefinitionFilter {
+		return e.getInstrumentedMetricDefinitionFilter(filterInstrumentation{})
+	})
+}
+
+func (e *expressionMatchTag) getInstrumentedMetricDefinitionFilter(instrumentation filterInstrumentation) MetricDefinitionFilter {
+	if e.matchString("name") {
 		// every metric has a tag name, so we can always return Pass
 		return func(_ schema.MKey, _ string, _ []string) FilterDecision { return Pass }
 	}
 
 	resultIfTagIsAbsent := None
 	if !MetaTagSupport {
-		resultIfTagIsAbsent = Fail
+		resultIfTagIsAbsent = e.GetDefaultDecision()
 	}
 
-	var matchCache, missCache sync.Map
-	var currentMatchCacheSize, currentMissCacheSize int32
-
+	matches := e.getCachedMatcher(instrumentation)
 	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
 		for _, tag := range tags {
 			values := strings.SplitN(tag, "=", 2)
 			if len(values) < 2 {
 				continue
 			}
-			value := values[0]
-
-			if _, ok := missCache.Load(value); ok {
-				continue
-			}
 
-			if _, ok := matchCache.Load(value); ok {
+			if matches(values[0]) {
 				return Pass
 			}
+		}
 
-			if e.valueRe.MatchString(value) {
-				if atomic.LoadInt32(&currentMatchCacheSize) < int32(MatchCacheSize) {
-					matchCache.Store(value, struct{}{})
-					atomic.AddInt32(&currentMatchCacheSize, 1)
-				}
-				return Pass
-			}
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionMatchTag) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.matchString("name") {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = e.GetDefaultDecision()
+	}
 
-			if atomic.LoadInt32(&currentMissCacheSize) < int32(MatchCacheSize) {
-				missCache.Store(value, struct{}{})
-				atomic.AddInt32(&currentMissCacheSize, 1)
+	matches := e.getCachedMatcher(filterInstrumentation{})
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if matches(tag.Key) {
+				return Pass
 			}
-			continue
 		}
 
 		return resultIfTagIsAbsent
 	}
 }
 
+func (e *expressionMatchTag) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagKey(e, tags)
+}
+
+func (e *expressionMatchTag) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionMatchTag) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByKey(e)
+}
+
 func (e *expressionMatchTag) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte("__tag=~"))
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, "__tag=~")
+	io.WriteString(writer, e.value)
 }
@@ -2,7 +2,6 @@ package tagquery
 
 import (
 	"io"
-	"strings"
 
 	"github.com/grafana/metrictank/schema"
 )
@@ -11,10 +10,26 @@ type expressionNotEqual struct {
 	expressionCommon
 }
 
+// NewExpressionNotEqual returns an expression which matches metrics that don't have the tag
+// with the given key and value, it is equivalent to parsing "<key>!=<value>".
+// the value is taken literally, it must not be escaped
+func NewExpressionNotEqual(key, value string) (Expression, error) {
+	return newExpressionFromValues(key, NOT_EQUAL, value)
+}
+
 func (e *expressionNotEqual) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+func (e *expressionNotEqual) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionNotEqual) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionNotEqual) GetDefaultDecision() FilterDecision {
 	return Pass
 }
@@ -27,6 +42,10 @@ func (e *expressionNotEqual) GetOperatorCost() uint32 {
 	return 2
 }
 
+func (e *expressionNotEqual) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
 func (e *expressionNotEqual) RequiresNonEmptyValue() bool {
 	return false
 }
@@ -39,6 +58,23 @@ func (e *expressionNotEqual) Matches(value string) bool {
 	return value != e.value
 }
 
+func (e *expressionNotEqual) MatchesBytes(value []byte) bool {
+	return string(value) != e.value
+}
+
+func (e *expressionNotEqual) MatchValue(value string) bool {
+	return value != e.value
+}
+
+func (e *expressionNotEqual) MatchAllValues() bool {
+	// tag values are never empty, so they all differ from an empty value
+	return e.value == ""
+}
+
+func (e *expressionNotEqual) FilterValues(values map[string]struct{}) []string {
+	return filterValuesExcept(values, e.value)
+}
+
 func (e *expressionNotEqual) GetMetricDefinitionFilter(lookup IdTagLookup) MetricDefinitionFilter {
 	if e.key == "name" {
 		if e.value == "" {
@@ -62,7 +98,6 @@ func (e *expressionNotEqual) GetMetricDefinitionFilter(lookup IdTagLookup) Metri
 		}
 	}
 
-	prefix := e.key + "="
 	return func(id schema.MKey, _ string, tags []string) FilterDecision {
 		if lookup(id, e.key, e.value) {
 			return Fail
@@ -71,7 +106,30 @@ func (e *expressionNotEqual) GetMetricDefinitionFilter(lookup IdTagLookup) Metri
 		for _, tag := range tags {
 			// the tag is set, but it has a different value,
 			// no need to keep looking at other indexes
-			if strings.HasPrefix(tag, prefix) {
+			if tagHasKey(tag, e.key) {
+				return Pass
+			}
+		}
+
+		return None
+	}
+}
+
+func (e *expressionNotEqual) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" || !MetaTagSupport {
+		// these filters don't look at the tags
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	return func(id schema.MKey, _ string, tags Tags) FilterDecision {
+		if lookup(id, e.key, e.value) {
+			return Fail
+		}
+
+		for _, tag := range tags {
+			// the tag is set, but it has a different value,
+			// no need to keep looking at other indexes
+			if tag.Key == e.key {
 				return Pass
 			}
 		}
@@ -80,8 +138,20 @@ func (e *expressionNotEqual) GetMetricDefinitionFilter(lookup IdTagLookup) Metri
 	}
 }
 
+func (e *expressionNotEqual) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionNotEqual) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionNotEqual) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
 func (e *expressionNotEqual) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
-	writer.Write([]byte("!="))
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "!=")
+	io.WriteString(writer, escapeValue(e.value))
 }
@@ -0,0 +1,163 @@
+package tagquery
+
+import (
+	"io"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+type expressionNotEqualAny struct {
+	expressionCommon
+	values map[string]struct{}
+}
+
+// newExpressionNotEqualAny takes an expressionCommon of which the value is a "|" separated
+// list of values and it instantiates an expressionNotEqualAny from it.
+func newExpressionNotEqualAny(resCommon expressionCommon, expr string) (Expression, error) {
+	values, ok := parseValueSet(&resCommon)
+	if !ok {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	return &expressionNotEqualAny{expressionCommon: resCommon, values: values}, nil
+}
+
+// NewExpressionNotEqualAny returns an expression which matches metrics that don't have the tag with the
+// given key and one of the given values, it is equivalent to parsing "<key>!|=<value1>|<value2>|..."
+func NewExpressionNotEqualAny(key string, values []string) (Expression, error) {
+	value, err := joinValueSet(values)
+	if err != nil {
+		return nil, err
+	}
+	return newExpressionFromValues(key, NOT_EQUAL_ANY, value)
+}
+
+func (e *expressionNotEqualAny) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionNotEqualAny) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionNotEqualAny) Clone() Expression {
+	res := *e
+	res.values = cloneValueSet(e.values)
+	return &res
+}
+
+func (e *expressionNotEqualAny) GetDefaultDecision() FilterDecision {
+	return Pass
+}
+
+func (e *expressionNotEqualAny) GetOperator() ExpressionOperator {
+	return NOT_EQUAL_ANY
+}
+
+func (e *expressionNotEqualAny) GetOperatorCost() uint32 {
+	return 3
+}
+
+func (e *expressionNotEqualAny) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
+func (e *expressionNotEqualAny) RequiresNonEmptyValue() bool {
+	return false
+}
+
+func (e *expressionNotEqualAny) ResultIsSmallerWhenInverted() bool {
+	return true
+}
+
+func (e *expressionNotEqualAny) Matches(value string) bool {
+	_, ok := e.values[value]
+	return !ok
+}
+
+func (e *expressionNotEqualAny) MatchesBytes(value []byte) bool {
+	_, ok := e.values[string(value)]
+	return !ok
+}
+
+func (e *expressionNotEqualAny) FilterValues(values map[string]struct{}) []string {
+	return filterValues(values, e.Matches)
+}
+
+func (e *expressionNotEqualAny) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	if e.key == "name" {
+		return func(_ schema.MKey, name string, _ []string) FilterDecision {
+			if _, ok := e.values[name]; ok {
+				return Fail
+			}
+			return Pass
+		}
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Pass
+	}
+
+	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
+		for _, tag := range tags {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if _, ok := e.values[value]; ok {
+				return Fail
+			}
+			return Pass
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionNotEqualAny) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Pass
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if _, ok := e.values[tag.Value]; ok {
+				return Fail
+			}
+			return Pass
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionNotEqualAny) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionNotEqualAny) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionNotEqualAny) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
+func (e *expressionNotEqualAny) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "!|=")
+	io.WriteString(writer, escapeValue(e.value))
+}
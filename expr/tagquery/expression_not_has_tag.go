@@ -2,7 +2,6 @@ package tagquery
 
 import (
 	"io"
-	"strings"
 
 	"github.com/grafana/metrictank/schema"
 )
@@ -11,10 +10,25 @@ type expressionNotHasTag struct {
 	expressionCommon
 }
 
+// NewExpressionNotHasTag returns an expression which matches metrics that don't
+// have the tag with the given key, it is equivalent to parsing "<key>="
+func NewExpressionNotHasTag(key string) (Expression, error) {
+	return newExpressionFromValues(key, EQUAL, "")
+}
+
 func (e *expressionNotHasTag) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+func (e *expressionNotHasTag) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionNotHasTag) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionNotHasTag) GetDefaultDecision() FilterDecision {
 	return Pass
 }
@@ -27,6 +41,10 @@ func (e *expressionNotHasTag) GetOperatorCost() uint32 {
 	return 10
 }
 
+func (e *expressionNotHasTag) GetCost() uint32 {
+	return tagCost(e.GetOperatorCost())
+}
+
 func (e *expressionNotHasTag) OperatesOnTag() bool {
 	return true
 }
@@ -43,6 +61,10 @@ func (e *expressionNotHasTag) Matches(value string) bool {
 	return value != e.key
 }
 
+func (e *expressionNotHasTag) FilterValues(values map[string]struct{}) []string {
+	return filterValuesExcept(values, e.key)
+}
+
 func (e *expressionNotHasTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
 	if e.key == "name" {
 		return func(_ schema.MKey, _ string, _ []string) FilterDecision { return Fail }
@@ -53,10 +75,30 @@ func (e *expressionNotHasTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDef
 		resultIfTagIsAbsent = Pass
 	}
 
-	matchPrefix := e.key + "="
 	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
 		for _, tag := range tags {
-			if strings.HasPrefix(tag, matchPrefix) {
+			if tagHasKey(tag, e.key) {
+				return Fail
+			}
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionNotHasTag) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Pass
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key == e.key {
 				return Fail
 			}
 		}
@@ -65,7 +107,22 @@ func (e *expressionNotHasTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDef
 	}
 }
 
+func (e *expressionNotHasTag) MatchesTags(tags map[string]string) FilterDecision {
+	if _, ok := tags[e.key]; ok || e.key == "name" {
+		return Fail
+	}
+	return decisionIfTagIsAbsent(e)
+}
+
+func (e *expressionNotHasTag) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionNotHasTag) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByKey(e)
+}
+
 func (e *expressionNotHasTag) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
-	writer.Write([]byte("="))
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "=")
 }
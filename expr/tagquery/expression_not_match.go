@@ -3,8 +3,6 @@ package tagquery
 import (
 	"io"
 	"strings"
-	"sync"
-	"sync/atomic"
 
 	"github.com/grafana/metrictank/schema"
 )
@@ -13,8 +11,26 @@ type expressionNotMatch struct {
 	expressionCommonRe
 }
 
+// NewExpressionNotMatch returns an expression which matches metrics that don't have the tag with
+// the given key and a value matching the given pattern, it is equivalent to parsing "<key>!=~<pattern>"
+func NewExpressionNotMatch(key, pattern string) (Expression, error) {
+	return newExpressionFromValues(key, NOT_MATCH, pattern)
+}
+
+// Equals compares the patterns without their anchoring at the beginning, because the parser
+// anchors them anyway, f.e. "a=~b.*" equals "a=~^b.*" and "a=~^(?:b.*)"
 func (e *expressionNotMatch) Equals(other Expression) bool {
-	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && normalizeRegexValue(e.value) == normalizeRegexValue(other.GetValue())
+}
+
+func (e *expressionNotMatch) IsEquivalentTo(other Expression) bool {
+	return regexIsEquivalentTo(e, other)
+}
+
+func (e *expressionNotMatch) Clone() Expression {
+	res := *e
+	res.memo = &filterMemo{}
+	return &res
 }
 
 func (e *expressionNotMatch) GetDefaultDecision() FilterDecision {
@@ -38,6 +54,10 @@ func (e *expressionNotMatch) GetOperatorCost() uint32 {
 	return 10
 }
 
+func (e *expressionNotMatch) GetCost() uint32 {
+	return e.regexCost(e.GetOperatorCost())
+}
+
 func (e *expressionNotMatch) RequiresNonEmptyValue() bool {
 	return e.matchesEmpty
 }
@@ -47,10 +67,33 @@ func (e *expressionNotMatch) ResultIsSmallerWhenInverted() bool {
 }
 
 func (e *expressionNotMatch) Matches(value string) bool {
-	return !e.valueRe.MatchString(value)
+	return !e.matchString(value)
+}
+
+func (e *expressionNotMatch) MatchesBytes(value []byte) bool {
+	return !e.matchBytes(value)
+}
+
+func (e *expressionNotMatch) MatchValue(value string) bool {
+	return !e.matchString(value)
 }
 
+func (e *expressionNotMatch) MatchAllValues() bool {
+	return false
+}
+
+func (e *expressionNotMatch) FilterValues(values map[string]struct{}) []string {
+	return e.filterValuesByRegex(values, true)
+}
+
+// GetMetricDefinitionFilter returns the same filter on every call, see memoizeFilter
 func (e *expressionNotMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	return e.memoizeFilter(func() MetricDefinitionFilter {
+		return e.getInstrumentedMetricDefinitionFilter(filterInstrumentation{})
+	})
+}
+
+func (e *expressionNotMatch) getInstrumentedMetricDefinitionFilter(instrumentation filterInstrumentation) MetricDefinitionFilter {
 	if e.key == "name" {
 		if e.value == "" {
 			// every metric has a name
@@ -58,7 +101,12 @@ func (e *expressionNotMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefi
 		}
 
 		return func(_ schema.MKey, name string, _ []string) FilterDecision {
-			if e.valueRe.MatchString(schema.SanitizeNameAsTagValue(name)) {
+			name = schema.SanitizeNameAsTagValue(name)
+			// names without the literal prefix of the pattern can't match
+			if !strings.HasPrefix(name, e.literalPrefix) {
+				return Pass
+			}
+			if e.matchStringInstrumented(name, instrumentation) {
 				return Fail
 			}
 			return Pass
@@ -67,41 +115,48 @@ func (e *expressionNotMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefi
 
 	resultIfTagIsAbsent := None
 	if !MetaTagSupport {
-		resultIfTagIsAbsent = Pass
+		resultIfTagIsAbsent = e.GetDefaultDecision()
 	}
 
-	prefix := e.key + "="
-	var matchCache, missCache sync.Map
-	var currentMatchCacheSize, currentMissCacheSize int32
+	matches := e.getCachedMatcher(instrumentation)
 	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
 		for _, tag := range tags {
-			if !strings.HasPrefix(tag, prefix) {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
 				continue
 			}
 
-			value := tag[len(prefix):]
-
-			// reduce regex matching by looking up cached non-matches
-			if _, ok := missCache.Load(value); ok {
-				return Pass
-			}
-
-			// reduce regex matching by looking up cached matches
-			if _, ok := matchCache.Load(value); ok {
+			// the tag is set, so no need to keep looking at other indexes
+			if matches(value) {
 				return Fail
 			}
+			return Pass
+		}
 
-			if e.valueRe.MatchString(value) {
-				if atomic.LoadInt32(&currentMatchCacheSize) < int32(MatchCacheSize) {
-					matchCache.Store(value, struct{}{})
-					atomic.AddInt32(&currentMatchCacheSize, 1)
-				}
-				return Fail
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionNotMatch) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = e.GetDefaultDecision()
+	}
+
+	matches := e.getCachedMatcher(filterInstrumentation{})
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
 			}
 
-			if atomic.LoadInt32(&currentMissCacheSize) < int32(MatchCacheSize) {
-				missCache.Store(value, struct{}{})
-				atomic.AddInt32(&currentMissCacheSize, 1)
+			// the tag is set, so no need to keep looking at other indexes
+			if matches(tag.Value) {
+				return Fail
 			}
 			return Pass
 		}
@@ -110,8 +165,20 @@ func (e *expressionNotMatch) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefi
 	}
 }
 
+func (e *expressionNotMatch) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionNotMatch) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionNotMatch) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
 func (e *expressionNotMatch) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
-	writer.Write([]byte("!=~"))
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "!=~")
+	io.WriteString(writer, e.value)
 }
@@ -0,0 +1,155 @@
+package tagquery
+
+import (
+	"io"
+	"strings"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+type expressionNotPrefix struct {
+	expressionCommon
+}
+
+// NewExpressionNotPrefix returns an expression which matches metrics that don't have the tag with
+// the given key and a value starting with the given prefix, it is equivalent to parsing "<key>!^=<prefix>"
+func NewExpressionNotPrefix(key, prefix string) (Expression, error) {
+	return newExpressionFromValues(key, NOT_PREFIX, prefix)
+}
+
+func (e *expressionNotPrefix) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionNotPrefix) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionNotPrefix) Clone() Expression {
+	res := *e
+	return &res
+}
+
+func (e *expressionNotPrefix) GetDefaultDecision() FilterDecision {
+	// a metric which does not have the tag can't have a value with the prefix
+	return Pass
+}
+
+func (e *expressionNotPrefix) GetOperator() ExpressionOperator {
+	return NOT_PREFIX
+}
+
+func (e *expressionNotPrefix) GetOperatorCost() uint32 {
+	return 3
+}
+
+func (e *expressionNotPrefix) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
+func (e *expressionNotPrefix) RequiresNonEmptyValue() bool {
+	return false
+}
+
+func (e *expressionNotPrefix) ResultIsSmallerWhenInverted() bool {
+	return true
+}
+
+func (e *expressionNotPrefix) Matches(value string) bool {
+	return !strings.HasPrefix(value, e.value)
+}
+
+func (e *expressionNotPrefix) MatchesBytes(value []byte) bool {
+	return !bytesHavePrefix(value, e.value)
+}
+
+func (e *expressionNotPrefix) FilterValues(values map[string]struct{}) []string {
+	var res []string
+	for value := range values {
+		if !strings.HasPrefix(value, e.value) {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
+func (e *expressionNotPrefix) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	if e.key == "name" {
+		return func(_ schema.MKey, name string, _ []string) FilterDecision {
+			if strings.HasPrefix(schema.SanitizeNameAsTagValue(name), e.value) {
+				return Fail
+			}
+
+			return Pass
+		}
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Pass
+	}
+
+	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
+		for _, tag := range tags {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
+				continue
+			}
+
+			if strings.HasPrefix(value, e.value) {
+				return Fail
+			}
+
+			// the tag is set, but its value does not have the prefix,
+			// no need to keep looking at other indexes
+			return Pass
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionNotPrefix) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Pass
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if strings.HasPrefix(tag.Value, e.value) {
+				return Fail
+			}
+			return Pass
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionNotPrefix) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionNotPrefix) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionNotPrefix) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
+func (e *expressionNotPrefix) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "!^=")
+	io.WriteString(writer, escapeValue(e.value))
+}
@@ -11,10 +11,25 @@ type expressionPrefix struct {
 	expressionCommon
 }
 
+// NewExpressionPrefix returns an expression which matches metrics that have the tag with the given
+// key and a value starting with the given prefix, it is equivalent to parsing "<key>^=<prefix>"
+func NewExpressionPrefix(key, prefix string) (Expression, error) {
+	return newExpressionFromValues(key, PREFIX, prefix)
+}
+
 func (e *expressionPrefix) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+func (e *expressionPrefix) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionPrefix) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionPrefix) GetDefaultDecision() FilterDecision {
 	return Fail
 }
@@ -27,6 +42,10 @@ func (e *expressionPrefix) GetOperatorCost() uint32 {
 	return 3
 }
 
+func (e *expressionPrefix) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
 func (e *expressionPrefix) RequiresNonEmptyValue() bool {
 	// we know it requires an non-empty value, because the expression
 	// "__tag^=" would get parsed into the type expressionMatchAll
@@ -37,10 +56,29 @@ func (e *expressionPrefix) Matches(value string) bool {
 	return strings.HasPrefix(value, e.value)
 }
 
-func (e *expressionPrefix) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
-	prefix := e.key + "="
-	matchString := prefix + e.value
+func (e *expressionPrefix) MatchesBytes(value []byte) bool {
+	return bytesHavePrefix(value, e.value)
+}
+
+func (e *expressionPrefix) MatchValue(value string) bool {
+	return strings.HasPrefix(value, e.value)
+}
+
+func (e *expressionPrefix) MatchAllValues() bool {
+	return e.value == ""
+}
+
+func (e *expressionPrefix) FilterValues(values map[string]struct{}) []string {
+	var res []string
+	for value := range values {
+		if strings.HasPrefix(value, e.value) {
+			res = append(res, value)
+		}
+	}
+	return res
+}
 
+func (e *expressionPrefix) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
 	if e.key == "name" {
 		return func(_ schema.MKey, name string, _ []string) FilterDecision {
 			if strings.HasPrefix(schema.SanitizeNameAsTagValue(name), e.value) {
@@ -58,21 +96,62 @@ func (e *expressionPrefix) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefini
 
 	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
 		for _, tag := range tags {
-			if strings.HasPrefix(tag, matchString) {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
+				continue
+			}
+
+			if strings.HasPrefix(value, e.value) {
 				return Pass
 			}
+			return Fail
+		}
 
-			if strings.HasPrefix(tag, prefix) {
-				return Fail
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionPrefix) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
+			}
+
+			// the tag is set, so no need to keep looking at other indexes
+			if strings.HasPrefix(tag.Value, e.value) {
+				return Pass
 			}
+			return Fail
 		}
 
 		return resultIfTagIsAbsent
 	}
 }
 
+func (e *expressionPrefix) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionPrefix) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionPrefix) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
 func (e *expressionPrefix) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(e.key))
-	writer.Write([]byte("^="))
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "^=")
+	io.WriteString(writer, escapeValue(e.value))
 }
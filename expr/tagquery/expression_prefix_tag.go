@@ -11,10 +11,25 @@ type expressionPrefixTag struct {
 	expressionCommon
 }
 
+// NewExpressionPrefixTag returns an expression which matches metrics that have a tag of
+// which the key starts with the given prefix, it is equivalent to parsing "__tag^=<prefix>"
+func NewExpressionPrefixTag(prefix string) (Expression, error) {
+	return newExpressionFromValues("__tag", PREFIX, prefix)
+}
+
 func (e *expressionPrefixTag) Equals(other Expression) bool {
 	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
 }
 
+func (e *expressionPrefixTag) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionPrefixTag) Clone() Expression {
+	res := *e
+	return &res
+}
+
 func (e *expressionPrefixTag) GetDefaultDecision() FilterDecision {
 	return Fail
 }
@@ -27,6 +42,10 @@ func (e *expressionPrefixTag) GetOperatorCost() uint32 {
 	return 15
 }
 
+func (e *expressionPrefixTag) GetCost() uint32 {
+	return tagCost(e.GetOperatorCost())
+}
+
 func (e *expressionPrefixTag) OperatesOnTag() bool {
 	return true
 }
@@ -41,6 +60,16 @@ func (e *expressionPrefixTag) Matches(tag string) bool {
 	return strings.HasPrefix(tag, e.value)
 }
 
+func (e *expressionPrefixTag) FilterValues(values map[string]struct{}) []string {
+	var res []string
+	for value := range values {
+		if strings.HasPrefix(value, e.value) {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
 func (e *expressionPrefixTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
 	if strings.HasPrefix("name", e.value) {
 		// every metric has a name
@@ -62,7 +91,39 @@ func (e *expressionPrefixTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDef
 	}
 }
 
+func (e *expressionPrefixTag) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if strings.HasPrefix("name", e.value) {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if strings.HasPrefix(tag.Key, e.value) {
+				return Pass
+			}
+		}
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionPrefixTag) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagKey(e, tags)
+}
+
+func (e *expressionPrefixTag) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionPrefixTag) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByKey(e)
+}
+
 func (e *expressionPrefixTag) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte("__tag^="))
-	writer.Write([]byte(e.value))
+	io.WriteString(writer, "__tag^=")
+	io.WriteString(writer, escapeValue(e.value))
 }
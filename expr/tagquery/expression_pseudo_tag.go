@@ -0,0 +1,217 @@
+package tagquery
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/dur"
+)
+
+const (
+	// pseudoTagLastUpdate is a reserved key to filter metrics by their lastUpdate property.
+	// its value is either an absolute unix timestamp or a relative time like "-1h"
+	pseudoTagLastUpdate = "__lastUpdate__"
+
+	// pseudoTagInterval is a reserved key to filter metrics by their interval property.
+	// its value is either a number of seconds or a duration like "1min"
+	pseudoTagInterval = "__interval__"
+)
+
+func isPseudoTag(key string) bool {
+	return key == pseudoTagLastUpdate || key == pseudoTagInterval
+}
+
+// IdPropertyLookup takes a metric key and returns the lastUpdate and interval properties
+// of the according metric definition, the returned bool is false if the metric is unknown
+type IdPropertyLookup func(id schema.MKey) (lastUpdate int64, interval int, ok bool)
+
+// MetricPropertyExpression is implemented by the expressions using one of the reserved keys
+// "__lastUpdate__" and "__interval__". These don't get evaluated based on the tags of a metric,
+// but based on properties of the metric definition. Their MetricDefinitionFilter must be obtained
+// via GetMetricPropertyFilter(), the one returned by GetMetricDefinitionFilter() can't come to a
+// decision and always returns None. The same goes for MatchesTags() and GetMetaRecordFilter(),
+// so with their default decision Fail MatchesMetric() never matches, and MetaTagRecord.Validate
+// rejects records of which the query uses a pseudo tag.
+type MetricPropertyExpression interface {
+	Expression
+
+	// GetMetricPropertyFilter returns a MetricDefinitionFilter which uses the given
+	// lookup to get the properties of the metrics it evaluates
+	GetMetricPropertyFilter(lookup IdPropertyLookup) MetricDefinitionFilter
+}
+
+// expressionPseudoTag implements the comparison operators on the pseudo tags
+// "__lastUpdate__" and "__interval__"
+type expressionPseudoTag struct {
+	expressionCommon
+	operator ExpressionOperator
+
+	// relative is true if the value is a time relative to now, in which case
+	// valueInt is the number of seconds to go back from now
+	relative bool
+	valueInt int64
+}
+
+// newExpressionPseudoTag takes an expressionCommon with one of the pseudo tags as its key
+// and one of the comparison operators, it returns an error if the value can't be parsed
+func newExpressionPseudoTag(resCommon expressionCommon, operator ExpressionOperator, expr string) (Expression, error) {
+	switch operator {
+	case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL:
+	default:
+		return nil, UnsupportedOperatorError(expr)
+	}
+
+	res := expressionPseudoTag{expressionCommon: resCommon, operator: operator}
+
+	if len(resCommon.value) > 1 && resCommon.value[0] == '-' && resCommon.key == pseudoTagLastUpdate {
+		offset, err := dur.ParseNDuration(resCommon.value[1:])
+		if err != nil {
+			return nil, InvalidExpressionError(expr)
+		}
+		res.relative = true
+		res.valueInt = int64(offset)
+		return &res, nil
+	}
+
+	if resCommon.key == pseudoTagInterval {
+		interval, err := dur.ParseNDuration(resCommon.value)
+		if err != nil {
+			return nil, InvalidExpressionError(expr)
+		}
+		res.valueInt = int64(interval)
+		return &res, nil
+	}
+
+	var err error
+	res.valueInt, err = strconv.ParseInt(resCommon.value, 10, 64)
+	if err != nil || res.valueInt < 0 {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	return &res, nil
+}
+
+func (e *expressionPseudoTag) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionPseudoTag) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionPseudoTag) Clone() Expression {
+	res := *e
+	return &res
+}
+
+func (e *expressionPseudoTag) GetDefaultDecision() FilterDecision {
+	return Fail
+}
+
+func (e *expressionPseudoTag) GetOperator() ExpressionOperator {
+	return e.operator
+}
+
+func (e *expressionPseudoTag) GetOperatorCost() uint32 {
+	return 8
+}
+
+func (e *expressionPseudoTag) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
+func (e *expressionPseudoTag) RequiresNonEmptyValue() bool {
+	// there is no index of the pseudo tags, so they can't be used
+	// as the initial expression of a query
+	return false
+}
+
+// threshold returns the value which the metric properties get compared to,
+// if the value is relative it gets resolved based on the current time
+func (e *expressionPseudoTag) threshold() int64 {
+	if e.relative {
+		return time.Now().Unix() - e.valueInt
+	}
+	return e.valueInt
+}
+
+func (e *expressionPseudoTag) evaluate(value, threshold int64) bool {
+	switch e.operator {
+	case GREATER:
+		return value > threshold
+	case GREATER_EQUAL:
+		return value >= threshold
+	case LESS:
+		return value < threshold
+	case LESS_EQUAL:
+		return value <= threshold
+	}
+	return false
+}
+
+func (e *expressionPseudoTag) Matches(value string) bool {
+	valueInt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false
+	}
+	return e.evaluate(valueInt, e.threshold())
+}
+
+func (e *expressionPseudoTag) FilterValues(values map[string]struct{}) []string {
+	return filterValues(values, e.Matches)
+}
+
+func (e *expressionPseudoTag) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	return func(_ schema.MKey, _ string, _ []string) FilterDecision { return None }
+}
+
+func (e *expressionPseudoTag) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+}
+
+// MatchesTags can't come to a decision, because the tags don't contain the properties of a metric
+func (e *expressionPseudoTag) MatchesTags(_ map[string]string) FilterDecision {
+	return None
+}
+
+func (e *expressionPseudoTag) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+// GetMetaRecordFilter returns a filter which never comes to a decision,
+// because meta records can't assign pseudo tags
+func (e *expressionPseudoTag) GetMetaRecordFilter() MetaRecordFilter {
+	return func(_ Tags) FilterDecision { return None }
+}
+
+func (e *expressionPseudoTag) GetMetricPropertyFilter(lookup IdPropertyLookup) MetricDefinitionFilter {
+	// relative values get resolved once, so all metrics which
+	// get filtered by this filter are compared to the same time
+	threshold := e.threshold()
+	lastUpdate := e.key == pseudoTagLastUpdate
+
+	return func(id schema.MKey, _ string, _ []string) FilterDecision {
+		metricLastUpdate, metricInterval, ok := lookup(id)
+		if !ok {
+			return Fail
+		}
+
+		value := int64(metricInterval)
+		if lastUpdate {
+			value = metricLastUpdate
+		}
+
+		if e.evaluate(value, threshold) {
+			return Pass
+		}
+		return Fail
+	}
+}
+
+func (e *expressionPseudoTag) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, escapeKey(e.key))
+	e.operator.StringIntoWriter(writer)
+	io.WriteString(writer, e.value)
+}
@@ -0,0 +1,144 @@
+package tagquery
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// ExpressionStats are the statistics of evaluating the filter of one expression. The filters
+// update them atomically, so they can be used concurrently by multiple query workers
+type ExpressionStats struct {
+	Evaluations     uint64 // number of times the filter has been called
+	RegexExecutions uint64 // number of times the regular expression has been executed
+	CacheHits       uint64 // number of values of which the match result was cached
+	CacheMisses     uint64 // number of values which had to be matched by executing the regular expression
+	Nanoseconds     uint64 // cumulative time spent in the filter
+	CacheBypasses   uint64 // number of values which got matched without the caches, because the match cache got bypassed
+}
+
+func (s *ExpressionStats) addRegexExecution() {
+	if s != nil {
+		atomic.AddUint64(&s.RegexExecutions, 1)
+	}
+}
+
+func (s *ExpressionStats) addCacheHit() {
+	if s != nil {
+		atomic.AddUint64(&s.CacheHits, 1)
+	}
+}
+
+func (s *ExpressionStats) addCacheMiss() {
+	if s != nil {
+		atomic.AddUint64(&s.CacheMisses, 1)
+	}
+}
+
+func (s *ExpressionStats) addCacheBypass() {
+	if s != nil {
+		atomic.AddUint64(&s.CacheBypasses, 1)
+	}
+}
+
+// load returns a copy of the stats which is safe to read while the filters are still in use
+func (s *ExpressionStats) load() ExpressionStats {
+	return ExpressionStats{
+		Evaluations:     atomic.LoadUint64(&s.Evaluations),
+		RegexExecutions: atomic.LoadUint64(&s.RegexExecutions),
+		CacheHits:       atomic.LoadUint64(&s.CacheHits),
+		CacheMisses:     atomic.LoadUint64(&s.CacheMisses),
+		Nanoseconds:     atomic.LoadUint64(&s.Nanoseconds),
+		CacheBypasses:   atomic.LoadUint64(&s.CacheBypasses),
+	}
+}
+
+// filterInstrumentation gets passed into the filters of the regex expressions, the stats and the
+// budget are both optional. without them reporting to the instrumentation doesn't cost more than
+// a nil check
+type filterInstrumentation struct {
+	stats  *ExpressionStats
+	budget *RegexBudget
+}
+
+func (i filterInstrumentation) regexExecution() {
+	i.stats.addRegexExecution()
+	i.budget.spend()
+}
+
+func (i filterInstrumentation) cacheHit() {
+	i.stats.addCacheHit()
+}
+
+func (i filterInstrumentation) cacheMiss() {
+	i.stats.addCacheMiss()
+}
+
+func (i filterInstrumentation) cacheBypass() {
+	i.stats.addCacheBypass()
+}
+
+// instrumentedExpression is implemented by the expressions which can report more details than
+// the number of evaluations and the time spent, f.e. the regex expressions count the lookups of
+// their caches and their regex executions
+type instrumentedExpression interface {
+	getInstrumentedMetricDefinitionFilter(instrumentation filterInstrumentation) MetricDefinitionFilter
+}
+
+// StatsCollector collects the ExpressionStats of a set of expressions, it gets passed to
+// Expressions.GetMetricDefinitionFiltersWithStats to instrument the filters of the expressions
+type StatsCollector struct {
+	expressions Expressions
+	stats       []ExpressionStats
+}
+
+// NewStatsCollector returns a collector for the stats of the given expressions, the filters
+// which get instrumented with it must be obtained from the same expressions
+func NewStatsCollector(expressions Expressions) *StatsCollector {
+	return &StatsCollector{
+		expressions: expressions,
+		stats:       make([]ExpressionStats, len(expressions)),
+	}
+}
+
+// Stats returns the current stats of the expression at the given index
+func (c *StatsCollector) Stats(index int) ExpressionStats {
+	return c.stats[index].load()
+}
+
+// Traces returns the current stats of all expressions as ExpressionTraces, in their original order
+func (c *StatsCollector) Traces() []ExpressionTrace {
+	expressions := c.expressions.Strings()
+	res := make([]ExpressionTrace, len(c.expressions))
+	for i := range c.expressions {
+		stats := c.stats[i].load()
+		res[i] = ExpressionTrace{
+			Expression:      expressions[i],
+			Evaluations:     stats.Evaluations,
+			RegexExecutions: stats.RegexExecutions,
+			CacheHits:       stats.CacheHits,
+			CacheMisses:     stats.CacheMisses,
+			Nanoseconds:     stats.Nanoseconds,
+			CacheBypasses:   stats.CacheBypasses,
+		}
+	}
+	return res
+}
+
+// Summary returns the stats of all expressions as one line, f.e. to attach it to the log entry
+// of a slow query. The expressions are listed in their original order
+func (c *StatsCollector) Summary() string {
+	return FormatExpressionTraces(c.Traces())
+}
+
+// instrumentFilter wraps the given filter to count its evaluations and the time spent in it
+func instrumentFilter(filter MetricDefinitionFilter, stats *ExpressionStats) MetricDefinitionFilter {
+	return func(id schema.MKey, name string, tags []string) FilterDecision {
+		start := time.Now()
+		decision := filter(id, name, tags)
+		atomic.AddUint64(&stats.Nanoseconds, uint64(time.Since(start)))
+		atomic.AddUint64(&stats.Evaluations, 1)
+		return decision
+	}
+}
@@ -0,0 +1,143 @@
+package tagquery
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+func TestGetMetricDefinitionFiltersWithStats(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.MatchCacheSize = 10
+	expressions, err := ParseExpressionsWithOptions([]string{"service=~a.*i", "dc=us-east-1", "name=~abc.*cde", "host!=~web-[12]"}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	lookup := func(_ schema.MKey, _, _ string) bool { return true }
+	collector := NewStatsCollector(expressions)
+	filters, _ := expressions.GetMetricDefinitionFiltersWithStats(lookup, nil, collector)
+	uninstrumented, _ := expressions.GetMetricDefinitionFilters(lookup, nil)
+
+	metrics := [][]string{
+		{"dc=us-east-1", "host=web-1", "service=api"},
+		{"dc=us-east-1", "host=web-3", "service=api"},
+		{"dc=us-west-1", "host=web-1", "service=web"},
+		{"dc=us-east-1"},
+	}
+	for _, tags := range metrics {
+		for i := range filters {
+			if res, expect := filters[i](schema.MKey{}, "abc.bcd.cde", tags), uninstrumented[i](schema.MKey{}, "abc.bcd.cde", tags); res != expect {
+				t.Fatalf("Expected instrumented filter of %q to return %s like the uninstrumented one, got %s", expressions.Strings()[i], expect, res)
+			}
+		}
+	}
+
+	type expectedStats struct {
+		evaluations, regexExecutions, cacheHits, cacheMisses uint64
+	}
+
+	expect := []expectedStats{
+		// the value "api" gets matched once, then it is cached. "web" doesn't
+		// start with the literal prefix of the pattern, so it never gets matched
+		{evaluations: 4, regexExecutions: 1, cacheHits: 1, cacheMisses: 1},
+		{evaluations: 4},
+		// the name isn't cached
+		{evaluations: 4, regexExecutions: 4},
+		{evaluations: 4, regexExecutions: 2, cacheHits: 1, cacheMisses: 2},
+	}
+
+	for i := range expressions {
+		stats := collector.Stats(i)
+		res := expectedStats{stats.Evaluations, stats.RegexExecutions, stats.CacheHits, stats.CacheMisses}
+		if res != expect[i] {
+			t.Fatalf("Unexpected stats of %q, expected %+v, got %+v", expressions.Strings()[i], expect[i], res)
+		}
+	}
+
+	summary := collector.Summary()
+	if parts := strings.Split(summary, "; "); len(parts) != len(expressions) || !strings.HasPrefix(parts[0], "service=~a.*i: evaluations=4 regex=1 cache-hits=1 cache-misses=1 time=") {
+		t.Fatalf("Unexpected summary: %s", summary)
+	}
+}
+
+func benchmarkGetMetricDefinitionFiltersWithStats(b *testing.B, collect bool) {
+	expressions, err := ParseExpressions(benchmarkFilterTagsExpressions)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	var collector *StatsCollector
+	if collect {
+		collector = NewStatsCollector(expressions)
+	}
+
+	lookup := func(_ schema.MKey, _, _ string) bool { return true }
+	filters, _ := expressions.GetMetricDefinitionFiltersWithStats(lookup, nil, collector)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, filter := range filters {
+			filter(schema.MKey{}, "abc.bcd.cde", benchmarkFilterTagsMetricTags)
+		}
+	}
+}
+
+// BenchmarkGetMetricDefinitionFiltersWithoutStats should perform the same as BenchmarkFilterTagStrings,
+// because without collector the filters don't get instrumented
+func BenchmarkGetMetricDefinitionFiltersWithoutStats(b *testing.B) {
+	benchmarkGetMetricDefinitionFiltersWithStats(b, false)
+}
+
+func BenchmarkGetMetricDefinitionFiltersWithStats(b *testing.B) {
+	benchmarkGetMetricDefinitionFiltersWithStats(b, true)
+}
+
+func TestGetMetricDefinitionFiltersWithMatchNone(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"service=~a.*i", "dc!=us-east-1", "host!=~.*", "name=~abc.*cde"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	lookups := 0
+	lookup := func(_ schema.MKey, _, _ string) bool {
+		lookups++
+		return true
+	}
+	collector := NewStatsCollector(expressions)
+	filters, defaults := expressions.GetMetricDefinitionFiltersWithStats(lookup, nil, collector)
+	if len(filters) != 1 || len(defaults) != 1 || defaults[0] != Fail {
+		t.Fatalf("Expected a single filter with the default decision Fail, got %d filters and the defaults %v", len(filters), defaults)
+	}
+
+	defs := []MetricDefinitionLike{
+		{Name: "abc.bcd.cde", Tags: []string{"dc=us-west-1", "host=web-1", "service=api"}},
+		{Name: "abc.bcd.cde", Tags: []string{"service=api"}},
+		{Name: "xyz", Tags: nil},
+	}
+	res, err := filters.FilterBatch(context.Background(), defs, defaults)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i := range res {
+		if res[i] != Fail {
+			t.Fatalf("Expected metric %d to fail, got %s", i, res[i])
+		}
+	}
+
+	for i := range expressions {
+		expect := uint64(0)
+		if expressions[i].GetOperator() == MATCH_NONE {
+			expect = uint64(len(defs))
+		}
+		if stats := collector.Stats(i); stats.Evaluations != expect || stats.RegexExecutions != 0 {
+			t.Fatalf("Expected the filter of %q to be evaluated %d times without executing a regex, got %+v", expressions.Strings()[i], expect, stats)
+		}
+	}
+	if lookups != 0 {
+		t.Fatalf("Expected no lookups, got %d", lookups)
+	}
+}
@@ -0,0 +1,275 @@
+package tagquery
+
+import (
+	"io"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/schema"
+)
+
+// tagValueInnerKey is the key used for the expression which evaluates the
+// value condition of an expressionTagValue, its value is never looked at
+const tagValueInnerKey = "value"
+
+// KeyValueExpression is implemented by expressions which constrain the keys and the values
+// of tags at the same time. Their Matches() method only evaluates the tag keys, because
+// OperatesOnTag() returns true, MatchesKeyValue() needs to be used to evaluate both
+type KeyValueExpression interface {
+	Expression
+
+	// MatchesKeyValue returns whether a tag with the given key and value satisfies this expression
+	MatchesKeyValue(key, value string) bool
+}
+
+// expressionTagValue combines a regular expression on the tag keys with a condition on the tag values.
+// f.e. "__tag=~dc_.*:=us-east" matches metrics which have at least one tag of which the key matches
+// "dc_.*" and the value is "us-east".
+// it needs to look at every tag of each metric it evaluates, so it is one of the most expensive expressions
+type expressionTagValue struct {
+	expressionCommon
+
+	// keyRe is the pattern which the tag keys get matched against
+	keyRe *regexp.Regexp
+
+	// valueExpr evaluates the condition on the values of the tags with a matching key
+	valueExpr Expression
+}
+
+// NewTagValueExpression returns an expression which matches metrics that have at least one tag of which
+// the key matches the regular expression keyRe and of which the value satisfies the given operator and value.
+// f.e. NewTagValueExpression("dc_.*", EQUAL, "us-east") is the same as parsing "__tag=~dc_.*:=us-east"
+func NewTagValueExpression(keyRe string, valueOp ExpressionOperator, value string) (Expression, error) {
+	switch valueOp {
+	case EQUAL:
+		value = escapeEqualValue(value)
+	case NOT_EQUAL, PREFIX, NOT_PREFIX, EQUAL_ANY, NOT_EQUAL_ANY, WILDCARD, GREATER, GREATER_EQUAL, LESS, LESS_EQUAL, EQUAL_OR_ABSENT:
+		value = escapeValue(value)
+	case MATCH, NOT_MATCH:
+	default:
+		return nil, errors.NewBadRequestf("Operator %s can't be used as value condition", valueOp)
+	}
+
+	var builder strings.Builder
+	builder.WriteString("__tag=~")
+	builder.WriteString(keyRe)
+	builder.WriteString(":")
+	valueOp.StringIntoWriter(&builder)
+	builder.WriteString(value)
+
+	return ParseExpression(builder.String())
+}
+
+// splitTagValuePattern takes the value of an expression using "__tag=~" and splits it into the key
+// pattern and the value condition, f.e. "dc_.*:=us-east" results in "dc_.*" and "=us-east".
+// the key pattern ends at the first ":" which is followed by an operator and which is preceded by a
+// valid regular expression. since all operators contain a "=", which is not allowed in tag keys, this
+// does not change the meaning of any pattern which can match a tag key.
+// if there is no such ":" the returned bool is false
+func splitTagValuePattern(value string) (string, string, bool) {
+	for pos := strings.IndexByte(value, ':'); pos >= 0; {
+		condition := value[pos+1:]
+		if startsWithOperator(condition) {
+			if _, err := syntax.Parse(value[:pos], syntax.Perl); err == nil {
+				return value[:pos], condition, true
+			}
+		}
+
+		next := strings.IndexByte(condition, ':')
+		if next < 0 {
+			break
+		}
+		pos += next + 1
+	}
+	return "", "", false
+}
+
+// startsWithOperator returns true if the given string begins with
+// one of the operators which can be used as value condition
+func startsWithOperator(condition string) bool {
+	for _, operator := range []string{"=", "!=", "^=", "!^=", "|=", "!|=", "*=", ">", "<"} {
+		if strings.HasPrefix(condition, operator) {
+			return true
+		}
+	}
+	return false
+}
+
+// newExpressionTagValue takes an expressionCommon with the key "__tag" of which the value consists
+// of a key pattern and a value condition, it returns an error if either of them is invalid
+func newExpressionTagValue(resCommon expressionCommon, opts *ParseOptions, expr string) (Expression, error) {
+	keyPattern, condition, ok := splitTagValuePattern(resCommon.value)
+	if !ok {
+		return nil, InvalidExpressionError(expr)
+	}
+
+	if err := opts.RegexLimits.check(expr, keyPattern); err != nil {
+		return nil, err
+	}
+
+	keyRe, err := compileRegex("^(?:" + keyPattern + ")")
+	if err != nil {
+		return nil, BadRegexError{Expression: expr, Err: err}
+	}
+
+	valueExpr, err := parseExpression(tagValueInnerKey+condition, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch valueExpr.GetOperator() {
+	case HAS_TAG, NOT_HAS_TAG:
+		// the value condition must not be empty, use __tag=~ to
+		// only check whether a metric has a tag with a matching key
+		return nil, InvalidExpressionError(expr)
+	}
+
+	return &expressionTagValue{
+		expressionCommon: resCommon,
+		keyRe:            keyRe,
+		valueExpr:        valueExpr,
+	}, nil
+}
+
+func (e *expressionTagValue) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionTagValue) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionTagValue) Clone() Expression {
+	res := *e
+	res.valueExpr = e.valueExpr.Clone()
+	return &res
+}
+
+func (e *expressionTagValue) GetDefaultDecision() FilterDecision {
+	return Fail
+}
+
+func (e *expressionTagValue) GetOperator() ExpressionOperator {
+	return TAG_VALUE
+}
+
+func (e *expressionTagValue) GetOperatorCost() uint32 {
+	return 30
+}
+
+func (e *expressionTagValue) GetCost() uint32 {
+	return tagCost(e.GetOperatorCost())
+}
+
+func (e *expressionTagValue) OperatesOnTag() bool {
+	return true
+}
+
+func (e *expressionTagValue) RequiresNonEmptyValue() bool {
+	// there is no index which could be used to look up the metrics
+	// matching this expression, so it must never be the initial expression
+	return false
+}
+
+// Matches returns whether the given tag key matches the key pattern,
+// use MatchesKeyValue to also evaluate the value condition
+func (e *expressionTagValue) Matches(tag string) bool {
+	return e.keyRe.MatchString(tag)
+}
+
+func (e *expressionTagValue) FilterValues(values map[string]struct{}) []string {
+	return filterValues(values, e.Matches)
+}
+
+// MatchesKeyValue returns whether the given key matches the key pattern
+// and the given value satisfies the value condition
+func (e *expressionTagValue) MatchesKeyValue(key, value string) bool {
+	return e.keyRe.MatchString(key) && e.valueExpr.Matches(value)
+}
+
+func (e *expressionTagValue) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	matchesName := e.keyRe.MatchString("name")
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, name string, tags []string) FilterDecision {
+		if matchesName && e.valueExpr.Matches(schema.SanitizeNameAsTagValue(name)) {
+			return Pass
+		}
+
+		for _, tag := range tags {
+			pos := strings.IndexByte(tag, '=')
+			if pos < 0 {
+				continue
+			}
+
+			if e.MatchesKeyValue(tag[:pos], tag[pos+1:]) {
+				return Pass
+			}
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionTagValue) GetMetricDefinitionTagsFilter(_ IdTagLookup) MetricDefinitionTagsFilter {
+	matchesName := e.keyRe.MatchString("name")
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = Fail
+	}
+
+	return func(_ schema.MKey, name string, tags Tags) FilterDecision {
+		if matchesName && e.valueExpr.Matches(schema.SanitizeNameAsTagValue(name)) {
+			return Pass
+		}
+
+		for _, tag := range tags {
+			if e.MatchesKeyValue(tag.Key, tag.Value) {
+				return Pass
+			}
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionTagValue) MatchesTags(tags map[string]string) FilterDecision {
+	for key, value := range tags {
+		if e.MatchesKeyValue(key, value) {
+			return Pass
+		}
+	}
+	return decisionIfTagIsAbsent(e)
+}
+
+func (e *expressionTagValue) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionTagValue) GetMetaRecordFilter() MetaRecordFilter {
+	return func(metaTags Tags) FilterDecision {
+		res := None
+		for _, tag := range metaTags {
+			if tag.Key == "name" {
+				continue
+			}
+			if e.MatchesKeyValue(tag.Key, tag.Value) {
+				return Pass
+			}
+			res = Fail
+		}
+		return res
+	}
+}
+
+func (e *expressionTagValue) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, "__tag=~")
+	io.WriteString(writer, e.value)
+}
@@ -1,10 +1,23 @@
 package tagquery
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/schema"
 )
 
 func TestExpressionParsing(t *testing.T) {
@@ -51,8 +64,33 @@ func TestExpressionParsing(t *testing.T) {
 		}, {
 			expression: "tag1=~^abc.*",
 			key:        "tag1",
-			value:      "^abc.*",
+			value:      "abc",
+			operator:   PREFIX,
+		}, {
+			expression: "tag1=~abc.+",
+			key:        "tag1",
+			value:      "abc.+",
+			operator:   MATCH,
+		}, {
+			expression: "tag1=~ab(c)\\..*",
+			key:        "tag1",
+			value:      "abc.",
+			operator:   PREFIX,
+		}, {
+			expression: "tag1=~abc.*$",
+			key:        "tag1",
+			value:      "abc.*$",
+			operator:   MATCH,
+		}, {
+			expression: "tag1=~a.c.*",
+			key:        "tag1",
+			value:      "a.c.*",
 			operator:   MATCH,
+		}, {
+			expression: "__tag=~abc.*",
+			key:        "__tag",
+			value:      "abc",
+			operator:   PREFIX_TAG,
 		}, {
 			expression: "abc=~",
 			key:        "abc",
@@ -61,22 +99,27 @@ func TestExpressionParsing(t *testing.T) {
 		}, {
 			expression: "abc=~.*",
 			key:        "abc",
-			value:      "^(?:.*)",
+			value:      ".*",
 			operator:   MATCH_ALL,
 		}, {
 			expression: "abc=~.+",
 			key:        "abc",
-			value:      "^(?:.+)",
-			operator:   MATCH,
+			value:      "",
+			operator:   HAS_TAG,
+		}, {
+			expression: "abc!=~.+",
+			key:        "abc",
+			value:      "",
+			operator:   NOT_HAS_TAG,
 		}, {
 			expression: "tag123=~.*value.*",
 			key:        "tag123",
-			value:      "^(?:.*value.*)",
+			value:      ".*value.*",
 			operator:   MATCH,
 		}, {
 			expression: "__tag=~.*value.*",
 			key:        "__tag",
-			value:      "^(?:.*value.*)",
+			value:      ".*value.*",
 			operator:   MATCH_TAG,
 		}, {
 			expression: "__tag=~",
@@ -86,22 +129,22 @@ func TestExpressionParsing(t *testing.T) {
 		}, {
 			expression: "__tag=~.*",
 			key:        "__tag",
-			value:      "^(?:.*)",
+			value:      ".*",
 			operator:   MATCH_ALL,
 		}, {
 			expression: "__tag=~.+",
 			key:        "__tag",
-			value:      "^(?:.+)",
+			value:      ".+",
 			operator:   MATCH_TAG,
 		}, {
 			expression: "abc!=~.*",
 			key:        "abc",
-			value:      "^(?:.*)",
+			value:      ".*",
 			operator:   MATCH_NONE,
 		}, {
 			expression: "key!=~v_alue",
 			key:        "key",
-			value:      "^(?:v_alue)",
+			value:      "v_alue",
 			operator:   NOT_MATCH,
 		}, {
 			expression: "k!=~",
@@ -111,12 +154,12 @@ func TestExpressionParsing(t *testing.T) {
 		}, {
 			expression: "k!=~.*",
 			key:        "k",
-			value:      "^(?:.*)",
+			value:      ".*",
 			operator:   MATCH_NONE,
 		}, {
 			expression: "sometag!=~.*abc.*",
 			key:        "sometag",
-			value:      "^(?:.*abc.*)",
+			value:      ".*abc.*",
 			operator:   NOT_MATCH,
 		}, {
 			expression: "tag1^=",
@@ -149,12 +192,12 @@ func TestExpressionParsing(t *testing.T) {
 		}, {
 			expression: "key=~=value",
 			key:        "key",
-			value:      "^(?:=value)",
+			value:      "=value",
 			operator:   MATCH,
 		}, {
 			expression: "__tag=~key",
 			key:        "__tag",
-			value:      "^(?:key)",
+			value:      "key",
 			operator:   MATCH_TAG,
 		}, {
 			expression: "__tag^=some.key",
@@ -173,6 +216,268 @@ func TestExpressionParsing(t *testing.T) {
 		}, {
 			expression: "key",
 			err:        true,
+		}, {
+			expression: "host|=c|a|b|a",
+			key:        "host",
+			value:      "a|b|c",
+			operator:   EQUAL_ANY,
+		}, {
+			expression: "host|=a",
+			key:        "host",
+			value:      "a",
+			operator:   EQUAL_ANY,
+		}, {
+			expression: "ho|st=a",
+			key:        "ho|st",
+			value:      "a",
+			operator:   EQUAL,
+		}, {
+			expression: "host|=",
+			err:        true,
+		}, {
+			expression: "host|=a||b",
+			err:        true,
+		}, {
+			expression: "host|=~a|b",
+			err:        true,
+		}, {
+			expression: "__tag|=a|b",
+			err:        true,
+		}, {
+			expression: "host!|=b|a",
+			key:        "host",
+			value:      "a|b",
+			operator:   NOT_EQUAL_ANY,
+		}, {
+			expression: "host!|=",
+			err:        true,
+		}, {
+			expression: "host!|=~a",
+			err:        true,
+		}, {
+			expression: "__tag!|=a",
+			err:        true,
+		}, {
+			expression: "shard>32",
+			key:        "shard",
+			value:      "32",
+			operator:   GREATER,
+		}, {
+			expression: "shard>=32",
+			key:        "shard",
+			value:      "32",
+			operator:   GREATER_EQUAL,
+		}, {
+			expression: "version<1.5",
+			key:        "version",
+			value:      "1.5",
+			operator:   LESS,
+		}, {
+			expression: "version<=-1e3",
+			key:        "version",
+			value:      "-1e3",
+			operator:   LESS_EQUAL,
+		}, {
+			expression: "a<b=c",
+			key:        "a<b",
+			value:      "c",
+			operator:   EQUAL,
+		}, {
+			expression: "a>b!=c",
+			key:        "a>b",
+			value:      "c",
+			operator:   NOT_EQUAL,
+		}, {
+			expression: `a<\>=~c`,
+			key:        "a<>",
+			value:      "c",
+			operator:   MATCH,
+		}, {
+			expression: `a\<=5`,
+			key:        "a<",
+			value:      "5",
+			operator:   EQUAL,
+		}, {
+			expression: `a\>b>5`,
+			key:        "a>b",
+			value:      "5",
+			operator:   GREATER,
+		}, {
+			expression: "shard>",
+			err:        true,
+		}, {
+			expression: "shard>abc",
+			err:        true,
+		}, {
+			expression: "shard>NaN",
+			err:        true,
+		}, {
+			expression: "shard>=~1",
+			err:        true,
+		}, {
+			expression: "__tag>1",
+			err:        true,
+		}, {
+			expression: "status=\\~literal-tilde",
+			key:        "status",
+			value:      "~literal-tilde",
+			operator:   EQUAL,
+		}, {
+			expression: "status=\\\\~x",
+			key:        "status",
+			value:      "\\~x",
+			operator:   EQUAL,
+		}, {
+			expression: "status!=\\~x",
+			key:        "status",
+			value:      "~x",
+			operator:   NOT_EQUAL,
+		}, {
+			expression: "status=a\\~",
+			key:        "status",
+			value:      "a\\~",
+			operator:   EQUAL,
+		}, {
+			// the first "~" is the regex marker, the second one is part of the pattern
+			expression: "status=~~x",
+			key:        "status",
+			value:      "~x",
+			operator:   MATCH,
+		}, {
+			expression: "status=~\\~x",
+			key:        "status",
+			value:      "\\~x",
+			operator:   MATCH,
+		}, {
+			expression: "status^=\\~x",
+			key:        "status",
+			value:      "~x",
+			operator:   PREFIX,
+		}, {
+			expression: "status!^=~x",
+			err:        true,
+		}, {
+			expression: "host!^=web-",
+			key:        "host",
+			value:      "web-",
+			operator:   NOT_PREFIX,
+		}, {
+			expression: "host!^=",
+			key:        "host",
+			value:      "",
+			operator:   MATCH_NONE,
+		}, {
+			expression: "host!=~web-.*",
+			key:        "host",
+			value:      "web-",
+			operator:   NOT_PREFIX,
+		}, {
+			expression: "host!^=~web-",
+			err:        true,
+		}, {
+			expression: "__tag!^=web-",
+			err:        true,
+		}, {
+			expression: "host*=web*db?",
+			key:        "host",
+			value:      "web*db?",
+			operator:   WILDCARD,
+		}, {
+			expression: "host*=web*",
+			key:        "host",
+			value:      "web",
+			operator:   PREFIX,
+		}, {
+			expression: "host*=web",
+			key:        "host",
+			value:      "web",
+			operator:   EQUAL,
+		}, {
+			expression: "host*=**",
+			key:        "host",
+			value:      "**",
+			operator:   MATCH_ALL,
+		}, {
+			expression: "host*=",
+			key:        "host",
+			value:      "",
+			operator:   NOT_HAS_TAG,
+		}, {
+			expression: "ho*st=a",
+			key:        "ho*st",
+			value:      "a",
+			operator:   EQUAL,
+		}, {
+			expression: "host*=~a",
+			err:        true,
+		}, {
+			expression: "__tag*=a*",
+			err:        true,
+		}, {
+			expression: "a|*=b",
+			key:        "a|",
+			value:      "b",
+			operator:   EQUAL,
+		}, {
+			expression: "a*|=b",
+			key:        "a*",
+			value:      "b",
+			operator:   EQUAL_ANY,
+		}, {
+			expression: `a\|=b`,
+			key:        "a|",
+			value:      "b",
+			operator:   EQUAL,
+		}, {
+			expression: `a\*=b`,
+			key:        "a*",
+			value:      "b",
+			operator:   EQUAL,
+		}, {
+			expression: `a\\|=b`,
+			key:        `a\`,
+			value:      "b",
+			operator:   EQUAL_ANY,
+		}, {
+			expression: `a\b=c`,
+			key:        `a\b`,
+			value:      "c",
+			operator:   EQUAL,
+		}, {
+			expression: "host=~web-01$",
+			key:        "host",
+			value:      "web-01",
+			operator:   EQUAL,
+		}, {
+			expression: "host=~(web\\.01)$",
+			key:        "host",
+			value:      "web.01",
+			operator:   EQUAL,
+		}, {
+			expression: "host!=~^web-01$",
+			key:        "host",
+			value:      "web-01",
+			operator:   NOT_EQUAL,
+		}, {
+			expression: "host=~web-01",
+			key:        "host",
+			value:      "web-01",
+			operator:   MATCH,
+		}, {
+			expression: "host=~(?i)web$",
+			key:        "host",
+			value:      "(?i)web$",
+			operator:   MATCH,
+		}, {
+			expression: "host=~web.01$",
+			key:        "host",
+			value:      "web.01$",
+			operator:   MATCH,
+		}, {
+			expression: "host=~$",
+			key:        "host",
+			value:      "$",
+			operator:   MATCH,
 		},
 	}
 
@@ -193,28 +498,124 @@ func TestExpressionParsing(t *testing.T) {
 	}
 }
 
+// keys ending in a character which can be the start of an operator used to be parsed as part
+// of the key, since these operators exist such keys need to be escaped with a backslash
+func TestExpressionParsingKeyEndingInOperatorCharacter(t *testing.T) {
+	testCases := []struct {
+		expression string
+		key        string
+		value      string
+		operator   ExpressionOperator
+		str        string
+	}{
+		{
+			// used to be the key "a|" with the operator "="
+			expression: "a|=b",
+			key:        "a",
+			value:      "b",
+			operator:   EQUAL_ANY,
+			str:        "a|=b",
+		}, {
+			expression: `a\|=b`,
+			key:        "a|",
+			value:      "b",
+			operator:   EQUAL,
+			str:        `a\|=b`,
+		}, {
+			// used to be the key "a!|" with the operator "="
+			expression: "a!|=b",
+			key:        "a",
+			value:      "b",
+			operator:   NOT_EQUAL_ANY,
+			str:        "a!|=b",
+		}, {
+			expression: `a\|!=b`,
+			key:        "a|",
+			value:      "b",
+			operator:   NOT_EQUAL,
+			str:        `a\|!=b`,
+		}, {
+			// used to be the key "a*" with the operator "=", without wildcards "*=" is the same as "="
+			expression: "a*=b",
+			key:        "a",
+			value:      "b",
+			operator:   EQUAL,
+			str:        "a=b",
+		}, {
+			expression: "a*=b?c",
+			key:        "a",
+			value:      "b?c",
+			operator:   WILDCARD,
+			str:        "a*=b?c",
+		}, {
+			expression: `a\*=b?c`,
+			key:        "a*",
+			value:      "b?c",
+			operator:   EQUAL,
+			str:        `a\*=b?c`,
+		}, {
+			expression: `a\*!=b`,
+			key:        "a*",
+			value:      "b",
+			operator:   NOT_EQUAL,
+			str:        `a\*!=b`,
+		},
+	}
+
+	for i, tc := range testCases {
+		expression, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error when parsing %q: %s", i, tc.expression, err)
+		}
+		if expression.GetKey() != tc.key || expression.GetValue() != tc.value || expression.GetOperator() != tc.operator {
+			t.Fatalf("TC %d: Expected %q, %q, %s, got %q, %q, %s", i, tc.key, tc.value, tc.operator, expression.GetKey(), expression.GetValue(), expression.GetOperator())
+		}
+		if str := (Expressions{expression}).Strings()[0]; str != tc.str {
+			t.Fatalf("TC %d: Expected %q to be written as %q, got %q", i, tc.expression, tc.str, str)
+		}
+	}
+}
+
 func TestExpressionsParsingAndBackToString(t *testing.T) {
 	tests := make([]struct {
 		got    string
 		expect string
-	}, 8)
+	}, 17)
 
 	tests[0].got = "a=b"
 	tests[0].expect = "a=b"
 	tests[1].got = "ccc!=$@#@"
 	tests[1].expect = "ccc!=$@#@"
 	tests[2].got = "~=~!"
-	tests[2].expect = "~=~^(?:!)"
+	tests[2].expect = "~=~!"
 	tests[3].got = "d=~e"
-	tests[3].expect = "d=~^(?:e)"
+	tests[3].expect = "d=~e"
 	tests[4].got = "f!=~g"
-	tests[4].expect = "f!=~^(?:g)"
+	tests[4].expect = "f!=~g"
 	tests[5].got = "h^=i"
 	tests[5].expect = "h^=i"
 	tests[6].got = "__tag^=q"
 	tests[6].expect = "__tag^=q"
 	tests[7].got = "__tag=~abc"
-	tests[7].expect = "__tag=~^(?:abc)"
+	tests[7].expect = "__tag=~abc"
+	tests[8].got = "host|=b|a"
+	tests[8].expect = "host|=a|b"
+	tests[9].got = "host!|=b|a|b"
+	tests[9].expect = "host!|=a|b"
+	tests[10].got = "shard>=32"
+	tests[10].expect = "shard>=32"
+	tests[11].got = "shard<2.5"
+	tests[11].expect = "shard<2.5"
+	tests[12].got = "host*=a?b*"
+	tests[12].expect = "host*=a?b*"
+	tests[13].got = "host*=*"
+	tests[13].expect = "host*=*"
+	tests[14].got = "__tag=a!b"
+	tests[14].expect = "__tag=a!b"
+	tests[15].got = "__tag=__tag"
+	tests[15].expect = "__tag=__tag"
+	tests[16].got = "__tag=abc"
+	tests[16].expect = "abc!="
 
 	builder := strings.Builder{}
 	for i, tc := range tests {
@@ -235,6 +636,212 @@ func TestExpressionsParsingAndBackToString(t *testing.T) {
 	}
 }
 
+func TestRegexExpressionsEqualIgnoringAnchoring(t *testing.T) {
+	type testCase struct {
+		a, b  string
+		equal bool
+	}
+
+	testCases := []testCase{
+		{a: "dc=~us.*", b: "dc=~^(?:us.*)", equal: true},
+		{a: "dc=~us.*", b: "dc=~^us.*", equal: true},
+		{a: "dc=~^us.*", b: "dc=~^(?:us.*)", equal: true},
+		{a: "dc!=~us.*", b: "dc!=~^(?:us.*)", equal: true},
+		{a: "__tag=~d.*", b: "__tag=~^d.*", equal: true},
+		{a: "dc=~us.*", b: "dc=~us.+", equal: false},
+		{a: "dc=~us.*", b: "dc!=~^us.*", equal: false},
+		{a: "dc=~us.*", b: "host=~^us.*", equal: false},
+		{a: "dc=~(?:a)|(?:b)", b: "dc=~^(?:a)|(?:b)", equal: true},
+		{a: "dc=~^(?:a)|(?:b)", b: "dc=~a|(?:b)", equal: false},
+		// the literal operators compare the values byte by byte
+		{a: "dc=us", b: "dc=^us", equal: false},
+		{a: "dc^=us", b: "dc^=^us", equal: false},
+	}
+
+	for _, tc := range testCases {
+		a, err := ParseExpression(tc.a)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.a, err)
+		}
+		b, err := ParseExpression(tc.b)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.b, err)
+		}
+
+		if a.Equals(b) != tc.equal || b.Equals(a) != tc.equal {
+			t.Fatalf("Expected %q and %q to be equal: %t", tc.a, tc.b, tc.equal)
+		}
+
+		// an expression parsed from its own string representation is equal to the original
+		for _, e := range []Expression{a, b} {
+			parsed, err := ParseExpression(Expressions{e}.Strings()[0])
+			if err != nil || !parsed.Equals(e) {
+				t.Fatalf("Expected %q to be equal to the original after round-trip: %v", Expressions{e}.Strings()[0], err)
+			}
+		}
+	}
+}
+
+func TestExpressionsString(t *testing.T) {
+	expressions, err := ParseExpressions(append(wireTestExpressions, "a=\\~b", "a=b\\", "__tag=a=b", "a|=b|c|d"))
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	if res := expressions.String(); res != strings.Join(expressions.Strings(), ";") {
+		t.Fatalf("Expected String() to join the result of Strings(), got %q", res)
+	}
+	if res := (Expressions{}).String(); res != "" {
+		t.Fatalf("Expected empty string, got %q", res)
+	}
+
+	q, err := ParseQuery(expressions.String(), 100, 200)
+	if err != nil {
+		t.Fatalf("Unexpected error when parsing the joined expressions: %s", err)
+	}
+	if !q.Expressions.Equal(expressions) || q.From != 100 || q.To != 200 {
+		t.Fatalf("Expected the parsed query to have the original expressions, got %+v", q.Expressions.Strings())
+	}
+
+	// String() uses one buffer for all expressions, so the number of allocations must not
+	// grow with the number of expressions. values which need escaping get copied, so they're
+	// not part of this check
+	expressions, err = ParseExpressions([]string{"a=b", "c!=d", "e=~f.*", "g^=h", "i|=j|k", "__tag^=l", "m>=5"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	single := testing.AllocsPerRun(100, func() { _ = expressions[:1].String() })
+	if allocs := testing.AllocsPerRun(100, func() { _ = expressions.String() }); allocs != single {
+		t.Fatalf("Expected String() of %d expressions to allocate as often as String() of one (%f), got %f allocations", len(expressions), single, allocs)
+	}
+
+	// the same goes for Strings(). the compiler may put very small slices on the stack,
+	// so this compares the expressions to twice as many instead of to a single one
+	doubled := append(expressions.Clone(), expressions...)
+	expected := testing.AllocsPerRun(100, func() { _ = expressions.Strings() })
+	if allocs := testing.AllocsPerRun(100, func() { _ = doubled.Strings() }); allocs != expected {
+		t.Fatalf("Expected Strings() of %d expressions to allocate as often as Strings() of %d (%f), got %f allocations", len(doubled), len(expressions), expected, allocs)
+	}
+}
+
+func TestExpressionsStrings(t *testing.T) {
+	expressions, err := ParseExpressions(append(wireTestExpressions, "a=\\~b", "a=b\\", "__tag=a=b", "a|=b|c|d", "name=~a.b{1,3}", "a=~"+strings.Repeat("b", 1000)))
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	// every string is the same as the one written by the expression itself
+	res := expressions.Strings()
+	if len(res) != len(expressions) {
+		t.Fatalf("Expected %d strings, got %d", len(expressions), len(res))
+	}
+	for i := range expressions {
+		builder := strings.Builder{}
+		expressions[i].StringIntoWriter(&builder)
+		if res[i] != builder.String() {
+			t.Fatalf("Expected string %d to be %q, got %q", i, builder.String(), res[i])
+		}
+	}
+
+	if res := (Expressions{}).Strings(); len(res) != 0 {
+		t.Fatalf("Expected no strings, got %v", res)
+	}
+}
+
+func TestExpressionsStringRoundTrip(t *testing.T) {
+	alphabet := []byte("ab~!^=|*<>'\"\\ .()[]{}?+-:_")
+	operators := []string{"=", "!=", "=~", "!=~", "^=", "!^=", "|=", "!|=", "*=", ">", ">=", "<", "<=", "~", "=?"}
+	keys := []string{"__tag", "__any_tag", "name", "a"}
+
+	randomString := func(r *rand.Rand) string {
+		res := make([]byte, r.Intn(6))
+		for i := range res {
+			res[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(res)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	builder := strings.Builder{}
+	for i := 0; i < 50000; i++ {
+		key := randomString(r)
+		if r.Intn(3) == 0 {
+			key = keys[r.Intn(len(keys))]
+		}
+		raw := key + operators[r.Intn(len(operators))] + randomString(r)
+
+		original, err := ParseExpression(raw)
+		if err != nil {
+			continue
+		}
+
+		original.StringIntoWriter(&builder)
+		serialized := builder.String()
+		builder.Reset()
+
+		parsed, err := ParseExpression(serialized)
+		if err != nil {
+			t.Fatalf("Failed to parse serialized expression \"%s\" (from \"%s\"): %s", serialized, raw, err)
+		}
+
+		if !original.Equals(parsed) || parsed.GetOperator() != original.GetOperator() {
+			t.Fatalf("Expression \"%s\" (from \"%s\") did not round-trip, got key \"%s\" value \"%s\" operator %d", serialized, raw, parsed.GetKey(), parsed.GetValue(), parsed.GetOperator())
+		}
+
+		parsed.StringIntoWriter(&builder)
+		if builder.String() != serialized {
+			t.Fatalf("Expected serialization \"%s\" to be stable, but got \"%s\"", serialized, builder.String())
+		}
+		builder.Reset()
+	}
+}
+
+func TestMatchAllAndMatchNoneConstructors(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	tests := []struct {
+		expression Expression
+		parsed     string
+		operator   ExpressionOperator
+		decision   FilterDecision
+	}{
+		{NewMatchAllExpression("a"), "a=~.*", MATCH_ALL, Pass},
+		{NewMatchNoneExpression("a"), "a!=~.*", MATCH_NONE, Fail},
+	}
+
+	builder := strings.Builder{}
+	for _, tc := range tests {
+		if tc.expression.GetOperator() != tc.operator {
+			t.Fatalf("Expected operator %d, but got %d", tc.operator, tc.expression.GetOperator())
+		}
+
+		parsed, err := ParseExpression(tc.parsed)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of \"%s\": %s", tc.parsed, err)
+		}
+		if !tc.expression.Equals(parsed) {
+			t.Fatalf("Expected constructed expression to equal the parsed expression \"%s\"", tc.parsed)
+		}
+
+		tc.expression.StringIntoWriter(&builder)
+		roundTripped, err := ParseExpression(builder.String())
+		if err != nil || !tc.expression.Equals(roundTripped) {
+			t.Fatalf("Expected serialized expression \"%s\" to round-trip, but it did not: %v", builder.String(), err)
+		}
+		builder.Reset()
+
+		filter := tc.expression.GetMetricDefinitionFilter(nil)
+		if decision := filter(schema.MKey{}, "name", []string{"a=b"}); decision != tc.decision {
+			t.Fatalf("Expected decision %d, but got %d", tc.decision, decision)
+		}
+		if tc.expression.Matches("b") != (tc.decision == Pass) {
+			t.Fatalf("Unexpected result of Matches()")
+		}
+	}
+}
+
 func TestExpression_IsEqualTo(t *testing.T) {
 	tests := make([]struct {
 		expression string
@@ -280,23 +887,503 @@ func TestExpression_IsEqualTo(t *testing.T) {
 	}
 }
 
-func BenchmarkExpressionParsing(b *testing.B) {
-	expressions := [][]string{
-		{"key=value", "key!=value"},
-		{"key=~value", "key!=~value"},
-		{"key1=~", "key2=~"},
-		{"key1!=~aaa", "key2=~abc"},
+func TestExpressionEqualAnyFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("host|=a|b")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
 	}
+	filter := e.GetMetricDefinitionFilter(nil)
 
-	b.ReportAllocs()
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		for i := 0; i < 4; i++ {
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"host=a"}, Pass},
+		{[]string{"dc=x", "host=b"}, Pass},
+		{[]string{"host=c"}, Fail},
+		{[]string{"host=ab"}, Fail},
+		{[]string{"hostname=a"}, Fail},
+		{[]string{"dc=x"}, Fail},
+	}
+
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+
+	nameExpr, err := ParseExpression("name|=a.b|c.d")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filter = nameExpr.GetMetricDefinitionFilter(nil)
+	if decision := filter(schema.MKey{}, "c.d", nil); decision != Pass {
+		t.Fatalf("Expected name filter to pass, but got %d", decision)
+	}
+	if decision := filter(schema.MKey{}, "c.d.e", nil); decision != Fail {
+		t.Fatalf("Expected name filter to fail, but got %d", decision)
+	}
+}
+
+func TestExpressionNotEqualAnyFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("host!|=a|b")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filter := e.GetMetricDefinitionFilter(nil)
+
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"host=a"}, Fail},
+		{[]string{"dc=x", "host=b"}, Fail},
+		{[]string{"host=c"}, Pass},
+		{[]string{"hostname=a"}, Pass},
+		{[]string{"dc=x"}, Pass},
+	}
+
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+
+	if e.GetDefaultDecision() != Pass {
+		t.Fatalf("Expected default decision to be Pass, but got %d", e.GetDefaultDecision())
+	}
+}
+
+func TestExpressionNotPrefixFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("host!^=web-")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filter := e.GetMetricDefinitionFilter(nil)
+
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"host=web-1"}, Fail},
+		{[]string{"dc=x", "host=web-"}, Fail},
+		{[]string{"host=db-1"}, Pass},
+		{[]string{"host=web"}, Pass},
+		{[]string{"hostname=web-1"}, Pass},
+		{[]string{"dc=x"}, Pass},
+	}
+
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+
+	if e.Matches("web-1") || !e.Matches("db-1") {
+		t.Fatalf("Unexpected result of Matches()")
+	}
+
+	if e.GetDefaultDecision() != Pass {
+		t.Fatalf("Expected default decision to be Pass, but got %d", e.GetDefaultDecision())
+	}
+}
+
+func TestExpressionAnyOfValuesEqualityIsOrderInsensitive(t *testing.T) {
+	for _, tc := range [][2]string{{"a|=x|y|z", "a|=z|x|y"}, {"a!|=x|y", "a!|=y|x|y"}} {
+		e1, err := ParseExpression(tc[0])
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of \"%s\": %s", tc[0], err)
+		}
+		e2, err := ParseExpression(tc[1])
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of \"%s\": %s", tc[1], err)
+		}
+		if !e1.Equals(e2) {
+			t.Fatalf("Expected expressions to be equal, but they were not: \"%s\"/\"%s\"", tc[0], tc[1])
+		}
+	}
+
+	e1, _ := ParseExpression("a|=x|y")
+	e2, _ := ParseExpression("a!|=x|y")
+	if e1.Equals(e2) {
+		t.Fatalf("Expected expressions with different operators to not be equal")
+	}
+}
+
+func TestExpressionCompareMatches(t *testing.T) {
+	tests := []struct {
+		expression string
+		pass       []string
+		fail       []string
+	}{
+		{"a>32", []string{"33", "32.5", "1e3"}, []string{"32", "31", "-40", "abc", "", "NaN"}},
+		{"a>=32", []string{"32", "32.0", "33"}, []string{"31.9", "abc"}},
+		{"a<1.5", []string{"1", "1.4999", "-1"}, []string{"1.5", "2", "abc"}},
+		{"a<=1.5", []string{"1.5", "1"}, []string{"1.51", "abc"}},
+		{"a>9007199254740992", []string{"9007199254740993"}, []string{"9007199254740992"}},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of \"%s\": %s", tc.expression, err)
+		}
+		for _, value := range tc.pass {
+			if !e.Matches(value) {
+				t.Fatalf("Expected value \"%s\" to satisfy expression \"%s\", but it did not", value, tc.expression)
+			}
+		}
+		for _, value := range tc.fail {
+			if e.Matches(value) {
+				t.Fatalf("Expected value \"%s\" to not satisfy expression \"%s\", but it did", value, tc.expression)
+			}
+		}
+	}
+}
+
+func TestExpressionCompareFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = true
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("shard>=32")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filter := e.GetMetricDefinitionFilter(nil)
+
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"shard=32"}, Pass},
+		{[]string{"a=b", "shard=100"}, Pass},
+		{[]string{"shard=31"}, Fail},
+		{[]string{"shard=abc"}, Fail},
+		{[]string{"a=b"}, None},
+	}
+
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+}
+
+func TestExpressionWildcardMatches(t *testing.T) {
+	tests := []struct {
+		expression string
+		pass       []string
+		fail       []string
+	}{
+		{"a*=web*db?", []string{"webdb1", "web-01-db2", "webdbdb3", "webdbä"}, []string{"webdb", "web-01-db", "web-01-db12", "xwebdb1"}},
+		{"a*=*db", []string{"db", "webdb", "dbdb"}, []string{"dbx", "d"}},
+		{"a*=?", []string{"a", "ä"}, []string{"", "ab"}},
+		{"a*=w*e*b", []string{"web", "wxexb", "weeeb"}, []string{"we", "wbe"}},
+		{"a*=web[0-9]*", []string{"web1", "web9xyz"}, []string{"web", "webx"}},
+		{"a*=*.{com,org}", []string{"a.com", "b.org"}, []string{"a.net", "acom"}},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of \"%s\": %s", tc.expression, err)
+		}
+		for _, value := range tc.pass {
+			if !e.Matches(value) {
+				t.Fatalf("Expected value \"%s\" to satisfy expression \"%s\", but it did not", value, tc.expression)
+			}
+		}
+		for _, value := range tc.fail {
+			if e.Matches(value) {
+				t.Fatalf("Expected value \"%s\" to not satisfy expression \"%s\", but it did", value, tc.expression)
+			}
+		}
+	}
+}
+
+func TestExpressionWildcardFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("host*=web-?-*")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filter := e.GetMetricDefinitionFilter(nil)
+
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"host=web-1-a"}, Pass},
+		{[]string{"a=b", "host=web-2-"}, Pass},
+		{[]string{"host=web-12-a"}, Fail},
+		{[]string{"a=b"}, Fail},
+	}
+
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+}
+
+func BenchmarkExpressionParsing(b *testing.B) {
+	expressions := [][]string{
+		{"key=value", "key!=value"},
+		{"key=~value", "key!=~value"},
+		{"key1=~", "key2=~"},
+		{"key1!=~aaa", "key2=~abc"},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < 4; i++ {
 			NewQueryFromStrings(expressions[i], 0)
 		}
 	}
 }
 
+// benchmarkRetainedBytesOfExpressions parses 100k distinct expressions built by the given
+// function and logs how many bytes of the heap each of them retains. the expression strings
+// get created before measuring, so only what the parsed expressions add to them is counted
+func benchmarkRetainedBytesOfExpressions(b *testing.B, format func(i int) string) {
+	const count = 100000
+	strs := make([]string, count)
+	for i := range strs {
+		strs[i] = format(i)
+	}
+	opts := DefaultParseOptions()
+	opts.LazyRegexCompilation = true
+
+	var retained uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		expressions := make([]Expression, count)
+		for i := range strs {
+			var err error
+			expressions[i], err = ParseExpressionWithOptions(strs[i], opts)
+			if err != nil {
+				b.Fatalf("Unexpected parsing error: %s", err)
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained = after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(expressions)
+	}
+	b.StopTimer()
+	b.Logf("%d bytes retained per parsed expression", retained/count)
+}
+
+func BenchmarkRetainedBytesOfMatchExpressions(b *testing.B) {
+	benchmarkRetainedBytesOfExpressions(b, func(i int) string {
+		return fmt.Sprintf("host=~web-%d-[a-z]+", i)
+	})
+}
+
+func BenchmarkRetainedBytesOfEqualExpressions(b *testing.B) {
+	benchmarkRetainedBytesOfExpressions(b, func(i int) string {
+		return fmt.Sprintf("host=web-%d", i)
+	})
+}
+
+func TestRegexValueIsKeptAsGiven(t *testing.T) {
+	tests := []struct {
+		expression string
+		matches    []string
+		notMatches []string
+	}{
+		{expression: "a=~(^b|^c)d", matches: []string{"bd", "cd", "bde"}, notMatches: []string{"xbd", "b"}},
+		{expression: "a=~(b|c)", matches: []string{"b", "cx"}, notMatches: []string{"xb"}},
+		{expression: "a=~^b|c", matches: []string{"b", "c", "cx"}, notMatches: []string{"xc"}},
+		{expression: "a!=~^b", matches: []string{"c"}, notMatches: []string{"b"}},
+		{expression: "a=~\\^b", matches: []string{"^b"}, notMatches: []string{"b", "x^b"}},
+		{expression: "a=~[\\^b]c", matches: []string{"^c", "bc"}, notMatches: []string{"c"}},
+		{expression: "__tag=~(a|b)c", matches: []string{"ac", "bc"}, notMatches: []string{"xac"}},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.expression, err)
+		}
+
+		expectValue := tc.expression[strings.Index(tc.expression, "~")+1:]
+		if e.GetValue() != expectValue {
+			t.Fatalf("Expected value of %q to be %q, but got %q", tc.expression, expectValue, e.GetValue())
+		}
+
+		builder := strings.Builder{}
+		e.StringIntoWriter(&builder)
+		if builder.String() != tc.expression {
+			t.Fatalf("Expected %q to be serialized as it was given, but got %q", tc.expression, builder.String())
+		}
+
+		parsed, err := ParseExpression(builder.String())
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", builder.String(), err)
+		}
+		if !parsed.Equals(e) {
+			t.Fatalf("Expected %q to be equal after round-trip", tc.expression)
+		}
+
+		for _, value := range tc.matches {
+			if !e.Matches(value) {
+				t.Fatalf("Expected %q to match %q", tc.expression, value)
+			}
+		}
+		for _, value := range tc.notMatches {
+			if e.Matches(value) {
+				t.Fatalf("Expected %q to not match %q", tc.expression, value)
+			}
+		}
+	}
+
+	if _, err := ParseExpression("a=~b)|(c"); err == nil {
+		t.Fatalf("Expected pattern which breaks out of its group to be rejected")
+	}
+}
+
+func TestExpressionsDedup(t *testing.T) {
+	// "a=~b" and "a=~^(?:b)" are equal, because the anchoring of the patterns gets ignored
+	expressions, err := ParseExpressions([]string{"dc=us-east", "a=~b", "dc=us-east", "a=~^(?:b)", "a!=~b", "name=x", "a=~b"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	expect := []string{"dc=us-east", "a=~b", "a!=~b", "name=x"}
+	if res := expressions.Dedup().Strings(); !reflect.DeepEqual(res, expect) {
+		t.Fatalf("Unexpected result of Dedup, expected:\n%+v\nGot:\n%+v", expect, res)
+	}
+
+	opts := DefaultParseOptions()
+	opts.Dedup = true
+	expressions, err = ParseExpressionsWithOptions([]string{"a=b", "c=d", "a=b"}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if res := expressions.Strings(); !reflect.DeepEqual(res, []string{"a=b", "c=d"}) {
+		t.Fatalf("Unexpected result of ParseExpressionsWithOptions with Dedup: %+v", res)
+	}
+
+	if res := (Expressions{}).Dedup(); len(res) != 0 {
+		t.Fatalf("Expected empty result, got %+v", res)
+	}
+}
+
+func benchmarkFilterExpressions(b *testing.B, dedup bool) {
+	raw := []string{"name=~a.*b.*c", "dc=~us-.*-[0-9]", "name=~a.*b.*c", "dc=~us-.*-[0-9]", "name=~a.*b.*c", "dc=~us-.*-[0-9]"}
+	opts := DefaultParseOptions()
+	opts.Dedup = dedup
+	expressions, err := ParseExpressionsWithOptions(raw, opts)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	filters := make([]MetricDefinitionFilter, len(expressions))
+	for i := range expressions {
+		filters[i] = expressions[i].GetMetricDefinitionFilter(nil)
+	}
+
+	tags := []string{"dc=us-east-1", "host=web-1", "service=api"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, filter := range filters {
+			filter(schema.MKey{}, "abc.bcd.cde", tags)
+		}
+	}
+}
+
+var benchmarkFilterTagsExpressions = []string{"dc=us-east-1", "host!=web-2", "service=~a.*", "env^=pro", "cluster!=", "name=abc.bcd.cde"}
+var benchmarkFilterTagsMetricTags = []string{"cluster=c1", "dc=us-east-1", "env=production", "host=web-1", "os=linux", "rack=r12", "service=api"}
+
+func BenchmarkFilterTagStrings(b *testing.B) {
+	expressions, err := ParseExpressions(benchmarkFilterTagsExpressions)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	lookup := func(_ schema.MKey, _, _ string) bool { return true }
+	filters := make([]MetricDefinitionFilter, len(expressions))
+	for i := range expressions {
+		filters[i] = expressions[i].GetMetricDefinitionFilter(lookup)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, filter := range filters {
+			filter(schema.MKey{}, "abc.bcd.cde", benchmarkFilterTagsMetricTags)
+		}
+	}
+}
+
+func benchmarkFilterTags(b *testing.B, splitPerMetric bool) {
+	expressions, err := ParseExpressions(benchmarkFilterTagsExpressions)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	lookup := func(_ schema.MKey, _, _ string) bool { return true }
+	filters := make([]MetricDefinitionTagsFilter, len(expressions))
+	for i := range expressions {
+		filters[i] = expressions[i].GetMetricDefinitionTagsFilter(lookup)
+	}
+
+	tags := SplitTags(benchmarkFilterTagsMetricTags)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if splitPerMetric {
+			tags = SplitTags(benchmarkFilterTagsMetricTags)
+		}
+		for _, filter := range filters {
+			filter(schema.MKey{}, "abc.bcd.cde", tags)
+		}
+	}
+}
+
+func BenchmarkFilterTags(b *testing.B) {
+	benchmarkFilterTags(b, false)
+}
+
+func BenchmarkFilterTagsIncludingSplit(b *testing.B) {
+	benchmarkFilterTags(b, true)
+}
+
+func BenchmarkFilterDuplicateMatchExpressions(b *testing.B) {
+	benchmarkFilterExpressions(b, false)
+}
+
+func BenchmarkFilterDedupedMatchExpressions(b *testing.B) {
+	benchmarkFilterExpressions(b, true)
+}
+
 func TestParseTagExpressions(t *testing.T) {
 	type testCase struct {
 		inputValue        string
@@ -307,7 +1394,7 @@ func TestParseTagExpressions(t *testing.T) {
 		{
 			inputValue:        "',=+'  , 'a=b','c=d', '~=~!', \"'[])(&%$#@!={}'\"",
 			expectError:       false,
-			expectExpressions: []string{",=+", "a=b", "c=d", "~=~^(?:!)", "'[])(&%$#@!={}'"},
+			expectExpressions: []string{",=+", "a=b", "c=d", "~=~!", "'[])(&%$#@!={}'"},
 		},
 		{
 			inputValue:        "'a=b',\"c=d\",'e=f'",
@@ -347,17 +1434,17 @@ func TestParseTagExpressions(t *testing.T) {
 		{
 			inputValue:        "'a!=~.*'",
 			expectError:       false,
-			expectExpressions: []string{"a!=~^(?:.*)"},
+			expectExpressions: []string{"a!=~.*"},
 		},
 		{
 			inputValue:        "'a=~.*' , '__tag^=a'",
 			expectError:       false,
-			expectExpressions: []string{"a=~^(?:.*)", "__tag^=a"},
+			expectExpressions: []string{"a=~.*", "__tag^=a"},
 		},
 		{
 			inputValue:        "'a=~.+'",
 			expectError:       false,
-			expectExpressions: []string{"a=~^(?:.+)"},
+			expectExpressions: []string{"a!="},
 		},
 		{
 			inputValue:        "",
@@ -409,6 +1496,12 @@ func TestParseTagExpressions(t *testing.T) {
 			expectError:       true,
 			expectExpressions: nil,
 		},
+		{
+			// backslashes are kept as they are, so a value may end in one
+			inputValue:        `'name=~a\\', 'b=c\'`,
+			expectError:       false,
+			expectExpressions: []string{`name=~a\\`, `b=c\`},
+		},
 	}
 
 	for i, tc := range testCases {
@@ -430,6 +1523,61 @@ func TestParseTagExpressions(t *testing.T) {
 	}
 }
 
+func TestParseSeriesByTagCall(t *testing.T) {
+	tests := []struct {
+		raw         string
+		expectError bool
+		expect      []string
+	}{
+		{raw: `seriesByTag('name=cpu', "dc=~us.*")`, expect: []string{"name=cpu", "dc^=us"}},
+		{raw: ` seriesByTag('a=b') `, expect: []string{"a=b"}},
+		{raw: `seriesByTag('a=it\'s', "b=say \"hi\"", 'c=\d')`, expect: []string{"a=it's", `b=say "hi"`, `c=\d`}},
+		{raw: `seriesByTag('a=b', c=d)`, expectError: true},
+		{raw: `seriesByTag('a=b' 'c=d')`, expectError: true},
+		{raw: `seriesByTag('a=b\')`, expectError: true},
+		{raw: `seriesByTag('a=b\\', "c=~d\\\\")`, expect: []string{`a=b\`, `c=~d\\`}},
+		{raw: `seriesByTag('a=b\\\'c')`, expect: []string{`a=b\'c`}},
+		{raw: `seriesByTag(,'a=b')`, expectError: true},
+		{raw: `seriesByTag('a!=b')`, expectError: true},
+		{raw: `sumSeries('a=b')`, expectError: true},
+	}
+
+	for i, tc := range tests {
+		expressions, err := ParseSeriesByTagCall(tc.raw)
+		if (err != nil) != tc.expectError {
+			t.Fatalf("TC %d: Got unexpected error value %q when parsing %s", i, err, tc.raw)
+		}
+		if tc.expectError {
+			continue
+		}
+		if !reflect.DeepEqual(expressions.Strings(), tc.expect) {
+			t.Fatalf("TC %d: Got unexpected expressions\nExpected:\n%+v\nGot:\n%+v\n", i, tc.expect, expressions.Strings())
+		}
+	}
+}
+
+func TestParseSeriesByTagArgsErrorIdentifiesArgument(t *testing.T) {
+	_, err := ParseSeriesByTagArgs([]string{"'a=b'", "'c=~(d'"})
+	if err == nil {
+		t.Fatalf("Expected an error, but did not get one")
+	}
+	if !strings.Contains(err.Error(), "Argument 2") {
+		t.Fatalf("Expected error to identify argument 2, but got: %s", err)
+	}
+	var argErr SeriesByTagArgError
+	if !errors.As(err, &argErr) || argErr.Arg != 2 {
+		t.Fatalf("Expected a SeriesByTagArgError of argument 2, but got: %v", err)
+	}
+	if !errors.Is(err, ErrInvalidExpression) || !errors.Is(err, ErrBadRegex) {
+		t.Fatalf("Expected error to be a bad regex error, but got: %v", err)
+	}
+
+	_, err = ParseSeriesByTagArgs([]string{"a=b"})
+	if err == nil || !strings.Contains(err.Error(), "Argument 1") {
+		t.Fatalf("Expected error about unquoted argument 1, but got: %v", err)
+	}
+}
+
 func TestIsSeriesByTagExpression(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -449,3 +1597,2874 @@ func TestIsSeriesByTagExpression(t *testing.T) {
 		})
 	}
 }
+
+func TestExpressionOperatorStringAndParseOperator(t *testing.T) {
+	seen := make(map[string]struct{})
+	for o := EQUAL; o <= EQUAL_OR_ABSENT; o++ {
+		name := o.String()
+		if _, ok := seen[name]; ok {
+			t.Fatalf("Operator name %q is not unique", name)
+		}
+		seen[name] = struct{}{}
+
+		parsed, err := ParseOperator(name)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing operator %q: %s", name, err)
+		}
+		if parsed != o {
+			t.Fatalf("Expected %q to be parsed as %d, but got %d", name, o, parsed)
+		}
+	}
+
+	if HAS_TAG.String() != "HAS_TAG" || NOT_EQUAL.String() != "NOT_EQUAL" {
+		t.Fatalf("Unexpected operator names: %s, %s", HAS_TAG, NOT_EQUAL)
+	}
+
+	if name := (EQUAL_OR_ABSENT + 1).String(); name != fmt.Sprintf("ExpressionOperator(%d)", EQUAL_OR_ABSENT+1) {
+		t.Fatalf("Unexpected name for unknown operator: %s", name)
+	}
+
+	if _, err := ParseOperator("NOT_AN_OPERATOR"); err == nil {
+		t.Fatalf("Expected an error when parsing an unknown operator name")
+	}
+}
+
+func TestRegexExpressionsMatchingEmptyValue(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	// docs: https://graphite.readthedocs.io/en/latest/tags.html
+	// > Any tag spec that matches an empty value is considered to
+	// > match series that don’t have that tag
+	tests := []struct {
+		expression       string
+		tagIsAbsent      FilterDecision
+		requiresNonEmpty bool
+	}{
+		{expression: "tag=~.*", tagIsAbsent: Pass},
+		{expression: "tag=~a*", tagIsAbsent: Pass},
+		{expression: "tag=~(a|)", tagIsAbsent: Pass},
+		{expression: "tag=~(foo)?", tagIsAbsent: Pass},
+		{expression: "tag=~^$", tagIsAbsent: Pass},
+		{expression: "tag=~.+", tagIsAbsent: Fail, requiresNonEmpty: true},
+		{expression: "tag=~a+", tagIsAbsent: Fail, requiresNonEmpty: true},
+		{expression: "tag=~.*[0-9]", tagIsAbsent: Fail, requiresNonEmpty: true},
+		{expression: "tag!=~.*", tagIsAbsent: Fail, requiresNonEmpty: true},
+		{expression: "tag!=~a*", tagIsAbsent: Fail, requiresNonEmpty: true},
+		{expression: "tag!=~(foo)?", tagIsAbsent: Fail, requiresNonEmpty: true},
+		{expression: "tag!=~^$", tagIsAbsent: Fail, requiresNonEmpty: true},
+		{expression: "tag!=~.+", tagIsAbsent: Pass},
+		{expression: "tag!=~a+", tagIsAbsent: Pass},
+		{expression: "tag!=~.*[0-9]", tagIsAbsent: Pass},
+		{expression: "__tag=~x*", tagIsAbsent: Pass},
+		{expression: "__tag=~.*", tagIsAbsent: Pass},
+		{expression: "__tag=~(foo)?", tagIsAbsent: Pass},
+		{expression: "__tag=~^$", tagIsAbsent: Pass},
+		{expression: "tag*={x,}*", tagIsAbsent: Pass},
+		{expression: "tag*=x?y*", tagIsAbsent: Fail, requiresNonEmpty: true},
+	}
+
+	tags := []string{"other=value", "another=a"}
+	for _, tc := range tests {
+		e, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.expression, err)
+		}
+
+		if e.RequiresNonEmptyValue() != tc.requiresNonEmpty {
+			t.Fatalf("Expected RequiresNonEmptyValue() of %q to be %t", tc.expression, tc.requiresNonEmpty)
+		}
+
+		// the regex expressions compute whether their pattern matches the empty value once,
+		// when they get parsed or decoded from the wire format
+		wire := Expressions{e}.toWire()
+		decoded, err := wire.toExpressions()
+		if err != nil {
+			t.Fatalf("Unexpected error when decoding %q: %s", tc.expression, err)
+		}
+		for _, expression := range []Expression{e, decoded[0]} {
+			if re := commonReOf(expression); re != nil && re.matchesEmpty != re.valueRe.MatchString("") {
+				t.Fatalf("Expected matchesEmpty of %q (%T) to be %t", tc.expression, expression, re.valueRe.MatchString(""))
+			}
+			if expression.RequiresNonEmptyValue() != tc.requiresNonEmpty || expression.GetDefaultDecision() != e.GetDefaultDecision() {
+				t.Fatalf("Expected the decoded %q to have the same properties as the parsed one", tc.expression)
+			}
+		}
+
+		MetaTagSupport = false
+		if decision := e.GetMetricDefinitionFilter(nil)(schema.MKey{}, "name", tags); decision != tc.tagIsAbsent {
+			t.Fatalf("Expected filter of %q to return %d for a metric without the tag, but got %d", tc.expression, tc.tagIsAbsent, decision)
+		}
+
+		MetaTagSupport = true
+		decision := e.GetMetricDefinitionFilter(nil)(schema.MKey{}, "name", tags)
+		if decision == None {
+			decision = e.GetDefaultDecision()
+		}
+		if decision != tc.tagIsAbsent {
+			t.Fatalf("Expected %q to decide %d for a metric without the tag with meta tag support, but got %d", tc.expression, tc.tagIsAbsent, decision)
+		}
+	}
+}
+
+// commonReOf returns the expressionCommonRe of the given expression, or nil if it isn't a regex expression
+func commonReOf(e Expression) *expressionCommonRe {
+	switch e := e.(type) {
+	case *expressionMatch:
+		return &e.expressionCommonRe
+	case *expressionNotMatch:
+		return &e.expressionCommonRe
+	case *expressionMatchTag:
+		return &e.expressionCommonRe
+	}
+	return nil
+}
+
+func TestExpressionPseudoTags(t *testing.T) {
+	now := time.Now().Unix()
+	properties := map[schema.MKey][2]int64{
+		{Key: [16]byte{1}}: {now, 10},
+		{Key: [16]byte{2}}: {now - 7200, 60},
+	}
+	lookup := func(id schema.MKey) (int64, int, bool) {
+		p, ok := properties[id]
+		return p[0], int(p[1]), ok
+	}
+
+	tests := []struct {
+		expression string
+		expect     []FilterDecision
+		err        bool
+	}{
+		{expression: "__lastUpdate__>=-1h", expect: []FilterDecision{Pass, Fail, Fail}},
+		{expression: "__lastUpdate__<-1h", expect: []FilterDecision{Fail, Pass, Fail}},
+		{expression: fmt.Sprintf("__lastUpdate__>%d", now-60), expect: []FilterDecision{Pass, Fail, Fail}},
+		{expression: "__interval__<=10", expect: []FilterDecision{Pass, Fail, Fail}},
+		{expression: "__interval__>=1min", expect: []FilterDecision{Fail, Pass, Fail}},
+		{expression: "__lastUpdate__=123", err: true},
+		{expression: "__lastUpdate__>=-", err: true},
+		{expression: "__lastUpdate__>=abc", err: true},
+		{expression: "__interval__>-10", err: true},
+		{expression: "__interval__>=", err: true},
+		{expression: "__interval__!=10", err: true},
+	}
+
+	ids := []schema.MKey{{Key: [16]byte{1}}, {Key: [16]byte{2}}, {Key: [16]byte{3}}}
+	for _, tc := range tests {
+		e, err := ParseExpression(tc.expression)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("Expected an error when parsing %q", tc.expression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.expression, err)
+		}
+
+		if e.RequiresNonEmptyValue() {
+			t.Fatalf("Expected %q to not be usable as initial expression", tc.expression)
+		}
+
+		if res := (Expressions{e}).Strings()[0]; res != tc.expression {
+			t.Fatalf("Expected %q to be serialized unchanged, but got %q", tc.expression, res)
+		}
+
+		propertyExpr, ok := e.(MetricPropertyExpression)
+		if !ok {
+			t.Fatalf("Expected %q to be a MetricPropertyExpression", tc.expression)
+		}
+
+		filter := propertyExpr.GetMetricPropertyFilter(lookup)
+		for i, id := range ids {
+			if decision := filter(id, "name", nil); decision != tc.expect[i] {
+				t.Fatalf("Expected %q to return %d for metric %d, but got %d", tc.expression, tc.expect[i], i, decision)
+			}
+		}
+	}
+}
+
+func TestExpressionTagKeyExistence(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	// "__tag=region" must be equivalent to "region!=", so the index can use its by-tag lookup
+	e, err := ParseExpression("__tag=region")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	equivalent, err := ParseExpression("region!=")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if !e.Equals(equivalent) {
+		t.Fatalf("Expected \"__tag=region\" to be equal to \"region!=\"")
+	}
+
+	if e.GetKey() != "region" || e.GetOperator() != HAS_TAG || !e.OperatesOnTag() || !e.MatchesExactly() {
+		t.Fatalf("Unexpected properties of expression \"__tag=region\": key=%s operator=%s", e.GetKey(), e.GetOperator())
+	}
+
+	filter := e.GetMetricDefinitionFilter(nil)
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"region=eu"}, Pass},
+		{[]string{"dc=x", "region=us"}, Pass},
+		{[]string{"regions=eu"}, Fail},
+		{[]string{"subregion=eu"}, Fail},
+		{[]string{"__tag=region"}, Fail},
+		{nil, Fail},
+	}
+
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+}
+
+func TestExpressionsWithLeadingTildeRoundTrip(t *testing.T) {
+	tests := []struct {
+		expression string
+		value      string
+	}{
+		{expression: "a=\\~b", value: "~b"},
+		{expression: "a!=\\~b", value: "~b"},
+		{expression: "a=\\\\~b", value: "\\~b"},
+		{expression: "a^=\\~b", value: "~b"},
+		{expression: "a!^=\\~b", value: "~b"},
+		{expression: "a|=\\~b", value: "~b"},
+		{expression: "a|=c|~b", value: "c|~b"},
+		{expression: "a*=\\~b*c", value: "~b*c"},
+		{expression: "__tag^=\\~b", value: "~b"},
+		{expression: "a=~~b", value: "~b"},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.expression, err)
+		}
+		if e.GetValue() != tc.value {
+			t.Fatalf("Expected value of %q to be %q, but got %q", tc.expression, tc.value, e.GetValue())
+		}
+
+		builder := strings.Builder{}
+		e.StringIntoWriter(&builder)
+		if builder.String() != tc.expression {
+			t.Fatalf("Expected %q to be serialized unchanged, but got %q", tc.expression, builder.String())
+		}
+	}
+
+	// a regex which only matches a literal with a leading "~" gets downgraded to EQUAL
+	e, err := ParseExpression("a=~\\~b$")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if e.GetOperator() != EQUAL || e.GetValue() != "~b" {
+		t.Fatalf("Expected EQUAL expression with value \"~b\", but got %s with value %q", e.GetOperator(), e.GetValue())
+	}
+	if res := (Expressions{e}).Strings()[0]; res != "a=\\~b" {
+		t.Fatalf("Unexpected serialization: %q", res)
+	}
+}
+
+func TestExpressionTagValue(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("__tag=~dc_.*:=us-east")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if e.GetOperator() != TAG_VALUE || e.GetKey() != "__tag" || e.GetValue() != "dc_.*:=us-east" {
+		t.Fatalf("Unexpected expression: %s %s %s", e.GetKey(), e.GetOperator(), e.GetValue())
+	}
+	if e.RequiresNonEmptyValue() {
+		t.Fatalf("Expected expression to not be usable as initial expression")
+	}
+	filter := e.GetMetricDefinitionFilter(nil)
+
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"dc_primary=us-east"}, Pass},
+		{[]string{"dc_primary=eu-west", "dc_backup=us-east"}, Pass},
+		{[]string{"dc_primary=eu-west"}, Fail},
+		{[]string{"region=us-east"}, Fail},
+		{[]string{"dc=us-east"}, Fail},
+		{nil, Fail},
+	}
+
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+
+	nameFilter, err := ParseExpression("__tag=~name:^=some.")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if decision := nameFilter.GetMetricDefinitionFilter(nil)(schema.MKey{}, "some.metric", nil); decision != Pass {
+		t.Fatalf("Expected the metric name to be evaluated, but got decision %d", decision)
+	}
+
+	for _, other := range []string{"a!=b", "c=~d", "__tag=~e", "__tag^=f", "g!="} {
+		otherExpr, err := ParseExpression(other)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		if e.GetOperatorCost() <= otherExpr.GetOperatorCost() {
+			t.Fatalf("Expected the tag value expression to be more expensive than %q", other)
+		}
+	}
+
+	if _, err := NewQueryFromStrings([]string{"__tag=~dc_.*:=us-east"}, 0); err == nil {
+		t.Fatalf("Expected an error when querying only by a tag value expression")
+	}
+}
+
+func TestParseTagValueExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		operator   ExpressionOperator
+		err        bool
+	}{
+		{expression: "__tag=~dc_.*:!=us-east", operator: TAG_VALUE},
+		{expression: "__tag=~dc_.*:=~us-.*east", operator: TAG_VALUE},
+		{expression: "__tag=~(?:dc|region):|=a|b", operator: TAG_VALUE},
+		{expression: "__tag=~[a:]=x", operator: MATCH_TAG},
+		{expression: "__tag=~[:=]:=x", operator: TAG_VALUE},
+		{expression: "__tag=~dc:x", operator: MATCH_TAG},
+		{expression: "__tag=~dc_.*:=", err: true},
+		{expression: "__tag=~dc_.*:!=", err: true},
+		{expression: "__tag=~dc_.*:=~(a", err: true},
+		{expression: "__tag=~dc_.*:;=a", err: true},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseExpression(tc.expression)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("Expected an error when parsing %q, but got %s", tc.expression, e.GetOperator())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", tc.expression, err)
+		}
+		if e.GetOperator() != tc.operator {
+			t.Fatalf("Expected %q to use operator %s, but got %s", tc.expression, tc.operator, e.GetOperator())
+		}
+		if res := (Expressions{e}).Strings()[0]; res != tc.expression {
+			t.Fatalf("Expected expression to be serialized as %q, but got %q", tc.expression, res)
+		}
+	}
+}
+
+func TestNewTagValueExpression(t *testing.T) {
+	e, err := NewTagValueExpression("dc_.*", EQUAL, "~us-east")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res := (Expressions{e}).Strings()[0]; res != `__tag=~dc_.*:=\~us-east` {
+		t.Fatalf("Unexpected expression: %s", res)
+	}
+	kv, ok := e.(KeyValueExpression)
+	if !ok {
+		t.Fatalf("Expected expression to implement KeyValueExpression")
+	}
+	if !kv.MatchesKeyValue("dc_a", "~us-east") || kv.MatchesKeyValue("dc_a", "us-east") || kv.MatchesKeyValue("a", "~us-east") {
+		t.Fatalf("Unexpected result of MatchesKeyValue()")
+	}
+
+	e, err = NewTagValueExpression("dc", NOT_MATCH, "us-.*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res := (Expressions{e}).Strings()[0]; res != "__tag=~dc:!=~us-.*" {
+		t.Fatalf("Unexpected expression: %s", res)
+	}
+
+	for _, operator := range []ExpressionOperator{HAS_TAG, NOT_HAS_TAG, MATCH_TAG, PREFIX_TAG, MATCH_ALL, MATCH_NONE, TAG_VALUE} {
+		if _, err := NewTagValueExpression("dc", operator, "a"); err == nil {
+			t.Fatalf("Expected an error when using operator %s", operator)
+		}
+	}
+}
+
+func TestExpressionHasAnyTag(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("__any_tag=rack|cage|rack")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if e.GetOperator() != HAS_ANY_TAG || e.GetKey() != "" || e.GetValue() != "cage|rack" {
+		t.Fatalf("Unexpected expression: %q %s %q", e.GetKey(), e.GetOperator(), e.GetValue())
+	}
+	if !e.OperatesOnTag() || e.RequiresNonEmptyValue() {
+		t.Fatalf("Expected expression to operate on tags and to not be usable as initial expression")
+	}
+	if !e.Matches("rack") || !e.Matches("cage") || e.Matches("row") {
+		t.Fatalf("Unexpected result of Matches()")
+	}
+	if res := (Expressions{e}).Strings()[0]; res != "__any_tag=cage|rack" {
+		t.Fatalf("Unexpected serialization: %s", res)
+	}
+
+	filter := e.GetMetricDefinitionFilter(nil)
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"rack=a"}, Pass},
+		{[]string{"dc=x", "cage=b"}, Pass},
+		{[]string{"rack=a", "cage=b"}, Pass},
+		{[]string{"racks=a", "row=b"}, Fail},
+		{nil, Fail},
+	}
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+
+	nameExpr, err := ParseExpression("__any_tag=rack|name")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if decision := nameExpr.GetMetricDefinitionFilter(nil)(schema.MKey{}, "some.name", nil); decision != Pass {
+		t.Fatalf("Expected every metric to have the tag name, but got decision %d", decision)
+	}
+
+	for _, expression := range []string{"__any_tag=", "__any_tag!=rack", "__any_tag=~rack", "__any_tag^=rack", "__any_tag|=rack", "__any_tag=rack||cage", "__any_tag=ra;ck"} {
+		if _, err := ParseExpression(expression); err == nil {
+			t.Fatalf("Expected an error when parsing %q", expression)
+		}
+	}
+
+	if _, err := NewQueryFromStrings([]string{"__any_tag=rack|cage"}, 0); err == nil {
+		t.Fatalf("Expected an error when querying only by an any-of tag expression")
+	}
+	if _, err := NewQueryFromStrings([]string{"dc=x", "__any_tag=rack|cage"}, 0); err != nil {
+		t.Fatalf("Unexpected error when creating query: %s", err)
+	}
+}
+
+func TestExpressionEqualOrAbsent(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression("tier=?frontend")
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if e.GetOperator() != EQUAL_OR_ABSENT || e.GetKey() != "tier" || e.GetValue() != "frontend" {
+		t.Fatalf("Unexpected expression: %s %s %s", e.GetKey(), e.GetOperator(), e.GetValue())
+	}
+	if e.RequiresNonEmptyValue() || e.GetDefaultDecision() != Pass {
+		t.Fatalf("Expected expression to not be usable as initial expression and to pass by default")
+	}
+
+	notEqual, _ := ParseExpression("tier!=frontend")
+	if e.GetOperatorCost() != notEqual.GetOperatorCost() {
+		t.Fatalf("Expected the same cost as !=, but got %d", e.GetOperatorCost())
+	}
+
+	filter := e.GetMetricDefinitionFilter(nil)
+	tests := []struct {
+		tags   []string
+		expect FilterDecision
+	}{
+		{[]string{"tier=frontend"}, Pass},
+		{[]string{"dc=x", "tier=frontend"}, Pass},
+		{[]string{"tier=backend"}, Fail},
+		{[]string{"tiers=backend"}, Pass},
+		{nil, Pass},
+	}
+	for i, tc := range tests {
+		if decision := filter(schema.MKey{}, "name", tc.tags); decision != tc.expect {
+			t.Fatalf("TC %d: Expected decision %d for tags %+v, but got %d", i, tc.expect, tc.tags, decision)
+		}
+	}
+
+	nameFilter, _ := ParseExpression("name=?a.b")
+	if nameFilter.GetMetricDefinitionFilter(nil)(schema.MKey{}, "a.c", nil) != Fail {
+		t.Fatalf("Expected a metric with a different name to fail")
+	}
+
+	parseTests := []struct {
+		expression string
+		operator   ExpressionOperator
+		value      string
+	}{
+		{expression: "tier=?", operator: NOT_HAS_TAG, value: ""},
+		{expression: "tier=??a", operator: EQUAL_OR_ABSENT, value: "?a"},
+		{expression: "tier=?~a", operator: EQUAL_OR_ABSENT, value: "~a"},
+		{expression: `tier=\?a`, operator: EQUAL, value: "?a"},
+		{expression: `tier=\\?a`, operator: EQUAL, value: `\?a`},
+		{expression: "tier!=?a", operator: NOT_EQUAL, value: "?a"},
+		{expression: "tier^=?a", operator: PREFIX, value: "?a"},
+	}
+	for _, tc := range parseTests {
+		parsed, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", tc.expression, err)
+		}
+		if parsed.GetOperator() != tc.operator || parsed.GetValue() != tc.value {
+			t.Fatalf("Expected %q to be parsed as %s %q, but got %s %q", tc.expression, tc.operator, tc.value, parsed.GetOperator(), parsed.GetValue())
+		}
+		reparsed, err := ParseExpression((Expressions{parsed}).Strings()[0])
+		if err != nil || !reparsed.Equals(parsed) {
+			t.Fatalf("Expression %q did not round-trip: %v", tc.expression, err)
+		}
+	}
+
+	for _, expression := range []string{"__tag=?a", "__any_tag=?a", "__interval__=?10"} {
+		if _, err := ParseExpression(expression); err == nil {
+			t.Fatalf("Expected an error when parsing %q", expression)
+		}
+	}
+
+	constructed, err := NewExpressionEqualOrAbsent("tier", "~frontend")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if constructed.GetOperator() != EQUAL_OR_ABSENT || constructed.GetValue() != "~frontend" {
+		t.Fatalf("Unexpected expression: %s %q", constructed.GetOperator(), constructed.GetValue())
+	}
+
+	if _, err := NewQueryFromStrings([]string{"tier=?frontend"}, 0); err == nil {
+		t.Fatalf("Expected an error when querying only by an equal-or-absent expression")
+	}
+}
+
+func TestExpressionConstructors(t *testing.T) {
+	type testCase struct {
+		name        string
+		construct   func() (Expression, error)
+		parsed      string
+		expectedErr bool
+	}
+
+	testCases := []testCase{
+		{
+			name:      "equal",
+			construct: func() (Expression, error) { return NewExpressionEqual("a", "b") },
+			parsed:    "a=b",
+		}, {
+			name:      "equal with value that needs escaping",
+			construct: func() (Expression, error) { return NewExpressionEqual("a", "~?b") },
+			parsed:    "a=\\~?b",
+		}, {
+			name:      "equal with empty value",
+			construct: func() (Expression, error) { return NewExpressionEqual("a", "") },
+			parsed:    "a=",
+		}, {
+			name:      "not equal",
+			construct: func() (Expression, error) { return NewExpressionNotEqual("a", "~b") },
+			parsed:    "a!=\\~b",
+		}, {
+			name:      "match",
+			construct: func() (Expression, error) { return NewExpressionMatch("a", "b.*c") },
+			parsed:    "a=~b.*c",
+		}, {
+			name:      "match gets optimized like when parsing it",
+			construct: func() (Expression, error) { return NewExpressionMatch("a", "b.*") },
+			parsed:    "a=~b.*",
+		}, {
+			name:      "match all",
+			construct: func() (Expression, error) { return NewExpressionMatch("a", ".*") },
+			parsed:    "a=~.*",
+		}, {
+			name:      "not match",
+			construct: func() (Expression, error) { return NewExpressionNotMatch("a", "~b") },
+			parsed:    "a!=~~b",
+		}, {
+			name:      "match tag",
+			construct: func() (Expression, error) { return NewExpressionMatchTag("a.+") },
+			parsed:    "__tag=~a.+",
+		}, {
+			name:      "prefix",
+			construct: func() (Expression, error) { return NewExpressionPrefix("a", "b") },
+			parsed:    "a^=b",
+		}, {
+			name:      "not prefix",
+			construct: func() (Expression, error) { return NewExpressionNotPrefix("a", "b") },
+			parsed:    "a!^=b",
+		}, {
+			name:      "prefix tag",
+			construct: func() (Expression, error) { return NewExpressionPrefixTag("a") },
+			parsed:    "__tag^=a",
+		}, {
+			name:      "equal any",
+			construct: func() (Expression, error) { return NewExpressionEqualAny("a", []string{"c", "b"}) },
+			parsed:    "a|=b|c",
+		}, {
+			name:      "not equal any",
+			construct: func() (Expression, error) { return NewExpressionNotEqualAny("a", []string{"b", "c"}) },
+			parsed:    "a!|=c|b",
+		}, {
+			name:      "wildcard",
+			construct: func() (Expression, error) { return NewExpressionWildcard("a", "b*c") },
+			parsed:    "a*=b*c",
+		}, {
+			name:      "compare",
+			construct: func() (Expression, error) { return NewExpressionCompare("a", GREATER_EQUAL, "5") },
+			parsed:    "a>=5",
+		}, {
+			name:      "compare pseudo tag",
+			construct: func() (Expression, error) { return NewExpressionCompare("__interval__", LESS, "10s") },
+			parsed:    "__interval__<10s",
+		}, {
+			name:      "has tag",
+			construct: func() (Expression, error) { return NewExpressionHasTag("a") },
+			parsed:    "a!=",
+		}, {
+			name:      "not has tag",
+			construct: func() (Expression, error) { return NewExpressionNotHasTag("a") },
+			parsed:    "a=",
+		}, {
+			name:      "has any tag",
+			construct: func() (Expression, error) { return NewExpressionHasAnyTag([]string{"a", "b"}) },
+			parsed:    "__any_tag=a|b",
+		}, {
+			name:      "equal or absent",
+			construct: func() (Expression, error) { return NewExpressionEqualOrAbsent("a", "b") },
+			parsed:    "a=?b",
+		}, {
+			name:        "invalid key",
+			construct:   func() (Expression, error) { return NewExpressionEqual("a=b", "c") },
+			expectedErr: true,
+		}, {
+			name:        "empty key",
+			construct:   func() (Expression, error) { return NewExpressionHasTag("") },
+			expectedErr: true,
+		}, {
+			name:        "invalid pattern",
+			construct:   func() (Expression, error) { return NewExpressionMatch("a", "(b") },
+			expectedErr: true,
+		}, {
+			name:        "value with semicolon",
+			construct:   func() (Expression, error) { return NewExpressionEqual("a", "b;c") },
+			expectedErr: true,
+		}, {
+			name:        "value with surrounding whitespace",
+			construct:   func() (Expression, error) { return NewExpressionEqual("a", " b") },
+			expectedErr: true,
+		}, {
+			name:        "value of set containing separator",
+			construct:   func() (Expression, error) { return NewExpressionEqualAny("a", []string{"b|c"}) },
+			expectedErr: true,
+		}, {
+			name:        "empty value of set",
+			construct:   func() (Expression, error) { return NewExpressionEqualAny("a", []string{"b", ""}) },
+			expectedErr: true,
+		}, {
+			name:        "not a comparison operator",
+			construct:   func() (Expression, error) { return NewExpressionCompare("a", EQUAL, "5") },
+			expectedErr: true,
+		}, {
+			name:        "invalid number",
+			construct:   func() (Expression, error) { return NewExpressionCompare("a", GREATER, "b") },
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			constructed, err := tc.construct()
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("Expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			parsed, err := ParseExpression(tc.parsed)
+			if err != nil {
+				t.Fatalf("Unexpected error when parsing %q: %s", tc.parsed, err)
+			}
+
+			if !constructed.Equals(parsed) || !parsed.Equals(constructed) {
+				t.Fatalf("Expected constructed expression %v to equal parsed expression %v", (Expressions{constructed}).Strings(), (Expressions{parsed}).Strings())
+			}
+			if reflect.TypeOf(constructed) != reflect.TypeOf(parsed) {
+				t.Fatalf("Expected constructed expression to be of type %T, but it is %T", parsed, constructed)
+			}
+		})
+	}
+}
+
+func TestExpressionsEqual(t *testing.T) {
+	type testCase struct {
+		a, b  []string
+		equal bool
+	}
+
+	testCases := []testCase{
+		{a: []string{"a=b", "c=d"}, b: []string{"a=b", "c=d"}, equal: true},
+		{a: []string{"a=b", "c=d"}, b: []string{"c=d", "a=b"}, equal: true},
+		{a: []string{"a=b", "c=d", "a=b"}, b: []string{"c=d", "a=b"}, equal: true},
+		{a: []string{"a=b", "a=b", "a=b"}, b: []string{"a=b"}, equal: true},
+		{a: []string{"a=~b", "c=d"}, b: []string{"c=d", "a=~^(?:b)"}, equal: true},
+		{a: []string{"a=~^b"}, b: []string{"a=~b"}, equal: true},
+		{a: []string{"a=~.*"}, b: []string{"a=~^(.*)"}, equal: true},
+		// the whole pattern gets anchored, so the "^" only applying to the first alternative doesn't matter
+		{a: []string{"a=~^(?:b)|(?:c)"}, b: []string{"a=~b|(?:c)"}, equal: true},
+		{a: []string{"a=~(b)(c)"}, b: []string{"a=~bc"}, equal: true},
+		{a: []string{"a=~b|c"}, b: []string{"a=~b|d"}, equal: false},
+		{a: []string{"a=b", "c=d"}, b: []string{"a=b"}, equal: false},
+		{a: []string{"a=b", "c=d"}, b: []string{"a=b", "c!=d"}, equal: false},
+		{a: []string{"a=b", "c=d"}, b: []string{"a=b", "c=e"}, equal: false},
+		{a: []string{"a=b", "a=b"}, b: []string{"a=b", "c=d"}, equal: false},
+		{a: []string{"a=~b"}, b: []string{"a!=~b"}, equal: false},
+		{a: []string{}, b: []string{}, equal: true},
+	}
+
+	for _, tc := range testCases {
+		a, err := ParseExpressions(tc.a)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		b, err := ParseExpressions(tc.b)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+
+		if a.Equal(b) != tc.equal || b.Equal(a) != tc.equal {
+			t.Fatalf("Expected equality of %v and %v to be %t", tc.a, tc.b, tc.equal)
+		}
+
+		if strings.Join(a.Strings(), ";") != strings.Join(tc.a, ";") {
+			t.Fatalf("Expected Equal to not modify the expressions, got %v", a.Strings())
+		}
+	}
+}
+
+func TestExpressionsSortByCanonicalOrder(t *testing.T) {
+	for o := EQUAL; o <= EQUAL_OR_ABSENT; o++ {
+		if _, ok := canonicalOperatorRank[o]; !ok {
+			t.Fatalf("Operator %s is missing in canonicalOperatorOrder", o)
+		}
+	}
+
+	expressions, err := ParseExpressions([]string{"b!=x", "a=~c.*d", "b=y", "a=z", "a!=x", "__tag^=a"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	expressions.SortByCanonicalOrder()
+
+	expect := []string{"a=z", "b=y", "a!=x", "b!=x", "a=~c.*d", "__tag^=a"}
+	if res := expressions.Strings(); !reflect.DeepEqual(res, expect) {
+		t.Fatalf("Unexpected result of SortByCanonicalOrder, expected:\n%+v\nGot:\n%+v", expect, res)
+	}
+}
+
+func TestExpressionsNormalize(t *testing.T) {
+	raw := []string{"dc=~^(?:us-east)$", "a=~^b.*", "dc=us-east", "a=~^(?:c.*d)", "a=~c.*d", "x=~.*", "x=~^.*"}
+	expressions, err := ParseExpressions(raw)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	before := expressions.Strings()
+	normalized := expressions.Normalize()
+
+	expect := []string{"dc=us-east", "a=~c.*d", "a^=b", "x=~.*"}
+	if res := normalized.Strings(); !reflect.DeepEqual(res, expect) {
+		t.Fatalf("Unexpected result of Normalize, expected:\n%+v\nGot:\n%+v", expect, res)
+	}
+	if res := expressions.Strings(); !reflect.DeepEqual(res, before) {
+		t.Fatalf("Expected Normalize to not modify the original expressions, got:\n%+v", res)
+	}
+
+	reordered, err := ParseExpressions([]string{"a=~c.*d", "x=~.*", "a^=b", "dc=us-east"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if res := reordered.Normalize().Strings(); !reflect.DeepEqual(res, expect) {
+		t.Fatalf("Expected equivalent expressions to have the same canonical form, got:\n%+v", res)
+	}
+}
+
+func TestExpressionsHash(t *testing.T) {
+	parse := func(raw ...string) Expressions {
+		expressions, err := ParseExpressions(raw)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		return expressions
+	}
+
+	original := parse("dc=us-east", "a=~c.*d", "x=~.*", "b!=y")
+	equivalent := []Expressions{
+		parse("b!=y", "x=~.*", "a=~c.*d", "dc=us-east"),
+		parse("dc=us-east", "a=~^c.*d", "x=~^.*", "b!=y", "b!=y"),
+		parse("dc=~^(?:us-east)$", "a=~^(?:c.*d)", "x=~.*", "b!=y"),
+		parse("dc=us-east", "a=~(c).*(d)", "x=~.*", "b!=y"),
+	}
+
+	hash := original.Hash()
+	for _, expressions := range equivalent {
+		if !expressions.Equal(original) {
+			t.Fatalf("Expected %+v to be equal to %+v", expressions.Strings(), original.Strings())
+		}
+		if res := expressions.Hash(); res != hash {
+			t.Fatalf("Expected equal expressions to have the same hash:\n%s: %d\n%s: %d", original.CanonicalString(), hash, expressions.CanonicalString(), res)
+		}
+	}
+
+	// hashing doesn't modify the expressions and always returns the same value
+	before := original.Strings()
+	if original.Hash() != hash || !reflect.DeepEqual(original.Strings(), before) {
+		t.Fatalf("Expected hashing to be stable and to not modify the expressions")
+	}
+
+	// the canonical string can be parsed back into equal expressions
+	if parsed := parse(strings.Split(original.CanonicalString(), ";")...); parsed.Hash() != hash {
+		t.Fatalf("Expected the parsed canonical string %q to have the same hash", original.CanonicalString())
+	}
+}
+
+func TestExpressionIsEquivalentTo(t *testing.T) {
+	type testCase struct {
+		a, b       string
+		equivalent bool
+	}
+
+	testCases := []testCase{
+		{a: "dc=~us-.*", b: "dc=~us-.*", equivalent: true},
+		{a: "dc=~us-.*", b: "dc=~^(?:us-.*)", equivalent: true},
+		{a: "dc=~us-.*", b: "dc=~(?:us-.*)", equivalent: true},
+		{a: "dc=~us-.*", b: "dc=~(us-.*)", equivalent: true},
+		{a: "dc=~us-.*", b: "dc=~(u)(s)-.*", equivalent: true},
+		{a: "dc=~[ab]+x", b: "dc=~(?:[ab])+x", equivalent: true},
+		{a: "dc!=~us-.*", b: "dc!=~^(us-.*)", equivalent: true},
+		{a: "__tag=~d.*c", b: "__tag=~(d).*(c)", equivalent: true},
+		{a: "dc=~.*", b: "dc=~^.*", equivalent: true},
+		{a: "dc=us-east", b: "dc=us-east", equivalent: true},
+
+		// equivalent patterns, but their syntax trees differ
+		{a: "dc=~a.*|b.*", b: "dc=~[ab].*", equivalent: false},
+
+		{a: "dc=~us-.*", b: "dc=~eu-.*", equivalent: false},
+		{a: "dc=~us-.*", b: "az=~us-.*", equivalent: false},
+		{a: "dc=~us-.*", b: "dc!=~us-.*", equivalent: false},
+		{a: "dc=~us-.*", b: "__tag=~us-.*", equivalent: false},
+		{a: "dc=us-east", b: "dc!=us-east", equivalent: false},
+	}
+
+	for _, tc := range testCases {
+		a, err := ParseExpression(tc.a)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.a, err)
+		}
+		b, err := ParseExpression(tc.b)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.b, err)
+		}
+
+		if a.IsEquivalentTo(b) != tc.equivalent || b.IsEquivalentTo(a) != tc.equivalent {
+			t.Fatalf("Expected equivalence of %q and %q to be %t", tc.a, tc.b, tc.equivalent)
+		}
+
+		if !tc.equivalent {
+			continue
+		}
+
+		// equivalent expressions get merged and result in the same hash
+		if res := (Expressions{a, b}).Dedup(); len(res) != 1 || res[0] != a {
+			t.Fatalf("Expected Dedup of %q and %q to only keep the first one, got %+v", tc.a, tc.b, res.Strings())
+		}
+		if (Expressions{a}).Hash() != (Expressions{b}).Hash() {
+			t.Fatalf("Expected %q and %q to have the same hash:\n%s\n%s", tc.a, tc.b, Expressions{a}.CanonicalString(), Expressions{b}.CanonicalString())
+		}
+	}
+}
+
+func TestExpressionsHashCollisions(t *testing.T) {
+	expressions, err := ParseExpressions(wireTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	// every pair of expressions which aren't equal must have different hashes
+	seen := make(map[uint64]Expressions)
+	for i := range expressions {
+		for j := i; j < len(expressions); j++ {
+			pair := Expressions{expressions[i], expressions[j]}
+			hash := pair.Hash()
+			if other, ok := seen[hash]; ok && !other.Equal(pair) {
+				t.Fatalf("Hash collision between %+v and %+v", other.Strings(), pair.Strings())
+			}
+			seen[hash] = pair
+		}
+	}
+}
+
+func TestExpressionsSelectionHelpers(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"a=b", "c=~d.*e", "f!=~g", "__tag^=h", "__tag=~i.*j", "k*=l*", "m*=n[o", "p=q", "__tag=~[a-z]+=r"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	before := expressions.Strings()
+
+	type testCase struct {
+		name   string
+		res    Expressions
+		expect []string
+	}
+
+	testCases := []testCase{
+		{name: "ByOperator(EQUAL)", res: expressions.ByOperator(EQUAL), expect: []string{"a=b", "p=q"}},
+		{name: "ByOperator(NOT_EQUAL)", res: expressions.ByOperator(NOT_EQUAL), expect: nil},
+		{name: "WithRe", res: expressions.WithRe(), expect: []string{"c=~d.*e", "f!=~g", "__tag=~i.*j", "m*=n[o", "__tag=~[a-z]+=r"}},
+		{name: "OnTag", res: expressions.OnTag(), expect: []string{"__tag^=h", "__tag=~i.*j", "__tag=~[a-z]+=r"}},
+		{name: "Without(0)", res: expressions.Without(0), expect: before[1:]},
+		{name: "Without(last)", res: expressions.Without(len(expressions) - 1), expect: before[:len(before)-1]},
+		{name: "Without(2)", res: expressions.Without(2), expect: append(append([]string{}, before[:2]...), before[3:]...)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if res := tc.res.Strings(); !reflect.DeepEqual(res, tc.expect) && !(len(res) == 0 && len(tc.expect) == 0) {
+				t.Fatalf("Expected:\n%+v\nGot:\n%+v", tc.expect, res)
+			}
+
+			// appending to the result must not overwrite the original expressions
+			extra, _ := ParseExpression("x=y")
+			for i := 0; i < len(expressions); i++ {
+				tc.res = append(tc.res, extra)
+			}
+			if res := expressions.Strings(); !reflect.DeepEqual(res, before) {
+				t.Fatalf("Expected the original expressions to be unchanged, got:\n%+v", res)
+			}
+		})
+	}
+}
+
+func TestExpressionsInvolvedTagKeys(t *testing.T) {
+	type testCase struct {
+		expressions      []string
+		expectKeys       []string
+		involvesTagNames bool
+	}
+
+	testCases := []testCase{
+		{
+			expressions: []string{"b=c", "a!=d", "b=~e.*f", "a!^=g"},
+			expectKeys:  []string{"a", "b"},
+		}, {
+			expressions: []string{"name=~a.*b", "dc=us-east", "name!=c"},
+			expectKeys:  []string{"dc", "name"},
+		}, {
+			expressions:      []string{"a=b", "__tag=~c.*d"},
+			expectKeys:       []string{"a"},
+			involvesTagNames: true,
+		}, {
+			expressions:      []string{"a=b", "__tag^=c"},
+			expectKeys:       []string{"a"},
+			involvesTagNames: true,
+		}, {
+			expressions:      []string{"a=b", "__tag=~dc_.*:=us-east"},
+			expectKeys:       []string{"a"},
+			involvesTagNames: true,
+		}, {
+			expressions:      []string{"a=b", "__tag=~.*"},
+			expectKeys:       []string{"a"},
+			involvesTagNames: true,
+		}, {
+			expressions: []string{"a=b", "c!=", "d=", "e=~.+"},
+			expectKeys:  []string{"a", "c", "d", "e"},
+		}, {
+			expressions: []string{"a=b", "__any_tag=d|c|a"},
+			expectKeys:  []string{"a", "c", "d"},
+		}, {
+			expressions: []string{"a=b", "__lastUpdate__>=-1h", "__interval__<10s", "c>=3"},
+			expectKeys:  []string{"a", "c"},
+		}, {
+			expressions: []string{"a=b", "c=?d", "e|=f|g", "h*=i*j"},
+			expectKeys:  []string{"a", "c", "e", "h"},
+		},
+	}
+
+	for i, tc := range testCases {
+		expressions, err := ParseExpressions(tc.expressions)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected parsing error: %s", i, err)
+		}
+
+		keys, involvesTagNames := expressions.InvolvedTagKeys()
+		if !reflect.DeepEqual(keys, tc.expectKeys) {
+			t.Fatalf("TC %d: Expected keys %v, got %v", i, tc.expectKeys, keys)
+		}
+		if involvesTagNames != tc.involvesTagNames {
+			t.Fatalf("TC %d: Expected involvesTagNames to be %t, got %t", i, tc.involvesTagNames, involvesTagNames)
+		}
+	}
+}
+
+func TestExpressionsPartition(t *testing.T) {
+	type testCase struct {
+		name        string
+		expressions []string
+		initial     string
+		filters     []string
+	}
+
+	testCases := []testCase{
+		{
+			name:        "single expression",
+			expressions: []string{"a=b"},
+			initial:     "a=b",
+			filters:     []string{},
+		}, {
+			name:        "cheapest expression requiring a non-empty value",
+			expressions: []string{"c=~d.*e", "e!=f", "a=b"},
+			initial:     "a=b",
+			filters:     []string{"e!=f", "c=~d.*e"},
+		}, {
+			name:        "cheaper expressions matching the empty value become filters",
+			expressions: []string{"a=~b.*c", "c!=d", "e="},
+			initial:     "a=~b.*c",
+			filters:     []string{"c!=d", "e="},
+		}, {
+			name:        "regex matching the empty value",
+			expressions: []string{"a=~b*", "c^=d"},
+			initial:     "c^=d",
+			filters:     []string{"a=~b*"},
+		}, {
+			name:        "equal costs keep their order",
+			expressions: []string{"c=d", "a=b"},
+			initial:     "c=d",
+			filters:     []string{"a=b"},
+		}, {
+			name:        "tag key expressions",
+			expressions: []string{"__tag^=a", "b!="},
+			initial:     "b!=",
+			filters:     []string{"__tag^=a"},
+		}, {
+			name:        "no expression requires a non-empty value",
+			expressions: []string{"a!=b", "c!=~d", "e="},
+		}, {
+			name: "no expressions",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			expressions, err := ParseExpressions(tc.expressions)
+			if err != nil {
+				t.Fatalf("Unexpected parsing error: %s", err)
+			}
+			before := expressions.Strings()
+
+			initial, filters, err := expressions.Partition()
+			if len(tc.initial) == 0 {
+				if err != ErrNoInitialExpression {
+					t.Fatalf("Expected ErrNoInitialExpression, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if res := (Expressions{initial}).String(); res != tc.initial {
+				t.Fatalf("Expected initial expression %q, got %q", tc.initial, res)
+			}
+			if res := filters.Strings(); !reflect.DeepEqual(res, tc.filters) {
+				t.Fatalf("Expected filters:\n%+v\ngot:\n%+v", tc.filters, res)
+			}
+			if res := expressions.Strings(); !reflect.DeepEqual(res, before) {
+				t.Fatalf("Expected the original expressions to be unchanged, got:\n%+v", res)
+			}
+		})
+	}
+}
+
+// testEstimator estimates the cardinality of expressions by their string representation,
+// unknown expressions get the estimate 1000
+type testEstimator map[string]uint64
+
+func (e testEstimator) Estimate(key, value string, operator ExpressionOperator) uint64 {
+	builder := strings.Builder{}
+	builder.WriteString(key)
+	operator.StringIntoWriter(&builder)
+	builder.WriteString(value)
+	if estimate, ok := e[builder.String()]; ok {
+		return estimate
+	}
+	return 1000
+}
+
+func TestExpressionsPartitionWithEstimator(t *testing.T) {
+	type testCase struct {
+		name        string
+		expressions []string
+		estimator   CardinalityEstimator
+		initial     string
+	}
+
+	estimator := testEstimator{"dc=us-east": 5000000, "host=web-0042": 50, "a=~b.*c": 1}
+
+	testCases := []testCase{
+		{
+			name:        "without estimator the longest value of the same cost is used",
+			expressions: []string{"dc=us-east", "host=web-0042"},
+			initial:     "host=web-0042",
+		}, {
+			name:        "the estimate takes precedence over the name",
+			expressions: []string{"name^=cpu", "dc^=us-east"},
+			estimator:   testEstimator{"name^=cpu": 100, "dc^=us-east": 5},
+			initial:     "dc^=us-east",
+		}, {
+			name:        "equal estimates prefer the name",
+			expressions: []string{"dc^=us-east", "name^=cpu"},
+			estimator:   estimator,
+			initial:     "name^=cpu",
+		}, {
+			name:        "lowest estimate of the same cost",
+			expressions: []string{"dc=us-east", "host=web-0042", "c=d"},
+			estimator:   estimator,
+			initial:     "host=web-0042",
+		}, {
+			name:        "equal estimates keep the order",
+			expressions: []string{"c=d", "e=f"},
+			estimator:   estimator,
+			initial:     "c=d",
+		}, {
+			name:        "more expensive expressions don't get considered",
+			expressions: []string{"dc=us-east", "a=~b.*c"},
+			estimator:   estimator,
+			initial:     "dc=us-east",
+		}, {
+			name:        "expressions matching the empty value don't get considered",
+			expressions: []string{"dc=us-east", "host!=web-0042"},
+			estimator:   testEstimator{"dc=us-east": 5000000, "host!=web-0042": 1},
+			initial:     "dc=us-east",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			expressions, err := ParseExpressions(tc.expressions)
+			if err != nil {
+				t.Fatalf("Unexpected parsing error: %s", err)
+			}
+
+			initial, filters, err := expressions.PartitionWithEstimator(tc.estimator)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if res := (Expressions{initial}).String(); res != tc.initial {
+				t.Fatalf("Expected initial expression %q, got %q", tc.initial, res)
+			}
+			if len(filters) != len(expressions)-1 {
+				t.Fatalf("Expected all other expressions to be filters, got %+v", filters.Strings())
+			}
+		})
+	}
+
+	if _, _, err := (Expressions{}).PartitionWithEstimator(estimator); err != ErrNoInitialExpression {
+		t.Fatalf("Expected ErrNoInitialExpression, got %v", err)
+	}
+}
+
+// sortByFilterOrderTestExpressions contains expressions of all operator costs,
+// including several ones with the same operator cost
+var sortByFilterOrderTestExpressions = []string{"a=~.*", "host!=web-1", "dc=us-east", "key*=val*", "a|=b|c", "name=~met.*ric", "x!=~[0-9]+", "__tag^=ab", "host=web-0042", "b=", "c!=", "__lastts>100", "d!^=e", "e^=f", "f=?g", "z<5", "__tag=~a.*b", "a!=~.*", "g!|=h|i", "__any_tag=k|l", "c=~d[0-9]+e"}
+
+func TestExpressionsSortByFilterOrder(t *testing.T) {
+	// the order in which the filters get evaluated must not change by accident
+	expected := []string{
+		"a!=~.*",
+		"dc=us-east", "host=web-0042",
+		"host!=web-1", "a|=b|c", "f=?g",
+		"key^=val", "d!^=e", "e^=f", "g!|=h|i",
+		"__lastts>100", "z<5",
+		"name=~met.*ric", "c=~d[0-9]+e", "x!=~[0-9]+", "b=", "c!=",
+		"__any_tag=k|l",
+		"__tag^=ab",
+		"__tag=~a.*b",
+		"a=~.*",
+	}
+
+	expressions, err := ParseExpressions(sortByFilterOrderTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	withoutEstimator := expressions.Clone()
+
+	expressions.SortByFilterOrder()
+	if res := expressions.Strings(); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Expected order:\n%v\ngot:\n%v", expected, res)
+	}
+
+	// without estimator the order is exactly the same
+	withoutEstimator.SortByFilterOrderWithEstimator(nil)
+	if res := withoutEstimator.Strings(); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Expected the same order without estimator:\n%v\ngot:\n%v", expected, res)
+	}
+}
+
+func TestExpressionsSortByFilterOrderMatchNoneFirst(t *testing.T) {
+	// once the MATCH_NONE expression failed a metric no other expression needs to be evaluated
+	estimator := testEstimator{"a=b": 1, "c!=~.*": 1000}
+	for _, sortFunc := range []func(Expressions){
+		Expressions.SortByFilterOrder,
+		func(e Expressions) { e.SortByFilterOrderWithEstimator(estimator) },
+	} {
+		expressions, err := ParseExpressions([]string{"name=abc", "a=b", "c!=~.*", "d=~e.*f"})
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		sortFunc(expressions)
+		if res := expressions.Strings()[0]; res != "c!=~.*" {
+			t.Fatalf("Expected the MATCH_NONE expression to come first, got %v", expressions.Strings())
+		}
+	}
+}
+
+func TestExpressionsSortByFilterOrderWithEstimator(t *testing.T) {
+	estimator := testEstimator{"dc=us-east": 5000000, "host=web-0042": 50, "g!|=h|i": 1, "x!=~[0-9]+": 1, "c=~d[0-9]+e": 2}
+
+	// within the same operator cost the lowest estimate comes first, then the lowest cost,
+	// the expressions with the same estimate and cost keep their order
+	expected := []string{
+		"a!=~.*",
+		"host=web-0042", "dc=us-east",
+		"host!=web-1", "a|=b|c", "f=?g",
+		"g!|=h|i", "key^=val", "d!^=e", "e^=f",
+		"__lastts>100", "z<5",
+		"x!=~[0-9]+", "c=~d[0-9]+e", "name=~met.*ric", "b=", "c!=",
+		"__any_tag=k|l",
+		"__tag^=ab",
+		"__tag=~a.*b",
+		"a=~.*",
+	}
+
+	expressions, err := ParseExpressions(sortByFilterOrderTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	expressions.SortByFilterOrderWithEstimator(estimator)
+	if res := expressions.Strings(); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Expected order:\n%v\ngot:\n%v", expected, res)
+	}
+
+	// an estimator which doesn't distinguish the expressions doesn't change the order
+	expressions, err = ParseExpressions(sortByFilterOrderTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	sorted := expressions.Clone()
+	sorted.SortByFilterOrder()
+	expressions.SortByFilterOrderWithEstimator(testEstimator{})
+	if res, expected := expressions.Strings(), sorted.Strings(); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Expected the order of SortByFilterOrder with equal estimates:\n%v\ngot:\n%v", expected, res)
+	}
+}
+
+func TestExpressionsPartitionInitialExpression(t *testing.T) {
+	type testCase struct {
+		expressions []string
+		initial     string
+	}
+
+	testCases := []testCase{
+		// an EQUAL on the name is cheaper than the other EQUALs
+		{expressions: []string{"dc=us-east", "name=cpu.total"}, initial: "name=cpu.total"},
+		{expressions: []string{"datacenter=us-east-1", "name=cpu"}, initial: "name=cpu"},
+		// for the other operators the name wins among the same cost, even if its value is shorter
+		{expressions: []string{"datacenter^=us-east-1", "name^=cpu"}, initial: "name^=cpu"},
+		{expressions: []string{"a|=b|c", "name|=d|e"}, initial: "name|=d|e"},
+		{expressions: []string{"name=a", "name=abc"}, initial: "name=abc"},
+		{expressions: []string{"dc=us-east", "host=web-0042", "env=prod"}, initial: "host=web-0042"},
+		// equal lengths keep the order
+		{expressions: []string{"a=bc", "x=yz"}, initial: "a=bc"},
+		{expressions: []string{"x=yz", "a=bc"}, initial: "x=yz"},
+		// the rules only apply within the same cost, the EQUAL is cheaper than the PREFIX
+		{expressions: []string{"name^=cpu.total", "dc=us-east"}, initial: "dc=us-east"},
+		{expressions: []string{"a^=b", "c^=def"}, initial: "c^=def"},
+		{expressions: []string{"a^=bcd", "name^=c"}, initial: "name^=c"},
+		// regex patterns aren't literals, so the length of the pattern doesn't count
+		{expressions: []string{"a=~b[0-9]", "c=~d[0-9]"}, initial: "a=~b[0-9]"},
+		// expressions which match the empty value can't be the initial expression
+		{expressions: []string{"name!=cpu", "dc=us-east"}, initial: "dc=us-east"},
+	}
+
+	for i, tc := range testCases {
+		expressions, err := ParseExpressions(tc.expressions)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected parsing error: %s", i, err)
+		}
+
+		initial, filters, err := expressions.Partition()
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error: %s", i, err)
+		}
+		if res := (Expressions{initial}).String(); res != tc.initial {
+			t.Fatalf("TC %d: Expected initial expression %q of %v, got %q", i, tc.initial, tc.expressions, res)
+		}
+		if len(filters) != len(expressions)-1 {
+			t.Fatalf("TC %d: Expected all other expressions to be filters, got %+v", i, filters.Strings())
+		}
+	}
+}
+
+func TestExpressionsPartitionOrdered(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"c!=d", "e=~f.*", "a=b"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	// the order of the given expressions decides, not their cost
+	initial, filters, err := expressions.PartitionOrdered()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if initial != expressions[1] {
+		t.Fatalf("Expected the initial expression to be %q, got %q", expressions.Strings()[1], Expressions{initial}.String())
+	}
+	if res := filters.Strings(); !reflect.DeepEqual(res, []string{"c!=d", "a=b"}) {
+		t.Fatalf("Unexpected filters: %+v", res)
+	}
+
+	if _, _, err := expressions[:1].PartitionOrdered(); err != ErrNoInitialExpression {
+		t.Fatalf("Expected ErrNoInitialExpression, got %v", err)
+	}
+}
+
+func TestExpressionGetMetaRecordFilter(t *testing.T) {
+	type testCase struct {
+		expression string
+		metaTags   []string
+		expect     FilterDecision
+	}
+
+	testCases := []testCase{
+		{expression: "a=b", metaTags: []string{"a=b"}, expect: Pass},
+		{expression: "a=b", metaTags: []string{"a=c"}, expect: Fail},
+		{expression: "a=b", metaTags: []string{"c=b"}, expect: None},
+		{expression: "a=b", metaTags: nil, expect: None},
+		{expression: "a!=b", metaTags: []string{"a=c"}, expect: Pass},
+		{expression: "a!=b", metaTags: []string{"a=b"}, expect: Fail},
+		{expression: "a=~b.*", metaTags: []string{"a=c", "a=bb"}, expect: Pass},
+		{expression: "a=~b.*", metaTags: []string{"a=c", "d=bb"}, expect: Fail},
+		{expression: "a>5", metaTags: []string{"a=6"}, expect: Pass},
+		{expression: "a|=b|c", metaTags: []string{"a=c"}, expect: Pass},
+		{expression: "a!=", metaTags: []string{"a=c"}, expect: Pass},
+		{expression: "a!=", metaTags: []string{"b=c"}, expect: Fail},
+		{expression: "a=", metaTags: []string{"a=c"}, expect: Fail},
+		{expression: "a=", metaTags: []string{"b=c"}, expect: Pass},
+		{expression: "__tag^=a", metaTags: []string{"b=c", "ab=c"}, expect: Pass},
+		{expression: "__tag^=a", metaTags: []string{"b=c"}, expect: Fail},
+		{expression: "__tag^=a", metaTags: nil, expect: None},
+		{expression: "__tag=~dc_.*:=us-east", metaTags: []string{"dc_1=us-east"}, expect: Pass},
+		{expression: "__tag=~dc_.*:=us-east", metaTags: []string{"dc_1=us-west"}, expect: Fail},
+		{expression: "__lastUpdate__>5", metaTags: []string{"__lastUpdate__=10"}, expect: None},
+
+		// meta records can't assign the name of a metric, so the key "name" never matches
+		{expression: "name=b", metaTags: []string{"name=b"}, expect: None},
+		{expression: "name=~b.*", metaTags: []string{"name=b"}, expect: None},
+		{expression: "name!=b", metaTags: []string{"a=b"}, expect: None},
+		{expression: "__tag=name", metaTags: []string{"name=b"}, expect: None},
+		{expression: "__tag^=na", metaTags: []string{"name=b", "a=b"}, expect: Fail},
+		{expression: "__tag=~n.*:=b", metaTags: []string{"name=b"}, expect: None},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expression, func(t *testing.T) {
+			e, err := ParseExpression(tc.expression)
+			if err != nil {
+				t.Fatalf("Unexpected parsing error: %s", err)
+			}
+			metaTags, err := ParseTags(tc.metaTags)
+			if err != nil {
+				t.Fatalf("Unexpected error when parsing the meta tags: %s", err)
+			}
+			if res := e.GetMetaRecordFilter()(metaTags); res != tc.expect {
+				t.Fatalf("Expected decision %s for meta tags %+v, got %s", tc.expect, tc.metaTags, res)
+			}
+		})
+	}
+}
+
+func TestExpressionLiteralAlternatives(t *testing.T) {
+	type testCase struct {
+		expression string
+		expect     []string
+	}
+
+	testCases := []testCase{
+		{expression: "host=~(a01|a02|a03)$", expect: []string{"a01", "a02", "a03"}},
+		{expression: "host=~^(?:a01|a02)$", expect: []string{"a01", "a02"}},
+		{expression: "host=~a01$|a02$", expect: []string{"a01", "a02"}},
+		{expression: "host=~(a01$|(a02)$)", expect: []string{"a01", "a02"}},
+		{expression: "host=~(a\\.01|a\\|02|a\\(03)$", expect: []string{"a.01", "a|02", "a(03"}},
+		{expression: "host=~(a01|a01|a02)$", expect: []string{"a01", "a02"}},
+
+		// classes with a single character are literals, and a "|" inside them doesn't separate alternatives
+		{expression: "host=~(a01|a0[2]|a0[|])$", expect: []string{"a01", "a02", "a0|"}},
+		{expression: "host|=a01|a02", expect: []string{"a01", "a02"}},
+
+		// without the anchoring at the end the values may have any suffix
+		{expression: "host=~(a01|a02)", expect: nil},
+		{expression: "host=~a01|a02$", expect: nil},
+		{expression: "host=~(a01|a02)|a03$", expect: nil},
+
+		// quantifiers, classes, flags and empty alternatives can't be reduced to literals
+		{expression: "host=~(a01|a0+)$", expect: nil},
+		{expression: "host=~(a01|a0[23])$", expect: nil},
+		{expression: "host=~(a01|a0.)$", expect: nil},
+		{expression: "host=~(?i)(a01|a02)$", expect: nil},
+		{expression: "host=~(?i:a01|a02)$", expect: nil},
+		{expression: "host=~(a01||a02)$", expect: nil},
+		{expression: "host=~(a01|a02)$x", expect: nil},
+		{expression: "host!=~(a01|a02)$", expect: nil},
+		{expression: "host=a01", expect: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expression, func(t *testing.T) {
+			e, err := ParseExpression(tc.expression)
+			if err != nil {
+				t.Fatalf("Unexpected parsing error: %s", err)
+			}
+
+			alternativesExpr, ok := e.(LiteralAlternativesExpression)
+			var res []string
+			if ok {
+				res, ok = alternativesExpr.LiteralAlternatives()
+			}
+			if ok != (tc.expect != nil) || !reflect.DeepEqual(res, tc.expect) {
+				t.Fatalf("Expected literal alternatives %+v, got %+v (ok: %t)", tc.expect, res, ok)
+			}
+
+			// the literals must be exactly the values which satisfy the expression
+			for _, value := range res {
+				if !e.Matches(value) {
+					t.Fatalf("Expected %q to match %q", tc.expression, value)
+				}
+				if e.Matches(value+"x") || e.Matches("x"+value) {
+					t.Fatalf("Expected %q to only match the literal %q", tc.expression, value)
+				}
+			}
+		})
+	}
+}
+
+func TestExpressionsClone(t *testing.T) {
+	expressions, err := ParseExpressions(wireTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	clone := expressions.Clone()
+	if !clone.Equal(expressions) {
+		t.Fatalf("Expected clone to equal the original, got:\n%+v", clone.Strings())
+	}
+
+	for i := range expressions {
+		if clone[i] == expressions[i] {
+			t.Fatalf("Expected clone of %q to be a new expression", expressions.Strings()[i])
+		}
+		if reflect.TypeOf(clone[i]) != reflect.TypeOf(expressions[i]) {
+			t.Fatalf("Expected clone to be of type %T, but it is %T", expressions[i], clone[i])
+		}
+		if !reflect.DeepEqual(clone[i], expressions[i]) {
+			t.Fatalf("Expected clone of %q to have the same properties", expressions.Strings()[i])
+		}
+	}
+
+	if (Expressions(nil)).Clone() != nil {
+		t.Fatalf("Expected clone of nil to be nil")
+	}
+}
+
+func TestExpressionCloneDoesNotShareMatchCache(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"dc=~us-.*1", "dc!=~us-.*1", "__tag=~d.*c"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	for i, expression := range expressions {
+		original := expression.(interface{ getMatchCache() *matchCache })
+		clone := expression.Clone().(interface{ getMatchCache() *matchCache })
+		if original.getMatchCache() == clone.getMatchCache() {
+			t.Fatalf("Expected the clone of %q to have its own match cache", expressions.Strings()[i])
+		}
+		if cache := original.getMatchCache(); cache != original.getMatchCache() {
+			t.Fatalf("Expected %q to reuse its match cache", expressions.Strings()[i])
+		}
+	}
+}
+
+// the clones of shared expressions get modified concurrently, this test is
+// meant to be run with the race detector
+func TestExpressionsCloneConcurrentSort(t *testing.T) {
+	shared, err := ParseExpressions([]string{"dc=~us-.*", "host!=~web[0-9]", "a|=b|c", "__tag=~dc_.*:=us-east", "service=api"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	expected := shared.Strings()
+	lookup := func(_ schema.MKey, _, _ string) bool { return false }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				clone := shared.Clone()
+				name, err := NewExpressionEqual("name", fmt.Sprintf("metric%d", i))
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+				clone = append(clone, name)
+				if j%2 == 0 {
+					clone.Sort()
+				} else {
+					clone.SortByCanonicalOrder()
+				}
+				for _, expression := range clone {
+					expression.GetMetricDefinitionFilter(lookup)(schema.MKey{}, "metric", []string{"dc=us-east-1", "host=web1"})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if res := shared.Strings(); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Expected the shared expressions to be unchanged, got:\n%+v", res)
+	}
+}
+
+func TestExpressionGetCost(t *testing.T) {
+	expressions, err := ParseExpressions(append(wireTestExpressions, "name=a", "a=~abcdefgh.*[0-9]", "a=~(a|b|c)+[0-9]*x?", "__tag=a", "a!=~b"))
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	// the cost must never change the order of expressions with different operator costs
+	for _, a := range expressions {
+		for _, b := range expressions {
+			if a.GetOperatorCost() < b.GetOperatorCost() && a.GetCost() >= b.GetCost() {
+				strs := Expressions{a, b}.Strings()
+				t.Fatalf("Expected cost of %q (%d) to be lower than cost of %q (%d)", strs[0], a.GetCost(), strs[1], b.GetCost())
+			}
+		}
+	}
+
+	type testCase struct {
+		cheaper, expensive string
+	}
+
+	testCases := []testCase{
+		{cheaper: "name=a", expensive: "a=b"},
+		{cheaper: "a=~abcdefgh.*[0-9]", expensive: "a=~(a|b|c)+[0-9]*x?"},
+		{cheaper: "a=~ab[0-9]", expensive: "a=~[0-9]ab"},
+		{cheaper: "a!=~abc[0-9]", expensive: "a!=~(abc|d)+"},
+		{cheaper: "a=~b.*c", expensive: "a!="},
+	}
+
+	for _, tc := range testCases {
+		parsed, err := ParseExpressions([]string{tc.cheaper, tc.expensive})
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		if parsed[0].GetCost() >= parsed[1].GetCost() {
+			t.Fatalf("Expected cost of %q (%d) to be lower than cost of %q (%d)", tc.cheaper, parsed[0].GetCost(), tc.expensive, parsed[1].GetCost())
+		}
+	}
+}
+
+func TestFilterDecisionString(t *testing.T) {
+	for decision, expected := range map[FilterDecision]string{None: "none", Fail: "fail", Pass: "pass", FilterDecision(7): "FilterDecision(7)"} {
+		if decision.String() != expected {
+			t.Fatalf("Expected %q, got %q", expected, decision.String())
+		}
+	}
+}
+
+func TestFilterDecisionCombinators(t *testing.T) {
+	type testCase struct {
+		a, b    FilterDecision
+		and, or FilterDecision
+	}
+
+	testCases := []testCase{
+		{a: None, b: None, and: None, or: None},
+		{a: None, b: Fail, and: Fail, or: None},
+		{a: None, b: Pass, and: None, or: Pass},
+		{a: Fail, b: None, and: Fail, or: None},
+		{a: Fail, b: Fail, and: Fail, or: Fail},
+		{a: Fail, b: Pass, and: Fail, or: Pass},
+		{a: Pass, b: None, and: None, or: Pass},
+		{a: Pass, b: Fail, and: Fail, or: Pass},
+		{a: Pass, b: Pass, and: Pass, or: Pass},
+	}
+
+	for _, tc := range testCases {
+		if res := CombineAnd(tc.a, tc.b); res != tc.and {
+			t.Fatalf("Expected CombineAnd(%s, %s) to be %s, got %s", tc.a, tc.b, tc.and, res)
+		}
+		if res := CombineOr(tc.a, tc.b); res != tc.or {
+			t.Fatalf("Expected CombineOr(%s, %s) to be %s, got %s", tc.a, tc.b, tc.or, res)
+		}
+	}
+}
+
+func TestDecideWithDefaults(t *testing.T) {
+	type testCase struct {
+		decisions []FilterDecision
+		defaults  []FilterDecision
+		expect    FilterDecision
+	}
+
+	testCases := []testCase{
+		{decisions: nil, defaults: nil, expect: Pass},
+		{decisions: []FilterDecision{None}, defaults: nil, expect: None},
+		{decisions: []FilterDecision{None}, defaults: []FilterDecision{Pass}, expect: Pass},
+		{decisions: []FilterDecision{None}, defaults: []FilterDecision{Fail}, expect: Fail},
+		{decisions: []FilterDecision{Pass, None}, defaults: []FilterDecision{Pass, Fail}, expect: Fail},
+		{decisions: []FilterDecision{None, Pass}, defaults: []FilterDecision{Fail, Pass}, expect: Fail},
+		{decisions: []FilterDecision{None, None}, defaults: []FilterDecision{Pass, Fail}, expect: Fail},
+		{decisions: []FilterDecision{None, None}, defaults: []FilterDecision{Pass, Pass}, expect: Pass},
+		{decisions: []FilterDecision{Fail, Pass}, defaults: []FilterDecision{Pass, Pass}, expect: Fail},
+		{decisions: []FilterDecision{Pass, None}, defaults: []FilterDecision{Fail, None}, expect: None},
+		{decisions: []FilterDecision{None, Fail}, defaults: nil, expect: Fail},
+	}
+
+	for i, tc := range testCases {
+		if res := DecideWithDefaults(tc.decisions, tc.defaults); res != tc.expect {
+			t.Fatalf("TC %d: Expected DecideWithDefaults(%v, %v) to be %s, got %s", i, tc.decisions, tc.defaults, tc.expect, res)
+		}
+	}
+}
+
+// decisionCombinations returns all lists of the given length of which each entry is one of the decisions
+func decisionCombinations(length int) [][]FilterDecision {
+	res := [][]FilterDecision{nil}
+	for i := 0; i < length; i++ {
+		var next [][]FilterDecision
+		for _, combination := range res {
+			for _, decision := range []FilterDecision{None, Fail, Pass} {
+				next = append(next, append(append([]FilterDecision{}, combination...), decision))
+			}
+		}
+		res = next
+	}
+	return res
+}
+
+// DecideWithDefaults, FilterBatch and the combined filter must all apply the defaults to each
+// decision before combining them like CombineAnd does, for every combination of decisions
+func TestDecideWithDefaultsExhaustive(t *testing.T) {
+	for length := 0; length <= 3; length++ {
+		for _, decisions := range decisionCombinations(length) {
+			for _, defaults := range append(decisionCombinations(length), nil) {
+				expect := Pass
+				for i, decision := range decisions {
+					if decision == None && defaults != nil {
+						decision = defaults[i]
+					}
+					expect = CombineAnd(expect, decision)
+				}
+
+				if res := DecideWithDefaults(decisions, defaults); res != expect {
+					t.Fatalf("Expected DecideWithDefaults(%v, %v) to be %s, got %s", decisions, defaults, expect, res)
+				}
+
+				evaluated := 0
+				filters := make(MetricDefinitionFilters, len(decisions))
+				for i := range decisions {
+					decision := decisions[i]
+					filters[i] = func(_ schema.MKey, _ string, _ []string) FilterDecision {
+						evaluated++
+						return decision
+					}
+				}
+
+				res, err := filters.FilterBatch(context.Background(), []MetricDefinitionLike{{}}, defaults)
+				if err != nil || res[0] != expect {
+					t.Fatalf("Expected FilterBatch with decisions %v and defaults %v to decide %s, got %v (error: %v)", decisions, defaults, expect, res, err)
+				}
+
+				if defaults == nil {
+					continue
+				}
+
+				// the combined filter doesn't evaluate the filters after the first one that fails,
+				// either by itself or by its default
+				expectEvaluated := len(decisions)
+				for i := range decisions {
+					if decisions[i] == Fail || (decisions[i] == None && defaults[i] == Fail) {
+						expectEvaluated = i + 1
+						break
+					}
+				}
+				evaluated = 0
+				if res := filterAndDecideWithDefaults(filters, defaults)(schema.MKey{}, "", nil); res != expect || evaluated != expectEvaluated {
+					t.Fatalf("Expected the combined filter with decisions %v and defaults %v to decide %s after %d filters, got %s after %d", decisions, defaults, expect, expectEvaluated, res, evaluated)
+				}
+			}
+		}
+	}
+}
+
+// the filters returned by GetMetricDefinitionTagsFilter must make the
+// same decisions as the ones returned by GetMetricDefinitionFilter
+func TestMetricDefinitionTagsFilterMatchesMetricDefinitionFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	raw := append(wireTestExpressions, "name=a.b", "name!=a.b", "name=~a.*", "name!=~a.*", "name^=a", "a=~.*b", "__tag=~.*", "__tag^=n", "a=~b.*", "a=~b.*")
+	tagSets := [][]string{
+		nil,
+		{"a=b"},
+		{"a=bc", "b=c"},
+		{"a=c", "b=b"},
+		{"a=6"},
+		{"a=4", "dc_1=us-east"},
+		{"b=a", "ab=b"},
+		{"a="},
+		{"a=b=c"},
+	}
+
+	for _, metaTagSupport := range []bool{false, true} {
+		MetaTagSupport = metaTagSupport
+
+		expressions, err := ParseExpressions(raw)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+
+		for _, tags := range tagSets {
+			lookup := func(_ schema.MKey, tag, value string) bool {
+				for _, t := range tags {
+					if t == tag+"="+value {
+						return true
+					}
+				}
+				return false
+			}
+
+			for _, expression := range expressions {
+				// regex filters cache their results, so each filter gets called twice
+				filter := expression.GetMetricDefinitionFilter(lookup)
+				tagsFilter := expression.GetMetricDefinitionTagsFilter(lookup)
+				for i := 0; i < 2; i++ {
+					expected := filter(schema.MKey{}, "a.b", tags)
+					if res := tagsFilter(schema.MKey{}, "a.b", SplitTags(tags)); res != expected {
+						t.Fatalf("MetaTagSupport %t, expression %q, tags %v: Expected decision %s, got %s", metaTagSupport, Expressions{expression}.Strings()[0], tags, expected, res)
+					}
+				}
+			}
+		}
+	}
+}
+
+// MatchesTags must make the same decisions as the filters returned by GetMetricDefinitionFilter
+func TestMatchesTagsMatchesMetricDefinitionFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	raw := append(wireTestExpressions, "name=a.b", "name!=a.b", "name=~a.*", "name!=~a.*", "name^=a", "name!^=b", "name|=a.b|b", "name>5", "name!=", "__tag^=na", "__tag=~dc.*", "a!=~b.*c")
+	keys := []string{"a", "b", "ab", "dc_1", "dc_2"}
+	values := []string{"b", "bc", "c", "4", "5", "6", "a.b", "us-east"}
+	names := []string{"a.b", "b.c", "5", "6"}
+
+	random := rand.New(rand.NewSource(1))
+	for _, metaTagSupport := range []bool{false, true} {
+		MetaTagSupport = metaTagSupport
+
+		expressions, err := ParseExpressions(raw)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+
+		for i := 0; i < 1000; i++ {
+			tagMap := map[string]string{"name": names[random.Intn(len(names))]}
+			var tags []string
+			for _, key := range keys {
+				if random.Intn(2) == 0 {
+					continue
+				}
+				tagMap[key] = values[random.Intn(len(values))]
+				tags = append(tags, key+"="+tagMap[key])
+			}
+
+			lookup := func(_ schema.MKey, tag, value string) bool {
+				v, ok := tagMap[tag]
+				return ok && v == value
+			}
+
+			expected := Pass
+			for _, expression := range expressions {
+				decision := expression.GetMetricDefinitionFilter(lookup)(schema.MKey{}, tagMap["name"], tags)
+				if res := expression.MatchesTags(tagMap); res != decision {
+					t.Fatalf("MetaTagSupport %t, expression %q, tags %v: Expected decision %s, got %s", metaTagSupport, Expressions{expression}.Strings()[0], tagMap, decision, res)
+				}
+				expected = CombineAnd(expected, decision)
+			}
+
+			if res := expressions.MatchesTags(tagMap); res != expected {
+				t.Fatalf("MetaTagSupport %t, tags %v: Expected combined decision %s, got %s", metaTagSupport, tagMap, expected, res)
+			}
+		}
+	}
+}
+
+func TestExpressionsGetMetricDefinitionFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = true
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	// with meta tag support the first two expressions return None for metrics
+	// which don't have their tags, so their default decisions apply
+	expressions, err := ParseExpressions([]string{"a!=x", "b=y", "__interval__>5"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	var tags []string
+	lookup := func(_ schema.MKey, tag, value string) bool {
+		for _, t := range tags {
+			if t == tag+"="+value {
+				return true
+			}
+		}
+		return false
+	}
+	propertyLookup := func(_ schema.MKey) (int64, int, bool) { return 200, 10, true }
+
+	filters, defaultDecisions := expressions.GetMetricDefinitionFilters(lookup, propertyLookup)
+	if len(filters) != 3 || !reflect.DeepEqual(defaultDecisions, []FilterDecision{Pass, Fail, Fail}) {
+		t.Fatalf("Unexpected filters or default decisions: %d %v", len(filters), defaultDecisions)
+	}
+
+	type testCase struct {
+		tags                  []string
+		expected              FilterDecision
+		expectedWithoutLookup FilterDecision
+	}
+
+	testCases := []testCase{
+		{tags: []string{"b=y"}, expected: Pass, expectedWithoutLookup: Fail},
+		{tags: []string{"b=z"}, expected: Fail, expectedWithoutLookup: Fail},
+		{tags: []string{"a=x", "b=y"}, expected: Fail, expectedWithoutLookup: Fail},
+		{tags: []string{"a=z"}, expected: Fail, expectedWithoutLookup: Fail},
+	}
+
+	filter := expressions.GetMetricDefinitionFilter(lookup, propertyLookup)
+	filterWithoutPropertyLookup := expressions.GetMetricDefinitionFilter(lookup, nil)
+	for i, tc := range testCases {
+		tags = tc.tags
+		if res := filter(schema.MKey{}, "metric", tags); res != tc.expected {
+			t.Fatalf("TC %d: Expected decision %s, got %s", i, tc.expected, res)
+		}
+
+		// without property lookup the pseudo tag expression returns None, so its default decision applies
+		if res := filterWithoutPropertyLookup(schema.MKey{}, "metric", tags); res != tc.expectedWithoutLookup {
+			t.Fatalf("TC %d: Expected decision %s without property lookup, got %s", i, tc.expectedWithoutLookup, res)
+		}
+	}
+}
+
+func TestSortedTagsOfKey(t *testing.T) {
+	tags := []string{"a-b=1", "a.b=2", "a=1", "a=2", "ab=3", "b=", "b=4", "c=5"}
+	if !sort.StringsAreSorted(tags) {
+		t.Fatalf("Test tags are not sorted: %v", tags)
+	}
+
+	type testCase struct {
+		key      string
+		expected []string
+	}
+
+	testCases := []testCase{
+		{key: "a", expected: []string{"a=1", "a=2"}},
+		{key: "a-b", expected: []string{"a-b=1"}},
+		{key: "a.b", expected: []string{"a.b=2"}},
+		{key: "ab", expected: []string{"ab=3"}},
+		{key: "b", expected: []string{"b=", "b=4"}},
+		{key: "c", expected: []string{"c=5"}},
+		{key: "0", expected: []string{}},
+		{key: "a-", expected: []string{}},
+		{key: "bb", expected: []string{}},
+		{key: "d", expected: []string{}},
+	}
+
+	for i, tc := range testCases {
+		if res := sortedTagsOfKey(tags, tc.key); !reflect.DeepEqual(res, tc.expected) {
+			t.Fatalf("TC %d: Expected tags %v of key %q, got %v", i, tc.expected, tc.key, res)
+		}
+	}
+
+	if res := sortedTagsOfKey(nil, "a"); len(res) != 0 {
+		t.Fatalf("Expected no tags without input, got %v", res)
+	}
+}
+
+func testGetMetricDefinitionFiltersForSortedTags(t *testing.T) {
+	expressions, err := ParseExpressions(append(wireTestExpressions, "a=~.*[0-9]", "b!=~.*[0-9]", "b=", "b!=", "ab=3", "name=~met.*"))
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	// with a MATCH_NONE expression only its filter would be returned
+	expressions = expressions.filter(func(expression Expression) bool {
+		return expression.GetOperator() != MATCH_NONE
+	})
+
+	metrics := [][]string{
+		{},
+		{"a=b"},
+		{"a-b=1", "a=b"},
+		{"a=bc", "a.b=c", "b=1"},
+		{"a=5", "ab=3", "b=x"},
+		{"aa=b", "b=", "c=d"},
+		{"a=1", "a=6", "z=z"},
+		{"0=a", "a=b1c"},
+	}
+
+	var tags []string
+	lookup := func(_ schema.MKey, tag, value string) bool {
+		for _, t := range tags {
+			if t == tag+"="+value {
+				return true
+			}
+		}
+		return false
+	}
+
+	filters, _ := expressions.GetMetricDefinitionFilters(lookup, nil)
+	sortedTagsFilters, _ := expressions.GetMetricDefinitionFiltersForSortedTags(lookup, nil, nil)
+	random := rand.New(rand.NewSource(1))
+	for i := range metrics {
+		tags = metrics[i]
+		sort.Strings(tags)
+
+		// the filters which don't rely on the tags being sorted must come to the same decisions
+		// when the tags are in a different order
+		unsortedTags := make([]string, len(tags))
+		for j, k := range random.Perm(len(tags)) {
+			unsortedTags[j] = tags[k]
+		}
+
+		for j := range expressions {
+			expected := filters[j](schema.MKey{}, "metric", tags)
+			if res := sortedTagsFilters[j](schema.MKey{}, "metric", tags); res != expected {
+				t.Fatalf("Metric %d: Expected decision %s of expression %s for sorted tags %v, got %s", i, expected, expressions[j], tags, res)
+			}
+			if res := filters[j](schema.MKey{}, "metric", unsortedTags); res != expected {
+				t.Fatalf("Metric %d: Expected decision %s of expression %s for unsorted tags %v, got %s", i, expected, expressions[j], unsortedTags, res)
+			}
+		}
+	}
+}
+
+func TestGetMetricDefinitionFiltersForSortedTagsWithMetaTagSupport(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = true
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	testGetMetricDefinitionFiltersForSortedTags(t)
+}
+
+func TestGetMetricDefinitionFiltersForSortedTagsWithoutMetaTagSupport(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	testGetMetricDefinitionFiltersForSortedTags(t)
+}
+
+func TestExpressionFilterValues(t *testing.T) {
+	expressions, err := ParseExpressions(append(wireTestExpressions, "a|=b|c|d|e|f|g|h|i|j", "a=~[0-9]", "__tag=~[ab]", "__tag^=b"))
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	values := map[string]struct{}{}
+	for _, value := range []string{"a", "b", "bc", "cb", "c", "4", "5", "6", "101", "a.b", "", "b*c", "bxc"} {
+		values[value] = struct{}{}
+	}
+
+	for _, e := range expressions {
+		var expected []string
+		for value := range values {
+			if e.Matches(value) {
+				expected = append(expected, value)
+			}
+		}
+
+		res := e.FilterValues(values)
+		sort.Strings(expected)
+		sort.Strings(res)
+		if len(res) != len(expected) || (len(res) > 0 && !reflect.DeepEqual(res, expected)) {
+			t.Fatalf("Expression %q: Expected values %+v, got %+v", Expressions{e}.Strings()[0], expected, res)
+		}
+	}
+}
+
+func benchmarkFilterValues(b *testing.B, expression string, batch bool) {
+	e, err := ParseExpression(expression)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	values := make(map[string]struct{}, 10000)
+	for i := 0; i < 10000; i++ {
+		values[fmt.Sprintf("value%d", i)] = struct{}{}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if batch {
+			e.FilterValues(values)
+			continue
+		}
+
+		var res []string
+		for value := range values {
+			if e.Matches(value) {
+				res = append(res, value)
+			}
+		}
+	}
+}
+
+func BenchmarkFilterValuesEqual(b *testing.B) {
+	benchmarkFilterValues(b, "a=value123", true)
+}
+
+func BenchmarkFilterValuesEqualByMatches(b *testing.B) {
+	benchmarkFilterValues(b, "a=value123", false)
+}
+
+func BenchmarkFilterValuesMatch(b *testing.B) {
+	benchmarkFilterValues(b, "a=~value1.*3", true)
+}
+
+func BenchmarkFilterValuesMatchByMatches(b *testing.B) {
+	benchmarkFilterValues(b, "a=~value1.*3", false)
+}
+
+func TestExpressionMatchesMetric(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	tags := Tags{{Key: "dc", Value: "us-east"}, {Key: "host", Value: "web1"}}
+
+	type testCase struct {
+		expression string
+		expected   bool
+	}
+
+	testCases := []testCase{
+		{expression: "name=cpu.total", expected: true},
+		{expression: "name=~cpu\\..*", expected: true},
+		{expression: "name!=cpu.total", expected: false},
+		{expression: "dc=us-east", expected: true},
+		{expression: "dc=eu-west", expected: false},
+		{expression: "dc!=eu-west", expected: true},
+		{expression: "host=~web[0-9]", expected: true},
+		{expression: "host!=~web[0-9]", expected: false},
+		{expression: "host^=db", expected: false},
+		{expression: "dc|=us-east|eu-west", expected: true},
+		{expression: "rack=", expected: true},
+		{expression: "rack!=", expected: false},
+		// the tag is absent, so the default decisions apply
+		{expression: "rack!=r1", expected: true},
+		{expression: "rack=~.*", expected: true},
+		{expression: "rack=~r.*", expected: false},
+		{expression: "rack=?r1", expected: true},
+		{expression: "__tag=host", expected: true},
+		{expression: "__tag^=ra", expected: false},
+	}
+
+	// with meta tag support the filters return None for absent tags,
+	// the default decisions must lead to the same results
+	for _, metaTagSupport := range []bool{false, true} {
+		MetaTagSupport = metaTagSupport
+
+		all := make([]string, len(testCases))
+		for i, tc := range testCases {
+			e, err := ParseExpression(tc.expression)
+			if err != nil {
+				t.Fatalf("Unexpected parsing error of %q: %s", tc.expression, err)
+			}
+			if res := e.MatchesMetric("cpu.total", tags); res != tc.expected {
+				t.Fatalf("MetaTagSupport %t, expression %q: Expected %t, got %t", metaTagSupport, tc.expression, tc.expected, res)
+			}
+
+			all[i] = tc.expression
+			if !tc.expected {
+				all[i] = "dc=us-east"
+			}
+		}
+
+		expressions, err := ParseExpressions(all)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		if !expressions.MatchesMetric("cpu.total", tags) {
+			t.Fatalf("MetaTagSupport %t: Expected the metric to satisfy all expressions %+v", metaTagSupport, expressions.Strings())
+		}
+
+		other, err := ParseExpression("host=web2")
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+		expressions = append(expressions, other)
+		if expressions.MatchesMetric("cpu.total", tags) {
+			t.Fatalf("MetaTagSupport %t: Expected the metric to not satisfy all expressions %+v", metaTagSupport, expressions.Strings())
+		}
+	}
+}
+
+func TestMetricDefinitionFiltersFilterAndFilterOr(t *testing.T) {
+	filter := func(decision FilterDecision) MetricDefinitionFilter {
+		return func(_ schema.MKey, _ string, _ []string) FilterDecision { return decision }
+	}
+
+	type testCase struct {
+		decisions []FilterDecision
+		and, or   FilterDecision
+	}
+
+	testCases := []testCase{
+		{decisions: nil, and: Pass, or: Fail},
+		{decisions: []FilterDecision{None}, and: None, or: None},
+		{decisions: []FilterDecision{Pass, Pass}, and: Pass, or: Pass},
+		{decisions: []FilterDecision{Fail, Fail}, and: Fail, or: Fail},
+		{decisions: []FilterDecision{None, Fail}, and: Fail, or: None},
+		{decisions: []FilterDecision{Fail, None}, and: Fail, or: None},
+		{decisions: []FilterDecision{None, Pass}, and: None, or: Pass},
+		{decisions: []FilterDecision{Pass, None}, and: None, or: Pass},
+		{decisions: []FilterDecision{Pass, Fail}, and: Fail, or: Pass},
+		{decisions: []FilterDecision{Fail, Pass}, and: Fail, or: Pass},
+		{decisions: []FilterDecision{Pass, None, Fail}, and: Fail, or: Pass},
+		{decisions: []FilterDecision{None, Pass, None}, and: None, or: Pass},
+		{decisions: []FilterDecision{None, Fail, None}, and: Fail, or: None},
+	}
+
+	for i, tc := range testCases {
+		filters := make(MetricDefinitionFilters, len(tc.decisions))
+		for j, decision := range tc.decisions {
+			filters[j] = filter(decision)
+		}
+
+		if res := filters.FilterAnd(schema.MKey{}, "", nil); res != tc.and {
+			t.Fatalf("TC %d: Expected FilterAnd(%v) to be %s, got %s", i, tc.decisions, tc.and, res)
+		}
+		if res := filters.FilterOr(schema.MKey{}, "", nil); res != tc.or {
+			t.Fatalf("TC %d: Expected FilterOr(%v) to be %s, got %s", i, tc.decisions, tc.or, res)
+		}
+	}
+}
+
+func TestMetricDefinitionFiltersFilterBatch(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"dc^=us-e", "host!=~web-[12]", "env="})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filters, defaultDecisions := expressions.GetMetricDefinitionFilters(nil, nil)
+
+	defs := []MetricDefinitionLike{
+		{Name: "a", Tags: []string{"dc=us-east", "host=web-3"}},
+		{Name: "b", Tags: []string{"dc=us-east", "host=web-1"}},
+		{Name: "c", Tags: []string{"dc=us-west", "host=web-3"}},
+		{Name: "d", Tags: []string{"dc=us-east", "env=prod"}},
+		{Name: "e", Tags: []string{"dc=us-east"}},
+	}
+
+	expect := []FilterDecision{Pass, Fail, Fail, Fail, Pass}
+	res, err := filters.FilterBatch(context.Background(), defs, defaultDecisions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(res, expect) {
+		t.Fatalf("Expected decisions %v, got %v", expect, res)
+	}
+
+	// the decisions are the same as the ones of the combined filter
+	combined := expressions.GetMetricDefinitionFilter(nil, nil)
+	for i, def := range defs {
+		if decision := combined(def.Id, def.Name, def.Tags); decision != res[i] {
+			t.Fatalf("Expected decision of %s to be %s like the one of the combined filter, got %s", def.Name, decision, res[i])
+		}
+	}
+
+	// the default decisions replace None, without defaults None stays None
+	undecided := MetricDefinitionFilters{func(_ schema.MKey, _ string, _ []string) FilterDecision { return None }}
+	if res, err := undecided.FilterBatch(context.Background(), defs[:1], []FilterDecision{Fail}); err != nil || res[0] != Fail {
+		t.Fatalf("Expected the default decision Fail, got %v (error: %v)", res, err)
+	}
+	if res, err := undecided.FilterBatch(context.Background(), defs[:1], nil); err != nil || res[0] != None {
+		t.Fatalf("Expected decision None without defaults, got %v (error: %v)", res, err)
+	}
+}
+
+func TestMetricDefinitionFiltersFilterBatchCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the filter cancels the context at the given call, after that the batch must
+	// stop within one check interval
+	cancelAt := FilterBatchCheckInterval + 10
+	calls := 0
+	filters := MetricDefinitionFilters{func(_ schema.MKey, _ string, _ []string) FilterDecision {
+		calls++
+		if calls == cancelAt {
+			cancel()
+		}
+		return Pass
+	}}
+
+	defs := make([]MetricDefinitionLike, 10*FilterBatchCheckInterval)
+	res, err := filters.FilterBatch(ctx, defs, nil)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if res != nil {
+		t.Fatalf("Expected no decisions after the cancellation, got %d", len(res))
+	}
+	if calls < cancelAt || calls > cancelAt+FilterBatchCheckInterval {
+		t.Fatalf("Expected the filter to be called between %d and %d times, got %d", cancelAt, cancelAt+FilterBatchCheckInterval, calls)
+	}
+
+	// a context which is already done doesn't evaluate any filter
+	calls = 0
+	if _, err := filters.FilterBatch(ctx, defs, nil); err != context.Canceled || calls != 0 {
+		t.Fatalf("Expected context.Canceled without filtering, got %v after %d calls", err, calls)
+	}
+
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), 0)
+	defer cancelDeadline()
+	if _, err := filters.FilterBatch(deadline, defs, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestMetricDefinitionFiltersFilterBatchParallel(t *testing.T) {
+	defer SetSharedMatchCacheSize(0)
+	SetSharedMatchCacheSize(100)
+
+	expressions, err := ParseExpressions([]string{"dc^=us-", "host=~.*web-[0-9]*[13579]", "env!=~.*dev", "tier="})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	defs := make([]MetricDefinitionLike, 3*FilterBatchCheckInterval+17)
+	for i := range defs {
+		defs[i] = MetricDefinitionLike{
+			Name: fmt.Sprintf("metric%d", i),
+			Tags: []string{fmt.Sprintf("dc=%s", []string{"us-east", "us-west", "eu-west"}[i%3]), fmt.Sprintf("env=%s", []string{"prod", "dev"}[i%2]), fmt.Sprintf("host=web-%d", i%200)},
+		}
+	}
+
+	for _, count := range []int{0, 1, FilterBatchCheckInterval, FilterBatchCheckInterval + 1, len(defs)} {
+		filters, defaultDecisions := expressions.GetMetricDefinitionFilters(nil, nil)
+		expect, err := filters.FilterBatch(context.Background(), defs[:count], defaultDecisions)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		for _, workers := range []int{-1, 0, 1, 2, 3, 8, 100} {
+			// new filters, so their caches get populated concurrently
+			filters, defaultDecisions := expressions.GetMetricDefinitionFilters(nil, nil)
+			res, err := filters.FilterBatchParallel(context.Background(), defs[:count], defaultDecisions, workers)
+			if err != nil {
+				t.Fatalf("Unexpected error with %d metrics and %d workers: %s", count, workers, err)
+			}
+			if !reflect.DeepEqual(res, expect) {
+				t.Fatalf("Expected the same decisions as FilterBatch with %d metrics and %d workers:\n%v\ngot:\n%v", count, workers, expect, res)
+			}
+		}
+	}
+}
+
+func TestMetricDefinitionFiltersFilterBatchParallelCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the filter cancels the context at the given call, after that every worker
+	// must stop within one chunk
+	workers := 4
+	cancelAt := int64(FilterBatchCheckInterval + 10)
+	var calls int64
+	filters := MetricDefinitionFilters{func(_ schema.MKey, _ string, _ []string) FilterDecision {
+		if atomic.AddInt64(&calls, 1) == cancelAt {
+			cancel()
+		}
+		return Pass
+	}}
+
+	defs := make([]MetricDefinitionLike, 100*FilterBatchCheckInterval)
+	res, err := filters.FilterBatchParallel(ctx, defs, nil, workers)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if res != nil {
+		t.Fatalf("Expected no decisions after the cancellation, got %d", len(res))
+	}
+	if max := cancelAt + int64(workers*FilterBatchCheckInterval); calls < cancelAt || calls > max {
+		t.Fatalf("Expected the filter to be called between %d and %d times, got %d", cancelAt, max, calls)
+	}
+
+	// a context which is already done doesn't evaluate any filter
+	calls = 0
+	if _, err := filters.FilterBatchParallel(ctx, defs, nil, workers); err != context.Canceled || calls != 0 {
+		t.Fatalf("Expected context.Canceled without filtering, got %v after %d calls", err, calls)
+	}
+}
+
+// the text representation of the operators is used in api responses,
+// so the mapping must never change
+func TestExpressionOperatorTextMarshaling(t *testing.T) {
+	expected := map[ExpressionOperator]string{
+		EQUAL:           "equal",
+		NOT_EQUAL:       "not_equal",
+		MATCH:           "match",
+		MATCH_TAG:       "match_tag",
+		NOT_MATCH:       "not_match",
+		PREFIX:          "prefix",
+		PREFIX_TAG:      "prefix_tag",
+		HAS_TAG:         "has_tag",
+		NOT_HAS_TAG:     "not_has_tag",
+		MATCH_ALL:       "match_all",
+		MATCH_NONE:      "match_none",
+		EQUAL_ANY:       "equal_any",
+		NOT_EQUAL_ANY:   "not_equal_any",
+		GREATER:         "greater",
+		GREATER_EQUAL:   "greater_equal",
+		LESS:            "less",
+		LESS_EQUAL:      "less_equal",
+		WILDCARD:        "wildcard",
+		NOT_PREFIX:      "not_prefix",
+		TAG_VALUE:       "tag_value",
+		HAS_ANY_TAG:     "has_any_tag",
+		EQUAL_OR_ABSENT: "equal_or_absent",
+	}
+
+	for o := EQUAL; o <= EQUAL_OR_ABSENT; o++ {
+		text, err := o.MarshalText()
+		if err != nil {
+			t.Fatalf("Unexpected error when marshaling %s: %s", o, err)
+		}
+		if string(text) != expected[o] {
+			t.Fatalf("Expected operator %s to be marshaled as %q, got %q", o, expected[o], text)
+		}
+
+		var unmarshaled ExpressionOperator
+		if err := unmarshaled.UnmarshalText(text); err != nil {
+			t.Fatalf("Unexpected error when unmarshaling %q: %s", text, err)
+		}
+		if unmarshaled != o {
+			t.Fatalf("Expected %q to be unmarshaled as %s, got %s", text, o, unmarshaled)
+		}
+	}
+	if len(expected) != int(EQUAL_OR_ABSENT)+1 {
+		t.Fatalf("Expected the mapping to cover all %d operators", EQUAL_OR_ABSENT+1)
+	}
+
+	encoded, err := json.Marshal(struct {
+		Operators []ExpressionOperator `json:"operators"`
+	}{Operators: []ExpressionOperator{NOT_MATCH, PREFIX_TAG}})
+	if err != nil {
+		t.Fatalf("Unexpected error when encoding json: %s", err)
+	}
+	if string(encoded) != `{"operators":["not_match","prefix_tag"]}` {
+		t.Fatalf("Unexpected json: %s", encoded)
+	}
+
+	var decoded []ExpressionOperator
+	if err := json.Unmarshal([]byte(`["equal","has_tag"]`), &decoded); err != nil {
+		t.Fatalf("Unexpected error when decoding json: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, []ExpressionOperator{EQUAL, HAS_TAG}) {
+		t.Fatalf("Unexpected decoded operators: %v", decoded)
+	}
+
+	for _, invalid := range []string{`["not_an_operator"]`, `["EQUAL"]`, `[0]`} {
+		if err := json.Unmarshal([]byte(invalid), &decoded); err == nil {
+			t.Fatalf("Expected an error when decoding %s", invalid)
+		}
+	}
+
+	if _, err := (EQUAL_OR_ABSENT + 1).MarshalText(); err == nil {
+		t.Fatalf("Expected an error when marshaling an unknown operator")
+	}
+}
+
+func TestExpressionIndexablePrefix(t *testing.T) {
+	type testCase struct {
+		expression string
+		prefix     string
+		exhaustive bool
+		indexable  bool
+	}
+
+	testCases := []testCase{
+		{expression: "name=~servers\\.prod\\..*\\.cpu", prefix: "servers.prod.", indexable: true},
+		{expression: "name=~^servers", prefix: "servers", exhaustive: true, indexable: true},
+		{expression: "name=~servers-?$", prefix: "servers", indexable: true},
+		{expression: "host=~web-[0-9]+", prefix: "web-", indexable: true},
+		{expression: "__tag=~ho", prefix: "ho", exhaustive: true, indexable: true},
+
+		// patterns without a literal prefix have an empty one
+		{expression: "name=~.*\\.cpu", prefix: "", indexable: true},
+		{expression: "name=~(a|b)", prefix: "", indexable: true},
+		{expression: "name=~(?i)abc", prefix: "", indexable: true},
+
+		// the values without the prefix satisfy negated expressions, so they can't be skipped
+		{expression: "name!=~servers", indexable: false},
+		{expression: "name=servers", indexable: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expression, func(t *testing.T) {
+			e, err := ParseExpression(tc.expression)
+			if err != nil {
+				t.Fatalf("Unexpected parsing error: %s", err)
+			}
+
+			prefixExpr, ok := e.(IndexablePrefixExpression)
+			if ok != tc.indexable {
+				t.Fatalf("Expected the expression to implement IndexablePrefixExpression: %t, got %t", tc.indexable, ok)
+			}
+			if !ok {
+				return
+			}
+
+			prefix, exhaustive := prefixExpr.IndexablePrefix()
+			if prefix != tc.prefix || exhaustive != tc.exhaustive {
+				t.Fatalf("Expected indexable prefix %q/%t, got %q/%t", tc.prefix, tc.exhaustive, prefix, exhaustive)
+			}
+
+			// no value without the prefix may satisfy the expression
+			for _, value := range []string{"", "x", "xservers.prod.a.cpu", "web", "ho"} {
+				if !strings.HasPrefix(value, prefix) && e.Matches(value) {
+					t.Fatalf("Expected %q to not match %q, because it doesn't have the prefix %q", tc.expression, value, prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestValueMatcher(t *testing.T) {
+	type testCase struct {
+		expression    string
+		matchesAll    bool
+		expectMatcher bool
+	}
+
+	testCases := []testCase{
+		{expression: "a=b", expectMatcher: true},
+		{expression: "a!=b", expectMatcher: true},
+		{expression: "a^=b", expectMatcher: true},
+		{expression: "a=~b.*c", expectMatcher: true},
+		{expression: "a!=~b.*c", expectMatcher: true},
+		{expression: "a=~.*", expectMatcher: true, matchesAll: true},
+		{expression: "a!=~.*", expectMatcher: true},
+		{expression: "__tag=~a.*b"},
+		{expression: "__tag^=a"},
+		{expression: "__tag=~a.*:=b"},
+		{expression: "a!="},
+		{expression: "a="},
+	}
+
+	values := []string{"b", "bc", "bxc", "c", "abc", "b.c"}
+	for _, tc := range testCases {
+		expression, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected parsing error of %q: %s", tc.expression, err)
+		}
+
+		matcher, ok := expression.(ValueMatcher)
+		if ok != tc.expectMatcher {
+			t.Fatalf("Expected %q to implement ValueMatcher: %t, got %t", tc.expression, tc.expectMatcher, ok)
+		}
+		if !ok {
+			continue
+		}
+
+		if matcher.MatchAllValues() != tc.matchesAll {
+			t.Fatalf("Expected MatchAllValues of %q to return %t", tc.expression, tc.matchesAll)
+		}
+
+		// for the expressions on values MatchValue makes the same decisions as Matches
+		for _, value := range values {
+			if res, expect := matcher.MatchValue(value), expression.Matches(value); res != expect {
+				t.Fatalf("Expected MatchValue(%q) of %q to return %t, got %t", value, tc.expression, expect, res)
+			}
+		}
+	}
+
+	// the parser turns "a!=" into HAS_TAG, but the expression on its own matches all values
+	notEqualEmpty := &expressionNotEqual{expressionCommon: expressionCommon{key: "a"}}
+	if !notEqualEmpty.MatchAllValues() {
+		t.Fatalf("Expected all values to differ from an empty value")
+	}
+}
+
+var benchmarkValueMatcherValues = []string{"web-1", "web-2", "db-1", "db-2", "cache-1", "web-cache-3"}
+
+func BenchmarkValueMatcherMatchValue(b *testing.B) {
+	expression, err := ParseExpression("host=~web-.*[0-9]")
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+	matcher := expression.(ValueMatcher)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, value := range benchmarkValueMatcherValues {
+			matcher.MatchValue(value)
+		}
+	}
+}
+
+// BenchmarkValueMatcherMetricDefinitionFilter makes the same decisions as BenchmarkValueMatcherMatchValue,
+// but it has to find the tag in the tags of each metric
+func BenchmarkValueMatcherMetricDefinitionFilter(b *testing.B) {
+	expression, err := ParseExpression("host=~web-.*[0-9]")
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filter := expression.GetMetricDefinitionFilter(nil)
+
+	tags := make([][]string, len(benchmarkValueMatcherValues))
+	for i, value := range benchmarkValueMatcherValues {
+		tags[i] = []string{"dc=us-east-1", "host=" + value, "service=api"}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range tags {
+			filter(schema.MKey{}, "abc.bcd.cde", tags[i])
+		}
+	}
+}
+
+// benchmarkMetricDefinitionFilter runs the filter of the given expression against
+// metrics which mostly have the tag of the expression with different values
+func benchmarkMetricDefinitionFilter(b *testing.B, expression string, create bool) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	e, err := ParseExpression(expression)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	metrics := make([][]string, 1000)
+	for i := range metrics {
+		metrics[i] = []string{"cluster=c1", fmt.Sprintf("dc=us-east-%d", i%5), "env=production", fmt.Sprintf("host=web-%d", i), "os=linux"}
+	}
+
+	lookup := func(_ schema.MKey, _, _ string) bool { return true }
+	filter := e.GetMetricDefinitionFilter(lookup)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if create {
+			filter = e.GetMetricDefinitionFilter(lookup)
+		}
+		filter(schema.MKey{}, "a.b.c", metrics[i%len(metrics)])
+	}
+}
+
+func BenchmarkMetricDefinitionFilterEqual(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host=web-1", false)
+}
+
+func BenchmarkMetricDefinitionFilterPrefix(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host^=web-1", false)
+}
+
+func BenchmarkMetricDefinitionFilterMatch(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host=~web-[0-9]*1$", false)
+}
+
+func BenchmarkMetricDefinitionFilterNotMatch(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host!=~web-[0-9]*1$", false)
+}
+
+func BenchmarkCreateMetricDefinitionFilterEqual(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host=web-1", true)
+}
+
+func BenchmarkCreateMetricDefinitionFilterPrefix(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host^=web-1", true)
+}
+
+func BenchmarkCreateMetricDefinitionFilterMatch(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host=~web-[0-9]*1$", true)
+}
+
+func BenchmarkCreateMetricDefinitionFilterNotMatch(b *testing.B) {
+	benchmarkMetricDefinitionFilter(b, "host!=~web-[0-9]*1$", true)
+}
+
+func benchmarkFilterManyTags(b *testing.B, sortedTags bool) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	// 6 expressions on tags which are spread over the 30 tags of the metric
+	expressions, err := ParseExpressions([]string{"key04^=value", "key09*=value*", "key14!^=other", "key19^=val", "key24=~.*ue24", "key29!=~.*other"})
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	tags := make([]string, 30)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("key%02d=value%d", i, i)
+	}
+
+	var filters MetricDefinitionFilters
+	if sortedTags {
+		filters, _ = expressions.GetMetricDefinitionFiltersForSortedTags(nil, nil, nil)
+	} else {
+		filters, _ = expressions.GetMetricDefinitionFilters(nil, nil)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if filters.FilterAnd(schema.MKey{}, "metric", tags) != Pass {
+			b.Fatalf("Expected the metric to pass the filters")
+		}
+	}
+}
+
+func BenchmarkFilterManyTagsUnsorted(b *testing.B) {
+	benchmarkFilterManyTags(b, false)
+}
+
+func BenchmarkFilterManyTagsSorted(b *testing.B) {
+	benchmarkFilterManyTags(b, true)
+}
+
+var filterBatchParallelCorpus struct {
+	sync.Once
+	defs []MetricDefinitionLike
+}
+
+// getFilterBatchParallelCorpus returns 1M synthetic metric definitions with sorted tags
+func getFilterBatchParallelCorpus() []MetricDefinitionLike {
+	filterBatchParallelCorpus.Do(func() {
+		defs := make([]MetricDefinitionLike, 1000000)
+		for i := range defs {
+			defs[i] = MetricDefinitionLike{
+				Name: fmt.Sprintf("some.metric.%d", i%1000),
+				Tags: []string{
+					fmt.Sprintf("dc=%s", []string{"eu-west", "us-east", "us-west"}[i%3]),
+					fmt.Sprintf("env=%s", []string{"dev", "prod", "staging"}[i%3]),
+					fmt.Sprintf("host=web-%d", i%5000),
+					fmt.Sprintf("service=svc-%d", i%50),
+				},
+			}
+		}
+		filterBatchParallelCorpus.defs = defs
+	})
+	return filterBatchParallelCorpus.defs
+}
+
+func benchmarkFilterBatchParallel(b *testing.B, workers int) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = false
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	defs := getFilterBatchParallelCorpus()
+	expressions, err := ParseExpressions([]string{"dc^=us-", "env!^=dev", "host=~.*web-[0-9]*[13579]", "service!=~.*svc-1[0-9]"})
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filters, defaultDecisions := expressions.GetMetricDefinitionFiltersForSortedTags(nil, nil, nil)
+		if _, err := filters.FilterBatchParallel(context.Background(), defs, defaultDecisions, workers); err != nil {
+			b.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func BenchmarkFilterBatchParallel1M(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkFilterBatchParallel(b, workers)
+		})
+	}
+}
+
+func benchmarkExpressionsStrings(b *testing.B, count int) {
+	expressionStrs := make([]string, count)
+	for i := range expressionStrs {
+		switch i % 4 {
+		case 0:
+			expressionStrs[i] = fmt.Sprintf("key%d=some-longer-value-%d", i, i)
+		case 1:
+			expressionStrs[i] = fmt.Sprintf("key%d!=~value-[0-9]+-%d", i, i)
+		case 2:
+			expressionStrs[i] = fmt.Sprintf("key%d^=prefix%d", i, i)
+		case 3:
+			expressionStrs[i] = fmt.Sprintf("key%d|=a%d|b%d|c%d", i, i, i, i)
+		}
+	}
+	expressions, err := ParseExpressions(expressionStrs)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		expressions.Strings()
+	}
+}
+
+func BenchmarkExpressionsStrings10(b *testing.B) {
+	benchmarkExpressionsStrings(b, 10)
+}
+
+func BenchmarkExpressionsStrings100(b *testing.B) {
+	benchmarkExpressionsStrings(b, 100)
+}
+
+var parseBenchQuery = []string{
+	"name=some.metric.name",
+	"dc=us-east",
+	"host^=web-",
+	"env!=dev",
+	"rack|=a1|a2|b1",
+	"service=~api-[0-9]+",
+}
+
+func BenchmarkParseExpressions6(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseExpressions(parseBenchQuery); err != nil {
+			b.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func TestParseExpressionAllocations(t *testing.T) {
+	// regex expressions are left out, because parsing their patterns allocates
+	expressions := []string{"name=some.metric.name", "dc=us-east", "host^=web-", "env!=dev", "rack!=", "dc=~", "__tag^=ho"}
+	for _, expr := range expressions {
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := ParseExpression(expr); err != nil {
+				t.Fatalf("Unexpected error when parsing %q: %s", expr, err)
+			}
+		})
+		if allocs != 1 {
+			t.Fatalf("Expected parsing %q to only allocate the expression, got %f allocations", expr, allocs)
+		}
+	}
+}
+
+func TestAnchorPattern(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "abc", expected: "^(?:abc)"},
+		{value: "^abc", expected: "^abc"},
+		{value: "(^a)b", expected: "(^a)b"},
+		{value: "^a|b", expected: "^(?:^a|b)"},
+		{value: "^*a", expected: "^(?:^*a)"},
+		{value: "a^", expected: "^(?:a^)"},
+	}
+
+	for i, tc := range testCases {
+		parsed, err := syntax.Parse(tc.value, syntax.Perl)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error when parsing %q: %s", i, tc.value, err)
+		}
+		if res, _ := anchorPattern(tc.value, parsed); res != tc.expected {
+			t.Fatalf("TC %d: Expected pattern %q for value %q, got %q", i, tc.expected, tc.value, res)
+		}
+	}
+}
+
+func TestMatchesEmpty(t *testing.T) {
+	patterns := []string{
+		"", "a", "a*", "a+", "a?", "(a*)+", "a{0,2}", "a{1,2}", "(a*){2}", "a|", "a|b", "a*b*", "a*b",
+		"^", "$", "^$", "(?m)^$", "\\A\\z", "\\b", "\\B", "a*\\b", "[a-z]*", "[^a]", ".*", ".", "(?s).*",
+		"(|a)b", "(?:a|b*)c?", "[^\\x00-\\x{10FFFF}]",
+	}
+
+	for i, pattern := range patterns {
+		parsed, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error when parsing %q: %s", i, pattern, err)
+		}
+		if res, expected := matchesEmpty(parsed), regexp.MustCompile("^(?:"+pattern+")").MatchString(""); res != expected {
+			t.Fatalf("TC %d: Expected matchesEmpty of %q to be %t, got %t", i, pattern, expected, res)
+		}
+	}
+}
+
+func TestExpressionMatchesBytes(t *testing.T) {
+	expressions := []string{
+		"dc=us-east-1", "dc!=us-east-1", "dc^=us-", "dc!^=us-", "dc|=us-east-1|eu-west-1", "dc!|=us-east-1|eu-west-1",
+		"dc=~us-[a-z]+-[0-9]$", "dc=~us-[0-9]+", "dc=~(us|eu)-.*[0-9]", "dc!=~us-[a-z]+-[0-9]$", "__tag=~d[a-z]",
+	}
+	values := []string{"", "us", "us-", "us-east", "us-east-1", "us-east-12", "eu-west-1", "us-1", "dc", "a-much-longer-value-which-does-not-fit-into-a-small-buffer"}
+
+	for _, expression := range expressions {
+		e, err := ParseExpression(expression)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", expression, err)
+		}
+		bytesMatcher, ok := e.(BytesMatcher)
+		if !ok {
+			t.Fatalf("Expected %q (%T) to implement BytesMatcher", expression, e)
+		}
+
+		for _, value := range values {
+			valueBytes := []byte(value)
+			if res, expected := bytesMatcher.MatchesBytes(valueBytes), e.Matches(value); res != expected {
+				t.Fatalf("Expected MatchesBytes of %q on %q to return %t, got %t", expression, value, expected, res)
+			}
+			if raceEnabled {
+				continue
+			}
+			allocs := testing.AllocsPerRun(10, func() {
+				bytesMatcher.MatchesBytes(valueBytes)
+			})
+			if allocs != 0 {
+				t.Fatalf("Expected MatchesBytes of %q on %q to not allocate, got %f allocations", expression, value, allocs)
+			}
+		}
+	}
+}
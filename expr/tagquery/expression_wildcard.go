@@ -0,0 +1,285 @@
+package tagquery
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// expressionWildcard matches values by a glob pattern, where "*" matches any
+// sequence of characters and "?" matches exactly one character.
+// patterns which additionally use character classes ("[0-9]") or alternations
+// ("{a,b}") get translated into a regular expression, all others are evaluated
+// by a simple glob matcher which is cheaper than running a regular expression.
+type expressionWildcard struct {
+	expressionCommon
+
+	// literalPrefix is the part of the pattern before the first wildcard
+	literalPrefix string
+
+	// valueRe is only set if the pattern could not be evaluated by globMatch
+	valueRe      *regexp.Regexp
+	matchesEmpty bool
+}
+
+// newExpressionWildcard takes an expressionCommon of which the value is a glob pattern,
+// it returns the cheapest expression which is equivalent to that pattern:
+// - if the pattern has no wildcards it returns an expressionEqual
+// - if the pattern consists only of "*" it returns an expressionMatchAll
+// - if the pattern is a literal followed by "*" it returns an expressionPrefix
+// - otherwise it returns an expressionWildcard
+func newExpressionWildcard(resCommon expressionCommon, expr string) (Expression, error) {
+	wildcardPos := strings.IndexAny(resCommon.value, "*?[{")
+	if wildcardPos < 0 {
+		return &expressionEqual{expressionCommon: resCommon}, nil
+	}
+
+	if strings.Trim(resCommon.value, "*") == "" {
+		return &expressionMatchAll{expressionCommon: resCommon, originalOperator: WILDCARD}, nil
+	}
+
+	literalPrefix := resCommon.value[:wildcardPos]
+	if strings.Trim(resCommon.value[wildcardPos:], "*") == "" {
+		return &expressionPrefix{expressionCommon: expressionCommon{key: resCommon.key, value: literalPrefix}}, nil
+	}
+
+	res := expressionWildcard{expressionCommon: resCommon, literalPrefix: literalPrefix}
+	if strings.ContainsAny(resCommon.value, "[{") {
+		var err error
+		res.valueRe, err = compileRegex(globToRegex(resCommon.value, ".*", "."))
+		if err != nil {
+			return nil, InvalidExpressionError(expr)
+		}
+		res.matchesEmpty = res.valueRe.MatchString("")
+	}
+
+	return &res, nil
+}
+
+// NewExpressionWildcard returns an expression which matches metrics that have the tag with the given key
+// and a value matching the given glob pattern, it is equivalent to parsing "<key>*=<pattern>"
+func NewExpressionWildcard(key, pattern string) (Expression, error) {
+	return newExpressionFromValues(key, WILDCARD, pattern)
+}
+
+// globToRegex translates a glob pattern into an anchored regular expression,
+// the wildcards "*" and "?" get translated into the given anyString and anyChar
+func globToRegex(pattern, anyString, anyChar string) string {
+	var builder strings.Builder
+	builder.WriteString("^(?:")
+
+	inAlternation := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			builder.WriteString(anyString)
+		case '?':
+			builder.WriteString(anyChar)
+		case '[':
+			// character classes are passed through as they are
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				builder.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = len(pattern)
+				continue
+			}
+			builder.WriteString(pattern[i : i+end+1])
+			i += end
+		case '{':
+			inAlternation = true
+			builder.WriteString("(?:")
+		case '}':
+			if inAlternation {
+				inAlternation = false
+				builder.WriteString(")")
+			} else {
+				builder.WriteString(`\}`)
+			}
+		case ',':
+			if inAlternation {
+				builder.WriteString("|")
+			} else {
+				builder.WriteString(",")
+			}
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	builder.WriteString(")$")
+	return builder.String()
+}
+
+// globMatch returns true if the given value matches the given pattern, which may contain
+// the wildcards "*" and "?". all other characters are compared literally
+func globMatch(pattern, value string) bool {
+	var p, v int
+	starP, starV := -1, 0
+	for v < len(value) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starV = p, v
+				p++
+				continue
+			case '?':
+				_, size := utf8.DecodeRuneInString(value[v:])
+				p++
+				v += size
+				continue
+			default:
+				if pattern[p] == value[v] {
+					p++
+					v++
+					continue
+				}
+			}
+		}
+
+		// no match at the current position, backtrack to the last "*"
+		// and let it consume one more character of the value
+		if starP < 0 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(value[starV:])
+		starV += size
+		p, v = starP+1, starV
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+func (e *expressionWildcard) Equals(other Expression) bool {
+	return e.key == other.GetKey() && e.GetOperator() == other.GetOperator() && e.value == other.GetValue()
+}
+
+func (e *expressionWildcard) IsEquivalentTo(other Expression) bool {
+	return e.Equals(other)
+}
+
+func (e *expressionWildcard) Clone() Expression {
+	res := *e
+	return &res
+}
+
+func (e *expressionWildcard) GetDefaultDecision() FilterDecision {
+	if e.matchesEmpty {
+		return Pass
+	}
+	return Fail
+}
+
+func (e *expressionWildcard) GetOperator() ExpressionOperator {
+	return WILDCARD
+}
+
+func (e *expressionWildcard) GetOperatorCost() uint32 {
+	return 6
+}
+
+func (e *expressionWildcard) GetCost() uint32 {
+	return defaultCost(e.GetOperatorCost())
+}
+
+func (e *expressionWildcard) RequiresNonEmptyValue() bool {
+	return !e.matchesEmpty
+}
+
+func (e *expressionWildcard) Matches(value string) bool {
+	if !strings.HasPrefix(value, e.literalPrefix) {
+		return false
+	}
+
+	if e.valueRe != nil {
+		return e.valueRe.MatchString(value)
+	}
+
+	return globMatch(e.value[len(e.literalPrefix):], value[len(e.literalPrefix):])
+}
+
+func (e *expressionWildcard) FilterValues(values map[string]struct{}) []string {
+	return filterValues(values, e.Matches)
+}
+
+func (e *expressionWildcard) GetMetricDefinitionFilter(_ IdTagLookup) MetricDefinitionFilter {
+	if e.key == "name" {
+		return func(_ schema.MKey, name string, _ []string) FilterDecision {
+			if e.Matches(name) {
+				return Pass
+			}
+			return Fail
+		}
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = e.GetDefaultDecision()
+	}
+
+	return func(_ schema.MKey, _ string, tags []string) FilterDecision {
+		for _, tag := range tags {
+			value, ok := tagValueOf(tag, e.key)
+			if !ok {
+				continue
+			}
+
+			if e.Matches(value) {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionWildcard) GetMetricDefinitionTagsFilter(lookup IdTagLookup) MetricDefinitionTagsFilter {
+	if e.key == "name" {
+		return ignoreTags(e.GetMetricDefinitionFilter(lookup))
+	}
+
+	resultIfTagIsAbsent := None
+	if !MetaTagSupport {
+		resultIfTagIsAbsent = e.GetDefaultDecision()
+	}
+
+	return func(_ schema.MKey, _ string, tags Tags) FilterDecision {
+		for _, tag := range tags {
+			if tag.Key != e.key {
+				continue
+			}
+
+			if e.Matches(tag.Value) {
+				return Pass
+			}
+			return Fail
+		}
+
+		return resultIfTagIsAbsent
+	}
+}
+
+func (e *expressionWildcard) MatchesTags(tags map[string]string) FilterDecision {
+	return matchesTagValue(e, tags)
+}
+
+func (e *expressionWildcard) MatchesMetric(name string, tags Tags) bool {
+	return matchesMetric(e, name, tags)
+}
+
+func (e *expressionWildcard) GetMetaRecordFilter() MetaRecordFilter {
+	return metaRecordFilterByValue(e)
+}
+
+func (e *expressionWildcard) StringIntoWriter(writer io.Writer) {
+	io.WriteString(writer, escapeKey(e.key))
+	io.WriteString(writer, "*=")
+	io.WriteString(writer, escapeValue(e.value))
+}
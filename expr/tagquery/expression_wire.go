@@ -0,0 +1,249 @@
+package tagquery
+
+import (
+	"regexp/syntax"
+	"strings"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+//go:generate msgp -unexported
+
+// expressionsWireVersion is the version of the wire representation of Expressions,
+// it has to be increased whenever the meaning of its fields changes
+const expressionsWireVersion = 1
+
+// expressionsWire is the representation of Expressions used to encode them with msgp.
+// Unlike their string representation it can be decoded without parsing the expressions,
+// only regular expressions still need to be compiled after decoding them
+type expressionsWire struct {
+	Version     uint8
+	Expressions []expressionWire
+}
+
+// expressionWire is the representation of a single Expression in expressionsWire
+type expressionWire struct {
+	Operator uint16
+
+	// OriginalOperator is only used by MATCH_ALL and MATCH_NONE, it
+	// is the operator which they have been parsed from
+	OriginalOperator uint16
+
+	Key   string
+	Value string
+}
+
+func (e Expressions) toWire() expressionsWire {
+	res := expressionsWire{
+		Version:     expressionsWireVersion,
+		Expressions: make([]expressionWire, len(e)),
+	}
+
+	for i, expr := range e {
+		res.Expressions[i] = expressionWire{
+			Operator: uint16(expr.GetOperator()),
+			Key:      expr.GetKey(),
+			Value:    expr.GetValue(),
+		}
+
+		switch expr := expr.(type) {
+		case *expressionMatchAll:
+			res.Expressions[i].OriginalOperator = uint16(expr.originalOperator)
+		case *expressionMatchNone:
+			res.Expressions[i].OriginalOperator = uint16(expr.originalOperator)
+		}
+	}
+
+	return res
+}
+
+func (w *expressionsWire) toExpressions() (Expressions, error) {
+	if w.Version != expressionsWireVersion {
+		return nil, errors.NewBadRequestf("Unsupported version of encoded expressions: %d", w.Version)
+	}
+
+	res := make(Expressions, len(w.Expressions))
+	for i := range w.Expressions {
+		var err error
+		res[i], err = w.Expressions[i].toExpression()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// toExpression instantiates the expression described by the wire representation,
+// without going through the parser. The given properties must be the ones of an
+// expression which has been returned by the parser, so no further optimizations
+// get applied. The key and the regular expressions still get validated the same
+// way as by the parser, so a corrupt wire representation results in the same errors
+func (w *expressionWire) toExpression() (Expression, error) {
+	operator := ExpressionOperator(w.Operator)
+	resCommon := expressionCommon{key: internKey(w.Key), value: w.Value}
+
+	// only used for error messages
+	var builder strings.Builder
+	builder.WriteString(escapeKey(w.Key))
+	operator.StringIntoWriter(&builder)
+	builder.WriteString(w.Value)
+	expr := builder.String()
+
+	// the key of "__tag=<key>" is the value of the parsed expression, which doesn't get
+	// validated as a key, see keyNeedsTagPrefix. HAS_ANY_TAG has no key, it validates the
+	// keys in its value itself
+	switch {
+	case operator == HAS_TAG && keyNeedsTagPrefix(w.Key):
+	case operator == HAS_ANY_TAG:
+	default:
+		if err := validateQueryExpressionTagKey(w.Key, defaultParseOptions.KeyValidation); err != nil {
+			return nil, InvalidKeyError{Expression: expr, Key: w.Key, Err: err}
+		}
+	}
+
+	if isPseudoTag(w.Key) {
+		return newExpressionPseudoTag(resCommon, operator, expr)
+	}
+
+	switch operator {
+	case EQUAL:
+		return &expressionEqual{expressionCommon: resCommon}, nil
+	case NOT_EQUAL:
+		return &expressionNotEqual{expressionCommon: resCommon}, nil
+	case PREFIX:
+		return &expressionPrefix{expressionCommon: resCommon}, nil
+	case NOT_PREFIX:
+		return &expressionNotPrefix{expressionCommon: resCommon}, nil
+	case PREFIX_TAG:
+		return &expressionPrefixTag{expressionCommon: resCommon}, nil
+	case HAS_TAG:
+		return &expressionHasTag{expressionCommon: resCommon}, nil
+	case NOT_HAS_TAG:
+		return &expressionNotHasTag{expressionCommon: resCommon}, nil
+	case EQUAL_OR_ABSENT:
+		return &expressionEqualOrAbsent{expressionCommon: resCommon}, nil
+	case MATCH_ALL:
+		return &expressionMatchAll{expressionCommon: resCommon, originalOperator: ExpressionOperator(w.OriginalOperator)}, nil
+	case MATCH_NONE:
+		return &expressionMatchNone{expressionCommon: resCommon, originalOperator: ExpressionOperator(w.OriginalOperator)}, nil
+	case EQUAL_ANY:
+		return newExpressionEqualAny(resCommon, expr)
+	case NOT_EQUAL_ANY:
+		return newExpressionNotEqualAny(resCommon, expr)
+	case WILDCARD:
+		return newExpressionWildcard(resCommon, expr)
+	case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL:
+		return newExpressionCompare(resCommon, operator, expr)
+	case TAG_VALUE:
+		return newExpressionTagValue(resCommon, &defaultParseOptions, expr)
+	case HAS_ANY_TAG:
+		return newExpressionHasAnyTag(resCommon, &defaultParseOptions, expr)
+	case MATCH, NOT_MATCH, MATCH_TAG:
+		parsed, err := syntax.Parse(w.Value, syntax.Perl)
+		if err != nil {
+			return nil, BadRegexError{Expression: expr, Err: err}
+		}
+
+		err = defaultParseOptions.RegexLimits.checkParsed(expr, w.Value, parsed)
+		if err != nil {
+			return nil, err
+		}
+
+		pattern, _ := anchorPattern(w.Value, parsed)
+		resCommonRe, err := newExpressionCommonRe(resCommon, pattern, parsed, 0, false)
+		if err != nil {
+			return nil, err
+		}
+
+		switch operator {
+		case MATCH:
+			return newExpressionMatch(resCommonRe), nil
+		case NOT_MATCH:
+			return &expressionNotMatch{expressionCommonRe: resCommonRe}, nil
+		default:
+			return &expressionMatchTag{expressionCommonRe: resCommonRe}, nil
+		}
+	}
+
+	return nil, errors.NewBadRequestf("Unknown operator of encoded expression: %d", w.Operator)
+}
+
+// EncodeMsg satisfies the msgp.Encodable interface
+func (e Expressions) EncodeMsg(en *msgp.Writer) error {
+	wire := e.toWire()
+	return wire.EncodeMsg(en)
+}
+
+// DecodeMsg satisfies the msgp.Decodable interface. before expressionsWire got introduced Expressions were
+// encoded as a list of strings, for compatibility such lists still get decoded by parsing them
+func (e *Expressions) DecodeMsg(dc *msgp.Reader) error {
+	t, err := dc.NextType()
+	if err != nil {
+		return err
+	}
+
+	if t == msgp.ArrayType {
+		size, err := dc.ReadArrayHeader()
+		if err != nil {
+			return err
+		}
+		expressionStrings := make([]string, size)
+		for i := range expressionStrings {
+			expressionStrings[i], err = dc.ReadString()
+			if err != nil {
+				return msgp.WrapError(err, i)
+			}
+		}
+		*e, err = ParseExpressions(expressionStrings)
+		return err
+	}
+
+	var wire expressionsWire
+	if err := wire.DecodeMsg(dc); err != nil {
+		return err
+	}
+	*e, err = wire.toExpressions()
+	return err
+}
+
+// MarshalMsg satisfies the msgp.Marshaler interface
+func (e Expressions) MarshalMsg(b []byte) ([]byte, error) {
+	wire := e.toWire()
+	return wire.MarshalMsg(b)
+}
+
+// UnmarshalMsg satisfies the msgp.Unmarshaler interface, like DecodeMsg
+// it also accepts the legacy encoding of Expressions as a list of strings
+func (e *Expressions) UnmarshalMsg(bts []byte) ([]byte, error) {
+	if msgp.NextType(bts) == msgp.ArrayType {
+		size, bts, err := msgp.ReadArrayHeaderBytes(bts)
+		if err != nil {
+			return bts, err
+		}
+		expressionStrings := make([]string, size)
+		for i := range expressionStrings {
+			expressionStrings[i], bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return bts, msgp.WrapError(err, i)
+			}
+		}
+		*e, err = ParseExpressions(expressionStrings)
+		return bts, err
+	}
+
+	var wire expressionsWire
+	bts, err := wire.UnmarshalMsg(bts)
+	if err != nil {
+		return bts, err
+	}
+	*e, err = wire.toExpressions()
+	return bts, err
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (e Expressions) Msgsize() int {
+	wire := e.toWire()
+	return wire.Msgsize()
+}
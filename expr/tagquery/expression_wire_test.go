@@ -0,0 +1,195 @@
+package tagquery
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+var wireTestExpressions = []string{
+	"a=b",
+	"a!=b",
+	"a=~b.*",
+	"a!=~b.*",
+	"a=~.*",
+	"a!=~.*",
+	"a^=b",
+	"a!^=b",
+	"a|=b|c",
+	"a!|=b|c",
+	"a*=b*c",
+	"a>5",
+	"a>=5",
+	"a<5",
+	"a<=5",
+	"a=?b",
+	"a!=",
+	"a=",
+	"__tag=a",
+	"__tag=a<b",
+	"__tag^=a",
+	"__tag=~a.*",
+	"__tag=~dc_.*:=us-east",
+	"__any_tag=a|b",
+	"__id|=a|b",
+	"__lastts>100",
+	"name!=~",
+}
+
+func TestExpressionsMsgpRoundTrip(t *testing.T) {
+	in, err := ParseExpressions(wireTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	encoded, err := in.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+
+	var out Expressions
+	rest, err := out.UnmarshalMsg(encoded)
+	if err != nil {
+		t.Fatalf("Unexpected error when unmarshaling: %s", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("Expected all bytes to be consumed, %d were left", len(rest))
+	}
+	if !in.Equal(out) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", in.Strings(), out.Strings())
+	}
+
+	var buf bytes.Buffer
+	if err := msgp.Encode(&buf, in); err != nil {
+		t.Fatalf("Unexpected error when encoding: %s", err)
+	}
+	out = nil
+	if err := msgp.Decode(&buf, &out); err != nil {
+		t.Fatalf("Unexpected error when decoding: %s", err)
+	}
+	if !in.Equal(out) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", in.Strings(), out.Strings())
+	}
+
+	for i := range in {
+		if in[i].GetOperatorCost() != out[i].GetOperatorCost() || in[i].GetDefaultDecision() != out[i].GetDefaultDecision() {
+			t.Fatalf("Expected decoded expression %q to have the properties of the original", in.Strings()[i])
+		}
+		for _, value := range []string{"", "b", "bc", "5", "us-east"} {
+			if in[i].Matches(value) != out[i].Matches(value) {
+				t.Fatalf("Expected decoded expression %q to match %q like the original", in.Strings()[i], value)
+			}
+		}
+	}
+}
+
+func TestExpressionsMsgpMatchAllOriginalOperator(t *testing.T) {
+	in, err := ParseExpressions([]string{"a=~.*", "a!=~.*"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	encoded, err := in.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+	var out Expressions
+	if _, err := out.UnmarshalMsg(encoded); err != nil {
+		t.Fatalf("Unexpected error when unmarshaling: %s", err)
+	}
+
+	if out[0].GetOperator() != MATCH_ALL || out[1].GetOperator() != MATCH_NONE {
+		t.Fatalf("Expected MATCH_ALL and MATCH_NONE, got %s and %s", out[0].GetOperator(), out[1].GetOperator())
+	}
+	if strs := out.Strings(); strs[0] != "a=~.*" || strs[1] != "a!=~.*" {
+		t.Fatalf("Expected the original operators to be preserved, got %v", out.Strings())
+	}
+}
+
+// before the wire representation existed Expressions were encoded as a list of strings
+func TestExpressionsMsgpLegacyEncoding(t *testing.T) {
+	var legacy []byte
+	legacy = msgp.AppendArrayHeader(legacy, uint32(len(wireTestExpressions)))
+	for _, expr := range wireTestExpressions {
+		legacy = msgp.AppendString(legacy, expr)
+	}
+
+	expected, err := ParseExpressions(wireTestExpressions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var out Expressions
+	rest, err := out.UnmarshalMsg(legacy)
+	if err != nil {
+		t.Fatalf("Unexpected error when unmarshaling: %s", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("Expected all bytes to be consumed, %d were left", len(rest))
+	}
+	if !expected.Equal(out) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", expected.Strings(), out.Strings())
+	}
+
+	out = nil
+	if err := msgp.Decode(bytes.NewReader(legacy), &out); err != nil {
+		t.Fatalf("Unexpected error when decoding: %s", err)
+	}
+	if !expected.Equal(out) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", expected.Strings(), out.Strings())
+	}
+
+	invalid := msgp.AppendString(msgp.AppendArrayHeader(nil, 1), "a=~(b")
+	if _, err := out.UnmarshalMsg(invalid); err == nil {
+		t.Fatalf("Expected an error when decoding an invalid legacy expression, but got none")
+	}
+}
+
+func TestExpressionsMsgpInvalidWire(t *testing.T) {
+	type testCase struct {
+		name        string
+		wire        expressionsWire
+		expectedErr error
+	}
+
+	testCases := []testCase{
+		{
+			name: "unknown version",
+			wire: expressionsWire{Version: expressionsWireVersion + 1},
+		}, {
+			name: "unknown operator",
+			wire: expressionsWire{Version: expressionsWireVersion, Expressions: []expressionWire{{Operator: 1000, Key: "a", Value: "b"}}},
+		}, {
+			name:        "invalid regex",
+			wire:        expressionsWire{Version: expressionsWireVersion, Expressions: []expressionWire{{Operator: uint16(MATCH), Key: "a", Value: "(b"}}},
+			expectedErr: ErrBadRegex,
+		}, {
+			name:        "invalid key",
+			wire:        expressionsWire{Version: expressionsWireVersion, Expressions: []expressionWire{{Operator: uint16(EQUAL), Key: "a;b", Value: "c"}}},
+			expectedErr: ErrInvalidKey,
+		}, {
+			name:        "empty key",
+			wire:        expressionsWire{Version: expressionsWireVersion, Expressions: []expressionWire{{Operator: uint16(NOT_EQUAL), Key: "", Value: "c"}}},
+			expectedErr: ErrInvalidKey,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded, err := tc.wire.MarshalMsg(nil)
+			if err != nil {
+				t.Fatalf("Unexpected error when marshaling: %s", err)
+			}
+			var out Expressions
+			_, err = out.UnmarshalMsg(encoded)
+			if err == nil {
+				t.Fatalf("Expected an error, but got none")
+			}
+			if tc.expectedErr != nil && !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package tagquery
+
+import (
+	"strings"
+
+	"github.com/grafana/metrictank/errors"
+)
+
+// ExpressionFromGraphitePattern takes a plain Graphite target pattern, such as
+// "servers.*.cpu.{user,system}", and returns the equivalent expression on the tag "name".
+// The wildcards "*" and "?" never match the node separator ".", the globs "{a,b}"
+// and "[0-9]" are supported, all other characters are matched literally.
+// If the pattern contains no wildcards at all, an EQUAL expression gets returned,
+// otherwise the pattern gets translated into a regular expression which is anchored
+// at both ends. GetOperator().UsesRegex() can be used to tell the two cases apart.
+func ExpressionFromGraphitePattern(pattern string) (Expression, error) {
+	if len(pattern) == 0 {
+		return nil, errors.NewBadRequestf("Graphite pattern must not be empty")
+	}
+
+	if !strings.ContainsAny(pattern, "*?[{") {
+		return NewExpressionEqual("name", pattern)
+	}
+
+	return NewExpressionMatch("name", globToRegex(pattern, "[^.]*", "[^.]"))
+}
@@ -0,0 +1,70 @@
+package tagquery
+
+import (
+	"testing"
+)
+
+func TestExpressionFromGraphitePattern(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		expect     string
+		usesRegex  bool
+		matches    []string
+		notMatches []string
+	}{
+		{
+			pattern: "servers.web1.cpu.total",
+			expect:  "name=servers.web1.cpu.total",
+		}, {
+			pattern:    "servers.*.cpu.total",
+			expect:     `name=~^(?:servers\.[^.]*\.cpu\.total)$`,
+			usesRegex:  true,
+			matches:    []string{"servers.web1.cpu.total", "servers..cpu.total"},
+			notMatches: []string{"servers.a.b.cpu.total", "servers.web1.cpu.total.x", "serversXweb1.cpu.total"},
+		}, {
+			pattern:    "a.b?.{c,d}",
+			expect:     `name=~^(?:a\.b[^.]\.(?:c|d))$`,
+			usesRegex:  true,
+			matches:    []string{"a.b1.c", "a.bx.d"},
+			notMatches: []string{"a.b.c", "a.b..c", "a.b1.e"},
+		}, {
+			pattern:    "host[0-9].load+1",
+			expect:     `name=~^(?:host[0-9]\.load\+1)$`,
+			usesRegex:  true,
+			matches:    []string{"host3.load+1"},
+			notMatches: []string{"hostx.load+1", "host3.loadd1"},
+		},
+	}
+
+	for _, tc := range tests {
+		e, err := ExpressionFromGraphitePattern(tc.pattern)
+		if err != nil {
+			t.Fatalf("Unexpected error for pattern %q: %s", tc.pattern, err)
+		}
+
+		if res := (Expressions{e}).Strings()[0]; res != tc.expect {
+			t.Fatalf("Expected pattern %q to result in %q, but got %q", tc.pattern, tc.expect, res)
+		}
+
+		if e.GetOperator().UsesRegex() != tc.usesRegex {
+			t.Fatalf("Expected UsesRegex() of %q to be %t", tc.pattern, tc.usesRegex)
+		}
+
+		for _, value := range tc.matches {
+			if !e.Matches(value) {
+				t.Fatalf("Expected %q to match %q", tc.pattern, value)
+			}
+		}
+		for _, value := range tc.notMatches {
+			if e.Matches(value) {
+				t.Fatalf("Expected %q to not match %q", tc.pattern, value)
+			}
+		}
+	}
+
+	for _, pattern := range []string{"", "a.{b,c", "a;b"} {
+		if _, err := ExpressionFromGraphitePattern(pattern); err == nil {
+			t.Fatalf("Expected an error for pattern %q", pattern)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package tagquery
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+var (
+	// metric tagquery.key-intern.ops.hit is a counter of keys of parsed expressions which were already interned
+	keyInternHit = stats.NewCounter32("tagquery.key-intern.ops.hit")
+	// metric tagquery.key-intern.ops.miss is a counter of keys of parsed expressions which were not interned yet, including those which didn't get added because the table is full
+	keyInternMiss = stats.NewCounter32("tagquery.key-intern.ops.miss")
+)
+
+// DefaultKeyInternSize is the number of keys which get interned until SetKeyInternSize gets called
+const DefaultKeyInternSize = 1000
+
+// maxInternedKeyLength is the length of the longest key which gets interned, long keys are
+// unlikely to be common ones and they would let few expressions take up a lot of memory
+const maxInternedKeyLength = 64
+
+// keyInterns holds the *keyInternTable which is used by the parser, or nil if interning is
+// disabled. see SetKeyInternSize
+var keyInterns atomic.Value
+
+func init() {
+	SetKeyInternSize(DefaultKeyInternSize)
+}
+
+// keyInternTable maps the keys of expressions to the copy of them which is shared by all the
+// expressions using that key. once it has reached its capacity no more keys get added, the
+// keys which are already in it stay, so the most common keys are the ones parsed first.
+// the map gets replaced by an updated copy when a key gets added, so lookups neither take a
+// lock nor box the key into an interface. It is safe for concurrent use
+type keyInternTable struct {
+	keys atomic.Value // map[string]string
+
+	sync.Mutex
+	capacity int
+}
+
+func newKeyInternTable(capacity int) *keyInternTable {
+	table := &keyInternTable{capacity: capacity}
+	table.keys.Store(map[string]string{})
+	return table
+}
+
+// SetKeyInternSize sets the number of distinct keys of parsed expressions which get interned.
+// The expressions using an interned key share its storage, instead of each holding onto the
+// expression string it has been parsed from, this reduces the memory used by cached queries.
+// Once the table is full further keys don't get interned anymore, so hostile inputs can't make
+// it grow without bounds. A size <= 0 disables interning. Setting the size replaces the table
+// by an empty one, the expressions which have been parsed before keep their keys
+func SetKeyInternSize(size int) {
+	var table *keyInternTable
+	if size > 0 {
+		table = newKeyInternTable(size)
+	}
+	keyInterns.Store(table)
+}
+
+// internKey returns the interned copy of the given key. if the key is not interned yet, it
+// gets added unless the table is full or the key is too long, then the key is returned as it is
+func internKey(key string) string {
+	table, _ := keyInterns.Load().(*keyInternTable)
+	if table == nil || len(key) > maxInternedKeyLength {
+		return key
+	}
+
+	if interned, ok := table.keys.Load().(map[string]string)[key]; ok {
+		keyInternHit.Inc()
+		return interned
+	}
+	keyInternMiss.Inc()
+
+	// only take the lock if the table isn't full yet, to not make the misses contend on it
+	if len(table.keys.Load().(map[string]string)) >= table.capacity {
+		return key
+	}
+	return table.add(key)
+}
+
+// add adds the given key to the table, unless it is full
+func (k *keyInternTable) add(key string) string {
+	k.Lock()
+	defer k.Unlock()
+
+	keys := k.keys.Load().(map[string]string)
+	// another caller might have added the same key concurrently
+	if interned, ok := keys[key]; ok {
+		return interned
+	}
+	if len(keys) >= k.capacity {
+		return key
+	}
+
+	updated := make(map[string]string, len(keys)+1)
+	for existing := range keys {
+		updated[existing] = existing
+	}
+	// the key usually is a substring of the expression, the copy doesn't keep that alive
+	copied := string([]byte(key))
+	updated[copied] = copied
+	k.keys.Store(updated)
+	return copied
+}
@@ -0,0 +1,123 @@
+package tagquery
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func parseTestKey(t *testing.T, expr string) string {
+	e, err := ParseExpression(expr)
+	if err != nil {
+		t.Fatalf("Unexpected error when parsing %q: %s", expr, err)
+	}
+	return e.GetKey()
+}
+
+func TestInternKey(t *testing.T) {
+	defer SetKeyInternSize(DefaultKeyInternSize)
+	SetKeyInternSize(2)
+
+	expr := "dc=us-east"
+	first := parseTestKey(t, expr)
+	if stringData(first) == stringData(expr) {
+		t.Fatalf("Expected the interned key to not share the storage of the expression")
+	}
+	if second := parseTestKey(t, "dc!=us-west"); stringData(second) != stringData(first) {
+		t.Fatalf("Expected the expressions of the same key to share it")
+	}
+
+	// "__tag=host" uses the key "host"
+	host := parseTestKey(t, "__tag=host")
+	if other := parseTestKey(t, "host=~web.*"); stringData(other) != stringData(host) {
+		t.Fatalf("Expected the expressions of the key host to share it")
+	}
+
+	// the table is full, so further keys don't get interned
+	expr = "env=prod"
+	if key := parseTestKey(t, expr); stringData(key) != stringData(expr) {
+		t.Fatalf("Expected the key of a full table to not get interned")
+	}
+	if second := parseTestKey(t, "dc^=us"); stringData(second) != stringData(first) {
+		t.Fatalf("Expected the keys which had been interned to stay interned")
+	}
+}
+
+func TestInternKeyDisabled(t *testing.T) {
+	defer SetKeyInternSize(DefaultKeyInternSize)
+	SetKeyInternSize(0)
+
+	expr := "dc=us-east"
+	if key := parseTestKey(t, expr); stringData(key) != stringData(expr) {
+		t.Fatalf("Expected the key to not get interned")
+	}
+}
+
+func TestInternKeyTooLong(t *testing.T) {
+	defer SetKeyInternSize(DefaultKeyInternSize)
+	SetKeyInternSize(10)
+
+	expr := strings.Repeat("a", maxInternedKeyLength+1) + "=b"
+	if key := parseTestKey(t, expr); stringData(key) != stringData(expr) {
+		t.Fatalf("Expected a key which is too long to not get interned")
+	}
+}
+
+func TestInternKeyOfDecodedExpressions(t *testing.T) {
+	defer SetKeyInternSize(DefaultKeyInternSize)
+	SetKeyInternSize(10)
+
+	expressions, err := ParseExpressions([]string{"dc=us-east", "dc!=~us-west-[0-9]"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	wire := expressions.toWire()
+	decoded, err := wire.toExpressions()
+	if err != nil {
+		t.Fatalf("Unexpected decoding error: %s", err)
+	}
+	for i := range decoded {
+		if stringData(decoded[i].GetKey()) != stringData(expressions[0].GetKey()) {
+			t.Fatalf("Expected the key of decoded expression %d to be the interned one", i)
+		}
+	}
+}
+
+// TestInternKeyConcurrentUse is meant to be run with the race detector
+func TestInternKeyConcurrentUse(t *testing.T) {
+	defer SetKeyInternSize(DefaultKeyInternSize)
+	SetKeyInternSize(50)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				expr := fmt.Sprintf("key%d=value", (i+worker)%100)
+				e, err := ParseExpression(expr)
+				if err != nil {
+					t.Errorf("Unexpected error when parsing %q: %s", expr, err)
+					return
+				}
+				if e.GetKey() != expr[:strings.IndexByte(expr, '=')] {
+					t.Errorf("Unexpected key %q of expression %q", e.GetKey(), expr)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	table := keyInterns.Load().(*keyInternTable)
+	if size := len(table.keys.Load().(map[string]string)); size != 50 {
+		t.Fatalf("Expected the table to be full with 50 keys, got %d", size)
+	}
+}
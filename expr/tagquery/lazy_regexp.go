@@ -0,0 +1,47 @@
+package tagquery
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+var (
+	// metric tagquery.regex.lazy-compile.ops is a counter of regular expressions which got compiled when they were used the first time, see ParseOptions.LazyRegexCompilation
+	lazyRegexCompile = stats.NewCounter32("tagquery.regex.lazy-compile.ops")
+	// metric tagquery.regex.lazy-compile.errors is a counter of deferred regex compilations which failed, the expressions using them match no value
+	lazyRegexCompileErrors = stats.NewCounter32("tagquery.regex.lazy-compile.errors")
+)
+
+// neverMatchingRegexp is used in place of a pattern which failed to compile
+var neverMatchingRegexp = regexp.MustCompile(`[^\x00-\x{10FFFF}]`)
+
+// lazyRegexp compiles a pattern when it gets used the first time. It is safe for concurrent use
+type lazyRegexp struct {
+	once sync.Once
+	re   *regexp.Regexp
+}
+
+// get returns the compiled pattern of the given value of a regex expression, which gets
+// anchored at the beginning like anchorPattern does if it isn't anchored already. the value
+// gets passed on every call instead of being kept, because after the first call it's not needed.
+// the parser has already parsed the pattern with the same flags as regexp.Compile uses, so
+// compiling it is not expected to fail. if it does anyway, the returned regular expression
+// doesn't match any value, because an expression can't return an error once it's parsed
+func (l *lazyRegexp) get(value string, anchored bool) *regexp.Regexp {
+	l.once.Do(func() {
+		lazyRegexCompile.Inc()
+		pattern := value
+		if !anchored {
+			pattern = "^(?:" + value + ")"
+		}
+		re, err := compileRegex(pattern)
+		if err != nil {
+			lazyRegexCompileErrors.Inc()
+			re = neverMatchingRegexp
+		}
+		l.re = re
+	})
+	return l.re
+}
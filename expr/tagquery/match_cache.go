@@ -0,0 +1,330 @@
+package tagquery
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+// the match caches of all filters report to the same counters, the cached results of values
+// which match the regular expression and of values which don't are counted separately
+var (
+	// metric tagquery.match-cache.match.ops.hit is a counter of match cache hits on values which match the regular expression
+	matchCacheMatchHit = stats.NewCounter32("tagquery.match-cache.match.ops.hit")
+	// metric tagquery.match-cache.miss.ops.hit is a counter of match cache hits on values which don't match the regular expression
+	matchCacheMissHit = stats.NewCounter32("tagquery.match-cache.miss.ops.hit")
+	// metric tagquery.match-cache.ops.miss is a counter of values which were not found in the match cache
+	matchCacheMiss = stats.NewCounter32("tagquery.match-cache.ops.miss")
+	// metric tagquery.match-cache.match.ops.insert is a counter of values which match the regular expression that got added to the match cache
+	matchCacheMatchInsert = stats.NewCounter32("tagquery.match-cache.match.ops.insert")
+	// metric tagquery.match-cache.miss.ops.insert is a counter of values which don't match the regular expression that got added to the match cache
+	matchCacheMissInsert = stats.NewCounter32("tagquery.match-cache.miss.ops.insert")
+	// metric tagquery.match-cache.ops.evict is a counter of values which got evicted from a full match cache to add another one
+	matchCacheEvict = stats.NewCounter32("tagquery.match-cache.ops.evict")
+	// metric tagquery.match-cache.bytes.insert is a counter of the approximate bytes of the values added to match caches
+	matchCacheBytesInsert = stats.NewCounter64("tagquery.match-cache.bytes.insert")
+	// metric tagquery.match-cache.bytes.evict is a counter of the approximate bytes of the values evicted from match caches
+	matchCacheBytesEvict = stats.NewCounter64("tagquery.match-cache.bytes.evict")
+	// metric tagquery.match-cache.ops.bypass is a counter of match caches which stopped caching because their hit ratio was too low
+	matchCacheBypass = stats.NewCounter32("tagquery.match-cache.ops.bypass")
+)
+
+// DefaultMatchCacheSize is the match cache size which applies until SetMatchCacheSize gets called
+const DefaultMatchCacheSize = 1000
+
+var matchCacheSize int32 = DefaultMatchCacheSize
+
+// SetMatchCacheSize sets the number of matches and non-matches which the filters of regex
+// expressions cache, unless ParseOptions.MatchCacheSize was set when parsing them. A value
+// <= 0 disables caching. An expression creates its cache once, when its first filter gets
+// created, so the call only affects the expressions which didn't create their filters yet.
+// It is safe to call it while other filters are in use
+func SetMatchCacheSize(size int) {
+	atomic.StoreInt32(&matchCacheSize, int32(size))
+}
+
+// GetMatchCacheSize returns the match cache size set by SetMatchCacheSize
+func GetMatchCacheSize() int {
+	return int(atomic.LoadInt32(&matchCacheSize))
+}
+
+var matchCacheMaxBytes int64
+
+// SetMatchCacheMaxBytes sets the approximate number of bytes which the match cache of a regex
+// expression may hold, in addition to the limit of SetMatchCacheSize. Whichever of the limits
+// gets reached first makes the cache evict values, see matchCacheEntryBytes. A value <= 0 means
+// there is no limit on the bytes. Like SetMatchCacheSize it only affects the caches which get
+// created after the call
+func SetMatchCacheMaxBytes(bytes int) {
+	atomic.StoreInt64(&matchCacheMaxBytes, int64(bytes))
+}
+
+// GetMatchCacheMaxBytes returns the byte limit set by SetMatchCacheMaxBytes
+func GetMatchCacheMaxBytes() int {
+	return int(atomic.LoadInt64(&matchCacheMaxBytes))
+}
+
+// DefaultMatchCacheBypassMinHitRatio is the hit ratio below which a match cache gets bypassed
+// until SetMatchCacheBypass gets called, if SetMatchCacheBypass enables the bypass at all
+const DefaultMatchCacheBypassMinHitRatio = 0.1
+
+var (
+	matchCacheBypassMinMisses   uint64
+	matchCacheBypassMinHitRatio uint64 = math.Float64bits(DefaultMatchCacheBypassMinHitRatio)
+)
+
+// SetMatchCacheBypass sets when the match cache of a regex expression stops caching because it
+// doesn't help, f.e. for the values of tags which are unique per metric. Once the cache had more
+// than minMisses misses and less than minHitRatio of its lookups were hits, it drops the cached
+// values and the filters of the expression keep executing the regular expression without
+// looking up or adding values to any cache, see StatsCollector.Traces. A minMisses of 0 disables
+// the bypass. Like SetMatchCacheSize it only affects the caches which get created after the call
+func SetMatchCacheBypass(minMisses uint64, minHitRatio float64) {
+	atomic.StoreUint64(&matchCacheBypassMinMisses, minMisses)
+	atomic.StoreUint64(&matchCacheBypassMinHitRatio, math.Float64bits(minHitRatio))
+}
+
+// GetMatchCacheBypass returns the thresholds set by SetMatchCacheBypass
+func GetMatchCacheBypass() (uint64, float64) {
+	return atomic.LoadUint64(&matchCacheBypassMinMisses), math.Float64frombits(atomic.LoadUint64(&matchCacheBypassMinHitRatio))
+}
+
+// matchCacheEntryOverhead approximates what a cached value takes in addition to its bytes: its
+// slot in the ring, its entry and the entry of the sync.Map which points at it
+const matchCacheEntryOverhead = 64
+
+// matchCacheEntryBytes returns the approximate number of bytes which caching the given value takes
+func matchCacheEntryBytes(value string) int64 {
+	return int64(len(value)) + matchCacheEntryOverhead
+}
+
+// matchCache caches the results of matching values against a regular expression. it holds
+// up to a fixed number of values, once it is full every insert evicts a value according to
+// the CLOCK algorithm: each value has a reference bit which gets set when it is looked up,
+// the clock hand moves over the values clearing the bits until it finds one which hasn't
+// been looked up since the last time the hand passed it and replaces that one.
+// this approximates an LRU, so the hot values stay cached and the cold ones get evicted.
+// lookups don't take a lock, only inserts serialize on a mutex.
+// if the cache has a byte limit it also evicts values until the approximate bytes of the cached
+// values leave room for the new one, see matchCacheEntryBytes.
+// if the cache has a bypass it counts its hits and misses, and once its hit ratio shows that it
+// doesn't help it empties itself and doesn't cache anything anymore, see SetMatchCacheBypass.
+// It is safe for concurrent use
+type matchCache struct {
+	// the lookups since the cache got created, they only get counted if bypassMinMisses > 0.
+	// they come first to be 64-bit aligned for the atomic operations
+	hits   uint64
+	misses uint64
+
+	// bypassed is 1 once the cache stopped caching
+	bypassed          uint32
+	bypassMinMisses   uint64
+	bypassMinHitRatio float64
+
+	entries sync.Map // value -> *matchCacheEntry
+
+	sync.Mutex
+	capacity int
+	ring     []matchCacheSlot // the cached values which the clock hand moves over
+	hand     int
+
+	// maxBytes is the limit of the approximate bytes of the cached values, 0 means unlimited.
+	// bytes are the ones of the currently cached values
+	maxBytes int64
+	bytes    int64
+}
+
+type matchCacheSlot struct {
+	value string
+	entry *matchCacheEntry
+}
+
+type matchCacheEntry struct {
+	match      bool
+	referenced uint32
+}
+
+// newMatchCache returns a matchCache which holds up to capacity values,
+// if capacity is <= 0 nothing gets cached
+func newMatchCache(capacity int) *matchCache {
+	return newMatchCacheWithMaxBytes(capacity, 0)
+}
+
+// newMatchCacheWithMaxBytes is like newMatchCache, but the cached values also must not take
+// more than maxBytes, if it is > 0
+func newMatchCacheWithMaxBytes(capacity int, maxBytes int64) *matchCache {
+	if capacity < 0 {
+		capacity = 0
+	}
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	return &matchCache{capacity: capacity, maxBytes: maxBytes}
+}
+
+// withBypass makes the cache stop caching once it had more than minMisses misses while its hit
+// ratio was below minHitRatio. it must be called before the cache gets used
+func (m *matchCache) withBypass(minMisses uint64, minHitRatio float64) *matchCache {
+	m.bypassMinMisses = minMisses
+	m.bypassMinHitRatio = minHitRatio
+	return m
+}
+
+// isBypassed returns true if the cache stopped caching because of its low hit ratio
+func (m *matchCache) isBypassed() bool {
+	return atomic.LoadUint32(&m.bypassed) == 1
+}
+
+// countLookup counts a hit or miss towards the hit ratio and bypasses the cache once the
+// thresholds of the bypass are reached. the bypassed cache drops its values, so the memory
+// they take can be freed
+func (m *matchCache) countLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.hits, 1)
+		return
+	}
+
+	misses := atomic.AddUint64(&m.misses, 1)
+	if misses <= m.bypassMinMisses || m.isBypassed() {
+		return
+	}
+	hits := atomic.LoadUint64(&m.hits)
+	if float64(hits)/float64(hits+misses) >= m.bypassMinHitRatio {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.isBypassed() {
+		return
+	}
+	atomic.StoreUint32(&m.bypassed, 1)
+	matchCacheBypass.Inc()
+	for _, slot := range m.ring {
+		m.entries.Delete(slot.value)
+	}
+	m.ring = nil
+	m.hand = 0
+	m.bytes = 0
+}
+
+// getBytes returns the approximate number of bytes of the cached values
+func (m *matchCache) getBytes() int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.bytes
+}
+
+// get returns the cached result for the given value, the second return value is
+// false if the value is not cached
+func (m *matchCache) get(value string) (bool, bool) {
+	if m.capacity == 0 || m.isBypassed() {
+		return false, false
+	}
+
+	cached, ok := m.entries.Load(value)
+	if m.bypassMinMisses > 0 {
+		m.countLookup(ok)
+	}
+	if !ok {
+		matchCacheMiss.Inc()
+		return false, false
+	}
+
+	entry := cached.(*matchCacheEntry)
+	// only write if necessary, to not invalidate the cache line of hot entries on every lookup
+	if atomic.LoadUint32(&entry.referenced) == 0 {
+		atomic.StoreUint32(&entry.referenced, 1)
+	}
+	if entry.match {
+		matchCacheMatchHit.Inc()
+	} else {
+		matchCacheMissHit.Inc()
+	}
+	return entry.match, true
+}
+
+// add caches the result for the given value, if the cache is full it evicts another value
+func (m *matchCache) add(value string, match bool) {
+	if m.capacity == 0 || m.isBypassed() {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	// the cache might have been bypassed since the caller looked the value up
+	if m.isBypassed() {
+		return
+	}
+
+	// another caller might have added the same value concurrently
+	if _, ok := m.entries.Load(value); ok {
+		return
+	}
+
+	// a value which would take more than the whole byte limit doesn't get cached at all,
+	// instead of evicting everything else
+	bytes := matchCacheEntryBytes(value)
+	if m.maxBytes > 0 && bytes > m.maxBytes {
+		return
+	}
+
+	if match {
+		matchCacheMatchInsert.Inc()
+	} else {
+		matchCacheMissInsert.Inc()
+	}
+	matchCacheBytesInsert.AddUint64(uint64(bytes))
+
+	// evict values until the new one fits into the byte limit, the slots of the evicted
+	// values get removed from the ring
+	for m.maxBytes > 0 && m.bytes+bytes > m.maxBytes {
+		m.advanceHand()
+		m.evictAtHand()
+		last := len(m.ring) - 1
+		m.ring[m.hand] = m.ring[last]
+		m.ring = m.ring[:last]
+		if m.hand >= len(m.ring) {
+			m.hand = 0
+		}
+	}
+
+	entry := &matchCacheEntry{match: match}
+	m.bytes += bytes
+	if len(m.ring) < m.capacity {
+		m.ring = append(m.ring, matchCacheSlot{value: value, entry: entry})
+		m.entries.Store(value, entry)
+		return
+	}
+
+	m.advanceHand()
+	m.evictAtHand()
+	m.ring[m.hand] = matchCacheSlot{value: value, entry: entry}
+	m.entries.Store(value, entry)
+	m.hand = (m.hand + 1) % len(m.ring)
+}
+
+// advanceHand moves the clock hand to the next value which hasn't been looked up since the
+// hand passed it the last time, clearing the reference bits of the values it passes. after
+// at most one full round all reference bits are cleared, so this terminates.
+// the ring must not be empty and the lock must be held
+func (m *matchCache) advanceHand() {
+	for atomic.LoadUint32(&m.ring[m.hand].entry.referenced) == 1 {
+		atomic.StoreUint32(&m.ring[m.hand].entry.referenced, 0)
+		m.hand = (m.hand + 1) % len(m.ring)
+	}
+}
+
+// evictAtHand removes the value under the clock hand from the entries, its slot is left to the
+// caller. the lock must be held
+func (m *matchCache) evictAtHand() {
+	value := m.ring[m.hand].value
+	bytes := matchCacheEntryBytes(value)
+	matchCacheEvict.Inc()
+	matchCacheBytesEvict.AddUint64(uint64(bytes))
+	m.entries.Delete(value)
+	m.bytes -= bytes
+}
@@ -0,0 +1,671 @@
+package tagquery
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/stats"
+)
+
+func TestMatchCacheIsBounded(t *testing.T) {
+	cache := newMatchCache(10)
+	for i := 0; i < 100; i++ {
+		cache.add(fmt.Sprintf("value%d", i), i%2 == 0)
+	}
+
+	cached := 0
+	for i := 0; i < 100; i++ {
+		if match, ok := cache.get(fmt.Sprintf("value%d", i)); ok {
+			cached++
+			if match != (i%2 == 0) {
+				t.Fatalf("Expected cached result of value%d to be %t, got %t", i, i%2 == 0, match)
+			}
+		}
+	}
+	if cached != 10 {
+		t.Fatalf("Expected 10 cached values, got %d", cached)
+	}
+
+	// the most recently added values must be the ones which are cached
+	for i := 90; i < 100; i++ {
+		if _, ok := cache.get(fmt.Sprintf("value%d", i)); !ok {
+			t.Fatalf("Expected value%d to be cached", i)
+		}
+	}
+}
+
+func TestMatchCacheKeepsHotValues(t *testing.T) {
+	cache := newMatchCache(10)
+	for i := 0; i < 5; i++ {
+		cache.add(fmt.Sprintf("hot%d", i), true)
+	}
+
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 5; j++ {
+			if _, ok := cache.get(fmt.Sprintf("hot%d", j)); !ok {
+				t.Fatalf("Expected hot%d to stay cached after adding %d cold values", j, i)
+			}
+		}
+		cache.add(fmt.Sprintf("cold%d", i), false)
+	}
+}
+
+func TestMatchCacheWithoutCapacity(t *testing.T) {
+	cache := newMatchCache(0)
+	cache.add("value", true)
+	if _, ok := cache.get("value"); ok {
+		t.Fatalf("Expected cache without capacity to not cache anything")
+	}
+}
+
+// checkMatchCacheBytes checks that the bytes of the cache are the ones of its cached values and
+// that they don't exceed its limit
+func checkMatchCacheBytes(t *testing.T, cache *matchCache) {
+	t.Helper()
+
+	expected := int64(0)
+	for _, slot := range cache.ring {
+		// not using get, because it would mark the values as referenced
+		if _, ok := cache.entries.Load(slot.value); !ok {
+			t.Fatalf("Expected %q of the ring to be cached", slot.value)
+		}
+		expected += matchCacheEntryBytes(slot.value)
+	}
+	entries := 0
+	cache.entries.Range(func(_, _ interface{}) bool {
+		entries++
+		return true
+	})
+	if entries != len(cache.ring) {
+		t.Fatalf("Expected %d entries like the ring has values, got %d", len(cache.ring), entries)
+	}
+
+	if res := cache.getBytes(); res != expected {
+		t.Fatalf("Expected the cache to account for %d bytes, got %d", expected, res)
+	}
+	if cache.maxBytes > 0 && expected > cache.maxBytes {
+		t.Fatalf("Expected the cache to hold at most %d bytes, got %d", cache.maxBytes, expected)
+	}
+}
+
+func TestMatchCacheMaxBytes(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	cache := newMatchCacheWithMaxBytes(1000, 20*matchCacheEntryOverhead)
+	for i := 0; i < 1000; i++ {
+		value := fmt.Sprintf("%d-%s", i, strings.Repeat("x", random.Intn(200)))
+		cache.add(value, i%2 == 0)
+		checkMatchCacheBytes(t, cache)
+
+		// the new value must have been cached, some of the others got evicted for it
+		if match, ok := cache.get(value); !ok || match != (i%2 == 0) {
+			t.Fatalf("Expected %q to be cached with the result %t, got %t, %t", value, i%2 == 0, match, ok)
+		}
+		if len(cache.ring) >= 20 {
+			t.Fatalf("Expected the byte limit to be reached before the values of %d bytes fill 20 slots, got %d", len(value), len(cache.ring))
+		}
+	}
+
+	// hot values stay cached like with the limit on the entries
+	cache.add("hot", true)
+	for i := 0; i < 100; i++ {
+		if _, ok := cache.get("hot"); !ok {
+			t.Fatalf("Expected hot to stay cached after adding %d values", i)
+		}
+		cache.add(fmt.Sprintf("%d-%s", i, strings.Repeat("y", random.Intn(200))), false)
+		checkMatchCacheBytes(t, cache)
+	}
+}
+
+func TestMatchCacheMaxBytesAndEntries(t *testing.T) {
+	// short values reach the limit on the entries first
+	cache := newMatchCacheWithMaxBytes(10, 100*matchCacheEntryOverhead)
+	for i := 0; i < 100; i++ {
+		cache.add(fmt.Sprintf("value%d", i), true)
+		checkMatchCacheBytes(t, cache)
+	}
+	if len(cache.ring) != 10 {
+		t.Fatalf("Expected 10 cached values, got %d", len(cache.ring))
+	}
+
+	// a long value evicts as many as it needs to fit, 3 of the 71 bytes values fit next to it
+	long := strings.Repeat("z", 95*matchCacheEntryOverhead)
+	cache.add(long, true)
+	checkMatchCacheBytes(t, cache)
+	if _, ok := cache.get(long); !ok || len(cache.ring) != 4 {
+		t.Fatalf("Expected the long value to be cached with 3 others, got %t with %d values", ok, len(cache.ring)-1)
+	}
+
+	// a value which doesn't fit into the limit at all doesn't get cached
+	tooLong := strings.Repeat("z", 100*matchCacheEntryOverhead)
+	cache.add(tooLong, true)
+	checkMatchCacheBytes(t, cache)
+	if _, ok := cache.get(tooLong); ok || len(cache.ring) != 4 {
+		t.Fatalf("Expected the value beyond the limit to not be cached and to not evict anything, got %t with %d values", ok, len(cache.ring))
+	}
+}
+
+func TestMatchCacheMaxBytesOfExpressions(t *testing.T) {
+	defer SetMatchCacheMaxBytes(GetMatchCacheMaxBytes())
+	SetMatchCacheMaxBytes(1000)
+
+	expressions, err := ParseExpressions([]string{"dc=~us-[a-z]+"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filter := expressions[0].GetMetricDefinitionFilter(nil)
+	for i := 0; i < 100; i++ {
+		filter(schema.MKey{}, "a.b", []string{"dc=us-" + strings.Repeat("a", i)})
+	}
+
+	cache := expressions[0].(*expressionMatch).getMatchCache()
+	if cache.maxBytes != 1000 {
+		t.Fatalf("Expected the cache of the expression to have the byte limit 1000, got %d", cache.maxBytes)
+	}
+	checkMatchCacheBytes(t, cache)
+}
+
+func TestMatchCacheBypass(t *testing.T) {
+	cache := newMatchCache(100).withBypass(10, 0.5)
+
+	// few distinct values keep the hit ratio high
+	for i := 0; i < 100; i++ {
+		value := fmt.Sprintf("value%d", i%5)
+		if _, ok := cache.get(value); !ok {
+			cache.add(value, true)
+		}
+	}
+	if cache.isBypassed() {
+		t.Fatalf("Expected the cache with a hit ratio of %d/%d to not be bypassed", cache.hits, cache.hits+cache.misses)
+	}
+
+	// unique values make it drop
+	for i := 0; cache.misses <= 200; i++ {
+		value := fmt.Sprintf("unique%d", i)
+		if _, ok := cache.get(value); !ok {
+			cache.add(value, true)
+		}
+		if cache.isBypassed() {
+			break
+		}
+	}
+	if !cache.isBypassed() {
+		t.Fatalf("Expected the cache with a hit ratio of %d/%d to be bypassed", cache.hits, cache.hits+cache.misses)
+	}
+	if len(cache.ring) != 0 || cache.getBytes() != 0 {
+		t.Fatalf("Expected the bypassed cache to be empty, got %d values with %d bytes", len(cache.ring), cache.getBytes())
+	}
+	cache.add("value0", true)
+	if _, ok := cache.get("value0"); ok {
+		t.Fatalf("Expected the bypassed cache to not cache values anymore")
+	}
+}
+
+func TestMatchCacheBypassOfUniqueValues(t *testing.T) {
+	defer SetMatchCacheBypass(GetMatchCacheBypass())
+
+	metrics := 1000
+	testCases := []struct {
+		minMisses     uint64
+		minHitRatio   float64
+		expectMisses  uint64
+		expectBypass  uint64
+		expectEntries int
+	}{
+		// the default doesn't bypass the cache, it keeps caching every value
+		{minMisses: 0, minHitRatio: DefaultMatchCacheBypassMinHitRatio, expectMisses: 1000, expectBypass: 0, expectEntries: 1000},
+		{minMisses: 100, minHitRatio: 0.1, expectMisses: 101, expectBypass: 899, expectEntries: 0},
+		// no hit ratio is below 0, so the cache never gets bypassed
+		{minMisses: 100, minHitRatio: 0, expectMisses: 1000, expectBypass: 0, expectEntries: 1000},
+	}
+
+	for i, tc := range testCases {
+		SetMatchCacheBypass(tc.minMisses, tc.minHitRatio)
+		opts := DefaultParseOptions()
+		opts.MatchCacheSize = metrics
+		expressions, err := ParseExpressionsWithOptions([]string{"host=~w.b-[0-9]+"}, opts)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected parsing error: %s", i, err)
+		}
+
+		collector := NewStatsCollector(expressions)
+		filters, _ := expressions.GetMetricDefinitionFiltersWithStats(nil, nil, collector)
+		for j := 0; j < metrics; j++ {
+			if res := filters[0](schema.MKey{}, "a.b", []string{fmt.Sprintf("host=web-%d", j)}); res != Pass {
+				t.Fatalf("TC %d: Expected the filter to pass metric %d, got %s", i, j, res)
+			}
+		}
+
+		stats := collector.Stats(0)
+		if stats.RegexExecutions != uint64(metrics) || stats.CacheMisses != tc.expectMisses || stats.CacheBypasses != tc.expectBypass {
+			t.Fatalf("TC %d: Expected %d regex executions, %d cache misses and %d cache bypasses, got %+v", i, metrics, tc.expectMisses, tc.expectBypass, stats)
+		}
+		if entries := len(expressions[0].(*expressionMatch).getMatchCache().ring); entries != tc.expectEntries {
+			t.Fatalf("TC %d: Expected the cache to have %d values, got %d", i, tc.expectEntries, entries)
+		}
+		if summary := collector.Summary(); strings.Contains(summary, "cache-bypasses=") != (tc.expectBypass > 0) {
+			t.Fatalf("TC %d: Unexpected summary: %s", i, summary)
+		}
+	}
+}
+
+func TestMatchCacheConcurrentUse(t *testing.T) {
+	cache := newMatchCache(50)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				value := fmt.Sprintf("value%d", (i*7+worker)%200)
+				if match, ok := cache.get(value); ok && match != (len(value)%2 == 0) {
+					t.Errorf("Unexpected cached result %t for %s", match, value)
+					return
+				}
+				cache.add(value, len(value)%2 == 0)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if len(cache.ring) != 50 {
+		t.Fatalf("Expected the cache to be full with 50 values, got %d", len(cache.ring))
+	}
+}
+
+// TestMatchCacheSizeUnderConcurrentInserts is meant to be run with the race detector,
+// the inserts of concurrent filter calls must never make the cache exceed its capacity,
+// also not when they insert the same values at the same time
+func TestMatchCacheSizeUnderConcurrentInserts(t *testing.T) {
+	const capacity = 64
+	cache := newMatchCache(capacity)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for worker := 0; worker < 32; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 2000; i++ {
+				// half of the workers insert the same values as another one
+				value := fmt.Sprintf("value%d-%d", worker/2, i)
+				if _, ok := cache.get(value); !ok {
+					cache.add(value, i%2 == 0)
+				}
+			}
+		}(worker)
+	}
+	close(start)
+	wg.Wait()
+
+	entries := 0
+	cache.entries.Range(func(_, _ interface{}) bool {
+		entries++
+		return true
+	})
+	if entries != capacity || len(cache.ring) != capacity {
+		t.Fatalf("Expected the cache to hold %d values, but it has %d entries and %d slots", capacity, entries, len(cache.ring))
+	}
+	for _, slot := range cache.ring {
+		if cached, ok := cache.entries.Load(slot.value); !ok || cached.(*matchCacheEntry) != slot.entry {
+			t.Fatalf("Expected the value %q of the ring to be cached with the same entry", slot.value)
+		}
+	}
+}
+
+func TestMatchCacheSizeOfParseOptions(t *testing.T) {
+	type testCase struct {
+		size            int
+		regexExecutions uint64
+	}
+
+	// the filter gets evaluated 3 times against the same value
+	testCases := []testCase{
+		{size: 0, regexExecutions: 1},
+		{size: 10, regexExecutions: 1},
+		{size: -1, regexExecutions: 3},
+	}
+
+	for i, tc := range testCases {
+		opts := DefaultParseOptions()
+		opts.MatchCacheSize = tc.size
+		expressions, err := ParseExpressionsWithOptions([]string{"dc=~us-[a-z]+"}, opts)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected parsing error: %s", i, err)
+		}
+
+		collector := NewStatsCollector(expressions)
+		filters, _ := expressions.GetMetricDefinitionFiltersWithStats(nil, nil, collector)
+		for j := 0; j < 3; j++ {
+			filters[0](schema.MKey{}, "a.b", []string{"dc=us-east"})
+		}
+
+		if res := collector.Stats(0).RegexExecutions; res != tc.regexExecutions {
+			t.Fatalf("TC %d: Expected %d regex executions with match cache size %d, got %d", i, tc.regexExecutions, tc.size, res)
+		}
+	}
+}
+
+func TestFiltersReuseMatchCache(t *testing.T) {
+	for _, expression := range []string{"dc=~us-[a-z]+", "dc!=~us-[a-z]+", "__tag=~d[a-z]?c"} {
+		expressions, err := ParseExpressions([]string{expression})
+		if err != nil {
+			t.Fatalf("Unexpected parsing error: %s", err)
+		}
+
+		// the filters of a second query with the same expression find the value cached
+		for query, expectedHits := range []uint64{0, 1} {
+			collector := NewStatsCollector(expressions)
+			filters, _ := expressions.GetMetricDefinitionFiltersWithStats(nil, nil, collector)
+			filters[0](schema.MKey{}, "a.b", []string{"dc=us-east"})
+			if stats := collector.Stats(0); stats.CacheHits != expectedHits || stats.RegexExecutions != 1-expectedHits {
+				t.Fatalf("Query %d: Expected %d cache hits of %q, got %+v", query, expectedHits, expression, stats)
+			}
+		}
+	}
+}
+
+// TestMemoizedFilterConcurrentFirstCalls is meant to be run with the race detector
+func TestMemoizedFilterConcurrentFirstCalls(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"dc=~us-[a-z]+"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			filter := expressions[0].GetMetricDefinitionFilter(nil)
+			for i := 0; i < 100; i++ {
+				tags := []string{fmt.Sprintf("dc=us-%c", 'a'+(i+worker)%26)}
+				if res := filter(schema.MKey{}, "a.b", tags); res != Pass {
+					t.Errorf("Expected %v to pass, got %s", tags, res)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// all workers filled the same cache, so none of the values needs to be matched again
+	collector := NewStatsCollector(expressions)
+	filters, _ := expressions.GetMetricDefinitionFiltersWithStats(nil, nil, collector)
+	for c := 'a'; c <= 'z'; c++ {
+		filters[0](schema.MKey{}, "a.b", []string{fmt.Sprintf("dc=us-%c", c)})
+	}
+	if stats := collector.Stats(0); stats.CacheHits != 26 || stats.RegexExecutions != 0 {
+		t.Fatalf("Expected all 26 values to be cached, got %+v", stats)
+	}
+}
+
+// TestSetMatchCacheSizeConcurrently is meant to be run with the race detector
+func TestSetMatchCacheSizeConcurrently(t *testing.T) {
+	defer SetMatchCacheSize(GetMatchCacheSize())
+
+	expressions, err := ParseExpressions([]string{"dc=~us-[a-z]+", "host!=~web-[12]$"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	stop := make(chan struct{})
+	setterDone := make(chan struct{})
+	go func() {
+		defer close(setterDone)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				SetMatchCacheSize(i % 20)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				filter := expressions.GetMetricDefinitionFilter(nil, nil)
+				host := (i + worker) % 5
+				tags := []string{"dc=us-east", fmt.Sprintf("host=web-%d", host)}
+				expected := Pass
+				if host == 1 || host == 2 {
+					expected = Fail
+				}
+				for j := 0; j < 3; j++ {
+					if res := filter(schema.MKey{}, "a.b", tags); res != expected {
+						t.Errorf("Expected decision %s for tags %v, got %s", expected, tags, res)
+						return
+					}
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	close(stop)
+	<-setterDone
+}
+
+// fillOnceMatcher is the cache which getCachedMatcher used before matchCache, it stops
+// caching new values once it is full. it is only kept to compare the benchmarks against
+func fillOnceMatcher(re *regexp.Regexp, size int, instrumentation filterInstrumentation) func(value string) bool {
+	var matchCache, missCache sync.Map
+	var currentMatchCacheSize, currentMissCacheSize int32
+
+	return func(value string) bool {
+		if _, ok := missCache.Load(value); ok {
+			instrumentation.cacheHit()
+			return false
+		}
+		if _, ok := matchCache.Load(value); ok {
+			instrumentation.cacheHit()
+			return true
+		}
+
+		instrumentation.cacheMiss()
+		if re.MatchString(value) {
+			if atomic.LoadInt32(&currentMatchCacheSize) < int32(size) {
+				matchCache.Store(value, struct{}{})
+				atomic.AddInt32(&currentMatchCacheSize, 1)
+			}
+			return true
+		}
+		if atomic.LoadInt32(&currentMissCacheSize) < int32(size) {
+			missCache.Store(value, struct{}{})
+			atomic.AddInt32(&currentMissCacheSize, 1)
+		}
+		return false
+	}
+}
+
+// skewedValues returns a sequence of values of which the frequencies follow a zipf
+// distribution. if coldStart is true the sequence begins with values which are never
+// seen again, like when the first metrics a query looks at have rare values
+func skewedValues(count, distinct, cacheSize int, coldStart bool) []string {
+	random := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(random, 1.1, 1, uint64(distinct-1))
+
+	res := make([]string, 0, count)
+	if coldStart {
+		for i := 0; i < 2*cacheSize; i++ {
+			res = append(res, fmt.Sprintf("cold-host%d.example.com", i))
+		}
+	}
+	for len(res) < count {
+		res = append(res, fmt.Sprintf("host%d.example.com", zipf.Uint64()))
+	}
+	return res
+}
+
+func benchmarkMatchCache(b *testing.B, clock, coldStart bool) {
+	const cacheSize = 1000
+	values := skewedValues(100000, 100000, cacheSize, coldStart)
+	re := regexp.MustCompile("^(?:.*host[0-9]*[13579].*\\.example\\.(com|net)$)")
+
+	var stats ExpressionStats
+	instrumentation := filterInstrumentation{stats: &stats}
+	var matches func(string) bool
+	if clock {
+		e := &expressionCommonRe{valueRe: re, matchCacheSize: cacheSize}
+		matches = e.getCachedMatcher(instrumentation)
+	} else {
+		matches = fillOnceMatcher(re, cacheSize, instrumentation)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matches(values[i%len(values)])
+	}
+	b.StopTimer()
+
+	snapshot := stats.load()
+	b.Logf("hit rate %.1f%% (%d hits, %d misses)", 100*float64(snapshot.CacheHits)/float64(snapshot.CacheHits+snapshot.CacheMisses), snapshot.CacheHits, snapshot.CacheMisses)
+}
+
+func BenchmarkMatchCacheSkewedFillOnce(b *testing.B) {
+	benchmarkMatchCache(b, false, false)
+}
+
+func BenchmarkMatchCacheSkewedClock(b *testing.B) {
+	benchmarkMatchCache(b, true, false)
+}
+
+func BenchmarkMatchCacheSkewedColdStartFillOnce(b *testing.B) {
+	benchmarkMatchCache(b, false, true)
+}
+
+func BenchmarkMatchCacheSkewedColdStartClock(b *testing.B) {
+	benchmarkMatchCache(b, true, true)
+}
+
+func TestMatchCacheStats(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.MatchCacheSize = 1
+	expressions, err := ParseExpressionsWithOptions([]string{"dc=~.*us-[a-z]+"}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	counters := []*stats.Counter32{matchCacheMatchHit, matchCacheMissHit, matchCacheMiss, matchCacheMatchInsert, matchCacheMissInsert, matchCacheEvict}
+	before := make([]uint32, len(counters))
+	for i := range counters {
+		before[i] = counters[i].Peek()
+	}
+
+	// the cache of the filter holds 2 * MatchCacheSize = 2 values
+	filter := expressions.GetMetricDefinitionFilter(nil, nil)
+	for _, dc := range []string{"us-east", "us-east", "eu-west", "eu-west", "us-west", "us-east"} {
+		filter(schema.MKey{}, "a.b", []string{"dc=" + dc})
+	}
+
+	// us-east and eu-west get inserted and hit once each. both have been referenced,
+	// so us-west evicts the one the clock hand reaches first after one round, us-east,
+	// which then gets inserted again and evicts eu-west
+	expected := []uint32{1, 1, 4, 3, 1, 2}
+	for i := range counters {
+		if res := counters[i].Peek() - before[i]; res != expected[i] {
+			t.Fatalf("Expected counter %d to increase by %d, got %d", i, expected[i], res)
+		}
+	}
+}
+
+func TestCachedMatcherLiteralPrefix(t *testing.T) {
+	type testCase struct {
+		pattern        string
+		prefix         string
+		prefixComplete bool
+	}
+
+	testCases := []testCase{
+		{pattern: "us-east-[0-9]+", prefix: "us-east-"},
+		{pattern: "abc", prefix: "abc", prefixComplete: true},
+		{pattern: "abc[0-9]$", prefix: "abc"},
+		{pattern: "abc|abd", prefix: "ab"},
+		{pattern: "a|b"},
+		{pattern: "(?i)abc"},
+		{pattern: ".*abc"},
+		{pattern: "\\.abc.+", prefix: ".abc"},
+	}
+
+	values := []string{"", "a", "ab", "abc", "abc1", "abcd", "abd", "ABC", "xabc", ".abc", ".abcd", "b", "us-east-1", "us-east-", "us-west-1"}
+
+	for i, tc := range testCases {
+		expression, err := ParseExpression("key=~" + tc.pattern)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected parsing error: %s", i, err)
+		}
+		e, ok := expression.(*expressionMatch)
+		if !ok {
+			t.Fatalf("TC %d: Expected a match expression, got %T", i, expression)
+		}
+
+		prefix, prefixComplete := e.literalPrefix, e.prefixComplete
+		if prefix != tc.prefix || prefixComplete != tc.prefixComplete {
+			t.Fatalf("TC %d: Expected literal prefix %q/%t for pattern %q, got %q/%t", i, tc.prefix, tc.prefixComplete, tc.pattern, prefix, prefixComplete)
+		}
+
+		matches := e.getCachedMatcher(filterInstrumentation{})
+		for _, value := range values {
+			if res, expected := matches(value), e.valueRe.MatchString(value); res != expected {
+				t.Fatalf("TC %d: Expected matching %q against %q to return %t, got %t", i, value, tc.pattern, expected, res)
+			}
+		}
+	}
+}
+
+// unprefixedValues returns values of which only every 10th starts with "us-east-"
+func unprefixedValues() []string {
+	res := make([]string, 1000)
+	for i := range res {
+		switch i % 10 {
+		case 0:
+			res[i] = fmt.Sprintf("us-east-%d", i)
+		case 1, 2, 3:
+			res[i] = fmt.Sprintf("us-west-%d", i)
+		default:
+			res[i] = fmt.Sprintf("eu-central-%d", i)
+		}
+	}
+	return res
+}
+
+func BenchmarkCachedMatcherMostlyUnprefixedValues(b *testing.B) {
+	values := unprefixedValues()
+	expression, err := ParseExpression("dc=~us-east-[0-9]+$")
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+	e := expression.(*expressionMatch)
+	// without caching every value which passes the prefix check executes the regex
+	e.matchCacheSize = -1
+	matches := e.getCachedMatcher(filterInstrumentation{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matches(values[i%len(values)])
+	}
+}
+
+func BenchmarkRegexMostlyUnprefixedValues(b *testing.B) {
+	values := unprefixedValues()
+	re := regexp.MustCompile("^(?:us-east-[0-9]+$)")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		re.MatchString(values[i%len(values)])
+	}
+}
@@ -1,8 +1,12 @@
 package tagquery
 
 import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
 	"github.com/grafana/metrictank/errors"
-	"github.com/grafana/metrictank/schema"
 )
 
 type MetaTagRecord struct {
@@ -10,7 +14,67 @@ type MetaTagRecord struct {
 	Expressions Expressions `json:"expressions"`
 }
 
+// the errors returned by MetaTagRecord.Validate satisfy ErrInvalidMetaTagRecord when
+// checked with errors.Is, ErrReservedMetaTagKey and ErrPseudoTagInMetaTagRecord describe
+// the reason in more detail
+var (
+	ErrInvalidMetaTagRecord     = errors.NewBadRequest("invalid meta tag record")
+	ErrReservedMetaTagKey       = errors.NewBadRequest("meta tag key is reserved")
+	ErrPseudoTagInMetaTagRecord = errors.NewBadRequest("meta tag record query must not use the pseudo tags __lastUpdate__ and __interval__")
+)
+
+// MetaTagRecordQueryError is returned by MetaTagRecord.Validate if the expressions of a
+// record don't make a valid query, the reason can be obtained with errors.Unwrap
+type MetaTagRecordQueryError struct {
+	Err error
+}
+
+func (m MetaTagRecordQueryError) Error() string {
+	return fmt.Sprintf("Invalid query of meta tag record: %s", m.Err.Error())
+}
+
+func (m MetaTagRecordQueryError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (m MetaTagRecordQueryError) Unwrap() error {
+	return m.Err
+}
+
+func (m MetaTagRecordQueryError) Is(target error) bool {
+	return target == ErrInvalidMetaTagRecord
+}
+
+// InvalidMetaTagError is returned by MetaTagRecord.Validate if one of the meta tags of
+// a record can't be assigned to metrics, the reason can be obtained with errors.Unwrap
+type InvalidMetaTagError struct {
+	Tag Tag
+	Err error
+}
+
+func (i InvalidMetaTagError) Error() string {
+	return fmt.Sprintf("Invalid meta tag \"%s=%s\": %s", i.Tag.Key, i.Tag.Value, i.Err.Error())
+}
+
+func (i InvalidMetaTagError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (i InvalidMetaTagError) Unwrap() error {
+	return i.Err
+}
+
+func (i InvalidMetaTagError) Is(target error) bool {
+	return target == ErrInvalidMetaTagRecord
+}
+
 func ParseMetaTagRecord(metaTags []string, expressions []string) (MetaTagRecord, error) {
+	return ParseMetaTagRecordWithOptions(metaTags, expressions, defaultParseOptions)
+}
+
+// ParseMetaTagRecordWithOptions is the same as ParseMetaTagRecord, but it takes options to
+// control the parsing of the expressions
+func ParseMetaTagRecordWithOptions(metaTags []string, expressions []string, opts ParseOptions) (MetaTagRecord, error) {
 	res := MetaTagRecord{}
 	var err error
 
@@ -19,37 +83,88 @@ func ParseMetaTagRecord(metaTags []string, expressions []string) (MetaTagRecord,
 		return res, err
 	}
 
-	res.Expressions, err = ParseExpressions(expressions)
+	res.Expressions, err = ParseExpressionsWithOptions(expressions, opts)
 	if err != nil {
 		return res, err
 	}
 
+	return res, res.Validate()
+}
+
+// Validate checks whether the meta tag record can be applied to metrics. It returns a
+// MetaTagRecordQueryError if the expressions don't make a valid query, if none of them
+// requires a non-empty value, because the record would apply to nearly every metric, if
+// one of them uses a pseudo tag, because the properties of the metrics which those compare
+// aren't available when a record gets applied, or if two of them contradict each other.
+// It returns an InvalidMetaTagError if the key of a meta tag is invalid, or if it is "name"
+// or starts with "__", because those keys are reserved for the metric name and the special
+// tags of the tag query syntax
+func (m *MetaTagRecord) Validate() error {
+	if len(m.Expressions) == 0 {
+		return MetaTagRecordQueryError{Err: errors.NewBadRequestf("Meta Tag Record must have at least one query")}
+	}
+
+	if m.Expressions.findInitialExpression() < 0 {
+		return MetaTagRecordQueryError{Err: ErrNoInitialExpression}
+	}
+
+	for _, expression := range m.Expressions {
+		if _, ok := expression.(MetricPropertyExpression); ok {
+			return MetaTagRecordQueryError{Err: ErrPseudoTagInMetaTagRecord}
+		}
+	}
+
 	// we don't actually need to instantiate a query at this point, but we want to verify
 	// that it is possible to instantiate a query from the given meta record expressions.
 	// if we can't instantiate a query from the given expressions, then the meta record
 	// upsert request should be considered invalid and should get rejected.
-	_, err = NewQuery(res.Expressions, 0)
+	// NewQuery sorts the expressions, so they get copied to keep their order
+	expressions := make(Expressions, len(m.Expressions))
+	copy(expressions, m.Expressions)
+	query, err := NewQuery(expressions, 0, 0)
 	if err != nil {
-		return res, errors.NewBadRequestf("Failed to instantiate query from given expressions: %s", err)
+		return MetaTagRecordQueryError{Err: err}
+	}
+	if err := query.Contradiction(); err != nil {
+		return MetaTagRecordQueryError{Err: err}
 	}
 
-	if len(res.Expressions) == 0 {
-		return res, errors.NewBadRequestf("Meta Tag Record must have at least one query")
+	for _, tag := range m.MetaTags {
+		if err := validateQueryExpressionTagKey(tag.Key, defaultParseOptions.KeyValidation); err != nil {
+			return InvalidMetaTagError{Tag: tag, Err: err}
+		}
+		if tag.Key == "name" || strings.HasPrefix(tag.Key, "__") {
+			return InvalidMetaTagError{Tag: tag, Err: ErrReservedMetaTagKey}
+		}
 	}
 
-	return res, nil
+	return nil
 }
 
 // Equals takes another MetaTagRecord and compares all its properties to its
-// own properties. It is assumed that the expressions of both meta tag records
-// are already sorted.
+// own properties, see Equal
 func (m *MetaTagRecord) Equals(other *MetaTagRecord) bool {
+	return m.Equal(other)
+}
+
+// Equal returns true if the other MetaTagRecord has the same set of expressions and
+// the same set of meta tags. Neither the order of the expressions nor the order of
+// the meta tags matters, so records which only differ in the order in which they
+// have been specified are equal
+func (m *MetaTagRecord) Equal(other *MetaTagRecord) bool {
 	if len(m.MetaTags) != len(other.MetaTags) {
 		return false
 	}
 
-	for i := range m.MetaTags {
-		if m.MetaTags[i] != other.MetaTags[i] {
+	if !m.MetaTags.Equal(other.MetaTags) {
+		// the common case is that the meta tags are sorted,
+		// only sort copies of them if that's not the case
+		sorted, otherSorted := make(Tags, len(m.MetaTags)), make(Tags, len(other.MetaTags))
+		copy(sorted, m.MetaTags)
+		copy(otherSorted, other.MetaTags)
+		sorted.Sort()
+		otherSorted.Sort()
+		if !sorted.Equal(otherSorted) {
 			return false
 		}
 	}
@@ -58,24 +173,28 @@ func (m *MetaTagRecord) Equals(other *MetaTagRecord) bool {
 }
 
 // HashExpressions returns a hash of all expressions in this meta tag record
-// It is assumed that the expressions are already sorted
+// It hashes the canonical form of the expressions, so records with equivalent
+// expressions get the same hash regardless of their order. Records which are
+// Equal always have the same hash
 func (m *MetaTagRecord) HashExpressions() uint32 {
 	h := QueryHash()
-	for _, expression := range m.Expressions {
-		expression.StringIntoWriter(h)
-
-		// trailing ";" doesn't matter, this is only hash input
-		h.WriteString(";")
-	}
+	h.WriteString(m.Expressions.CanonicalString())
 
 	return h.Sum32()
 }
 
 // HashMetaTags returns a hash of all meta tags in this meta tag record
-// It is assumed that the meta tags are already sorted
+// The meta tags get hashed in sorted order, so their order doesn't matter
 func (m *MetaTagRecord) HashMetaTags() uint32 {
+	metaTags := m.MetaTags
+	if !sort.IsSorted(metaTags) {
+		metaTags = make(Tags, len(m.MetaTags))
+		copy(metaTags, m.MetaTags)
+		metaTags.Sort()
+	}
+
 	h := QueryHash()
-	for _, metaTag := range m.MetaTags {
+	for _, metaTag := range metaTags {
 		metaTag.StringIntoWriter(h)
 
 		// trailing ";" doesn't matter, this is only hash input
@@ -98,31 +217,17 @@ func (m *MetaTagRecord) HasMetaTags() bool {
 	return len(m.MetaTags) > 0
 }
 
+// GetMetricDefinitionFilter returns a filter which decides whether a metric satisfies the
+// expressions of the meta tag record. the filters of meta tag records get evaluated against
+// all the tags of a metric, so if an expression can't come to a decision its default decision
+// applies
 func (m *MetaTagRecord) GetMetricDefinitionFilter(lookup IdTagLookup) MetricDefinitionFilter {
-	filters := make([]MetricDefinitionFilter, len(m.Expressions))
-	defaultDecisions := make([]FilterDecision, len(m.Expressions))
-	for i, expr := range m.Expressions {
-		filters[i] = expr.GetMetricDefinitionFilter(lookup)
-		defaultDecisions[i] = expr.GetDefaultDecision()
-	}
-
-	return func(id schema.MKey, name string, tags []string) FilterDecision {
-		for i := range filters {
-			decision := filters[i](id, name, tags)
-
-			if decision == None {
-				return defaultDecisions[i]
-			}
-
-			if decision == Pass {
-				continue
-			}
-
-			if decision == Fail {
-				return Fail
-			}
-		}
+	return m.Expressions.GetMetricDefinitionFilter(lookup, nil)
+}
 
-		return Pass
-	}
+// GetMetricDefinitionFilterWithMemo is like GetMetricDefinitionFilter, but the decisions of the
+// expressions get memoized in the given memo, so the records which share an expression only
+// evaluate it once per metric. The memo is optional
+func (m *MetaTagRecord) GetMetricDefinitionFilterWithMemo(lookup IdTagLookup, memo *DecisionMemo) MetricDefinitionFilter {
+	return m.Expressions.GetMetricDefinitionFilterWithMemo(lookup, nil, memo)
 }
@@ -3,6 +3,9 @@ package tagquery
 import (
 	"reflect"
 	"testing"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/schema"
 )
 
 func TestParseMetaTagRecord(t *testing.T) {
@@ -67,3 +70,163 @@ func TestErrorOnParsingMetaTagRecordWithValidExpressionsButInvalidQuery(t *testi
 		t.Fatalf("Expected an error, but did not get one")
 	}
 }
+
+func TestMetaTagRecordMetricDefinitionFilter(t *testing.T) {
+	_metaTagSupport := MetaTagSupport
+	MetaTagSupport = true
+	defer func() { MetaTagSupport = _metaTagSupport }()
+
+	// the first expression can't decide for metrics which don't have the tag "a",
+	// its default decision must not make the record skip the second expression
+	record, err := ParseMetaTagRecord([]string{"c=d"}, []string{"a!=x", "b=y"})
+	if err != nil {
+		t.Fatalf("Unexpected error when parsing meta tag record: %s", err)
+	}
+
+	var tags []string
+	lookup := func(_ schema.MKey, tag, value string) bool {
+		for _, t := range tags {
+			if t == tag+"="+value {
+				return true
+			}
+		}
+		return false
+	}
+	filter := record.GetMetricDefinitionFilter(lookup)
+
+	type testCase struct {
+		tags     []string
+		expected FilterDecision
+	}
+
+	testCases := []testCase{
+		{tags: []string{"b=y"}, expected: Pass},
+		{tags: []string{"b=z"}, expected: Fail},
+		{tags: []string{"a=z", "b=y"}, expected: Pass},
+		{tags: []string{"a=x", "b=y"}, expected: Fail},
+		{tags: []string{"a=z"}, expected: Fail},
+	}
+
+	for i, tc := range testCases {
+		tags = tc.tags
+		if res := filter(schema.MKey{}, "metric", tags); res != tc.expected {
+			t.Fatalf("TC %d: Expected decision %s for tags %v, got %s", i, tc.expected, tc.tags, res)
+		}
+	}
+}
+
+func TestMetaTagRecordEqual(t *testing.T) {
+	type testCase struct {
+		a, b  [2][]string
+		equal bool
+	}
+
+	testCases := []testCase{
+		{
+			a:     [2][]string{{"a=b", "c=d"}, {"e=f", "g=~h.*i"}},
+			b:     [2][]string{{"a=b", "c=d"}, {"e=f", "g=~h.*i"}},
+			equal: true,
+		}, {
+			a:     [2][]string{{"a=b", "c=d"}, {"e=f", "g=~h.*i"}},
+			b:     [2][]string{{"c=d", "a=b"}, {"g=~h.*i", "e=f"}},
+			equal: true,
+		}, {
+			a:     [2][]string{{"a=b", "c=d"}, {"e=f", "g=~h.*i"}},
+			b:     [2][]string{{"a=b", "c=x"}, {"g=~h.*i", "e=f"}},
+			equal: false,
+		}, {
+			a:     [2][]string{{"a=b", "c=d"}, {"e=f", "g=~h.*i"}},
+			b:     [2][]string{{"a=b"}, {"e=f", "g=~h.*i"}},
+			equal: false,
+		}, {
+			a:     [2][]string{{"a=b"}, {"e=f", "g=~h.*i"}},
+			b:     [2][]string{{"a=b"}, {"e=f", "g=~h.*j"}},
+			equal: false,
+		},
+	}
+
+	for i, tc := range testCases {
+		a, err := ParseMetaTagRecord(tc.a[0], tc.a[1])
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error when parsing meta tag record: %s", i, err)
+		}
+		b, err := ParseMetaTagRecord(tc.b[0], tc.b[1])
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error when parsing meta tag record: %s", i, err)
+		}
+
+		if a.Equal(&b) != tc.equal || b.Equal(&a) != tc.equal {
+			t.Fatalf("TC %d: Expected Equal to return %t for records %+v and %+v", i, tc.equal, a, b)
+		}
+		if tc.equal && (a.HashExpressions() != b.HashExpressions() || a.HashRecord() != b.HashRecord()) {
+			t.Fatalf("TC %d: Expected equal records %+v and %+v to have the same hashes", i, a, b)
+		}
+	}
+}
+
+func TestValidateMetaTagRecord(t *testing.T) {
+	type testCase struct {
+		metaTags    []string
+		expressions []string
+		expectedErr error
+	}
+
+	testCases := []testCase{
+		{
+			metaTags:    []string{"a=b"},
+			expressions: []string{"c=d", "e!=f"},
+		}, {
+			metaTags:    []string{"a=b"},
+			expressions: []string{"e!=f"},
+			expectedErr: ErrNoInitialExpression,
+		}, {
+			metaTags:    []string{"a=b"},
+			expressions: []string{"c=", "e!=~f.*"},
+			expectedErr: ErrNoInitialExpression,
+		}, {
+			metaTags:    []string{"a=b"},
+			expressions: []string{"c=d", "c!=d"},
+			expectedErr: ContradictionError{},
+		}, {
+			metaTags:    []string{"a=b"},
+			expressions: []string{"c=d", "__lastUpdate__>-1h"},
+			expectedErr: ErrPseudoTagInMetaTagRecord,
+		}, {
+			metaTags:    []string{"a=b"},
+			expressions: []string{"c=d", "__interval__<=10s"},
+			expectedErr: ErrPseudoTagInMetaTagRecord,
+		}, {
+			metaTags:    []string{"name=b"},
+			expressions: []string{"c=d"},
+			expectedErr: ErrReservedMetaTagKey,
+		}, {
+			metaTags:    []string{"a=b", "__tag=b"},
+			expressions: []string{"c=d"},
+			expectedErr: ErrReservedMetaTagKey,
+		}, {
+			// records without meta tags are valid, upserting them deletes the record
+			expressions: []string{"c=d"},
+		},
+	}
+
+	for i, tc := range testCases {
+		_, err := ParseMetaTagRecord(tc.metaTags, tc.expressions)
+		if tc.expectedErr == nil {
+			if err != nil {
+				t.Fatalf("TC %d: Unexpected error: %s", i, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, ErrInvalidMetaTagRecord) {
+			t.Fatalf("TC %d: Expected error to be an invalid meta tag record error, got %v", i, err)
+		}
+		if contradiction, ok := tc.expectedErr.(ContradictionError); ok {
+			if !errors.As(err, &contradiction) {
+				t.Fatalf("TC %d: Expected error to contain a ContradictionError, got %v", i, err)
+			}
+		} else if !errors.Is(err, tc.expectedErr) {
+			t.Fatalf("TC %d: Expected error %v, got %v", i, tc.expectedErr, err)
+		}
+	}
+}
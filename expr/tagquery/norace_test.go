@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package tagquery
+
+// raceEnabled is true if the tests are built with the race detector, which makes code allocate
+// that otherwise doesn't
+const raceEnabled = false
@@ -0,0 +1,455 @@
+package tagquery
+
+import (
+	"fmt"
+	"net/http"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParseOptions controls the behavior of ParseExpressionWithOptions and
+// ParseExpressionsWithOptions
+type ParseOptions struct {
+	// RegexLimits restricts the size and complexity of the patterns
+	// of expressions which use regular expressions
+	RegexLimits RegexLimits
+
+	// KeyValidation defines which characters are allowed in the keys of expressions
+	KeyValidation KeyValidationMode
+
+	// AllowInvalidCharacters disables the check which rejects expressions containing invalid
+	// UTF-8 or control characters. It is meant to be used together with KeyValidationPermissive
+	AllowInvalidCharacters bool
+
+	// Dedup makes ParseExpressionsWithOptions remove duplicate expressions, see Expressions.Dedup
+	Dedup bool
+
+	// AllowedOperators restricts the operators which may be used in expressions, if it is nil
+	// all operators are allowed. The operator gets checked before any optimizations are applied,
+	// so f.e. "a=~b.*" uses MATCH and "a=" uses NOT_HAS_TAG. See also StandardOperators
+	AllowedOperators []ExpressionOperator
+
+	// DisableTagKey makes expressions using the special key "__tag" invalid
+	DisableTagKey bool
+
+	// TrimWhitespace makes the parser remove whitespace around the key and the value, so f.e.
+	// "dc = us-east" is the same as "dc=us-east". By default such expressions are rejected
+	// with a WhitespaceError, because tag keys and values never begin or end with whitespace
+	TrimWhitespace bool
+
+	// QueryLimits restricts the size of the lists of expressions parsed by ParseExpressionsWithOptions
+	QueryLimits QueryLimits
+
+	// FullyAnchoredRegex makes the patterns of the regex operators =~, !=~ and __tag=~ match whole
+	// values, like in Prometheus, instead of only being anchored at the beginning like in Graphite.
+	// F.e. "dc=~us" then only matches "us", but not "us-east". The value of such an expression
+	// gets wrapped into "^(?:...)$", so it keeps its meaning when it gets serialized and parsed
+	// again without this option. Empty patterns and the key pattern of "__tag=~<key>:<op><value>"
+	// are not affected
+	FullyAnchoredRegex bool
+
+	// LazyRegexCompilation defers compiling the patterns of regex expressions until they get
+	// evaluated the first time, this speeds up parsing large sets of expressions of which many
+	// might never get evaluated, like the ones of meta tag records. The patterns still get parsed
+	// and checked against the RegexLimits, so invalid ones get rejected by the parser as usual
+	LazyRegexCompilation bool
+
+	// MatchCacheSize is the number of matches and non-matches which the filters of the parsed regex
+	// expressions cache. 0 means the package default set by SetMatchCacheSize applies, a negative
+	// value disables caching
+	MatchCacheSize int
+}
+
+// StandardOperators returns the operators which are part of the Graphite tag query
+// syntax, it can be used as ParseOptions.AllowedOperators to forbid the non-standard ones
+func StandardOperators() []ExpressionOperator {
+	return []ExpressionOperator{EQUAL, NOT_EQUAL, MATCH, NOT_MATCH, HAS_TAG, NOT_HAS_TAG, MATCH_ALL, MATCH_NONE}
+}
+
+func (o *ParseOptions) operatorIsAllowed(operator ExpressionOperator) bool {
+	if o.AllowedOperators == nil {
+		return true
+	}
+	for _, allowed := range o.AllowedOperators {
+		if allowed == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// OperatorNotAllowedError is returned when an expression uses an operator
+// which is not part of ParseOptions.AllowedOperators
+type OperatorNotAllowedError struct {
+	Expression string
+	Operator   ExpressionOperator
+}
+
+func (o OperatorNotAllowedError) Error() string {
+	return fmt.Sprintf("Invalid expression: %s, the operator %s is not allowed", o.Expression, o.Operator)
+}
+
+func (o OperatorNotAllowedError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (o OperatorNotAllowedError) Is(target error) bool {
+	return isParseError(target, ErrUnsupportedOperator)
+}
+
+// TagKeyNotAllowedError is returned when an expression uses the special
+// key "__tag" while ParseOptions.DisableTagKey is set
+type TagKeyNotAllowedError string
+
+func (t TagKeyNotAllowedError) Error() string {
+	return fmt.Sprintf("Invalid expression: %s, the key __tag is not allowed", string(t))
+}
+
+func (t TagKeyNotAllowedError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (t TagKeyNotAllowedError) Is(target error) bool {
+	return isParseError(target, ErrInvalidKey)
+}
+
+// DefaultParseOptions returns the options which are used by ParseExpression
+func DefaultParseOptions() ParseOptions {
+	return ParseOptions{
+		RegexLimits:   DefaultRegexLimits(),
+		KeyValidation: KeyValidationGraphite,
+	}
+}
+
+var defaultParseOptions = DefaultParseOptions()
+
+// KeyValidationMode defines how strictly the keys of expressions get validated
+type KeyValidationMode uint8
+
+const (
+	// KeyValidationGraphite rejects keys containing any of the characters ";!^=", same as Graphite does
+	KeyValidationGraphite KeyValidationMode = iota
+
+	// KeyValidationStrict only accepts keys consisting of the characters a-z, A-Z, 0-9, "_", "." and "-"
+	KeyValidationStrict
+
+	// KeyValidationPermissive only rejects keys containing characters which would break the parser,
+	// these are ";=!^~"
+	KeyValidationPermissive
+)
+
+// WhitespaceError is returned when the key or the value of an expression begins or ends
+// with whitespace, unless ParseOptions.TrimWhitespace is set
+type WhitespaceError struct {
+	Expression string
+
+	// Part is either "key" or "value"
+	Part string
+}
+
+func (w WhitespaceError) Error() string {
+	return fmt.Sprintf("Invalid expression: %q, the %s must not begin or end with whitespace", w.Expression, w.Part)
+}
+
+func (w WhitespaceError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (w WhitespaceError) Is(target error) bool {
+	if w.Part == "key" {
+		return isParseError(target, ErrInvalidKey)
+	}
+	return isParseError(target)
+}
+
+// hasSurroundingWhitespace returns true if the given string begins or ends with whitespace.
+// whitespace control characters like \t or \n are left to checkCharacters
+func hasSurroundingWhitespace(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	first, _ := utf8.DecodeRuneInString(s)
+	last, _ := utf8.DecodeLastRuneInString(s)
+	return isNonControlSpace(first) || isNonControlSpace(last)
+}
+
+func isNonControlSpace(r rune) bool {
+	return unicode.IsSpace(r) && !unicode.IsControl(r)
+}
+
+// handleWhitespace trims the whitespace around the given part of an expression if TrimWhitespace
+// is set, otherwise it returns a WhitespaceError if the part begins or ends with whitespace
+func (o *ParseOptions) handleWhitespace(expr, s, part string) (string, error) {
+	if o.TrimWhitespace {
+		return strings.TrimSpace(s), nil
+	}
+	if hasSurroundingWhitespace(s) {
+		return "", WhitespaceError{Expression: expr, Part: part}
+	}
+	return s, nil
+}
+
+// handleValueWhitespace is the same as handleWhitespace, but if anyOf is true the value
+// is treated as a "|" separated list of values of which each element gets handled
+func (o *ParseOptions) handleValueWhitespace(expr, value string, anyOf bool) (string, error) {
+	if !anyOf {
+		return o.handleWhitespace(expr, value, "value")
+	}
+
+	// the values only need to be split and joined again if there is whitespace to trim
+	needsTrimming := false
+	for rest := value; ; {
+		end := strings.IndexByte(rest, '|')
+		if end < 0 {
+			end = len(rest)
+		}
+		if o.TrimWhitespace {
+			needsTrimming = needsTrimming || len(strings.TrimSpace(rest[:end])) != end
+		} else if hasSurroundingWhitespace(rest[:end]) {
+			return "", WhitespaceError{Expression: expr, Part: "value"}
+		}
+		if end == len(rest) {
+			break
+		}
+		rest = rest[end+1:]
+	}
+	if !needsTrimming {
+		return value, nil
+	}
+
+	values := strings.Split(value, "|")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return strings.Join(values, "|"), nil
+}
+
+// InvalidCharacterError is returned when an expression contains invalid UTF-8 or a control character
+type InvalidCharacterError struct {
+	Expression string
+	Offset     int
+}
+
+func (i InvalidCharacterError) Error() string {
+	return fmt.Sprintf("Invalid expression: %q, invalid UTF-8 or control character at byte offset %d", i.Expression, i.Offset)
+}
+
+func (i InvalidCharacterError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (i InvalidCharacterError) Is(target error) bool {
+	return isParseError(target)
+}
+
+// checkCharacters verifies that the given expression is valid UTF-8 and
+// does not contain control characters such as \n, \r, \t or NUL
+func checkCharacters(expr string) error {
+	for pos := 0; pos < len(expr); {
+		r, size := utf8.DecodeRuneInString(expr[pos:])
+		if (r == utf8.RuneError && size == 1) || unicode.IsControl(r) {
+			return InvalidCharacterError{Expression: expr, Offset: pos}
+		}
+		pos += size
+	}
+	return nil
+}
+
+// RegexLimits defines limits on the patterns used by the regex operators =~, !=~ and __tag=~.
+// A pattern which exceeds one of the limits results in a RegexLimitError.
+// A limit of 0 disables that limit.
+type RegexLimits struct {
+	// MaxLength is the maximum length of a pattern in bytes
+	MaxLength int
+
+	// MaxCaptureGroups is the maximum number of capture groups in a pattern
+	MaxCaptureGroups int
+
+	// MaxAlternations is the maximum number of alternations ("|") in a pattern
+	MaxAlternations int
+
+	// MaxProgramSize is the maximum number of instructions of the compiled pattern,
+	// this is an estimate of the cost of matching it against a value
+	MaxProgramSize int
+}
+
+// DefaultRegexLimits returns limits which are generous enough to not break
+// any reasonable query, while preventing pathologically large patterns
+func DefaultRegexLimits() RegexLimits {
+	return RegexLimits{
+		MaxLength:        64 * 1024,
+		MaxCaptureGroups: 1000,
+		MaxAlternations:  10000,
+		MaxProgramSize:   100000,
+	}
+}
+
+// RegexLimitError is returned when the pattern of an expression exceeds one of the RegexLimits
+type RegexLimitError struct {
+	Expression string
+	Limit      string
+	Value      int
+	Max        int
+}
+
+func (r RegexLimitError) Error() string {
+	return fmt.Sprintf("Invalid expression: %s, the pattern exceeds the limit %s (%d > %d)", r.Expression, r.Limit, r.Value, r.Max)
+}
+
+func (r RegexLimitError) Code() int {
+	return http.StatusBadRequest
+}
+
+func (r RegexLimitError) Is(target error) bool {
+	return isParseError(target, ErrBadRegex)
+}
+
+// check verifies that the given pattern does not exceed any of the limits
+func (l *RegexLimits) check(expr, pattern string) error {
+	if l.MaxLength > 0 && len(pattern) > l.MaxLength {
+		return RegexLimitError{Expression: expr, Limit: "MaxLength", Value: len(pattern), Max: l.MaxLength}
+	}
+
+	if l.MaxCaptureGroups <= 0 && l.MaxAlternations <= 0 && l.MaxProgramSize <= 0 {
+		return nil
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		// the error will be reported when the pattern gets compiled
+		return nil
+	}
+	return l.checkParsed(expr, pattern, re)
+}
+
+// checkParsed is the same as check, but it takes the parsed pattern in addition to the pattern
+func (l *RegexLimits) checkParsed(expr, pattern string, re *syntax.Regexp) error {
+	if l.MaxLength > 0 && len(pattern) > l.MaxLength {
+		return RegexLimitError{Expression: expr, Limit: "MaxLength", Value: len(pattern), Max: l.MaxLength}
+	}
+
+	if l.MaxCaptureGroups > 0 {
+		if captureGroups := re.MaxCap(); captureGroups > l.MaxCaptureGroups {
+			return RegexLimitError{Expression: expr, Limit: "MaxCaptureGroups", Value: captureGroups, Max: l.MaxCaptureGroups}
+		}
+	}
+
+	if l.MaxAlternations > 0 {
+		if alternations := countAlternations(re); alternations > l.MaxAlternations {
+			return RegexLimitError{Expression: expr, Limit: "MaxAlternations", Value: alternations, Max: l.MaxAlternations}
+		}
+	}
+
+	if l.MaxProgramSize > 0 {
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil {
+			return nil
+		}
+		if len(prog.Inst) > l.MaxProgramSize {
+			return RegexLimitError{Expression: expr, Limit: "MaxProgramSize", Value: len(prog.Inst), Max: l.MaxProgramSize}
+		}
+	}
+
+	return nil
+}
+
+// countAlternations counts the number of alternations in the given parsed pattern
+func countAlternations(re *syntax.Regexp) int {
+	var res int
+	if re.Op == syntax.OpAlternate {
+		res += len(re.Sub) - 1
+	}
+	for _, sub := range re.Sub {
+		res += countAlternations(sub)
+	}
+	return res
+}
+
+// QueryLimits defines limits on the size of a query, so a single request can't make the index
+// build and evaluate an excessive number of filters. A query which exceeds one of the limits
+// results in a QueryLimitError. A limit of 0 disables that limit, which is the default.
+type QueryLimits struct {
+	// MaxExpressions is the maximum number of expressions in a query
+	MaxExpressions int
+
+	// MaxLength is the maximum total length of all expressions of a query in bytes
+	MaxLength int
+
+	// MaxRegexExpressions is the maximum number of expressions of a query which evaluate a regular expression
+	MaxRegexExpressions int
+}
+
+// QueryLimitError is returned when a query exceeds one of the QueryLimits
+type QueryLimitError struct {
+	Limit string
+	Value int
+	Max   int
+}
+
+func (q QueryLimitError) Error() string {
+	return fmt.Sprintf("Invalid query, it exceeds the limit %s (%d > %d)", q.Limit, q.Value, q.Max)
+}
+
+func (q QueryLimitError) Code() int {
+	return http.StatusBadRequest
+}
+
+// checkStrings verifies that the given unparsed expressions don't exceed the limits on their
+// number and length, this allows rejecting a query before parsing any of its expressions
+func (l *QueryLimits) checkStrings(expressions []string) error {
+	if l.MaxExpressions > 0 && len(expressions) > l.MaxExpressions {
+		return QueryLimitError{Limit: "MaxExpressions", Value: len(expressions), Max: l.MaxExpressions}
+	}
+
+	if l.MaxLength > 0 {
+		var length int
+		for _, expr := range expressions {
+			length += len(expr)
+		}
+		if length > l.MaxLength {
+			return QueryLimitError{Limit: "MaxLength", Value: length, Max: l.MaxLength}
+		}
+	}
+
+	return nil
+}
+
+// checkRegexExpressions verifies that the given expressions don't exceed the limit on
+// the number of expressions evaluating a regular expression
+func (l *QueryLimits) checkRegexExpressions(expressions Expressions) error {
+	if l.MaxRegexExpressions <= 0 {
+		return nil
+	}
+
+	var count int
+	for _, e := range expressions {
+		if usesRegex(e) {
+			count++
+		}
+	}
+	if count > l.MaxRegexExpressions {
+		return QueryLimitError{Limit: "MaxRegexExpressions", Value: count, Max: l.MaxRegexExpressions}
+	}
+
+	return nil
+}
+
+// Check verifies that the given expressions don't exceed any of the limits,
+// the length of the expressions is measured in their serialized form
+func (l *QueryLimits) Check(expressions Expressions) error {
+	if err := l.checkStrings(expressions.Strings()); err != nil {
+		return err
+	}
+	return l.checkRegexExpressions(expressions)
+}
+
+// usesRegex returns true if the given expression evaluates a regular expression,
+// this includes wildcard expressions with patterns which can't be evaluated by globMatch
+func usesRegex(e Expression) bool {
+	if wildcard, ok := e.(*expressionWildcard); ok {
+		return wildcard.valueRe != nil
+	}
+	return e.GetOperator().UsesRegex()
+}
@@ -0,0 +1,501 @@
+package tagquery
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegexLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     RegexLimits
+		expression string
+		limit      string
+	}{
+		{
+			name:       "pattern too long",
+			limits:     RegexLimits{MaxLength: 10},
+			expression: "a=~" + strings.Repeat("a", 11),
+			limit:      "MaxLength",
+		}, {
+			name:       "pattern within length limit",
+			limits:     RegexLimits{MaxLength: 20},
+			expression: "a=~" + strings.Repeat("a", 11),
+		}, {
+			name:       "too many capture groups",
+			limits:     RegexLimits{MaxCaptureGroups: 2},
+			expression: "a!=~(a)(b)(c)",
+			limit:      "MaxCaptureGroups",
+		}, {
+			name:       "non-capturing groups are not counted",
+			limits:     RegexLimits{MaxCaptureGroups: 2},
+			expression: "a=~(?:a)(?:b)(?:c)",
+		}, {
+			name:       "too many alternations",
+			limits:     RegexLimits{MaxAlternations: 2},
+			expression: "__tag=~aa|bb|cc|dd",
+			limit:      "MaxAlternations",
+		}, {
+			name:       "program too large",
+			limits:     RegexLimits{MaxProgramSize: 50},
+			expression: "a=~(a+)+(b{100})+$",
+			limit:      "MaxProgramSize",
+		}, {
+			name:       "no limits",
+			expression: "a=~" + strings.Repeat("(a|b)", 1000),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseExpressionWithOptions(tc.expression, ParseOptions{RegexLimits: tc.limits})
+			if len(tc.limit) == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				return
+			}
+
+			limitErr, ok := err.(RegexLimitError)
+			if !ok {
+				t.Fatalf("Expected a RegexLimitError, but got %v", err)
+			}
+			if limitErr.Limit != tc.limit {
+				t.Fatalf("Expected limit %s to be exceeded, but got %s", tc.limit, limitErr.Limit)
+			}
+		})
+	}
+}
+
+func TestDefaultRegexLimitsAllowCommonPatterns(t *testing.T) {
+	hosts := make([]string, 500)
+	for i := range hosts {
+		hosts[i] = "host-" + strings.Repeat("x", i%10) + "-name"
+	}
+
+	for _, expression := range []string{"a=~(a+)+$", "name=~" + strings.Join(hosts, "|"), "a=~.*foo.*bar.*"} {
+		if _, err := ParseExpression(expression); err != nil {
+			t.Fatalf("Unexpected error when parsing expression with default limits: %s", err)
+		}
+	}
+}
+
+func TestKeyValidationModes(t *testing.T) {
+	type accepted struct {
+		strict, graphite, permissive bool
+	}
+	tests := []struct {
+		key    string
+		expect accepted
+	}{
+		{key: "dc", expect: accepted{true, true, true}},
+		{key: "a.b_c-d", expect: accepted{true, true, true}},
+		{key: "__tag", expect: accepted{true, true, true}},
+		{key: "app:name", expect: accepted{false, true, true}},
+		{key: "a/b", expect: accepted{false, true, true}},
+		{key: "a|b", expect: accepted{false, true, true}},
+		{key: "tag€", expect: accepted{false, true, true}},
+		{key: "a~b", expect: accepted{false, true, false}},
+		{key: "a b", expect: accepted{false, true, true}},
+	}
+
+	for _, tc := range tests {
+		for mode, expect := range map[KeyValidationMode]bool{
+			KeyValidationStrict:     tc.expect.strict,
+			KeyValidationGraphite:   tc.expect.graphite,
+			KeyValidationPermissive: tc.expect.permissive,
+		} {
+			opts := DefaultParseOptions()
+			opts.KeyValidation = mode
+			_, err := ParseExpressionWithOptions(tc.key+"=value", opts)
+			if expect && err != nil {
+				t.Fatalf("Expected key %q to be accepted in mode %d, but got error: %s", tc.key, mode, err)
+			}
+			if !expect && err == nil {
+				t.Fatalf("Expected key %q to be rejected in mode %d", tc.key, mode)
+			}
+		}
+	}
+
+	// characters which break the parser are rejected in every mode
+	for _, mode := range []KeyValidationMode{KeyValidationStrict, KeyValidationGraphite, KeyValidationPermissive} {
+		opts := DefaultParseOptions()
+		opts.KeyValidation = mode
+		if _, err := ParseExpressionsWithOptions([]string{"a;b=value"}, opts); err == nil {
+			t.Fatalf("Expected key with ';' to be rejected in mode %d", mode)
+		}
+	}
+}
+
+func TestInvalidCharacters(t *testing.T) {
+	tests := []struct {
+		expression string
+		offset     int
+	}{
+		{expression: "a=b\nc", offset: 3},
+		{expression: "a\r=b", offset: 1},
+		{expression: "a=\tb", offset: 2},
+		{expression: "a!=~b\x00", offset: 5},
+		{expression: "a€=b\xffc", offset: 6},
+		{expression: "a=b\x7f", offset: 3},
+	}
+
+	for _, tc := range tests {
+		_, err := ParseExpression(tc.expression)
+		charErr, ok := err.(InvalidCharacterError)
+		if !ok {
+			t.Fatalf("Expected an InvalidCharacterError for %q, but got %v", tc.expression, err)
+		}
+		if charErr.Offset != tc.offset {
+			t.Fatalf("Expected offset %d for %q, but got %d", tc.offset, tc.expression, charErr.Offset)
+		}
+
+		opts := DefaultParseOptions()
+		opts.KeyValidation = KeyValidationPermissive
+		opts.AllowInvalidCharacters = true
+		if _, err := ParseExpressionWithOptions(tc.expression, opts); err != nil {
+			t.Fatalf("Unexpected error when parsing %q with invalid characters allowed: %s", tc.expression, err)
+		}
+	}
+
+	if _, err := ParseExpression("tag€=välue"); err != nil {
+		t.Fatalf("Unexpected error when parsing valid UTF-8: %s", err)
+	}
+}
+
+func TestAllowedOperators(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.AllowedOperators = StandardOperators()
+
+	for _, expression := range []string{"a=b", "a!=b", "a=~b.*", "a!=~b", "a=", "a!=", "a=~", "a=~b$"} {
+		if _, err := ParseExpressionWithOptions(expression, opts); err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", expression, err)
+		}
+	}
+
+	tests := []struct {
+		expression string
+		operator   ExpressionOperator
+	}{
+		{expression: "a^=b", operator: PREFIX},
+		{expression: "a!^=b", operator: NOT_PREFIX},
+		{expression: "a|=b|c", operator: EQUAL_ANY},
+		{expression: "a*=b*", operator: WILDCARD},
+		{expression: "a>=1", operator: GREATER_EQUAL},
+		{expression: "__tag^=a", operator: PREFIX_TAG},
+		{expression: "__tag=~a", operator: MATCH_TAG},
+	}
+
+	for _, tc := range tests {
+		_, err := ParseExpressionWithOptions(tc.expression, opts)
+		opErr, ok := err.(OperatorNotAllowedError)
+		if !ok {
+			t.Fatalf("Expected an OperatorNotAllowedError for %q, but got %v", tc.expression, err)
+		}
+		if opErr.Operator != tc.operator {
+			t.Fatalf("Expected operator %s to be reported for %q, but got %s", tc.operator, tc.expression, opErr.Operator)
+		}
+		if !strings.Contains(opErr.Error(), tc.operator.String()) {
+			t.Fatalf("Expected error message to name the operator %s: %s", tc.operator, opErr.Error())
+		}
+
+		if _, err := ParseExpression(tc.expression); err != nil {
+			t.Fatalf("Unexpected error when parsing %q with default options: %s", tc.expression, err)
+		}
+	}
+}
+
+func TestDisableTagKey(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.DisableTagKey = true
+
+	for _, expression := range []string{"__tag=a", "__tag^=a", "__tag=~a"} {
+		if _, err := ParseExpressionWithOptions(expression, opts); err == nil {
+			t.Fatalf("Expected an error when parsing %q", expression)
+		} else if _, ok := err.(TagKeyNotAllowedError); !ok {
+			t.Fatalf("Expected a TagKeyNotAllowedError for %q, but got %v", expression, err)
+		}
+	}
+
+	if _, err := ParseExpressionWithOptions("a=b", opts); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		limits      QueryLimits
+		expressions []string
+		limit       string
+	}{
+		{
+			name:        "unlimited",
+			expressions: []string{"a=b", "c=~d", "e!=~f", "g*=h[0-9]"},
+		}, {
+			name:        "within all limits",
+			limits:      QueryLimits{MaxExpressions: 3, MaxLength: 12, MaxRegexExpressions: 1},
+			expressions: []string{"a=b", "c=~d", "e!=f"},
+		}, {
+			name:        "too many expressions",
+			limits:      QueryLimits{MaxExpressions: 2},
+			expressions: []string{"a=b", "c=d", "e=f"},
+			limit:       "MaxExpressions",
+		}, {
+			name:        "too long",
+			limits:      QueryLimits{MaxLength: 8},
+			expressions: []string{"a=bcd", "e=fgh"},
+			limit:       "MaxLength",
+		}, {
+			name:        "too many regex expressions",
+			limits:      QueryLimits{MaxRegexExpressions: 1},
+			expressions: []string{"a=~b", "c!=~d"},
+			limit:       "MaxRegexExpressions",
+		}, {
+			name:        "wildcards which need a regex get counted",
+			limits:      QueryLimits{MaxRegexExpressions: 1},
+			expressions: []string{"a=~b", "c*=d[0-9]"},
+			limit:       "MaxRegexExpressions",
+		}, {
+			name:        "regex expressions optimized into cheaper ones don't get counted",
+			limits:      QueryLimits{MaxRegexExpressions: 1},
+			expressions: []string{"a=~b", "c=~d.*", "e*=f*", "g=~.*"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultParseOptions()
+			opts.QueryLimits = tc.limits
+
+			expressions, err := ParseExpressionsWithOptions(tc.expressions, opts)
+			if tc.limit == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				if err = tc.limits.Check(expressions); err != nil {
+					t.Fatalf("Unexpected error when checking parsed expressions: %s", err)
+				}
+				return
+			}
+
+			limitErr, ok := err.(QueryLimitError)
+			if !ok {
+				t.Fatalf("Expected a QueryLimitError, but got %v", err)
+			}
+			if limitErr.Limit != tc.limit {
+				t.Fatalf("Expected limit %s to be exceeded, but got %s", tc.limit, limitErr.Limit)
+			}
+			if limitErr.Code() != 400 {
+				t.Fatalf("Expected code 400, but got %d", limitErr.Code())
+			}
+
+			expressions, err = ParseExpressions(tc.expressions)
+			if err != nil {
+				t.Fatalf("Unexpected error when parsing with default options: %s", err)
+			}
+			if _, err = NewQueryWithLimits(expressions, 0, tc.limits); err == nil {
+				t.Fatalf("Expected NewQueryWithLimits to fail")
+			}
+		})
+	}
+}
+
+func TestWhitespaceIsRejectedByDefault(t *testing.T) {
+	tests := []struct {
+		expression string
+		part       string
+	}{
+		{expression: "dc = us-east", part: "key"},
+		{expression: " dc=us-east", part: "key"},
+		{expression: "dc= us-east", part: "value"},
+		{expression: "dc=us-east ", part: "value"},
+		{expression: "dc!=~ us-.*", part: "value"},
+		{expression: "dc|=us-east |eu-west", part: "value"},
+		{expression: "dc!|=us-east| eu-west", part: "value"},
+		{expression: "dc=us-east ", part: "value"},
+		{expression: "__tag^= dc", part: "value"},
+	}
+
+	for _, tc := range tests {
+		_, err := ParseExpression(tc.expression)
+		wsErr, ok := err.(WhitespaceError)
+		if !ok {
+			t.Fatalf("Expected a WhitespaceError for %q, but got %v", tc.expression, err)
+		}
+		if wsErr.Part != tc.part {
+			t.Fatalf("Expected the %s of %q to be reported, but got %s", tc.part, tc.expression, wsErr.Part)
+		}
+		if wsErr.Code() != 400 {
+			t.Fatalf("Expected code 400, but got %d", wsErr.Code())
+		}
+	}
+
+	// whitespace within keys and values is still allowed
+	if _, err := ParseExpression("some key=some value"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestTrimWhitespace(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.TrimWhitespace = true
+
+	tests := []struct {
+		expression string
+		expect     string
+	}{
+		{expression: "dc = us-east", expect: "dc=us-east"},
+		{expression: "  dc=us-east  ", expect: "dc=us-east"},
+		{expression: "dc != us-east", expect: "dc!=us-east"},
+		{expression: "dc =~ us-.*east", expect: "dc=~us-.*east"},
+		{expression: "dc ^= us", expect: "dc^=us"},
+		{expression: "dc |= us-east | eu-west", expect: "dc|=eu-west|us-east"},
+		{expression: "__tag = dc", expect: "dc!="},
+		{expression: "dc =  ", expect: "dc="},
+		{expression: "some key = some value", expect: "some key=some value"},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseExpressionWithOptions(tc.expression, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", tc.expression, err)
+		}
+		if res := (Expressions{e}).Strings()[0]; res != tc.expect {
+			t.Fatalf("Expected %q to be parsed as %q, but got %q", tc.expression, tc.expect, res)
+		}
+	}
+
+	if _, err := ParseExpressionWithOptions("  =us-east", opts); err == nil {
+		t.Fatalf("Expected an error when the key only consists of whitespace")
+	}
+}
+
+func TestFullyAnchoredRegex(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.FullyAnchoredRegex = true
+
+	tests := []struct {
+		expression string
+		expect     string
+		matches    []string
+		notMatches []string
+	}{
+		{expression: "dc=~us", expect: "dc=us", matches: []string{"us"}, notMatches: []string{"us-east", "useless-dc"}},
+		{expression: "dc!=~us", expect: "dc!=us", matches: []string{"us-east"}, notMatches: []string{"us"}},
+		{expression: "dc=~us-.*", expect: "dc=~^(?:us-.*)$", matches: []string{"us-east", "us-"}, notMatches: []string{"us", "eu-west"}},
+		{expression: "dc=~us|eu", expect: "dc=~^(?:us|eu)$", matches: []string{"us", "eu"}, notMatches: []string{"us-east", "eu-west"}},
+		{expression: "dc=~^us$", expect: "dc=us", matches: []string{"us"}, notMatches: []string{"us-east"}},
+		{expression: "__tag=~d.", expect: "__tag=~^(?:d.)$", matches: []string{"dc"}, notMatches: []string{"dcs"}},
+		{expression: "dc=~.*", expect: "dc=~.*"},
+		{expression: "dc=~.+", expect: "dc!="},
+		{expression: "dc=~", expect: "dc=~"},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseExpressionWithOptions(tc.expression, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", tc.expression, err)
+		}
+		serialized := (Expressions{e}).Strings()[0]
+		if serialized != tc.expect {
+			t.Fatalf("Expected %q to be parsed as %q, but got %q", tc.expression, tc.expect, serialized)
+		}
+
+		// the serialized expression has the same meaning when it's parsed with the default options
+		reparsed, err := ParseExpression(serialized)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q again: %s", serialized, err)
+		}
+		for _, parsed := range []Expression{e, reparsed} {
+			for _, value := range tc.matches {
+				if !parsed.Matches(value) {
+					t.Fatalf("Expected %q parsed from %q to match %q", parsed, tc.expression, value)
+				}
+			}
+			for _, value := range tc.notMatches {
+				if parsed.Matches(value) {
+					t.Fatalf("Expected %q parsed from %q to not match %q", parsed, tc.expression, value)
+				}
+			}
+		}
+	}
+}
+
+func TestLazyRegexCompilation(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.LazyRegexCompilation = true
+
+	tests := []struct {
+		expression string
+		values     []string
+	}{
+		{expression: "dc=~us-[a-z]+-[0-9]", values: []string{"us-east-1", "us-east", "eu-west-1", ""}},
+		{expression: "dc!=~us-[a-z]+-[0-9]", values: []string{"us-east-1", "us-east", "eu-west-1", ""}},
+		{expression: "__tag=~d[a-z]", values: []string{"dc", "d", "host"}},
+		{expression: "dc=~(us|eu)?-.*[0-9]$", values: []string{"us-east-1", "-1", "eu", ""}},
+	}
+
+	for _, tc := range tests {
+		lazy, err := ParseExpressionWithOptions(tc.expression, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", tc.expression, err)
+		}
+		eager, err := ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Unexpected error when parsing %q: %s", tc.expression, err)
+		}
+
+		lazyRe, eagerRe := commonReOf(lazy), commonReOf(eager)
+		if lazyRe == nil || lazyRe.valueRe != nil || lazyRe.lazyRe == nil {
+			t.Fatalf("Expected the compilation of the pattern of %q to be deferred", tc.expression)
+		}
+
+		// the properties which are computed when parsing don't need the compiled pattern
+		if lazy.RequiresNonEmptyValue() != eager.RequiresNonEmptyValue() || lazy.GetDefaultDecision() != eager.GetDefaultDecision() || lazyRe.matchesEmpty != eagerRe.matchesEmpty {
+			t.Fatalf("Expected %q to have the same properties with and without lazy compilation", tc.expression)
+		}
+		if lazyRe.lazyRe.re != nil {
+			t.Fatalf("Expected the pattern of %q to not be compiled before it gets evaluated", tc.expression)
+		}
+
+		for _, value := range tc.values {
+			if lazy.Matches(value) != eager.Matches(value) {
+				t.Fatalf("Expected %q to match %q the same way with and without lazy compilation", tc.expression, value)
+			}
+		}
+		if lazyRe.lazyRe.re == nil || lazyRe.getValueRe().String() != eagerRe.getValueRe().String() {
+			t.Fatalf("Expected the pattern of %q to be compiled once it got evaluated", tc.expression)
+		}
+	}
+
+	// invalid patterns still get rejected when parsing
+	for _, expression := range []string{"dc=~us-(", "dc=~[z-a]"} {
+		if _, err := ParseExpressionWithOptions(expression, opts); err == nil {
+			t.Fatalf("Expected an error when parsing %q", expression)
+		}
+	}
+}
+
+func TestLazyRegexCompilationConcurrentEvaluation(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.LazyRegexCompilation = true
+
+	e, err := ParseExpressionWithOptions("dc=~us-[a-z]+-[0-9]", opts)
+	if err != nil {
+		t.Fatalf("Unexpected error when parsing: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !e.Matches("us-east-1") || e.Matches("eu-west-1") {
+				t.Errorf("Unexpected result of matching %q", e)
+			}
+		}()
+	}
+	wg.Wait()
+}
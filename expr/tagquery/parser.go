@@ -0,0 +1,104 @@
+package tagquery
+
+import (
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/stats"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+var (
+	// metric tagquery.parse-cache.ops.hit is a counter of parse cache hits
+	parseCacheHit = stats.NewCounter32("tagquery.parse-cache.ops.hit")
+	// metric tagquery.parse-cache.ops.miss is a counter of parse cache misses
+	parseCacheMiss = stats.NewCounter32("tagquery.parse-cache.ops.miss")
+)
+
+// Parser parses expressions and memoizes the results in a size bounded LRU cache,
+// keyed on the raw expression string. This saves the parsing and the compilation
+// of regular expressions when the same expressions get parsed over and over again.
+// Expressions are immutable once they have been parsed, so the returned values
+// are shared between all callers and safe for concurrent use.
+// Expressions which fail to parse don't get cached.
+type Parser struct {
+	opts   ParseOptions
+	cache  *lru.Cache
+	hits   uint32
+	misses uint32
+}
+
+// NewParser returns a Parser which uses the default parse options and caches
+// up to cacheSize expressions. if cacheSize is <= 0 nothing gets cached
+func NewParser(cacheSize int) *Parser {
+	return NewParserWithOptions(cacheSize, DefaultParseOptions())
+}
+
+// NewParserWithOptions is the same as NewParser, but it takes options to control the parser
+func NewParserWithOptions(cacheSize int, opts ParseOptions) *Parser {
+	p := &Parser{opts: opts}
+	if cacheSize > 0 {
+		// lru.New only fails on a size <= 0
+		p.cache, _ = lru.New(cacheSize)
+	}
+	return p
+}
+
+// Parse parses a single expression, it returns the cached expression if
+// the same string has already been parsed before
+func (p *Parser) Parse(expr string) (Expression, error) {
+	if p.cache != nil {
+		if cached, ok := p.cache.Get(expr); ok {
+			atomic.AddUint32(&p.hits, 1)
+			parseCacheHit.Inc()
+			return cached.(Expression), nil
+		}
+	}
+
+	atomic.AddUint32(&p.misses, 1)
+	parseCacheMiss.Inc()
+
+	res, err := parseExpression(expr, &p.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.cache != nil {
+		p.cache.Add(expr, res)
+	}
+
+	return res, nil
+}
+
+// ParseExpressions is the same as the package level ParseExpressions, but it uses
+// the parser's options and its cache to parse each of the given expressions
+func (p *Parser) ParseExpressions(expressions []string) (Expressions, error) {
+	if err := p.opts.QueryLimits.checkStrings(expressions); err != nil {
+		return nil, err
+	}
+
+	res := make(Expressions, len(expressions))
+	for i := range expressions {
+		expression, err := p.Parse(expressions[i])
+		if err != nil {
+			return nil, err
+		}
+		res[i] = expression
+	}
+	if err := p.opts.QueryLimits.checkRegexExpressions(res); err != nil {
+		return nil, err
+	}
+	if p.opts.Dedup {
+		res = res.Dedup()
+	}
+	return res, nil
+}
+
+// Hits returns how many expressions have been served from the cache
+func (p *Parser) Hits() uint32 {
+	return atomic.LoadUint32(&p.hits)
+}
+
+// Misses returns how many expressions had to be parsed because they were not cached
+func (p *Parser) Misses() uint32 {
+	return atomic.LoadUint32(&p.misses)
+}
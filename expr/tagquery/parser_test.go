@@ -0,0 +1,145 @@
+package tagquery
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestParserCachesExpressions(t *testing.T) {
+	parser := NewParser(2)
+
+	first, err := parser.Parse("a=~b.*c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	second, err := parser.Parse("a=~b.*c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first != second {
+		t.Fatalf("Expected the second parse to return the cached expression")
+	}
+	if parser.Hits() != 1 || parser.Misses() != 1 {
+		t.Fatalf("Expected 1 hit and 1 miss, got %d hits and %d misses", parser.Hits(), parser.Misses())
+	}
+
+	// evicts "a=~b.*c" from the cache
+	for _, expr := range []string{"d=e", "f!=g"} {
+		if _, err := parser.Parse(expr); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	third, err := parser.Parse("a=~b.*c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if third == first {
+		t.Fatalf("Expected the evicted expression to get parsed again")
+	}
+	if !third.Equals(first) {
+		t.Fatalf("Expected re-parsed expression to equal the original one")
+	}
+	if parser.Hits() != 1 || parser.Misses() != 4 {
+		t.Fatalf("Expected 1 hit and 4 misses, got %d hits and %d misses", parser.Hits(), parser.Misses())
+	}
+}
+
+func TestParserDoesNotCacheErrors(t *testing.T) {
+	parser := NewParser(10)
+	for i := 0; i < 2; i++ {
+		if _, err := parser.Parse("a=~(b"); err == nil {
+			t.Fatalf("Expected an error, but got none")
+		}
+	}
+	if parser.Hits() != 0 || parser.Misses() != 2 {
+		t.Fatalf("Expected 0 hits and 2 misses, got %d hits and %d misses", parser.Hits(), parser.Misses())
+	}
+}
+
+func TestParserWithoutCache(t *testing.T) {
+	parser := NewParser(0)
+	for i := 0; i < 2; i++ {
+		if _, err := parser.Parse("a=b"); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if parser.Hits() != 0 || parser.Misses() != 2 {
+		t.Fatalf("Expected 0 hits and 2 misses, got %d hits and %d misses", parser.Hits(), parser.Misses())
+	}
+}
+
+func TestParserUsesOptions(t *testing.T) {
+	opts := DefaultParseOptions()
+	opts.AllowedOperators = []ExpressionOperator{EQUAL}
+	parser := NewParserWithOptions(10, opts)
+
+	if _, err := parser.Parse("a!=b"); err == nil {
+		t.Fatalf("Expected an error, but got none")
+	}
+
+	opts.Dedup = true
+	parser = NewParserWithOptions(10, opts)
+	res, err := parser.ParseExpressions([]string{"a=b", "c=d", "a=b"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 expressions, got %v", res.Strings())
+	}
+}
+
+func TestParserConcurrentUse(t *testing.T) {
+	parser := NewParser(5)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				expr, err := parser.Parse(fmt.Sprintf("key=~value%d.*", (i+j)%10))
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+				expr.Matches("value1")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if parser.Hits()+parser.Misses() != 800 {
+		t.Fatalf("Expected 800 lookups, got %d", parser.Hits()+parser.Misses())
+	}
+}
+
+var parserBenchExpressions = []string{
+	"name=~^some\\.metric\\.(a|b|cd)\\..*",
+	"dc=~us-(east|west)-[0-9]+",
+	"host!=~web[0-9]+\\.prod",
+	"service=api",
+}
+
+func BenchmarkParseExpressionsUncached(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, expr := range parserBenchExpressions {
+			if _, err := ParseExpression(expr); err != nil {
+				b.Fatalf("Unexpected error: %s", err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseExpressionsCached(b *testing.B) {
+	parser := NewParser(len(parserBenchExpressions))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, expr := range parserBenchExpressions {
+			if _, err := parser.Parse(expr); err != nil {
+				b.Fatalf("Unexpected error: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package tagquery
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/errors"
+)
+
+// ParsePromMatchers parses a Prometheus style series selector, such as
+// `http_requests_total{job="api", instance!~"canary.*"}`, into a set of expressions.
+// The matcher operators =, !=, =~ and !~ get translated into EQUAL, NOT_EQUAL, MATCH and
+// NOT_MATCH, the label __name__ as well as the optional metric name in front of the braces
+// get translated into the tag "name".
+//
+// Note that Prometheus regular expressions are anchored at both ends, while Graphite tag
+// expressions are only anchored at the beginning (f.e. "a=~b" matches the value "bc").
+// To retain the Prometheus semantics, the patterns of the returned regex expressions are
+// wrapped into "^(?:...)$".
+func ParsePromMatchers(selector string) (Expressions, error) {
+	selector = strings.TrimSpace(selector)
+
+	var res Expressions
+
+	// the metric name in front of the braces is optional
+	bracePos := strings.IndexByte(selector, '{')
+	name := selector
+	if bracePos >= 0 {
+		name = strings.TrimSpace(selector[:bracePos])
+	}
+	if len(name) > 0 {
+		if !isValidPromName(name, true) {
+			return nil, errors.NewBadRequestf("Invalid metric name in selector: %s", selector)
+		}
+		expression, err := NewExpressionEqual("name", name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, expression)
+	}
+
+	if bracePos < 0 {
+		if len(res) == 0 {
+			return nil, errors.NewBadRequestf("Selector must not be empty")
+		}
+		return res, nil
+	}
+
+	if selector[len(selector)-1] != '}' {
+		return nil, errors.NewBadRequestf("Missing closing brace in selector: %s", selector)
+	}
+
+	matchers := selector[bracePos+1 : len(selector)-1]
+	pos := 0
+	for {
+		pos = skipSpaces(matchers, pos)
+		if pos >= len(matchers) {
+			break
+		}
+
+		expression, newPos, err := parsePromMatcher(matchers, pos)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, expression)
+
+		pos = skipSpaces(matchers, newPos)
+		if pos >= len(matchers) {
+			break
+		}
+		if matchers[pos] != ',' {
+			return nil, errors.NewBadRequestf("Expected ',' at position %d in selector: %s", pos, selector)
+		}
+		pos++
+	}
+
+	if len(res) == 0 {
+		return nil, errors.NewBadRequestf("Selector must contain at least one matcher: %s", selector)
+	}
+
+	return res, nil
+}
+
+// parsePromMatcher parses a single matcher, such as `job="api"`, starting at
+// the given position. It returns the resulting expression and the position
+// right after the end of the matcher
+func parsePromMatcher(matchers string, pos int) (Expression, int, error) {
+	start := pos
+	for pos < len(matchers) && isPromNameChar(matchers[pos], pos == start, false) {
+		pos++
+	}
+	label := matchers[start:pos]
+	if len(label) == 0 {
+		return nil, 0, errors.NewBadRequestf("Missing label name at position %d in matchers: %s", start, matchers)
+	}
+	if label == "__name__" {
+		label = "name"
+	}
+
+	pos = skipSpaces(matchers, pos)
+	var operator string
+	for _, candidate := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(matchers[pos:], candidate) {
+			operator = candidate
+			break
+		}
+	}
+	if len(operator) == 0 {
+		return nil, 0, errors.NewBadRequestf("Missing operator after label \"%s\" in matchers: %s", label, matchers)
+	}
+	pos = skipSpaces(matchers, pos+len(operator))
+
+	value, pos, err := parsePromQuotedString(matchers, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var expression Expression
+	switch operator {
+	case "=":
+		// a leading "~" would make the value look like a regular expression
+		expression, err = ParseExpression(label + "=" + escapeEqualValue(value))
+	case "!=":
+		expression, err = ParseExpression(label + "!=" + escapeValue(value))
+	case "=~":
+		expression, err = ParseExpression(label + "=~^(?:" + value + ")$")
+	case "!~":
+		expression, err = ParseExpression(label + "!=~^(?:" + value + ")$")
+	}
+
+	return expression, pos, err
+}
+
+// parsePromQuotedString parses a string quoted by ", ' or ` starting at the given position.
+// It returns the unquoted string and the position right after the closing quote
+func parsePromQuotedString(matchers string, pos int) (string, int, error) {
+	if pos >= len(matchers) {
+		return "", 0, errors.NewBadRequestf("Missing value in matchers: %s", matchers)
+	}
+
+	quote := matchers[pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", 0, errors.NewBadRequestf("Value must be quoted at position %d in matchers: %s", pos, matchers)
+	}
+
+	end := pos + 1
+	for ; end < len(matchers); end++ {
+		if matchers[end] == '\\' && quote != '`' {
+			end++
+			continue
+		}
+		if matchers[end] == quote {
+			break
+		}
+	}
+	if end >= len(matchers) {
+		return "", 0, errors.NewBadRequestf("Unclosed quotes at position %d in matchers: %s", pos, matchers)
+	}
+
+	quoted := matchers[pos : end+1]
+	if quote == '\'' {
+		// strconv.Unquote interprets single quotes as a rune literal, so we
+		// convert the single quoted string into a double quoted one
+		quoted = `"` + strings.Replace(strings.Replace(quoted[1:len(quoted)-1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+	}
+
+	value, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", 0, errors.NewBadRequestf("Invalid escape sequence in quoted value %s: %s", matchers[pos:end+1], err)
+	}
+
+	return value, end + 1, nil
+}
+
+func skipSpaces(s string, pos int) int {
+	for pos < len(s) && (s[pos] == ' ' || s[pos] == '\t' || s[pos] == '\n') {
+		pos++
+	}
+	return pos
+}
+
+// isValidPromName validates a Prometheus label name, or a metric name if the
+// second argument is true. Metric names may additionally contain ':'
+func isValidPromName(name string, metricName bool) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isPromNameChar(name[i], i == 0, metricName) {
+			return false
+		}
+	}
+	return true
+}
+
+func isPromNameChar(c byte, first, metricName bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (metricName && c == ':') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
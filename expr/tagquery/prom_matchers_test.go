@@ -0,0 +1,109 @@
+package tagquery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePromMatchers(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "simple matchers",
+			selector: `{job="api", instance!~"canary.*"}`,
+			want:     []string{"job=api", "instance!=~^(?:canary.*)$"},
+		}, {
+			name:     "all operators",
+			selector: `{a="1",b!="2",c=~"3",d!~"4"}`,
+			want:     []string{"a=1", "b!=2", "c=3", "d!=4"},
+		}, {
+			name:     "regex operators with patterns",
+			selector: `{c=~"3|4",d!~"4.*"}`,
+			want:     []string{"c=~^(?:3|4)$", "d!=~^(?:4.*)$"},
+		}, {
+			name:     "metric name and __name__",
+			selector: `http_requests:total{__name__=~"http_.*", job="api",}`,
+			want:     []string{"name=http_requests:total", "name=~^(?:http_.*)$", "job=api"},
+		}, {
+			name:     "only metric name",
+			selector: ` up `,
+			want:     []string{"name=up"},
+		}, {
+			name:     "escapes and other quotes",
+			selector: `{a="x\"y\\z", b='it\'s "q"', c=~` + "`a\\.b`" + `}`,
+			want:     []string{`a=x"y\z`, `b=it's "q"`, `c=a.b`},
+		}, {
+			name:     "empty value",
+			selector: `{a="", b!="", c="d"}`,
+			want:     []string{"a=", "b!=", "c=d"},
+		}, {
+			name:     "empty selector",
+			selector: `{}`,
+			wantErr:  true,
+		}, {
+			name:     "unquoted value",
+			selector: `{a=b}`,
+			wantErr:  true,
+		}, {
+			name:     "unclosed quote",
+			selector: `{a="b}`,
+			wantErr:  true,
+		}, {
+			name:     "missing closing brace",
+			selector: `{a="b"`,
+			wantErr:  true,
+		}, {
+			name:     "missing comma",
+			selector: `{a="b" c="d"}`,
+			wantErr:  true,
+		}, {
+			name:     "invalid label name",
+			selector: `{0a="b"}`,
+			wantErr:  true,
+		}, {
+			name:     "invalid operator",
+			selector: `{a~"b"}`,
+			wantErr:  true,
+		}, {
+			name:     "invalid regex",
+			selector: `{a=~"(b"}`,
+			wantErr:  true,
+		}, {
+			name:     "value with leading tilde",
+			selector: `{a="~b", c!="\\~d"}`,
+			want:     []string{`a=\~b`, `c!=\\~d`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePromMatchers(tt.selector)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePromMatchers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Strings(), tt.want) {
+				t.Fatalf("ParsePromMatchers() = %v, want %v", got.Strings(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePromMatchersIsFullyAnchored(t *testing.T) {
+	expressions, err := ParsePromMatchers(`{a=~"b"}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !expressions[0].Matches("b") {
+		t.Fatalf("Expected expression to match \"b\"")
+	}
+	if expressions[0].Matches("bc") {
+		t.Fatalf("Expected expression to not match \"bc\"")
+	}
+}
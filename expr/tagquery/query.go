@@ -1,6 +1,10 @@
 package tagquery
 
 import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
 	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/metrictank/util"
@@ -8,9 +12,12 @@ import (
 
 var (
 	errInvalidQuery = errors.NewBadRequest("invalid query")
-	MatchCacheSize  int
 	MetaTagSupport  bool
 
+	// ErrNoInitialExpression is returned by Expressions.Partition if none of the expressions
+	// requires a non-empty value, so there is no expression to look up the candidate metrics
+	ErrNoInitialExpression = errors.NewBadRequest("no expression requires a non-empty value")
+
 	// the function we use to get the hash for hashing the meta records
 	// it can be replaced for mocking in tests
 	QueryHash func() util.StringHash32
@@ -27,6 +34,11 @@ type Query struct {
 	// clause that operates on LastUpdate field
 	From int64
 
+	// end of the time range of the request which the query is a part of, 0 means there is none.
+	// it doesn't filter the metrics, because a metric which got updated after To can still
+	// have data in the time range, it gets kept so the query can be logged and passed on as a whole
+	To int64
+
 	// slice of expressions sorted by the estimated cost of their operators
 	Expressions Expressions
 
@@ -34,6 +46,25 @@ type Query struct {
 	// we only support 0 or 1 tag expression per query
 	// tag expressions are __tag^= and __tag=~
 	tagClause int
+
+	// the error returned by Expressions.Validate, if it is not nil the query can never match anything
+	contradiction error
+
+	// whether one of the expressions is a MATCH_NONE expression, then the query can never match anything
+	matchNone bool
+
+	// the maximum number of results which the caller needs, 0 means unlimited.
+	// it doesn't change which metrics the query matches, it allows the executor to stop early
+	Limit uint
+
+	// if Trace is not nil the executor collects the stats of the filters of the query in it,
+	// f.e. for the slow query log. it doesn't change which metrics the query matches
+	Trace *QueryTrace
+
+	// if DecisionMemo is not nil the executor memoizes the decisions of the filters of the
+	// meta tag records in it, so the records which share expressions only evaluate them once
+	// per metric. it doesn't change which metrics the query matches
+	DecisionMemo *DecisionMemo
 }
 
 //NewQueryFromStrings parses a list of graphite tag expressions as used by the graphite `seriesByTag` function.
@@ -46,18 +77,120 @@ func NewQueryFromStrings(expressionStrs []string, from int64) (Query, error) {
 	if err != nil {
 		return res, err
 	}
-	return NewQuery(expressions, from)
+	return NewQuery(expressions, from, 0)
 }
 
-func NewQuery(expressions Expressions, from int64) (Query, error) {
-	q := Query{From: from, tagClause: -1}
+//ParseQuery parses a query which consists of graphite tag expressions joined by ";", as returned by Expressions.String()
+func ParseQuery(query string, from, to int64) (Query, error) {
+	var res Query
+	expressions, err := ParseExpressions(strings.Split(query, ";"))
+	if err != nil {
+		return res, err
+	}
+	return NewQuery(expressions, from, to)
+}
+
+//NewQueryFromStringsWithOptions is the same as NewQueryFromStrings, but it takes options to control the parser,
+//f.e. to enforce limits on the size of the query via ParseOptions.QueryLimits
+func NewQueryFromStringsWithOptions(expressionStrs []string, from int64, opts ParseOptions) (Query, error) {
+	var res Query
+	expressions, err := ParseExpressionsWithOptions(expressionStrs, opts)
+	if err != nil {
+		return res, err
+	}
+	return NewQuery(expressions, from, 0)
+}
+
+//NewQueryWithLimits is the same as NewQuery, but it returns a QueryLimitError
+//if the given expressions exceed any of the given limits
+func NewQueryWithLimits(expressions Expressions, from int64, limits QueryLimits) (Query, error) {
+	if err := limits.Check(expressions); err != nil {
+		return Query{From: from, tagClause: -1}, err
+	}
+	return NewQuery(expressions, from, 0)
+}
+
+//NewAutoCompleteValuesQuery returns the query to autocomplete the values of the given tag, as used
+//by the /tags/autoComplete/values endpoint. It consists of a prefix expression on the tag, or if the
+//prefix is empty an expression requiring the presence of the tag, combined with the given filters.
+//The limit gets recorded as Query.Limit. The filters don't get modified, they may be empty
+func NewAutoCompleteValuesQuery(tag, valuePrefix string, filters Expressions, limit uint) (Query, error) {
+	var valueExpression Expression
+	var err error
+	if len(valuePrefix) > 0 {
+		valueExpression, err = NewExpressionPrefix(tag, valuePrefix)
+	} else {
+		valueExpression, err = NewExpressionHasTag(tag)
+	}
+	if err != nil {
+		return Query{tagClause: -1}, err
+	}
+
+	return newAutoCompleteQuery(valueExpression, filters, limit)
+}
+
+//NewAutoCompleteTagsQuery returns the query to autocomplete tag keys, as used by the endpoint
+//"/tags/autoComplete/tags". It consists of the expression "__tag^=<prefix>" combined with
+//the given filters, the prefix must only contain characters which are valid in tag keys. If the
+//prefix is empty an expression matching all tag keys is used instead, so the filters may be empty.
+//The limit gets recorded as Query.Limit. The filters don't get modified
+func NewAutoCompleteTagsQuery(tagPrefix string, filters Expressions, limit uint) (Query, error) {
+	var tagExpression Expression
+	var err error
+	switch {
+	case len(tagPrefix) > 0:
+		if err = validateQueryExpressionTagKey(tagPrefix, defaultParseOptions.KeyValidation); err != nil {
+			return Query{tagClause: -1}, InvalidKeyError{Expression: "__tag^=" + tagPrefix, Key: tagPrefix, Err: err}
+		}
+		tagExpression, err = NewExpressionPrefixTag(tagPrefix)
+	case len(filters) > 0:
+		// "__tag=~.*" doesn't need to look at any tag, the filters select the metrics
+		tagExpression, err = NewExpressionMatchTag(".*")
+	default:
+		// without filters the query needs an expression which requires a non-empty value,
+		// every tag key is non-empty, so this selects all metrics which have any tag
+		tagExpression, err = NewExpressionMatchTag(".+")
+	}
+	if err != nil {
+		return Query{tagClause: -1}, err
+	}
+
+	return newAutoCompleteQuery(tagExpression, filters, limit)
+}
+
+// newAutoCompleteQuery returns a query consisting of the given expression and the filters
+func newAutoCompleteQuery(expression Expression, filters Expressions, limit uint) (Query, error) {
+	// NewQuery sorts the expressions, so they get copied to not reorder the filters
+	expressions := make(Expressions, 0, len(filters)+1)
+	expressions = append(expressions, filters...)
+	expressions = append(expressions, expression)
+
+	query, err := NewQuery(expressions, 0, 0)
+	if err != nil {
+		return query, err
+	}
+
+	query.Limit = limit
+	return query, nil
+}
+
+//NewQuery instantiates a query from the given expressions and time range, to may be 0 if the
+//time range has no end. It returns an error if the query is invalid, which is the case if it
+//has no expression which requires a non-empty value or more than one expression on the tag keys.
+//Expressions which contradict each other don't make the query invalid, they only make it
+//impossible to match anything, see Contradiction()
+func NewQuery(expressions Expressions, from, to int64) (Query, error) {
+	q := Query{From: from, To: to, tagClause: -1}
 
 	if len(expressions) == 0 {
 		return q, errInvalidQuery
 	}
 
+	if to > 0 && to < from {
+		return q, errors.NewBadRequestf("Invalid time range of query, from %d is after to %d", from, to)
+	}
+
 	expressions.Sort()
-	foundExpressionRequiringNonEmptyValue := false
 	for i := 0; i < len(expressions); i++ {
 		// skip duplicate expression
 		if i > 0 && expressions[i].Equals(expressions[i-1]) {
@@ -66,8 +199,6 @@ func NewQuery(expressions Expressions, from int64) (Query, error) {
 			continue
 		}
 
-		foundExpressionRequiringNonEmptyValue = foundExpressionRequiringNonEmptyValue || expressions[i].RequiresNonEmptyValue()
-
 		op := expressions[i].GetOperator()
 		switch op {
 		case MATCH_TAG:
@@ -82,11 +213,13 @@ func NewQuery(expressions Expressions, from int64) (Query, error) {
 		}
 	}
 
-	if !foundExpressionRequiringNonEmptyValue {
+	if expressions.findInitialExpression() < 0 {
 		return q, errInvalidQuery
 	}
 
 	q.Expressions = expressions
+	q.contradiction = expressions.Validate()
+	_, q.matchNone = expressions.MatchNoneExpression()
 
 	return q, nil
 }
@@ -103,3 +236,67 @@ func (q *Query) GetTagClause() Expression {
 	}
 	return q.Expressions[q.tagClause]
 }
+
+// Contradiction returns the ContradictionError found by NewQuery if two of the expressions
+// of the query contradict each other, in which case the query can never match anything.
+// Otherwise it returns nil
+func (q *Query) Contradiction() error {
+	return q.contradiction
+}
+
+// Unsatisfiable returns true if the query can never match anything, because two of its expressions
+// contradict each other or one of them is a MATCH_NONE expression, f.e. "a!=~.*". An executor can
+// return an empty result without walking the index then
+func (q *Query) Unsatisfiable() bool {
+	return q.contradiction != nil || q.matchNone
+}
+
+// String returns the expressions of the query separated by ";", followed by its time range and its
+// limit, f.e. "a=b;c!=d from=100 to=200 limit=10". the values which are 0 are omitted
+func (q Query) String() string {
+	var builder strings.Builder
+	builder.WriteString(q.Expressions.String())
+	if q.From != 0 {
+		builder.WriteString(" from=")
+		builder.WriteString(strconv.FormatInt(q.From, 10))
+	}
+	if q.To != 0 {
+		builder.WriteString(" to=")
+		builder.WriteString(strconv.FormatInt(q.To, 10))
+	}
+	if q.Limit != 0 {
+		builder.WriteString(" limit=")
+		builder.WriteString(strconv.FormatUint(uint64(q.Limit), 10))
+	}
+	return builder.String()
+}
+
+type queryJson struct {
+	Expressions Expressions `json:"expressions"`
+	From        int64       `json:"from"`
+	To          int64       `json:"to"`
+	Limit       uint        `json:"limit,omitempty"`
+}
+
+// MarshalJSON satisfies the json.Marshaler interface
+func (q Query) MarshalJSON() ([]byte, error) {
+	return json.Marshal(queryJson{Expressions: q.Expressions, From: q.From, To: q.To, Limit: q.Limit})
+}
+
+// UnmarshalJSON satisfies the json.Unmarshaler interface,
+// the decoded query gets validated in the same way as by NewQuery
+func (q *Query) UnmarshalJSON(data []byte) error {
+	var decoded queryJson
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	query, err := NewQuery(decoded.Expressions, decoded.From, decoded.To)
+	if err != nil {
+		return err
+	}
+	query.Limit = decoded.Limit
+
+	*q = query
+	return nil
+}
@@ -0,0 +1,153 @@
+package tagquery
+
+// QueryBuilder constructs a Query from expressions which get created by typed methods, so
+// their keys and values don't need to be escaped and parsed again. Each method validates its
+// input immediately, once a method has failed all following ones are no-ops and Build returns
+// the first error. Build runs the same validation as NewQuery, the builder can be used again
+// after it to build further queries. A QueryBuilder must not be used by multiple goroutines
+// concurrently. Example:
+//
+//	q, err := tagquery.NewQueryBuilder().
+//		Equal("name", "cpu.total").
+//		Match("dc", "us.*").
+//		NotHasTag("canary").
+//		From(ts).
+//		Build()
+type QueryBuilder struct {
+	expressions Expressions
+	from        int64
+	to          int64
+	err         error
+}
+
+// NewQueryBuilder returns a QueryBuilder without any expressions and without time range
+func NewQueryBuilder() *QueryBuilder {
+	return &QueryBuilder{}
+}
+
+// Expression adds an already created expression to the query
+func (b *QueryBuilder) Expression(expression Expression) *QueryBuilder {
+	if b.err == nil {
+		b.expressions = append(b.expressions, expression)
+	}
+	return b
+}
+
+// add adds the expression returned by one of the expression constructors, or records its error
+func (b *QueryBuilder) add(expression Expression, err error) *QueryBuilder {
+	if b.err != nil {
+		return b
+	}
+	if err != nil {
+		b.err = err
+		return b
+	}
+	return b.Expression(expression)
+}
+
+// Equal adds an expression as created by NewExpressionEqual
+func (b *QueryBuilder) Equal(key, value string) *QueryBuilder {
+	return b.add(NewExpressionEqual(key, value))
+}
+
+// NotEqual adds an expression as created by NewExpressionNotEqual
+func (b *QueryBuilder) NotEqual(key, value string) *QueryBuilder {
+	return b.add(NewExpressionNotEqual(key, value))
+}
+
+// EqualAny adds an expression as created by NewExpressionEqualAny
+func (b *QueryBuilder) EqualAny(key string, values []string) *QueryBuilder {
+	return b.add(NewExpressionEqualAny(key, values))
+}
+
+// NotEqualAny adds an expression as created by NewExpressionNotEqualAny
+func (b *QueryBuilder) NotEqualAny(key string, values []string) *QueryBuilder {
+	return b.add(NewExpressionNotEqualAny(key, values))
+}
+
+// EqualOrAbsent adds an expression as created by NewExpressionEqualOrAbsent
+func (b *QueryBuilder) EqualOrAbsent(key, value string) *QueryBuilder {
+	return b.add(NewExpressionEqualOrAbsent(key, value))
+}
+
+// Match adds an expression as created by NewExpressionMatch
+func (b *QueryBuilder) Match(key, pattern string) *QueryBuilder {
+	return b.add(NewExpressionMatch(key, pattern))
+}
+
+// NotMatch adds an expression as created by NewExpressionNotMatch
+func (b *QueryBuilder) NotMatch(key, pattern string) *QueryBuilder {
+	return b.add(NewExpressionNotMatch(key, pattern))
+}
+
+// Prefix adds an expression as created by NewExpressionPrefix
+func (b *QueryBuilder) Prefix(key, prefix string) *QueryBuilder {
+	return b.add(NewExpressionPrefix(key, prefix))
+}
+
+// NotPrefix adds an expression as created by NewExpressionNotPrefix
+func (b *QueryBuilder) NotPrefix(key, prefix string) *QueryBuilder {
+	return b.add(NewExpressionNotPrefix(key, prefix))
+}
+
+// Wildcard adds an expression as created by NewExpressionWildcard
+func (b *QueryBuilder) Wildcard(key, pattern string) *QueryBuilder {
+	return b.add(NewExpressionWildcard(key, pattern))
+}
+
+// Compare adds an expression as created by NewExpressionCompare
+func (b *QueryBuilder) Compare(key string, operator ExpressionOperator, value string) *QueryBuilder {
+	return b.add(NewExpressionCompare(key, operator, value))
+}
+
+// HasTag adds an expression as created by NewExpressionHasTag
+func (b *QueryBuilder) HasTag(key string) *QueryBuilder {
+	return b.add(NewExpressionHasTag(key))
+}
+
+// NotHasTag adds an expression as created by NewExpressionNotHasTag
+func (b *QueryBuilder) NotHasTag(key string) *QueryBuilder {
+	return b.add(NewExpressionNotHasTag(key))
+}
+
+// HasAnyTag adds an expression as created by NewExpressionHasAnyTag
+func (b *QueryBuilder) HasAnyTag(keys []string) *QueryBuilder {
+	return b.add(NewExpressionHasAnyTag(keys))
+}
+
+// MatchTag adds an expression as created by NewExpressionMatchTag
+func (b *QueryBuilder) MatchTag(pattern string) *QueryBuilder {
+	return b.add(NewExpressionMatchTag(pattern))
+}
+
+// PrefixTag adds an expression as created by NewExpressionPrefixTag
+func (b *QueryBuilder) PrefixTag(prefix string) *QueryBuilder {
+	return b.add(NewExpressionPrefixTag(prefix))
+}
+
+// From sets the beginning of the time range of the query, see Query.From
+func (b *QueryBuilder) From(from int64) *QueryBuilder {
+	b.from = from
+	return b
+}
+
+// To sets the end of the time range of the query, see Query.To
+func (b *QueryBuilder) To(to int64) *QueryBuilder {
+	b.to = to
+	return b
+}
+
+// Build returns the query consisting of the added expressions and the time range. It returns
+// the first error of the builder methods, or the error of NewQuery if the query is invalid.
+// The builder keeps its state, so further expressions can be added to build another query
+func (b *QueryBuilder) Build() (Query, error) {
+	if b.err != nil {
+		return Query{tagClause: -1}, b.err
+	}
+
+	// NewQuery sorts and deduplicates the given slice, the builder keeps its own
+	expressions := make(Expressions, len(b.expressions))
+	copy(expressions, b.expressions)
+
+	return NewQuery(expressions, b.from, b.to)
+}
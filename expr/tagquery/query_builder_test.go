@@ -0,0 +1,98 @@
+package tagquery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryBuilder(t *testing.T) {
+	q, err := NewQueryBuilder().
+		Equal("name", "cpu.total").
+		Match("dc", "us.*").
+		NotHasTag("canary").
+		EqualAny("host", []string{"a", "b"}).
+		Compare("level", GREATER, "5").
+		From(100).
+		To(200).
+		Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected, err := NewQueryFromStrings([]string{"name=cpu.total", "dc=~us.*", "canary=", "host|=a|b", "level>5"}, 100)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(q.Expressions.Strings(), expected.Expressions.Strings()) {
+		t.Fatalf("Expected expressions:\n%+v\ngot:\n%+v", expected.Expressions.Strings(), q.Expressions.Strings())
+	}
+	if q.From != 100 || q.To != 200 {
+		t.Fatalf("Expected time range 100-200, got %d-%d", q.From, q.To)
+	}
+}
+
+func TestQueryBuilderValuesDontNeedEscaping(t *testing.T) {
+	q, err := NewQueryBuilder().Equal("a", "~b").NotEqual("c", "=d").Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// the values are taken literally, when serializing they get escaped
+	if q.Expressions[0].GetValue() != "~b" || q.Expressions[1].GetValue() != "=d" {
+		t.Fatalf("Unexpected values: %+v", q.Expressions.Strings())
+	}
+
+	parsed, err := ParseExpressions(q.Expressions.Strings())
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	if !parsed.Equal(q.Expressions) {
+		t.Fatalf("Expected the serialized expressions to parse into the same expressions, got %+v", parsed.Strings())
+	}
+}
+
+func TestQueryBuilderErrors(t *testing.T) {
+	// the first error is kept, the following methods do nothing
+	b := NewQueryBuilder().Equal("a", "b").Match("c", "(").Equal("d;", "e")
+	if _, err := b.Build(); err == nil {
+		t.Fatalf("Expected an error because of the invalid pattern, but didn't get it")
+	}
+	if len(b.expressions) != 1 {
+		t.Fatalf("Expected the expressions after the error to be ignored, got %d expressions", len(b.expressions))
+	}
+
+	// the whole query gets validated by Build
+	if _, err := NewQueryBuilder().NotEqual("a", "b").Build(); err != errInvalidQuery {
+		t.Fatalf("Expected errInvalidQuery because no expression requires a non-empty value, got: %v", err)
+	}
+	if _, err := NewQueryBuilder().Equal("a", "b").From(200).To(100).Build(); err == nil {
+		t.Fatalf("Expected an error because from is after to, but didn't get it")
+	}
+}
+
+func TestQueryBuilderIsReusable(t *testing.T) {
+	b := NewQueryBuilder().NotEqual("c", "d").Equal("a", "b")
+
+	first, err := b.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	second, err := b.HasTag("e").Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if res := first.Expressions.Strings(); !reflect.DeepEqual(res, []string{"a=b", "c!=d"}) {
+		t.Fatalf("Expected the first query to be unchanged, got %+v", res)
+	}
+	if res := second.Expressions.Strings(); !reflect.DeepEqual(res, []string{"a=b", "c!=d", "e!="}) {
+		t.Fatalf("Unexpected expressions of the second query: %+v", res)
+	}
+
+	// building sorts the expressions of the query, but not the ones of the builder
+	if res := b.expressions.Strings(); !reflect.DeepEqual(res, []string{"c!=d", "a=b", "e!="}) {
+		t.Fatalf("Expected the builder to keep the order of its expressions, got %+v", res)
+	}
+}
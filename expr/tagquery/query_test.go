@@ -1,8 +1,11 @@
 package tagquery
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
+
+	"github.com/grafana/metrictank/errors"
 )
 
 func TestQueryByTagFilterByTagPrefixWithEmptyString(t *testing.T) {
@@ -19,6 +22,35 @@ func TestQueryByTagInvalidQuery(t *testing.T) {
 	}
 }
 
+// a regex which matches the empty value also matches series without the tag, so it can't be
+// used as the initial expression of a query
+func TestQueryRegexRequiresNonEmptyValue(t *testing.T) {
+	tests := []struct {
+		expressions []string
+		valid       bool
+	}{
+		{expressions: []string{"tag=~.*"}, valid: false},
+		{expressions: []string{"tag=~a*"}, valid: false},
+		{expressions: []string{"tag!=~.+"}, valid: false},
+		{expressions: []string{"__tag=~x*"}, valid: false},
+		{expressions: []string{"tag=~foo.*"}, valid: true},
+		{expressions: []string{"tag=~fo+"}, valid: true},
+		{expressions: []string{"tag!=~.*"}, valid: true},
+		{expressions: []string{"__tag=~x+"}, valid: true},
+		{expressions: []string{"tag=~.*", "other=~fo+"}, valid: true},
+	}
+
+	for _, tc := range tests {
+		_, err := NewQueryFromStrings(tc.expressions, 0)
+		if tc.valid && err != nil {
+			t.Fatalf("Expected query %+v to be valid, got error: %s", tc.expressions, err)
+		}
+		if !tc.valid && err != errInvalidQuery {
+			t.Fatalf("Expected query %+v to be rejected with errInvalidQuery, got: %v", tc.expressions, err)
+		}
+	}
+}
+
 func TestNewQueryFromStrings(t *testing.T) {
 	type args struct {
 		expressionStrs []string
@@ -43,9 +75,12 @@ func TestNewQueryFromStrings(t *testing.T) {
 						expressionCommonRe{
 							expressionCommon: expressionCommon{
 								key:   "__tag",
-								value: "^(?:k)",
+								value: "k",
 							},
-							valueRe: nil,
+							valueRe:        nil,
+							literalPrefix:  "k",
+							prefixComplete: true,
+							simple:         simpleMatcher{kind: simpleMatcherPrefix, literal: "k"},
 						},
 					},
 					&expressionEqual{
@@ -61,21 +96,27 @@ func TestNewQueryFromStrings(t *testing.T) {
 						},
 					},
 					&expressionMatch{
-						expressionCommonRe{
+						expressionCommonRe: expressionCommonRe{
 							expressionCommon: expressionCommon{
 								key:   "e",
-								value: "^(?:f)",
+								value: "f",
 							},
-							valueRe: nil,
+							valueRe:        nil,
+							literalPrefix:  "f",
+							prefixComplete: true,
+							simple:         simpleMatcher{kind: simpleMatcherPrefix, literal: "f"},
 						},
 					},
 					&expressionNotMatch{
 						expressionCommonRe{
 							expressionCommon: expressionCommon{
 								key:   "g",
-								value: "^(?:h)",
+								value: "h",
 							},
-							valueRe: nil,
+							valueRe:        nil,
+							literalPrefix:  "h",
+							prefixComplete: true,
+							simple:         simpleMatcher{kind: simpleMatcherPrefix, literal: "h"},
 						},
 					},
 					&expressionPrefix{
@@ -125,13 +166,9 @@ func TestNewQueryFromStrings(t *testing.T) {
 			want: Query{
 				From: 0,
 				Expressions: Expressions{
-					&expressionMatch{
-						expressionCommonRe{
-							expressionCommon: expressionCommon{
-								key:   "abc",
-								value: "^(?:.+)",
-							},
-							valueRe: nil,
+					&expressionHasTag{
+						expressionCommon{
+							key: "abc",
 						},
 					},
 				},
@@ -157,12 +194,15 @@ func TestNewQueryFromStrings(t *testing.T) {
 			want: Query{
 				Expressions: Expressions{
 					&expressionMatch{
-						expressionCommonRe{
+						expressionCommonRe: expressionCommonRe{
 							expressionCommon: expressionCommon{
 								key:   "abc",
-								value: "^(?:cba)",
+								value: "cba",
 							},
-							valueRe: nil,
+							valueRe:        nil,
+							literalPrefix:  "cba",
+							prefixComplete: true,
+							simple:         simpleMatcher{kind: simpleMatcherPrefix, literal: "cba"},
 						},
 					},
 				},
@@ -205,15 +245,18 @@ func TestNewQueryFromStrings(t *testing.T) {
 				return
 			}
 
-			// don't compare the compiled regex objects
+			// don't compare the compiled regex objects and the memoized filters
 			for i := range got.Expressions {
 				switch got.Expressions[i].(type) {
 				case *expressionMatch:
 					got.Expressions[i].(*expressionMatch).valueRe = nil
+					got.Expressions[i].(*expressionMatch).memo = nil
 				case *expressionNotMatch:
 					got.Expressions[i].(*expressionNotMatch).valueRe = nil
+					got.Expressions[i].(*expressionNotMatch).memo = nil
 				case *expressionMatchTag:
 					got.Expressions[i].(*expressionMatchTag).valueRe = nil
+					got.Expressions[i].(*expressionMatchTag).memo = nil
 				}
 			}
 
@@ -223,3 +266,261 @@ func TestNewQueryFromStrings(t *testing.T) {
 		})
 	}
 }
+
+func TestNewQueryWithTimeRange(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"a=b"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	q, err := NewQuery(expressions, 100, 200)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if q.From != 100 || q.To != 200 {
+		t.Fatalf("Expected time range 100-200, got %d-%d", q.From, q.To)
+	}
+
+	if _, err = NewQuery(expressions, 100, 0); err != nil {
+		t.Fatalf("Expected no error without end of the time range, got: %s", err)
+	}
+
+	if _, err = NewQuery(expressions, 200, 100); err == nil {
+		t.Fatalf("Expected an error because from is after to, but didn't get it")
+	}
+}
+
+func TestQueryContradiction(t *testing.T) {
+	q, err := NewQueryFromStrings([]string{"a=b", "c=d"}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := q.Contradiction(); err != nil {
+		t.Fatalf("Expected no contradiction, got: %s", err)
+	}
+
+	// a contradicting query is valid, it just can't match anything
+	q, err = NewQueryFromStrings([]string{"a=b", "a!=b"}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := q.Contradiction().(ContradictionError); !ok {
+		t.Fatalf("Expected a ContradictionError, got: %v", q.Contradiction())
+	}
+}
+
+func TestQueryUnsatisfiable(t *testing.T) {
+	testCases := []struct {
+		expressions   []string
+		unsatisfiable bool
+	}{
+		{expressions: []string{"a=b", "c=d"}, unsatisfiable: false},
+		{expressions: []string{"a=b", "c=~.*"}, unsatisfiable: false},
+		{expressions: []string{"a=b", "a!=b"}, unsatisfiable: true},
+		{expressions: []string{"a=b", "c!=~.*"}, unsatisfiable: true},
+		{expressions: []string{"a=b", "c!=~^.*", "d=e"}, unsatisfiable: true},
+	}
+
+	for i, tc := range testCases {
+		q, err := NewQueryFromStrings(tc.expressions, 0)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error: %s", i, err)
+		}
+		if res := q.Unsatisfiable(); res != tc.unsatisfiable {
+			t.Fatalf("TC %d: Expected query %v to be unsatisfiable %t, got %t", i, tc.expressions, tc.unsatisfiable, res)
+		}
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"c!=d", "a=b", "e=~f"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	q, err := NewQuery(expressions, 100, 200)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res := q.String(); res != "a=b;c!=d;e=~f from=100 to=200" {
+		t.Fatalf("Unexpected string representation: %s", res)
+	}
+
+	q.From, q.To = 0, 0
+	if res := q.String(); res != "a=b;c!=d;e=~f" {
+		t.Fatalf("Unexpected string representation: %s", res)
+	}
+}
+
+func TestQueryJSON(t *testing.T) {
+	q, err := NewQueryFromStrings([]string{"a=b", "c!=d", "__tag^=e"}, 100)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	q.To = 200
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+	if string(data) != `{"expressions":["__tag^=e","a=b","c!=d"],"from":100,"to":200}` {
+		t.Fatalf("Unexpected json: %s", data)
+	}
+
+	var decoded Query
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error when unmarshaling: %s", err)
+	}
+	if decoded.String() != q.String() || decoded.GetTagClause() == nil || decoded.GetTagClause().GetKey() != "__tag" {
+		t.Fatalf("Expected decoded query %s to equal %s", decoded.String(), q.String())
+	}
+
+	// the decoded query gets validated
+	if err := json.Unmarshal([]byte(`{"expressions":["a!=b"],"from":0,"to":0}`), &decoded); err == nil {
+		t.Fatalf("Expected an error when unmarshaling an invalid query, but didn't get it")
+	}
+}
+
+func TestNewAutoCompleteValuesQuery(t *testing.T) {
+	type testCase struct {
+		tag         string
+		valuePrefix string
+		filters     []string
+		limit       uint
+		expect      string
+		expectErr   bool
+	}
+
+	testCases := []testCase{
+		{tag: "host", valuePrefix: "web", filters: []string{"dc=us-east"}, limit: 10, expect: "dc=us-east;host^=web limit=10"},
+		{tag: "host", filters: []string{"dc=us-east"}, limit: 10, expect: "dc=us-east;host!= limit=10"},
+		{tag: "host", valuePrefix: "web", limit: 5, expect: "host^=web limit=5"},
+		{tag: "host", limit: 5, expect: "host!= limit=5"},
+		{tag: "name", valuePrefix: "a.b", filters: []string{"dc!=us-east"}, expect: "dc!=us-east;name^=a.b"},
+
+		// the prefix makes the filters a valid query, none of them requires a non-empty value
+		{tag: "host", valuePrefix: "web", filters: []string{"dc!=us-east", "service=~.*"}, limit: 1, expect: "dc!=us-east;host^=web;service=~.* limit=1"},
+
+		// the tag clauses of the filters get validated
+		{tag: "host", filters: []string{"__tag^=a", "__tag=~b.*c"}, expectErr: true},
+		{tag: "", valuePrefix: "web", expectErr: true},
+		{tag: "a;b", expectErr: true},
+	}
+
+	for i, tc := range testCases {
+		filters, err := ParseExpressions(tc.filters)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected parsing error: %s", i, err)
+		}
+		before := filters.Strings()
+
+		query, err := NewAutoCompleteValuesQuery(tc.tag, tc.valuePrefix, filters, tc.limit)
+		if tc.expectErr {
+			if err == nil {
+				t.Fatalf("TC %d: Expected an error, but got query %s", i, query.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error: %s", i, err)
+		}
+
+		if res := query.String(); res != tc.expect {
+			t.Fatalf("TC %d: Expected query %q, got %q", i, tc.expect, res)
+		}
+		if query.Limit != tc.limit {
+			t.Fatalf("TC %d: Expected limit %d, got %d", i, tc.limit, query.Limit)
+		}
+		if res := filters.Strings(); !reflect.DeepEqual(res, before) {
+			t.Fatalf("TC %d: Expected the filters to be unchanged, got %v", i, res)
+		}
+	}
+}
+
+func TestQueryJSONWithLimit(t *testing.T) {
+	q, err := NewAutoCompleteValuesQuery("host", "web", nil, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		t.Fatalf("Unexpected error when marshaling: %s", err)
+	}
+	if string(data) != `{"expressions":["host^=web"],"from":0,"to":0,"limit":10}` {
+		t.Fatalf("Unexpected json: %s", data)
+	}
+
+	var decoded Query
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error when unmarshaling: %s", err)
+	}
+	if decoded.Limit != 10 || decoded.String() != q.String() {
+		t.Fatalf("Expected decoded query %s to equal %s", decoded.String(), q.String())
+	}
+}
+
+func TestNewAutoCompleteTagsQuery(t *testing.T) {
+	type testCase struct {
+		tagPrefix string
+		filters   []string
+		limit     uint
+		expect    string
+		expectErr bool
+	}
+
+	testCases := []testCase{
+		{tagPrefix: "di", filters: []string{"dc=us-east"}, limit: 10, expect: "__tag^=di;dc=us-east limit=10"},
+		{tagPrefix: "di", limit: 10, expect: "__tag^=di limit=10"},
+		{filters: []string{"dc=us-east"}, limit: 10, expect: "__tag=~.*;dc=us-east limit=10"},
+
+		// without prefix and filters the query still needs an initial expression
+		{limit: 10, expect: "__tag=~.+ limit=10"},
+
+		// only one expression may operate on the tag keys
+		{tagPrefix: "di", filters: []string{"__tag=~a.*b"}, expectErr: true},
+		{filters: []string{"__tag^=a", "__tag=~a.*b"}, expectErr: true},
+
+		// none of the filters requires a non-empty value
+		{filters: []string{"dc!=us-east"}, expectErr: true},
+
+		// invalid characters in tag keys
+		{tagPrefix: "a=b", expectErr: true},
+		{tagPrefix: "a;b", expectErr: true},
+		{tagPrefix: "a!", expectErr: true},
+		{tagPrefix: "^a", expectErr: true},
+	}
+
+	for i, tc := range testCases {
+		filters, err := ParseExpressions(tc.filters)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected parsing error: %s", i, err)
+		}
+		before := filters.Strings()
+
+		query, err := NewAutoCompleteTagsQuery(tc.tagPrefix, filters, tc.limit)
+		if tc.expectErr {
+			if err == nil {
+				t.Fatalf("TC %d: Expected an error, but got query %s", i, query.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error: %s", i, err)
+		}
+
+		if res := query.String(); res != tc.expect {
+			t.Fatalf("TC %d: Expected query %q, got %q", i, tc.expect, res)
+		}
+		if query.Limit != tc.limit {
+			t.Fatalf("TC %d: Expected limit %d, got %d", i, tc.limit, query.Limit)
+		}
+		if res := filters.Strings(); !reflect.DeepEqual(res, before) {
+			t.Fatalf("TC %d: Expected the filters to be unchanged, got %v", i, res)
+		}
+	}
+
+	if _, err := NewAutoCompleteTagsQuery("a=b", nil, 10); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Expected an ErrInvalidKey for a prefix with an invalid character, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package tagquery
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:generate msgp
+//msgp:ignore QueryTrace
+
+// ExpressionTrace is the compact form of the ExpressionStats of one expression of a traced query,
+// it can be logged or returned to the client which requested the trace
+type ExpressionTrace struct {
+	Expression      string `json:"expression"`
+	Evaluations     uint64 `json:"evaluations"`
+	RegexExecutions uint64 `json:"regexExecutions"`
+	CacheHits       uint64 `json:"cacheHits"`
+	CacheMisses     uint64 `json:"cacheMisses"`
+	Nanoseconds     uint64 `json:"ns"`
+
+	// CacheBypasses is only > 0 if the values of the expression were so unlikely to repeat
+	// that its match cache got bypassed, see SetMatchCacheBypass
+	CacheBypasses uint64 `json:"cacheBypasses,omitempty"`
+}
+
+// String returns the trace as it appears in StatsCollector.Summary, the cache bypasses are only
+// included if there are any, to make the expressions of which the cache got bypassed stand out
+func (e ExpressionTrace) String() string {
+	res := fmt.Sprintf("%s: evaluations=%d regex=%d cache-hits=%d cache-misses=%d time=%s",
+		e.Expression, e.Evaluations, e.RegexExecutions, e.CacheHits, e.CacheMisses, time.Duration(e.Nanoseconds))
+	if e.CacheBypasses > 0 {
+		res += fmt.Sprintf(" cache-bypasses=%d", e.CacheBypasses)
+	}
+	return res
+}
+
+// QueryTrace collects the ExpressionStats of the filters of all executions of a query, f.e. the
+// executions on each partition of the index and the sub queries of meta tags. A query executor
+// only instruments its filters if the query has a trace, see Query.Trace, so queries without it
+// don't pay for the instrumentation. It is safe for concurrent use
+type QueryTrace struct {
+	sync.Mutex
+	collectors []*StatsCollector
+}
+
+// NewQueryTrace returns an empty QueryTrace
+func NewQueryTrace() *QueryTrace {
+	return &QueryTrace{}
+}
+
+// NewStatsCollector returns a StatsCollector for the given expressions which is part of the
+// trace. If the trace is nil it returns nil, so the filters don't get instrumented
+func (t *QueryTrace) NewStatsCollector(expressions Expressions) *StatsCollector {
+	if t == nil {
+		return nil
+	}
+
+	collector := NewStatsCollector(expressions)
+	t.Lock()
+	t.collectors = append(t.collectors, collector)
+	t.Unlock()
+	return collector
+}
+
+// Expressions returns the traces of the traced expressions in the order in which they have been
+// traced first. The stats of the same expression from multiple executions get summed up
+func (t *QueryTrace) Expressions() []ExpressionTrace {
+	if t == nil {
+		return nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	var res []ExpressionTrace
+	byExpression := make(map[string]int)
+	for _, collector := range t.collectors {
+		for _, trace := range collector.Traces() {
+			i, ok := byExpression[trace.Expression]
+			if !ok {
+				byExpression[trace.Expression] = len(res)
+				res = append(res, trace)
+				continue
+			}
+			res[i].Evaluations += trace.Evaluations
+			res[i].RegexExecutions += trace.RegexExecutions
+			res[i].CacheHits += trace.CacheHits
+			res[i].CacheMisses += trace.CacheMisses
+			res[i].Nanoseconds += trace.Nanoseconds
+			res[i].CacheBypasses += trace.CacheBypasses
+		}
+	}
+	return res
+}
+
+// FormatExpressionTraces returns the given traces as one line, in the same format as
+// StatsCollector.Summary, f.e. to attach it to the log entry of a slow query
+func FormatExpressionTraces(traces []ExpressionTrace) string {
+	builder := strings.Builder{}
+	for i := range traces {
+		if i > 0 {
+			builder.WriteString("; ")
+		}
+		builder.WriteString(traces[i].String())
+	}
+	return builder.String()
+}
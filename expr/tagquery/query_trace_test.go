@@ -0,0 +1,79 @@
+package tagquery
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+func TestNilQueryTrace(t *testing.T) {
+	var trace *QueryTrace
+	expressions, err := ParseExpressions([]string{"a=~b.*c", "c=d"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	if collector := trace.NewStatsCollector(expressions); collector != nil {
+		t.Fatalf("Expected a nil trace to return a nil collector, got %+v", collector)
+	}
+	if res := trace.Expressions(); res != nil {
+		t.Fatalf("Expected a nil trace to have no expressions, got %+v", res)
+	}
+}
+
+func TestQueryTraceMergesCollectors(t *testing.T) {
+	first, err := ParseExpressions([]string{"service=~a.*i", "dc=us-east-1"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	second, err := ParseExpressions([]string{"host=~web-.*1", "service=~a.*i"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	lookup := func(_ schema.MKey, _, _ string) bool { return true }
+	trace := NewQueryTrace()
+	tags := []string{"dc=us-east-1", "host=web-1", "service=api"}
+	var collectors []*StatsCollector
+	for _, expressions := range []Expressions{first, second} {
+		collector := trace.NewStatsCollector(expressions)
+		collectors = append(collectors, collector)
+		filters, _ := expressions.GetMetricDefinitionFiltersWithStats(lookup, nil, collector)
+		for _, filter := range filters {
+			filter(schema.MKey{}, "a.b", tags)
+			filter(schema.MKey{}, "a.b", tags)
+		}
+	}
+
+	res := trace.Expressions()
+	expectExpressions := []string{"service=~a.*i", "dc=us-east-1", "host=~web-.*1"}
+	expectEvaluations := []uint64{4, 2, 2}
+	if len(res) != len(expectExpressions) {
+		t.Fatalf("Expected %d traced expressions, got %+v", len(expectExpressions), res)
+	}
+	for i := range res {
+		if res[i].Expression != expectExpressions[i] || res[i].Evaluations != expectEvaluations[i] {
+			t.Fatalf("TC %d: Expected %q with %d evaluations, got %+v", i, expectExpressions[i], expectEvaluations[i], res[i])
+		}
+	}
+	expectRegexExecutions := collectors[0].Stats(0).RegexExecutions + collectors[1].Stats(1).RegexExecutions
+	if res[0].RegexExecutions != expectRegexExecutions {
+		t.Fatalf("Expected the merged trace of %q to have %d regex executions, got %d", res[0].Expression, expectRegexExecutions, res[0].RegexExecutions)
+	}
+}
+
+func TestFormatExpressionTracesIsSummary(t *testing.T) {
+	expressions, err := ParseExpressions([]string{"a=~b.*c", "c=d"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	collector := NewStatsCollector(expressions)
+
+	if res, expect := FormatExpressionTraces(collector.Traces()), collector.Summary(); res != expect {
+		t.Fatalf("Expected formatted traces %q, got %q", expect, res)
+	}
+	expect := "a=~b.*c: evaluations=0 regex=0 cache-hits=0 cache-misses=0 time=0s; c=d: evaluations=0 regex=0 cache-hits=0 cache-misses=0 time=0s"
+	if res := FormatExpressionTraces(collector.Traces()); res != expect {
+		t.Fatalf("Expected formatted traces %q, got %q", expect, res)
+	}
+}
@@ -0,0 +1,60 @@
+package tagquery
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/errors"
+)
+
+// ErrRegexBudgetExceeded is returned by MetricDefinitionFilters.FilterBatch once the filters
+// of a query have executed more regular expressions than its RegexBudget allows
+var ErrRegexBudgetExceeded = errors.NewBadRequest("query exceeded its budget of regular expression evaluations")
+
+// RegexBudget limits the number of regular expressions which the filters of one query may
+// execute. It is shared by all the filters of the query and can be used concurrently
+type RegexBudget struct {
+	limit uint64
+	used  uint64
+}
+
+// NewRegexBudget returns a budget which allows the given number of regular expression
+// executions, if the limit is 0 the budget is unlimited and only counts them
+func NewRegexBudget(limit uint64) *RegexBudget {
+	return &RegexBudget{limit: limit}
+}
+
+// spend counts one regular expression execution, a nil budget doesn't count anything
+func (b *RegexBudget) spend() {
+	if b != nil {
+		atomic.AddUint64(&b.used, 1)
+	}
+}
+
+// Used returns the number of regular expressions which have been executed so far
+func (b *RegexBudget) Used() uint64 {
+	return atomic.LoadUint64(&b.used)
+}
+
+// Err returns ErrRegexBudgetExceeded if more regular expressions have been executed than
+// the limit allows, otherwise it returns nil. A nil budget is never exceeded
+func (b *RegexBudget) Err() error {
+	if b == nil || b.limit == 0 || atomic.LoadUint64(&b.used) <= b.limit {
+		return nil
+	}
+	return ErrRegexBudgetExceeded
+}
+
+type regexBudgetContextKey struct{}
+
+// ContextWithRegexBudget returns a copy of the given context which carries the budget,
+// FilterBatch stops once the budget of its context is exceeded
+func ContextWithRegexBudget(ctx context.Context, budget *RegexBudget) context.Context {
+	return context.WithValue(ctx, regexBudgetContextKey{}, budget)
+}
+
+// RegexBudgetFromContext returns the budget of the given context, or nil if it has none
+func RegexBudgetFromContext(ctx context.Context) *RegexBudget {
+	budget, _ := ctx.Value(regexBudgetContextKey{}).(*RegexBudget)
+	return budget
+}
@@ -0,0 +1,130 @@
+package tagquery
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+func getRegexBudgetTestFilters(t testing.TB, budget *RegexBudget) (MetricDefinitionFilters, []FilterDecision, []MetricDefinitionLike) {
+	opts := DefaultParseOptions()
+	opts.MatchCacheSize = 100
+	expressions, err := ParseExpressionsWithOptions([]string{"dc=~us-.*t", "host!=~web-[12]$", "name=~a.*b"}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	filters, defaultDecisions := expressions.GetMetricDefinitionFiltersWithBudget(nil, nil, budget)
+
+	defs := make([]MetricDefinitionLike, 3*FilterBatchCheckInterval)
+	for i := range defs {
+		defs[i] = MetricDefinitionLike{Name: "a.b", Tags: []string{"dc=us-east", "host=web-" + strconv.Itoa(i)}}
+	}
+	return filters, defaultDecisions, defs
+}
+
+func TestRegexBudget(t *testing.T) {
+	// an unlimited budget only counts, the value of the tag "dc" is always the same so
+	// it only gets matched once, "host" gets matched once per metric and so does the name,
+	// except for the hosts web-1 and web-2 which fail the host expression before
+	unlimited := NewRegexBudget(0)
+	filters, defaultDecisions, defs := getRegexBudgetTestFilters(t, unlimited)
+	res, err := filters.FilterBatch(ContextWithRegexBudget(context.Background(), unlimited), defs, defaultDecisions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res) != len(defs) {
+		t.Fatalf("Expected %d decisions, got %d", len(defs), len(res))
+	}
+	if used, expect := unlimited.Used(), uint64(1+len(defs)+len(defs)-2); used != expect {
+		t.Fatalf("Expected %d regex executions, got %d", expect, used)
+	}
+
+	// the budget is shared by the filters of all expressions, so it gets exceeded after
+	// evaluating the first metrics. the filters only get checked every FilterBatchCheckInterval
+	limited := NewRegexBudget(10)
+	filters, defaultDecisions, defs = getRegexBudgetTestFilters(t, limited)
+	if _, err := filters.FilterBatch(ContextWithRegexBudget(context.Background(), limited), defs, defaultDecisions); err != ErrRegexBudgetExceeded {
+		t.Fatalf("Expected ErrRegexBudgetExceeded, got %v", err)
+	}
+	if used, max := limited.Used(), uint64(1+2*FilterBatchCheckInterval); used > max {
+		t.Fatalf("Expected filtering to stop within the check interval after at most %d regex executions, got %d", max, used)
+	}
+
+	// a budget which isn't in the context of FilterBatch doesn't stop it
+	limited = NewRegexBudget(10)
+	filters, defaultDecisions, defs = getRegexBudgetTestFilters(t, limited)
+	if _, err := filters.FilterBatch(context.Background(), defs, defaultDecisions); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if limited.Err() != ErrRegexBudgetExceeded {
+		t.Fatalf("Expected the budget to be exceeded after %d regex executions", limited.Used())
+	}
+}
+
+func TestRegexBudgetNil(t *testing.T) {
+	var budget *RegexBudget
+	budget.spend()
+	if err := budget.Err(); err != nil {
+		t.Fatalf("Expected a nil budget to never be exceeded, got %s", err)
+	}
+	if budget := RegexBudgetFromContext(context.Background()); budget != nil {
+		t.Fatalf("Expected no budget in a context without budget, got %+v", budget)
+	}
+
+	budget = NewRegexBudget(1)
+	if res := RegexBudgetFromContext(ContextWithRegexBudget(context.Background(), budget)); res != budget {
+		t.Fatalf("Expected to get the budget from the context, got %+v", res)
+	}
+}
+
+func benchmarkRegexBudget(b *testing.B, budget *RegexBudget) {
+	expressions, err := ParseExpressions(benchmarkFilterTagsExpressions)
+	if err != nil {
+		b.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	lookup := func(_ schema.MKey, _, _ string) bool { return true }
+	filters, _ := expressions.GetMetricDefinitionFiltersWithBudget(lookup, nil, budget)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, filter := range filters {
+			filter(schema.MKey{}, "abc.bcd.cde", benchmarkFilterTagsMetricTags)
+		}
+	}
+}
+
+func BenchmarkFilterWithoutRegexBudget(b *testing.B) {
+	benchmarkRegexBudget(b, nil)
+}
+
+func BenchmarkFilterWithUnlimitedRegexBudget(b *testing.B) {
+	benchmarkRegexBudget(b, NewRegexBudget(0))
+}
+
+func TestRegexBudgetFilterBatchParallel(t *testing.T) {
+	// without match cache every metric costs a regex execution
+	opts := DefaultParseOptions()
+	opts.MatchCacheSize = -1
+	expressions, err := ParseExpressionsWithOptions([]string{"host=~.*web-[0-9]+"}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	defs := make([]MetricDefinitionLike, 20*FilterBatchCheckInterval)
+	for i := range defs {
+		defs[i].Tags = []string{"host=web-" + strconv.Itoa(i)}
+	}
+
+	budget := NewRegexBudget(FilterBatchCheckInterval)
+	filters, defaultDecisions := expressions.GetMetricDefinitionFiltersWithBudget(nil, nil, budget)
+	if _, err := filters.FilterBatchParallel(ContextWithRegexBudget(context.Background(), budget), defs, defaultDecisions, 4); err != ErrRegexBudgetExceeded {
+		t.Fatalf("Expected ErrRegexBudgetExceeded, got %v", err)
+	}
+	if used := budget.Used(); used >= uint64(len(defs)) {
+		t.Fatalf("Expected the workers to stop before filtering all %d metrics, but %d regexes got executed", len(defs), used)
+	}
+}
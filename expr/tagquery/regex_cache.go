@@ -0,0 +1,66 @@
+package tagquery
+
+import (
+	"regexp"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/stats"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+var (
+	// metric tagquery.regex-cache.ops.hit is a counter of patterns which were found compiled in the regex cache
+	regexCacheHit = stats.NewCounter32("tagquery.regex-cache.ops.hit")
+	// metric tagquery.regex-cache.ops.miss is a counter of patterns which had to be compiled, because they were not in the regex cache
+	regexCacheMiss = stats.NewCounter32("tagquery.regex-cache.ops.miss")
+)
+
+// DefaultRegexCacheSize is the number of compiled patterns which get cached until SetRegexCacheSize gets called
+const DefaultRegexCacheSize = 1000
+
+// regexCache holds the *lru.Cache which maps patterns to their compiled regular expressions,
+// or nil if it is disabled. see SetRegexCacheSize
+var regexCache atomic.Value
+
+func init() {
+	SetRegexCacheSize(DefaultRegexCacheSize)
+}
+
+// SetRegexCacheSize sets the number of compiled regular expressions which get cached, so the
+// expressions parsed from the same pattern share one *regexp.Regexp instead of compiling it
+// again, f.e. when many dashboards query "dc=~us-.*". The patterns are the ones the expressions
+// get evaluated with, which are anchored at the beginning. The least recently used ones get
+// evicted once the cache is full. A size <= 0 disables the cache. Setting the size replaces
+// the cache by an empty one, the expressions which have been parsed before keep their
+// regular expressions
+func SetRegexCacheSize(size int) {
+	var cache *lru.Cache
+	if size > 0 {
+		// lru.New only fails on a size <= 0
+		cache, _ = lru.New(size)
+	}
+	regexCache.Store(cache)
+}
+
+// compileRegex returns the compiled regular expression of the given pattern, from the regex
+// cache if it is in there. patterns which fail to compile don't get cached.
+// a *regexp.Regexp is safe for concurrent use, so all the expressions can share it
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	cache := regexCache.Load().(*lru.Cache)
+	if cache == nil {
+		return regexp.Compile(pattern)
+	}
+
+	if cached, ok := cache.Get(pattern); ok {
+		regexCacheHit.Inc()
+		return cached.(*regexp.Regexp), nil
+	}
+	regexCacheMiss.Inc()
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	cache.Add(pattern, re)
+	return re, nil
+}
@@ -0,0 +1,74 @@
+package tagquery
+
+import (
+	"sync"
+	"testing"
+)
+
+func valueReOf(t *testing.T, expression string) *expressionCommonRe {
+	t.Helper()
+	e, err := ParseExpression(expression)
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+	re := commonReOf(e)
+	if re == nil {
+		t.Fatalf("Expected %q to be a regex expression, got %T", expression, e)
+	}
+	return re
+}
+
+func TestRegexCache(t *testing.T) {
+	defer SetRegexCacheSize(DefaultRegexCacheSize)
+	SetRegexCacheSize(2)
+
+	// the expressions using the same pattern share the compiled regular expression, no matter
+	// which operator they use
+	first, second, inverted := valueReOf(t, "dc=~us-[a-z]+-[0-9]"), valueReOf(t, "dc=~us-[a-z]+-[0-9]"), valueReOf(t, "dc!=~us-[a-z]+-[0-9]")
+	if first.valueRe != second.valueRe || first.valueRe != inverted.valueRe {
+		t.Fatalf("Expected the expressions with the same pattern to share the compiled regular expression")
+	}
+
+	// the cache is keyed by the anchored pattern, a pattern which already is anchored doesn't
+	// get wrapped into "^(?:...)", so it doesn't share the regular expression
+	if valueReOf(t, "dc=~^us-[a-z]+-[0-9]").valueRe.String() == first.valueRe.String() {
+		t.Fatalf("Expected the explicitly anchored pattern to be compiled as it is")
+	}
+	if valueReOf(t, "host=~us-[a-z]+-[0-9]").valueRe != first.valueRe {
+		t.Fatalf("Expected expressions with different keys to share the compiled regular expression")
+	}
+
+	// the least recently used pattern gets evicted once the cache is full
+	valueReOf(t, "dc=~eu-[a-z]+-[0-9]")
+	valueReOf(t, "dc=~ap-[a-z]+-[0-9]")
+	if valueReOf(t, "dc=~us-[a-z]+-[0-9]").valueRe == first.valueRe {
+		t.Fatalf("Expected the least recently used pattern to be evicted")
+	}
+
+	SetRegexCacheSize(0)
+	if valueReOf(t, "dc=~eu-[a-z]+-[0-9]").valueRe == valueReOf(t, "dc=~eu-[a-z]+-[0-9]").valueRe {
+		t.Fatalf("Expected every expression to compile its own regular expression when the cache is disabled")
+	}
+}
+
+func TestRegexCacheConcurrentUse(t *testing.T) {
+	defer SetRegexCacheSize(DefaultRegexCacheSize)
+	SetRegexCacheSize(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := ParseExpression("dc=~us-[a-z]+-[0-9]")
+			if err != nil {
+				t.Errorf("Unexpected parsing error: %s", err)
+				return
+			}
+			if !e.Matches("us-east-1") || e.Matches("eu-west-1") {
+				t.Errorf("Unexpected result of matching %q", e)
+			}
+		}()
+	}
+	wg.Wait()
+}
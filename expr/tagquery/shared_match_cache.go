@@ -0,0 +1,79 @@
+package tagquery
+
+import (
+	"regexp"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/stats"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+var (
+	// metric tagquery.shared-match-cache.ops.hit is a counter of shared regex match cache hits
+	sharedMatchCacheHit = stats.NewCounter32("tagquery.shared-match-cache.ops.hit")
+	// metric tagquery.shared-match-cache.ops.miss is a counter of shared regex match cache misses
+	sharedMatchCacheMiss = stats.NewCounter32("tagquery.shared-match-cache.ops.miss")
+)
+
+// sharedMatchCache holds the *lru.Cache which is shared by the filters of all regex
+// expressions, or nil if it is disabled. see SetSharedMatchCacheSize
+var sharedMatchCache atomic.Value
+
+func init() {
+	sharedMatchCache.Store((*lru.Cache)(nil))
+}
+
+type sharedMatchCacheKey struct {
+	pattern string
+	value   string
+}
+
+// SetSharedMatchCacheSize sets the number of regex match results which get cached in the
+// process wide cache shared by the filters of all regex expressions. Unlike the caches of
+// the filters it survives the queries, so the filters of consecutive queries using the same
+// regular expressions don't need to match the same values again. The least recently used
+// results get evicted once it is full. A size <= 0 disables the shared cache, that's the
+// default. Setting the size replaces the cache by an empty one, filters which have been
+// created before the call keep using the cache which was present when they got created
+func SetSharedMatchCacheSize(size int) {
+	var cache *lru.Cache
+	if size > 0 {
+		// lru.New only fails on a size <= 0
+		cache, _ = lru.New(size)
+	}
+	sharedMatchCache.Store(cache)
+}
+
+// getSharedMatcher returns a function which looks up the result of matching a value against
+// the given regular expression in the shared match cache, and a function to add a result to
+// it. if the shared match cache is disabled both are nil.
+// the results are keyed by the canonical form of the pattern, see canonicalRegex, so the filters
+// of equivalent expressions share their results
+func getSharedMatcher(pattern string, valueRe *regexp.Regexp) (func(value string) (bool, bool), func(value string, match bool)) {
+	cache := sharedMatchCache.Load().(*lru.Cache)
+	if cache == nil {
+		return nil, nil
+	}
+
+	key := sharedMatchCacheKey{pattern: valueRe.String()}
+	if re, ok := canonicalRegex(pattern); ok {
+		key.pattern = re.String()
+	}
+
+	get := func(value string) (bool, bool) {
+		key := key
+		key.value = value
+		if cached, ok := cache.Get(key); ok {
+			sharedMatchCacheHit.Inc()
+			return cached.(bool), true
+		}
+		sharedMatchCacheMiss.Inc()
+		return false, false
+	}
+	add := func(value string, match bool) {
+		key := key
+		key.value = value
+		cache.Add(key, match)
+	}
+	return get, add
+}
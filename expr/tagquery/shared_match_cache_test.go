@@ -0,0 +1,116 @@
+package tagquery
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// regexExecutionsOfFilter creates a new filter from the given expression, runs the given
+// tags through it and returns how many times the filter had to execute the regex
+func regexExecutionsOfFilter(t *testing.T, expression string, tags [][]string) uint64 {
+	expressions, err := ParseExpressions([]string{expression})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	collector := NewStatsCollector(expressions)
+	filters, _ := expressions.GetMetricDefinitionFiltersWithStats(nil, nil, collector)
+	for i := range tags {
+		filters[0](schema.MKey{}, "a.b", tags[i])
+	}
+	return collector.Stats(0).RegexExecutions
+}
+
+func TestSharedMatchCache(t *testing.T) {
+	defer SetSharedMatchCacheSize(0)
+
+	tags := [][]string{{"dc=us-east"}, {"dc=us-west"}, {"dc=eu-west"}}
+
+	// without the shared match cache every filter needs to match the values again
+	if res := regexExecutionsOfFilter(t, "dc=~.*us-[a-z]+", tags); res != 3 {
+		t.Fatalf("Expected the first filter to execute the regex 3 times, got %d", res)
+	}
+	if res := regexExecutionsOfFilter(t, "dc=~.*us-[a-z]+", tags); res != 3 {
+		t.Fatalf("Expected the second filter to execute the regex 3 times without shared match cache, got %d", res)
+	}
+
+	SetSharedMatchCacheSize(100)
+	hits, misses := sharedMatchCacheHit.Peek(), sharedMatchCacheMiss.Peek()
+	if res := regexExecutionsOfFilter(t, "dc=~.*us-[a-z]+", tags); res != 3 {
+		t.Fatalf("Expected the first filter to execute the regex 3 times with an empty shared match cache, got %d", res)
+	}
+	if res := regexExecutionsOfFilter(t, "dc=~.*us-[a-z]+", tags); res != 0 {
+		t.Fatalf("Expected the second filter to use the results of the first one, but it executed the regex %d times", res)
+	}
+
+	// the filters of equivalent expressions share their results, regardless of the operator
+	if res := regexExecutionsOfFilter(t, "dc!=~(.*us-[a-z]+)", tags); res != 0 {
+		t.Fatalf("Expected the filter of an equivalent expression to use the shared results, but it executed the regex %d times", res)
+	}
+	if res := regexExecutionsOfFilter(t, "dc=~.*us-[a-z]*", tags); res != 3 {
+		t.Fatalf("Expected the filter of a different expression to execute the regex 3 times, got %d", res)
+	}
+
+	if res := sharedMatchCacheHit.Peek() - hits; res != 6 {
+		t.Fatalf("Expected 6 shared match cache hits, got %d", res)
+	}
+	if res := sharedMatchCacheMiss.Peek() - misses; res != 6 {
+		t.Fatalf("Expected 6 shared match cache misses, got %d", res)
+	}
+}
+
+func TestSharedMatchCacheIsBounded(t *testing.T) {
+	defer SetSharedMatchCacheSize(0)
+	SetSharedMatchCacheSize(2)
+
+	tags := [][]string{{"dc=us-east"}, {"dc=us-west"}, {"dc=eu-west"}}
+	regexExecutionsOfFilter(t, "dc=~.*us-[a-z]+", tags)
+
+	// only the 2 most recently added results are left
+	if res := regexExecutionsOfFilter(t, "dc=~.*us-[a-z]+", tags[1:]); res != 0 {
+		t.Fatalf("Expected the results of the last 2 values to be cached, but the regex got executed %d times", res)
+	}
+	if res := regexExecutionsOfFilter(t, "dc=~.*us-[a-z]+", tags[:1]); res != 1 {
+		t.Fatalf("Expected the result of the first value to be evicted, but the regex got executed %d times", res)
+	}
+}
+
+// TestSharedMatchCacheConcurrentUse is meant to be run with the race detector
+func TestSharedMatchCacheConcurrentUse(t *testing.T) {
+	defer SetSharedMatchCacheSize(0)
+	SetSharedMatchCacheSize(50)
+
+	expressions, err := ParseExpressions([]string{"host=~web-[0-9]*[13579]$"})
+	if err != nil {
+		t.Fatalf("Unexpected parsing error: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if worker == 0 && i%5 == 0 {
+					SetSharedMatchCacheSize(50)
+				}
+				filter := expressions.GetMetricDefinitionFilter(nil, nil)
+				for j := 0; j < 100; j++ {
+					host := (i*100 + j + worker) % 200
+					expected := Fail
+					if host%2 == 1 {
+						expected = Pass
+					}
+					if res := filter(schema.MKey{}, "a.b", []string{fmt.Sprintf("host=web-%d", host)}); res != expected {
+						t.Errorf("Expected decision %s for host web-%d, got %s", expected, host, res)
+						return
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,211 @@
+package tagquery
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
+)
+
+// simpleMatcherKind identifies the shape of a pattern which a simpleMatcher evaluates
+type simpleMatcherKind uint8
+
+const (
+	// the pattern has none of the simple shapes, it has to be evaluated by the regular expression
+	simpleMatcherNone simpleMatcherKind = iota
+
+	// "abc$", the value must equal the literal
+	simpleMatcherLiteral
+
+	// "abc" or "abc.*", the value must start with the literal
+	simpleMatcherPrefix
+
+	// "(abc|abd)$", the value must equal one of the literals
+	simpleMatcherLiteralSet
+
+	// "abc|abd", the value must start with one of the literals
+	simpleMatcherPrefixSet
+
+	// "abc[0-9]+", the value must start with the literal followed by at least one digit
+	simpleMatcherPrefixDigits
+
+	// "abc[0-9]+$", the value must consist of the literal followed by at least one digit
+	simpleMatcherLiteralDigits
+)
+
+// simpleMatcher evaluates a pattern of one of a few simple shapes, which are common in queries,
+// without running a regular expression. Matching a value against it has the same result as
+// matching it against the pattern anchored at the beginning, like the parser anchors it.
+// See newSimpleMatcher for the shapes
+type simpleMatcher struct {
+	// literal is used by the kinds which have one literal
+	literal string
+
+	// sets is used by the kinds which have multiple literals. they are less common than the
+	// others, so the sets are kept out of line to not make every simpleMatcher larger
+	sets *simpleMatcherSets
+
+	kind simpleMatcherKind
+}
+
+type simpleMatcherSets struct {
+	// literals is used by simpleMatcherLiteralSet
+	literals map[string]struct{}
+
+	// prefixes is used by simpleMatcherPrefixSet
+	prefixes []string
+}
+
+// newSimpleMatcher returns a simpleMatcher for the given pattern and its parsed form, if it
+// consists of one of these shapes, each of them optionally anchored at the beginning:
+// * a literal, optionally followed by ".*" if it's not anchored at the end
+// * an alternation of literals, which are either all or none anchored at the end
+// * a literal followed by "[0-9]+", optionally anchored at the end
+// Otherwise the kind of the returned simpleMatcher is simpleMatcherNone
+func newSimpleMatcher(pattern string, parsed *syntax.Regexp) simpleMatcher {
+	nodes, _ := trimBeginText(flattenConcat(parsed, nil))
+
+	endAnchored := false
+	for len(nodes) > 0 && nodes[len(nodes)-1].Op == syntax.OpEndText {
+		endAnchored = true
+		nodes = nodes[:len(nodes)-1]
+	}
+	if len(nodes) == 0 {
+		return simpleMatcher{}
+	}
+
+	last := nodes[len(nodes)-1]
+	if literal, ok := literalOfNodes(nodes); ok {
+		literal = shareWithPattern(literal, pattern)
+		if endAnchored {
+			return simpleMatcher{kind: simpleMatcherLiteral, literal: literal}
+		}
+		return simpleMatcher{kind: simpleMatcherPrefix, literal: literal}
+	}
+
+	if literal, ok := literalOfNodes(nodes[:len(nodes)-1]); ok {
+		literal = shareWithPattern(literal, pattern)
+		// it doesn't matter whether "." matches new lines or not, because the rest of the value
+		// doesn't need to be looked at
+		if !endAnchored && last.Op == syntax.OpStar && (last.Sub[0].Op == syntax.OpAnyCharNotNL || last.Sub[0].Op == syntax.OpAnyChar) {
+			return simpleMatcher{kind: simpleMatcherPrefix, literal: literal}
+		}
+		if last.Op == syntax.OpPlus && isDigitClass(last.Sub[0]) {
+			if endAnchored {
+				return simpleMatcher{kind: simpleMatcherLiteralDigits, literal: literal}
+			}
+			return simpleMatcher{kind: simpleMatcherPrefixDigits, literal: literal}
+		}
+	}
+
+	// the parser factors out common prefixes of alternations, so they need to be split first
+	if strings.IndexByte(pattern, '|') < 0 {
+		return simpleMatcher{}
+	}
+	if literals, ok := literalAlternativesOfPattern(pattern); ok {
+		res := simpleMatcher{kind: simpleMatcherLiteralSet, sets: &simpleMatcherSets{literals: make(map[string]struct{}, len(literals))}}
+		for _, literal := range literals {
+			res.sets.literals[literal] = struct{}{}
+		}
+		return res
+	}
+	if prefixes, ok := literalPrefixAlternativesOfPattern(pattern); ok {
+		return simpleMatcher{kind: simpleMatcherPrefixSet, sets: &simpleMatcherSets{prefixes: prefixes}}
+	}
+
+	return simpleMatcher{}
+}
+
+// literalOfNodes returns the literal which the given nodes of a flattened pattern consist of,
+// and true if they don't contain anything else. utf8.RuneError is not taken as a literal,
+// because it also matches invalid UTF-8
+func literalOfNodes(nodes []*syntax.Regexp) (string, bool) {
+	var builder strings.Builder
+	for _, node := range nodes {
+		if node.Op != syntax.OpLiteral || node.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		for _, r := range node.Rune {
+			if r == utf8.RuneError {
+				return "", false
+			}
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String(), true
+}
+
+// isDigitClass returns true if the given node is the character class [0-9]
+func isDigitClass(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpCharClass && len(re.Rune) == 2 && re.Rune[0] == '0' && re.Rune[1] == '9'
+}
+
+// match returns whether the given value matches the pattern. it must not be called if the kind
+// is simpleMatcherNone
+func (s *simpleMatcher) match(value string) bool {
+	switch s.kind {
+	case simpleMatcherLiteral:
+		return value == s.literal
+	case simpleMatcherPrefix:
+		return strings.HasPrefix(value, s.literal)
+	case simpleMatcherLiteralSet:
+		_, ok := s.sets.literals[value]
+		return ok
+	case simpleMatcherPrefixSet:
+		for _, prefix := range s.sets.prefixes {
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+		}
+		return false
+	case simpleMatcherPrefixDigits:
+		return len(value) > len(s.literal) && strings.HasPrefix(value, s.literal) && isDigit(value[len(s.literal)])
+	case simpleMatcherLiteralDigits:
+		if len(value) <= len(s.literal) || !strings.HasPrefix(value, s.literal) {
+			return false
+		}
+		for i := len(s.literal); i < len(value); i++ {
+			if !isDigit(value[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// matchBytes is the same as match, but it takes the value as a byte slice
+func (s *simpleMatcher) matchBytes(value []byte) bool {
+	switch s.kind {
+	case simpleMatcherLiteral:
+		return string(value) == s.literal
+	case simpleMatcherPrefix:
+		return bytesHavePrefix(value, s.literal)
+	case simpleMatcherLiteralSet:
+		_, ok := s.sets.literals[string(value)]
+		return ok
+	case simpleMatcherPrefixSet:
+		for _, prefix := range s.sets.prefixes {
+			if bytesHavePrefix(value, prefix) {
+				return true
+			}
+		}
+		return false
+	case simpleMatcherPrefixDigits:
+		return len(value) > len(s.literal) && bytesHavePrefix(value, s.literal) && isDigit(value[len(s.literal)])
+	case simpleMatcherLiteralDigits:
+		if len(value) <= len(s.literal) || !bytesHavePrefix(value, s.literal) {
+			return false
+		}
+		for i := len(s.literal); i < len(value); i++ {
+			if !isDigit(value[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
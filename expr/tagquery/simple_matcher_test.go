@@ -0,0 +1,135 @@
+package tagquery
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"testing"
+)
+
+func newTestSimpleMatcher(t testing.TB, pattern string) (simpleMatcher, *regexp.Regexp) {
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		t.Fatalf("Unexpected error when parsing %q: %s", pattern, err)
+	}
+	anchored, _ := anchorPattern(pattern, parsed)
+	return newSimpleMatcher(pattern, parsed), regexp.MustCompile(anchored)
+}
+
+func TestSimpleMatcher(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		kind    simpleMatcherKind
+	}{
+		{pattern: "abc$", kind: simpleMatcherLiteral},
+		{pattern: "^abc$", kind: simpleMatcherLiteral},
+		{pattern: "(abc)$", kind: simpleMatcherLiteral},
+		{pattern: "abc", kind: simpleMatcherPrefix},
+		{pattern: "abc.*", kind: simpleMatcherPrefix},
+		{pattern: "^a\\.b.*", kind: simpleMatcherPrefix},
+		{pattern: "(abc|abd)$", kind: simpleMatcherLiteralSet},
+		{pattern: "^(?:abc$|ab$)", kind: simpleMatcherLiteralSet},
+		{pattern: "abc|abd", kind: simpleMatcherPrefixSet},
+		{pattern: "(ab|b)", kind: simpleMatcherPrefixSet},
+		{pattern: "abc[0-9]+", kind: simpleMatcherPrefixDigits},
+		{pattern: "abc\\d+", kind: simpleMatcherPrefixDigits},
+		{pattern: "abc[0-9]+$", kind: simpleMatcherLiteralDigits},
+		{pattern: "[0-9]+$", kind: simpleMatcherLiteralDigits},
+		{pattern: "abc.*$", kind: simpleMatcherNone},
+		{pattern: "abc$|abd", kind: simpleMatcherNone},
+		{pattern: "a(?i)|b", kind: simpleMatcherNone},
+		{pattern: "(?i)abc", kind: simpleMatcherNone},
+		{pattern: "abc[0-9]*", kind: simpleMatcherNone},
+		{pattern: "abc[0-8]+", kind: simpleMatcherNone},
+		{pattern: "abc|", kind: simpleMatcherNone},
+		{pattern: ".*abc", kind: simpleMatcherNone},
+		{pattern: "\\x{FFFD}", kind: simpleMatcherNone},
+		{pattern: "^", kind: simpleMatcherNone},
+	}
+
+	values := []string{"", "a", "ab", "abc", "abcd", "abd", "abde", "ABC", "b", "bc", "xabc", "a.b", "a.bc", "axb", "abc1", "abc123", "abc12x", "abcx1", "123", "1x", "\xff"}
+
+	for i, tc := range testCases {
+		matcher, re := newTestSimpleMatcher(t, tc.pattern)
+		if matcher.kind != tc.kind {
+			t.Fatalf("TC %d: Expected pattern %q to have the simple matcher kind %d, got %d", i, tc.pattern, tc.kind, matcher.kind)
+		}
+		if matcher.kind == simpleMatcherNone {
+			continue
+		}
+		for _, value := range values {
+			if res, expected := matcher.match(value), re.MatchString(value); res != expected {
+				t.Fatalf("TC %d: Expected matching %q against %q to return %t, got %t", i, value, tc.pattern, expected, res)
+			}
+			if res, expected := matcher.matchBytes([]byte(value)), re.MatchString(value); res != expected {
+				t.Fatalf("TC %d: Expected matching the bytes %q against %q to return %t, got %t", i, value, tc.pattern, expected, res)
+			}
+		}
+	}
+}
+
+func TestSimpleMatcherDoesNotExecuteRegex(t *testing.T) {
+	tags := [][]string{{"dc=us-east-1"}, {"dc=us-east-12"}, {"dc=us-east"}, {"dc=eu-west-1"}}
+
+	for _, expression := range []string{"dc=~us-east-[0-9]+", "dc=~(us-east-1|eu-west-1)$", "dc=~us-|eu-", "dc!=~us-east-[0-9]+$", "__tag=~d|e"} {
+		if res := regexExecutionsOfFilter(t, expression, tags); res != 0 {
+			t.Fatalf("Expected the filter of %q to not execute the regex, but it did %d times", expression, res)
+		}
+	}
+}
+
+func benchmarkSimpleMatcher(b *testing.B, pattern string, useRegex bool) {
+	matcher, re := newTestSimpleMatcher(b, pattern)
+	if matcher.kind == simpleMatcherNone {
+		b.Fatalf("Expected pattern %q to have a simple shape", pattern)
+	}
+	match := matcher.match
+	if useRegex {
+		match = re.MatchString
+	}
+
+	values := make([]string, 100000)
+	for i := range values {
+		values[i] = fmt.Sprintf("%s-%d", []string{"web", "db", "cache", "queue"}[i%4], i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, value := range values {
+			match(value)
+		}
+	}
+}
+
+func BenchmarkSimpleMatcherLiteral(b *testing.B) {
+	benchmarkSimpleMatcher(b, "web-1234$", false)
+}
+
+func BenchmarkSimpleMatcherLiteralByRegex(b *testing.B) {
+	benchmarkSimpleMatcher(b, "web-1234$", true)
+}
+
+func BenchmarkSimpleMatcherPrefix(b *testing.B) {
+	benchmarkSimpleMatcher(b, "web-12.*", false)
+}
+
+func BenchmarkSimpleMatcherPrefixByRegex(b *testing.B) {
+	benchmarkSimpleMatcher(b, "web-12.*", true)
+}
+
+func BenchmarkSimpleMatcherLiteralSet(b *testing.B) {
+	benchmarkSimpleMatcher(b, "(web-1|web-12|db-13|cache-14)$", false)
+}
+
+func BenchmarkSimpleMatcherLiteralSetByRegex(b *testing.B) {
+	benchmarkSimpleMatcher(b, "(web-1|web-12|db-13|cache-14)$", true)
+}
+
+func BenchmarkSimpleMatcherPrefixDigits(b *testing.B) {
+	benchmarkSimpleMatcher(b, "web-[0-9]+$", false)
+}
+
+func BenchmarkSimpleMatcherPrefixDigitsByRegex(b *testing.B) {
+	benchmarkSimpleMatcher(b, "web-[0-9]+$", true)
+}
@@ -145,8 +145,24 @@ func ParseTag(tag string) (Tag, error) {
 	return res, nil
 }
 
+// SplitTags splits the given tags in the form "key=value" into Tags, without validating them.
+// this is meant to convert the tags of a metric definition once, before evaluating
+// MetricDefinitionTagsFilters against it. tags without an equal sign are skipped and
+// the order of the tags is kept
+func SplitTags(tags []string) Tags {
+	res := make(Tags, 0, len(tags))
+	for _, tag := range tags {
+		pos := strings.IndexByte(tag, '=')
+		if pos < 0 {
+			continue
+		}
+		res = append(res, Tag{Key: tag[:pos], Value: tag[pos+1:]})
+	}
+	return res
+}
+
 func (t *Tag) StringIntoWriter(writer io.Writer) {
-	writer.Write([]byte(t.Key))
-	writer.Write([]byte("="))
-	writer.Write([]byte(t.Value))
+	io.WriteString(writer, t.Key)
+	io.WriteString(writer, "=")
+	io.WriteString(writer, t.Value)
 }
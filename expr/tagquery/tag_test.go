@@ -326,3 +326,20 @@ func TestTagSorting(t *testing.T) {
 		t.Fatalf("Expected tags1 and tags2 to be the same")
 	}
 }
+
+func TestSplitTags(t *testing.T) {
+	res := SplitTags([]string{"b=c", "a=", "invalid", "c=d=e", "=f"})
+	expected := Tags{
+		{Key: "b", Value: "c"},
+		{Key: "a", Value: ""},
+		{Key: "c", Value: "d=e"},
+		{Key: "", Value: "f"},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Expected tags %+v, got %+v", expected, res)
+	}
+
+	if res := SplitTags(nil); len(res) != 0 {
+		t.Fatalf("Expected no tags, got %+v", res)
+	}
+}
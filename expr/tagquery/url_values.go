@@ -0,0 +1,57 @@
+package tagquery
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// NoExpressionsError is returned by ExpressionsFromURLValues if the
+// given url values don't contain any value for the given key
+type NoExpressionsError string
+
+func (n NoExpressionsError) Error() string {
+	return fmt.Sprintf("no expressions given in parameter %q", string(n))
+}
+
+func (n NoExpressionsError) Code() int {
+	return http.StatusBadRequest
+}
+
+// NoInitialExpressionError is returned by ExpressionsFromURLValues if none of the given
+// expressions requires a non-empty value, so there is no expression which could be used
+// to look up the initial set of metrics of a query
+type NoInitialExpressionError []string
+
+func (n NoInitialExpressionError) Error() string {
+	return fmt.Sprintf("none of the expressions %q requires a non-empty value, at least one is required", []string(n))
+}
+
+func (n NoInitialExpressionError) Code() int {
+	return http.StatusBadRequest
+}
+
+// ExpressionsFromURLValues parses the repeated values of the given key, f.e. "expr" in
+// "?expr=a=b&expr=c!=d", using the given options. This includes their QueryLimits, so
+// f.e. QueryLimits.MaxExpressions limits the number of accepted values.
+// It returns a NoExpressionsError if the key has no values and a NoInitialExpressionError
+// if none of the parsed expressions is usable as the initial expression of a query
+func ExpressionsFromURLValues(v url.Values, key string, opts ParseOptions) (Expressions, error) {
+	values := v[key]
+	if len(values) == 0 {
+		return nil, NoExpressionsError(key)
+	}
+
+	res, err := ParseExpressionsWithOptions(values, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range res {
+		if e.RequiresNonEmptyValue() {
+			return res, nil
+		}
+	}
+
+	return nil, NoInitialExpressionError(values)
+}
@@ -0,0 +1,50 @@
+package tagquery
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestExpressionsFromURLValues(t *testing.T) {
+	v := url.Values{"expr": []string{"a=b", "c!=d", "c!=d"}, "other": []string{"e=f"}}
+
+	opts := DefaultParseOptions()
+	opts.Dedup = true
+	expressions, err := ExpressionsFromURLValues(v, "expr", opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(expressions.Strings(), []string{"a=b", "c!=d"}) {
+		t.Fatalf("Unexpected expressions: %v", expressions.Strings())
+	}
+
+	if _, err := ExpressionsFromURLValues(v, "missing", opts); err == nil {
+		t.Fatalf("Expected an error when the key has no values")
+	} else if _, ok := err.(NoExpressionsError); !ok {
+		t.Fatalf("Expected a NoExpressionsError, but got %v", err)
+	}
+
+	v.Set("expr", "a!=b")
+	v.Add("expr", "c=")
+	if _, err := ExpressionsFromURLValues(v, "expr", opts); err == nil {
+		t.Fatalf("Expected an error when no expression requires a non-empty value")
+	} else if noInitialErr, ok := err.(NoInitialExpressionError); !ok {
+		t.Fatalf("Expected a NoInitialExpressionError, but got %v", err)
+	} else if noInitialErr.Code() != 400 {
+		t.Fatalf("Expected code 400, but got %d", noInitialErr.Code())
+	}
+
+	v.Set("expr", "")
+	if _, err := ExpressionsFromURLValues(v, "expr", opts); err == nil {
+		t.Fatalf("Expected an error when parsing an empty expression")
+	}
+
+	v["expr"] = []string{"a=b", "c=d", "e=f"}
+	opts.QueryLimits.MaxExpressions = 2
+	if _, err := ExpressionsFromURLValues(v, "expr", opts); err == nil {
+		t.Fatalf("Expected an error when exceeding the expression limit")
+	} else if _, ok := err.(QueryLimitError); !ok {
+		t.Fatalf("Expected a QueryLimitError, but got %v", err)
+	}
+}
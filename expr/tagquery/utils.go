@@ -1,19 +1,52 @@
 package tagquery
 
 import (
+	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/grafana/metrictank/errors"
 )
 
-// validateQueryExpressionTagKey validates the key of a tag query expression
-func validateQueryExpressionTagKey(key string) error {
+var errEmptyTagKey = errors.NewBadRequest("Tag query expression key must not be empty")
+
+// invalidTagKeyCharacterError is returned by validateQueryExpressionTagKey when a key contains
+// a character which is not allowed, the message only gets formatted when it is requested
+type invalidTagKeyCharacterError string
+
+func (i invalidTagKeyCharacterError) Error() string {
+	return fmt.Sprintf("Invalid character in tag key %s ", string(i))
+}
+
+func (i invalidTagKeyCharacterError) Code() int {
+	return http.StatusBadRequest
+}
+
+// validateQueryExpressionTagKey validates the key of a tag query expression according to the given mode
+func validateQueryExpressionTagKey(key string, mode KeyValidationMode) error {
 	if len(key) == 0 {
-		return errors.NewBadRequestf("Tag query expression key must not be empty")
+		return errEmptyTagKey
 	}
 
-	if strings.ContainsAny(key, ";!^=") {
-		return errors.NewBadRequestf("Invalid character in tag key %s ", key)
+	switch mode {
+	case KeyValidationStrict:
+		for i := 0; i < len(key); i++ {
+			if !isStrictKeyChar(key[i]) {
+				return invalidTagKeyCharacterError(key)
+			}
+		}
+	case KeyValidationPermissive:
+		if strings.ContainsAny(key, ";=!^~") {
+			return invalidTagKeyCharacterError(key)
+		}
+	default:
+		if strings.ContainsAny(key, ";!^=") {
+			return invalidTagKeyCharacterError(key)
+		}
 	}
 	return nil
 }
+
+func isStrictKeyChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '.' || c == '-'
+}
@@ -0,0 +1,66 @@
+package tagquery
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ContradictionError is returned by Expressions.Validate if two of the expressions
+// contradict each other, so the query can never match any metric
+type ContradictionError struct {
+	A, B Expression
+}
+
+func (c ContradictionError) Error() string {
+	expressions := Expressions{c.A, c.B}.Strings()
+	return fmt.Sprintf("Unsatisfiable query, expression \"%s\" contradicts \"%s\"", expressions[0], expressions[1])
+}
+
+func (c ContradictionError) Code() int {
+	return http.StatusBadRequest
+}
+
+// Validate detects pairs of expressions on the same key which directly contradict each other,
+// in which case it returns a ContradictionError, because the query can never match anything.
+// Only these cheap literal cases get detected, regular expressions are not analyzed:
+//   - two EQUAL expressions with different values, f.e. "dc=us-east" and "dc=eu-west".
+//     this is skipped if meta tag support is enabled, because a metric which doesn't have the
+//     tag itself can get multiple values of the same tag from different meta records
+//   - an EQUAL and a NOT_EQUAL expression with the same value, f.e. "dc=us-east" and "dc!=us-east"
+//   - a HAS_TAG and a NOT_HAS_TAG expression, f.e. "dc!=" and "dc="
+//   - an EQUAL and a NOT_HAS_TAG expression, f.e. "dc=us-east" and "dc="
+func (e Expressions) Validate() error {
+	for i := range e {
+		for j := i + 1; j < len(e); j++ {
+			if e[i].GetKey() == e[j].GetKey() && contradict(e[i], e[j]) {
+				return ContradictionError{A: e[i], B: e[j]}
+			}
+		}
+	}
+	return nil
+}
+
+// contradict returns true if the given expressions, which have the same key,
+// are one of the contradicting pairs listed in the description of Validate
+func contradict(a, b Expression) bool {
+	// order the pair, so that each combination only needs to be checked once
+	if a.GetOperator() > b.GetOperator() {
+		a, b = b, a
+	}
+
+	switch a.GetOperator() {
+	case EQUAL:
+		switch b.GetOperator() {
+		case EQUAL:
+			return !MetaTagSupport && a.GetValue() != b.GetValue()
+		case NOT_EQUAL:
+			return a.GetValue() == b.GetValue()
+		case NOT_HAS_TAG:
+			return true
+		}
+	case HAS_TAG:
+		return b.GetOperator() == NOT_HAS_TAG
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package tagquery
+
+import (
+	"testing"
+)
+
+func TestExpressionsValidate(t *testing.T) {
+	type testCase struct {
+		name          string
+		expressions   []string
+		metaTags      bool
+		contradiction bool
+	}
+
+	testCases := []testCase{
+		{
+			name:          "different equal values",
+			expressions:   []string{"dc=us-east", "host=a", "dc=eu-west"},
+			contradiction: true,
+		}, {
+			name:          "different equal values with meta tag support",
+			expressions:   []string{"dc=us-east", "dc=eu-west"},
+			metaTags:      true,
+			contradiction: false,
+		}, {
+			name:          "same equal values",
+			expressions:   []string{"dc=us-east", "dc=us-east"},
+			contradiction: false,
+		}, {
+			name:          "equal and not equal with the same value",
+			expressions:   []string{"dc!=us-east", "dc=us-east"},
+			contradiction: true,
+		}, {
+			name:          "equal and not equal with the same value with meta tag support",
+			expressions:   []string{"dc!=us-east", "dc=us-east"},
+			metaTags:      true,
+			contradiction: true,
+		}, {
+			name:          "equal and not equal with different values",
+			expressions:   []string{"dc=us-east", "dc!=eu-west"},
+			contradiction: false,
+		}, {
+			name:          "has tag and not has tag",
+			expressions:   []string{"dc!=", "dc="},
+			contradiction: true,
+		}, {
+			name:          "equal and not has tag",
+			expressions:   []string{"dc=", "dc=us-east"},
+			contradiction: true,
+		}, {
+			name:          "different keys",
+			expressions:   []string{"dc=us-east", "region!=us-east", "host!=", "cage="},
+			contradiction: false,
+		}, {
+			name:          "regular expressions are not analyzed",
+			expressions:   []string{"dc=~us-.*", "dc!=~us-.*"},
+			contradiction: false,
+		},
+	}
+
+	defer func(original bool) { MetaTagSupport = original }(MetaTagSupport)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			MetaTagSupport = tc.metaTags
+
+			expressions, err := ParseExpressions(tc.expressions)
+			if err != nil {
+				t.Fatalf("Unexpected parsing error: %s", err)
+			}
+
+			err = expressions.Validate()
+			if tc.contradiction {
+				if _, ok := err.(ContradictionError); !ok {
+					t.Fatalf("Expected a ContradictionError, but got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		})
+	}
+}
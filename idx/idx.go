@@ -3,6 +3,7 @@
 package idx
 
 import (
+	"context"
 	"regexp"
 	"time"
 
@@ -100,14 +101,19 @@ type MetricIndex interface {
 	// be returned in the result.
 	// The returned results are not deduplicated and in certain cases it is possible
 	// that duplicate entries will be returned.
-	FindByTag(orgId uint32, query tagquery.Query) []Node
+	// Once the given context is done the query stops early and the result is incomplete,
+	// this applies to all the methods which take a context.
+	// If the query exceeds its budget of regular expression evaluations it returns
+	// tagquery.ErrRegexBudgetExceeded instead of an incomplete result, this applies to
+	// all the methods which run tag queries and return an error.
+	FindByTag(ctx context.Context, orgId uint32, query tagquery.Query) ([]Node, error)
 
 	// FindTerms takes a query object and executes the query on the index. The query
 	// is composed of one or many query expressions. From the matching series, a count
 	// is kept for each value of the requested tags.
 	// The series are not deduplicated and in certain cases it is possible that some
 	// entries will be double counted.
-	FindTerms(orgID uint32, tags []string, query tagquery.Query) (uint32, map[string]map[string]uint32)
+	FindTerms(ctx context.Context, orgID uint32, tags []string, query tagquery.Query) (uint32, map[string]map[string]uint32, error)
 
 	// Tags returns a list of all tag keys associated with the metrics of a given
 	// organization. The return values are filtered by the regex in the second parameter.
@@ -117,8 +123,8 @@ type MetricIndex interface {
 	// given org. The occurrences of each value is counted and the count is referred to by
 	// the metric names in the returned map.
 	// If the third parameter is not nil it will be used to filter the values before
-	// accounting for them.
-	TagDetails(orgId uint32, key string, filter *regexp.Regexp) map[string]uint64
+	// accounting for them. The context is used by the queries of the meta tag records.
+	TagDetails(ctx context.Context, orgId uint32, key string, filter *regexp.Regexp) (map[string]uint64, error)
 
 	// FindTags generates a list of possible tags that could complete a
 	// given prefix. It only supports simple queries by prefix and from,
@@ -131,7 +137,7 @@ type MetricIndex interface {
 	// user to narrow down the result by specifying additional expressions,
 	// but if the query isn't necessary it is recommended to use FindTags()
 	// because it is faster
-	FindTagsWithQuery(orgId uint32, prefix string, query tagquery.Query, limit uint) []string
+	FindTagsWithQuery(ctx context.Context, orgId uint32, prefix string, query tagquery.Query, limit uint) ([]string, error)
 
 	// FindTagValues generates a list of possible values that could complete
 	// a given value prefix. It requires a tag to be specified and only values
@@ -145,11 +151,12 @@ type MetricIndex interface {
 	// allows the caller to pass a tag query which is used to further narrow down the
 	// result set. If the tag query is not necessary, it is recommended to use
 	// FindTagValues() because it is faster
-	FindTagValuesWithQuery(orgId uint32, tag, prefix string, query tagquery.Query, limit uint) []string
+	FindTagValuesWithQuery(ctx context.Context, orgId uint32, tag, prefix string, query tagquery.Query, limit uint) ([]string, error)
 
 	// DeleteTagged deletes the series returned by the given query from the tag index
-	// and also the DefById index.
-	DeleteTagged(orgId uint32, query tagquery.Query) ([]Archive, error)
+	// and also the DefById index. If the context is done before the query completes,
+	// only a part of the series gets deleted.
+	DeleteTagged(ctx context.Context, orgId uint32, query tagquery.Query) ([]Archive, error)
 
 	// MetaTagRecordUpsert inserts, updates or deletes a meta record, depending on
 	// whether it already exists or is new. The identity of a record is determined
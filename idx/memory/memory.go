@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -46,6 +47,9 @@ var (
 	// metric idx.memory.filtered is number of series that have been excluded from responses due to their lastUpdate property
 	statFiltered = stats.NewCounter32("idx.memory.filtered")
 
+	// metric idx.memory.tag-query.regex-budget-exceeded is the number of tag queries which have been stopped because they exceeded their budget of regex evaluations
+	statRegexBudgetExceeded = stats.NewCounter32("idx.memory.tag-query.regex-budget-exceeded")
+
 	// metric idx.metrics_active is the number of currently known metrics in the index
 	statMetricsActive = stats.NewGauge32("idx.metrics_active")
 
@@ -54,6 +58,14 @@ var (
 	maxPruneLockTimeStr          string
 	TagSupport                   bool
 	TagQueryWorkers              int // number of workers to spin up when evaluation tag expressions
+	tagQueryRegexBudget          uint64
+	tagQueryDecisionMemoSize     int
+	matchCacheMaxBytes           int
+	matchCacheBypassMinMisses    uint64
+	matchCacheBypassMinHitRatio  = tagquery.DefaultMatchCacheBypassMinHitRatio
+	sharedMatchCacheSize         int
+	regexCacheSize               = tagquery.DefaultRegexCacheSize
+	tagKeyInternSize             = tagquery.DefaultKeyInternSize
 	metaTagEnricherQueueSize     = 100
 	metaTagEnricherBufferSize    = 10000
 	metaTagEnricherBufferTime    = 5 * time.Second
@@ -92,6 +104,14 @@ func ConfigSetup() *flag.FlagSet {
 	memoryIdx.StringVar(&indexRulesFile, "rules-file", "/etc/metrictank/index-rules.conf", "path to index-rules.conf file")
 	memoryIdx.StringVar(&maxPruneLockTimeStr, "max-prune-lock-time", "100ms", "Maximum duration each second a prune job can lock the index.")
 	memoryIdx.IntVar(&matchCacheSize, "match-cache-size", 1000, "size of regular expression cache in tag query evaluation")
+	memoryIdx.IntVar(&matchCacheMaxBytes, "match-cache-max-bytes", 0, "approximate number of bytes which the regular expression match cache of a tag query expression may hold, in addition to match-cache-size. whichever limit is reached first makes it evict values. 0 means unlimited")
+	memoryIdx.Uint64Var(&matchCacheBypassMinMisses, "match-cache-bypass-min-misses", 0, "number of misses after which the regular expression match cache of a tag query expression stops caching if its hit ratio is below match-cache-bypass-min-hit-ratio, f.e. for tags of which the values are unique per metric. 0 disables it")
+	memoryIdx.Float64Var(&matchCacheBypassMinHitRatio, "match-cache-bypass-min-hit-ratio", tagquery.DefaultMatchCacheBypassMinHitRatio, "ratio of lookups which must be hits for the regular expression match cache of a tag query expression to keep caching, see match-cache-bypass-min-misses. between 0 and 1")
+	memoryIdx.IntVar(&sharedMatchCacheSize, "shared-match-cache-size", 0, "size of the regular expression match cache which is shared by all tag queries, so consecutive queries don't need to evaluate the same expressions again. 0 disables it")
+	memoryIdx.IntVar(&regexCacheSize, "regex-cache-size", tagquery.DefaultRegexCacheSize, "number of compiled regular expressions to cache, so the tag query expressions using the same pattern share them instead of compiling it again. 0 disables it")
+	memoryIdx.IntVar(&tagKeyInternSize, "tag-key-intern-size", tagquery.DefaultKeyInternSize, "maximum number of distinct tag keys which get interned, so the parsed tag query expressions using the same key share its storage. keys beyond it are not interned. 0 disables it")
+	memoryIdx.Uint64Var(&tagQueryRegexBudget, "tag-query-regex-budget", 0, "maximum number of regular expression evaluations per tag query, queries exceeding it fail with a bad request error instead of returning incomplete results. 0 means unlimited")
+	memoryIdx.IntVar(&tagQueryDecisionMemoSize, "tag-query-decision-memo-size", 0, "maximum number of decisions of meta tag record expressions on metrics which a tag query memoizes, so the records sharing an expression only evaluate it once per metric. 0 disables it")
 	memoryIdx.BoolVar(&MetaTagSupport, "meta-tag-support", false, "enables/disables querying based on meta tags which get defined via meta tag rules")
 	globalconf.Register("memory-idx", memoryIdx, flag.ExitOnError)
 	return memoryIdx
@@ -119,8 +139,17 @@ func ConfigProcess() {
 		log.Fatal("find-cache-invalidate-max-size should be smaller than find-cache-invalidate-queue-size")
 	}
 
+	if matchCacheBypassMinHitRatio < 0 || matchCacheBypassMinHitRatio > 1 {
+		log.Fatalf("invalid match-cache-bypass-min-hit-ratio of %f. Must be between 0 and 1", matchCacheBypassMinHitRatio)
+	}
+
 	tagquery.MetaTagSupport = MetaTagSupport
-	tagquery.MatchCacheSize = matchCacheSize
+	tagquery.SetMatchCacheSize(matchCacheSize)
+	tagquery.SetMatchCacheMaxBytes(matchCacheMaxBytes)
+	tagquery.SetMatchCacheBypass(matchCacheBypassMinMisses, matchCacheBypassMinHitRatio)
+	tagquery.SetSharedMatchCacheSize(sharedMatchCacheSize)
+	tagquery.SetRegexCacheSize(regexCacheSize)
+	tagquery.SetKeyInternSize(tagKeyInternSize)
 }
 
 // interface implemented by both UnpartitionedMemoryIdx and PartitionedMemoryIdx
@@ -196,6 +225,21 @@ func (t TagIndex) idHasTag(id schema.MKey, tag, value string) bool {
 	return ok
 }
 
+// Estimate satisfies the tagquery.CardinalityEstimator interface. For equal expressions it
+// returns the number of ids with the given tag, for other expressions on tag values the
+// number of values of the tag. Expressions which need to look at all tag keys get the
+// number of keys, except the ones on a single key which get the number of its values
+func (t TagIndex) Estimate(key, value string, operator tagquery.ExpressionOperator) uint64 {
+	switch operator {
+	case tagquery.EQUAL:
+		return uint64(len(t[key][value]))
+	case tagquery.NOT_HAS_TAG, tagquery.HAS_ANY_TAG, tagquery.MATCH_TAG, tagquery.PREFIX_TAG, tagquery.TAG_VALUE:
+		return uint64(len(t))
+	default:
+		return uint64(len(t[key]))
+	}
+}
+
 func (defs defByTagSet) add(def *schema.MetricDefinition) {
 	var orgDefs map[string]map[*schema.MetricDefinition]struct{}
 	var ok bool
@@ -520,7 +564,7 @@ func (m *UnpartitionedMemoryIdx) MetaTagRecordUpsert(orgId uint32, upsertRecord
 
 	// initialize query in preparation to execute it once we have the look
 	// doing struct instantiations before acquiring lock to keep lock time short
-	query, err := tagquery.NewQuery(upsertRecord.Expressions, 0)
+	query, err := tagquery.NewQuery(upsertRecord.Expressions, 0, 0)
 	if err != nil {
 		return fmt.Errorf("Invalid record with expressions/meta tags: %q/%q", upsertRecord.Expressions, upsertRecord.MetaTags)
 	}
@@ -647,7 +691,7 @@ func (m *UnpartitionedMemoryIdx) MetaTagRecordSwap(orgId uint32, newRecords []ta
 	var err error
 	var recordsModified, recordsAdded, recordsPruned uint32
 	for _, record := range recordsToUpsert {
-		query, err = tagquery.NewQuery(record.Expressions, 0)
+		query, err = tagquery.NewQuery(record.Expressions, 0, 0)
 		if err != nil {
 			log.Errorf("Invalid record (%q/%q): %s", record.Expressions.Strings(), record.MetaTags.Strings(), err)
 			continue
@@ -745,7 +789,7 @@ func (m *UnpartitionedMemoryIdx) MetaTagRecordSwap(orgId uint32, newRecords []ta
 			}
 			m.Unlock()
 
-			query, err = tagquery.NewQuery(record.Expressions, 0)
+			query, err = tagquery.NewQuery(record.Expressions, 0, 0)
 			if err != nil {
 				log.Errorf("Invalid meta record with id %d and expressions/meta tags: %q/%q", recordId, record.Expressions.Strings(), record.MetaTags.Strings())
 				continue
@@ -1053,13 +1097,13 @@ func (m *UnpartitionedMemoryIdx) GetPath(orgId uint32, path string) []idx.Archiv
 	return archives
 }
 
-func (m *UnpartitionedMemoryIdx) FindByTag(orgId uint32, query tagquery.Query) []idx.Node {
+func (m *UnpartitionedMemoryIdx) FindByTag(ctx context.Context, orgId uint32, query tagquery.Query) ([]idx.Node, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
-		return nil
+		return nil, nil
 	}
 
-	queryCtx := NewTagQueryContext(query)
+	queryCtx := NewTagQueryContextWithContext(ctx, query)
 
 	m.RLock()
 	defer m.RUnlock()
@@ -1102,6 +1146,10 @@ func (m *UnpartitionedMemoryIdx) FindByTag(orgId uint32, query tagquery.Query) [
 		}
 	}
 
+	if err := queryCtx.Err(); err != nil {
+		return nil, err
+	}
+
 	results := make([]idx.Node, len(byPath))
 
 	i := 0
@@ -1110,13 +1158,13 @@ func (m *UnpartitionedMemoryIdx) FindByTag(orgId uint32, query tagquery.Query) [
 		i++
 	}
 
-	return results
+	return results, nil
 }
 
-func (m *UnpartitionedMemoryIdx) FindTerms(orgID uint32, tags []string, query tagquery.Query) (uint32, map[string]map[string]uint32) {
+func (m *UnpartitionedMemoryIdx) FindTerms(ctx context.Context, orgID uint32, tags []string, query tagquery.Query) (uint32, map[string]map[string]uint32, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
-		return 0, nil
+		return 0, nil, nil
 	}
 
 	needsName := false
@@ -1128,7 +1176,7 @@ func (m *UnpartitionedMemoryIdx) FindTerms(orgID uint32, tags []string, query ta
 		terms[tag] = make(map[string]uint32)
 	}
 
-	queryCtx := NewTagQueryContext(query)
+	queryCtx := NewTagQueryContextWithContext(ctx, query)
 
 	m.RLock()
 	defer m.RUnlock()
@@ -1164,7 +1212,11 @@ func (m *UnpartitionedMemoryIdx) FindTerms(orgID uint32, tags []string, query ta
 		}
 	}
 
-	return totalResults, terms
+	if err := queryCtx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return totalResults, terms, nil
 }
 
 // Tags returns a list of all tag keys associated with the metrics of a given
@@ -1220,10 +1272,10 @@ func (m *UnpartitionedMemoryIdx) Tags(orgId uint32, filter *regexp.Regexp) []str
 	return res
 }
 
-func (m *UnpartitionedMemoryIdx) TagDetails(orgId uint32, key string, filter *regexp.Regexp) map[string]uint64 {
+func (m *UnpartitionedMemoryIdx) TagDetails(ctx context.Context, orgId uint32, key string, filter *regexp.Regexp) (map[string]uint64, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
-		return nil
+		return nil, nil
 	}
 
 	m.RLock()
@@ -1231,7 +1283,7 @@ func (m *UnpartitionedMemoryIdx) TagDetails(orgId uint32, key string, filter *re
 
 	tags, ok := m.tags[orgId]
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	res := make(map[string]uint64)
@@ -1244,7 +1296,7 @@ func (m *UnpartitionedMemoryIdx) TagDetails(orgId uint32, key string, filter *re
 	}
 
 	if !MetaTagSupport {
-		return res
+		return res, nil
 	}
 
 	mtr, mti, _ := m.getMetaTagDataStructures(orgId, false)
@@ -1261,20 +1313,24 @@ func (m *UnpartitionedMemoryIdx) TagDetails(orgId uint32, key string, filter *re
 				log.Errorf("memory-idx: corrupt. record id %d is in meta tag index, but not in meta tag records", recordId)
 				continue
 			}
-			query, err := tagquery.NewQuery(record.Expressions, 0)
+			query, err := tagquery.NewQuery(record.Expressions, 0, 0)
 			if err != nil {
 				corruptIndex.Inc()
 				log.Errorf("memory-idx: corrupt. record expressions cannot instantiate query: %+v results in %s", record.Expressions, err)
 				continue
 			}
-			resCh := m.idsByTagQuery(orgId, NewTagQueryContext(query))
+			queryCtx := NewTagQueryContextWithContext(ctx, query)
+			resCh := m.idsByTagQuery(orgId, queryCtx)
 			for range resCh {
 				res[value]++
 			}
+			if err := queryCtx.Err(); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return res
+	return res, nil
 }
 
 // FindTags returns tags matching the specified conditions
@@ -1328,13 +1384,13 @@ func (m *UnpartitionedMemoryIdx) FindTags(orgId uint32, prefix string, limit uin
 // limit:       the maximum number of results to return
 //
 // the results will always be sorted alphabetically for consistency
-func (m *UnpartitionedMemoryIdx) FindTagsWithQuery(orgId uint32, prefix string, query tagquery.Query, limit uint) []string {
+func (m *UnpartitionedMemoryIdx) FindTagsWithQuery(ctx context.Context, orgId uint32, prefix string, query tagquery.Query, limit uint) ([]string, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
-		return nil
+		return nil, nil
 	}
 
-	queryCtx := NewTagQueryContext(query)
+	queryCtx := NewTagQueryContextWithContext(ctx, query)
 
 	m.RLock()
 	defer m.RUnlock()
@@ -1384,6 +1440,10 @@ func (m *UnpartitionedMemoryIdx) FindTagsWithQuery(orgId uint32, prefix string,
 		}
 	}
 
+	if err := queryCtx.Err(); err != nil {
+		return nil, err
+	}
+
 	// handle special case of the name tag
 	if len(prefix) == 0 || strings.HasPrefix("name", prefix) {
 		resMap["name"] = struct{}{}
@@ -1396,7 +1456,7 @@ func (m *UnpartitionedMemoryIdx) FindTagsWithQuery(orgId uint32, prefix string,
 		i++
 	}
 
-	return m.finalizeResult(res, limit, false)
+	return m.finalizeResult(res, limit, false), nil
 }
 
 // FindTagValues returns tag values matching the specified conditions
@@ -1443,13 +1503,13 @@ func (m *UnpartitionedMemoryIdx) FindTagValues(orgId uint32, tag, prefix string,
 	return m.finalizeResult(res, limit, true)
 }
 
-func (m *UnpartitionedMemoryIdx) FindTagValuesWithQuery(orgId uint32, tag, prefix string, query tagquery.Query, limit uint) []string {
+func (m *UnpartitionedMemoryIdx) FindTagValuesWithQuery(ctx context.Context, orgId uint32, tag, prefix string, query tagquery.Query, limit uint) ([]string, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
-		return nil
+		return nil, nil
 	}
 
-	queryCtx := NewTagQueryContext(query)
+	queryCtx := NewTagQueryContextWithContext(ctx, query)
 
 	m.RLock()
 	defer m.RUnlock()
@@ -1509,6 +1569,10 @@ func (m *UnpartitionedMemoryIdx) FindTagValuesWithQuery(orgId uint32, tag, prefi
 		}
 	}
 
+	if err := queryCtx.Err(); err != nil {
+		return nil, err
+	}
+
 	res := make([]string, len(resMap))
 	i := 0
 	for v := range resMap {
@@ -1516,7 +1580,7 @@ func (m *UnpartitionedMemoryIdx) FindTagValuesWithQuery(orgId uint32, tag, prefi
 		i++
 	}
 
-	return m.finalizeResult(res, limit, false)
+	return m.finalizeResult(res, limit, false), nil
 }
 
 func (m *UnpartitionedMemoryIdx) idsByTagQuery(orgId uint32, query TagQueryContext) chan schema.MKey {
@@ -1758,13 +1822,13 @@ func (m *UnpartitionedMemoryIdx) List(orgId uint32) []idx.Archive {
 	return defs
 }
 
-func (m *UnpartitionedMemoryIdx) DeleteTagged(orgId uint32, query tagquery.Query) ([]idx.Archive, error) {
+func (m *UnpartitionedMemoryIdx) DeleteTagged(ctx context.Context, orgId uint32, query tagquery.Query) ([]idx.Archive, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
 	}
 
-	queryCtx := NewTagQueryContext(query)
+	queryCtx := NewTagQueryContextWithContext(ctx, query)
 
 	m.RLock()
 	resCh := m.idsByTagQuery(orgId, queryCtx)
@@ -1775,6 +1839,11 @@ func (m *UnpartitionedMemoryIdx) DeleteTagged(orgId uint32, query tagquery.Query
 
 	m.RUnlock()
 
+	// nothing gets deleted if the query couldn't find all the series it would delete
+	if err := queryCtx.Err(); err != nil {
+		return nil, err
+	}
+
 	m.Lock()
 	defer m.Unlock()
 	return m.deleteTaggedByIdSet(orgId, ids), nil
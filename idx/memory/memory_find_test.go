@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"reflect"
@@ -158,7 +159,7 @@ func TestMain(m *testing.M) {
 	TagSupport = true
 	TagQueryWorkers = 5
 	matchCacheSize = 1000
-	tagquery.MatchCacheSize = 1000
+	tagquery.SetMatchCacheSize(1000)
 	// we dont need info logs in the test output
 	log.SetLevel(log.ErrorLevel)
 	os.Exit(m.Run())
@@ -331,7 +332,7 @@ func waitForMetaTagEnrichers(t testing.TB, ix MemoryIndex) {
 func queryAndCompareTagValues(t *testing.T, key, filter string, expected map[string]uint64) {
 	t.Helper()
 
-	values := ix.TagDetails(1, key, regexp.MustCompile(filter))
+	values, _ := ix.TagDetails(context.Background(), 1, key, regexp.MustCompile(filter))
 	if len(values) != len(expected) {
 		t.Fatalf("Expected %d values, but got %d", len(expected), len(values))
 	}
@@ -586,7 +587,7 @@ func testTagSorting(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error returned when parsing query: %s", err)
 	}
-	res := index.FindByTag(1, query)
+	res, _ := index.FindByTag(context.Background(), 1, query)
 	if len(res) != 1 {
 		t.Fatalf("Expected exactly 1 result, got %d: %+v", len(res), res)
 	}
@@ -615,7 +616,7 @@ func testTagSorting(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error when parsing query: %s", err)
 	}
-	res = index.FindByTag(1, query)
+	res, _ = index.FindByTag(context.Background(), 1, query)
 	if len(res) != 1 {
 		t.Fatalf("Expected exactly 1 result, got %d: %+v", len(res), res)
 	}
@@ -625,6 +626,120 @@ func testTagSorting(t *testing.T) {
 	}
 }
 
+func TestTagQueryWithPseudoTags(t *testing.T) {
+	withAndWithoutPartitonedIndex(testTagQueryWithPseudoTags)(t)
+}
+
+func testTagQueryWithPseudoTags(t *testing.T) {
+	index := New()
+	defer index.Stop()
+	index.Init()
+
+	now := time.Now().Unix()
+	for i, properties := range []struct {
+		interval   int
+		lastUpdate int64
+	}{{10, now}, {60, now}, {10, now - 7200}} {
+		md := &schema.MetricData{
+			Name:     fmt.Sprintf("name%d", i),
+			Tags:     []string{"dc=us-east"},
+			Interval: properties.interval,
+			OrgId:    1,
+			Time:     properties.lastUpdate,
+		}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		index.AddOrUpdate(mkey, md, getPartition(md))
+	}
+
+	type testCase struct {
+		expressions []string
+		expect      []string
+	}
+	testCases := []testCase{
+		{expressions: []string{"dc=us-east", "__lastUpdate__>=-1h"}, expect: []string{"name0;dc=us-east", "name1;dc=us-east"}},
+		{expressions: []string{"dc=us-east", "__interval__<=10s"}, expect: []string{"name0;dc=us-east", "name2;dc=us-east"}},
+		{expressions: []string{"dc=us-east", "__interval__>10", "__lastUpdate__<-1h"}, expect: nil},
+		{expressions: []string{"dc=us-east", fmt.Sprintf("__lastUpdate__<%d", now-3600)}, expect: []string{"name2;dc=us-east"}},
+	}
+
+	for i, tc := range testCases {
+		query, err := tagquery.NewQueryFromStrings(tc.expressions, 0)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error when parsing query: %s", i, err)
+		}
+
+		nodes, _ := index.FindByTag(context.Background(), 1, query)
+		var res []string
+		for _, node := range nodes {
+			res = append(res, node.Path)
+		}
+		sort.Strings(res)
+
+		if !reflect.DeepEqual(res, tc.expect) {
+			t.Fatalf("TC %d: Unexpected result.\nExpected: %+v\nGot: %+v", i, tc.expect, res)
+		}
+	}
+}
+
+func TestTagQueryWithTagValueExpression(t *testing.T) {
+	withAndWithoutPartitonedIndex(testTagQueryWithTagValueExpression)(t)
+}
+
+func testTagQueryWithTagValueExpression(t *testing.T) {
+	index := New()
+	defer index.Stop()
+	index.Init()
+
+	for i, tags := range [][]string{
+		{"app=web", "dc_primary=us-east"},
+		{"app=web", "dc_primary=eu-west", "dc_backup=us-east"},
+		{"app=web", "dc_primary=eu-west"},
+		{"app=web", "region=us-east"},
+	} {
+		md := &schema.MetricData{
+			Name:     fmt.Sprintf("name%d", i),
+			Tags:     tags,
+			Interval: 10,
+			OrgId:    1,
+			Time:     time.Now().Unix(),
+		}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		index.AddOrUpdate(mkey, md, getPartition(md))
+	}
+
+	type testCase struct {
+		expressions []string
+		expect      []string
+	}
+	testCases := []testCase{
+		{expressions: []string{"app=web", "__tag=~dc_.*:=us-east"}, expect: []string{"name0;app=web;dc_primary=us-east", "name1;app=web;dc_backup=us-east;dc_primary=eu-west"}},
+		{expressions: []string{"app=web", "__tag=~dc_primary:^=eu"}, expect: []string{"name1;app=web;dc_backup=us-east;dc_primary=eu-west", "name2;app=web;dc_primary=eu-west"}},
+		{expressions: []string{"app=web", "__tag=~dc_.*:!=eu-west"}, expect: []string{"name0;app=web;dc_primary=us-east", "name1;app=web;dc_backup=us-east;dc_primary=eu-west"}},
+		{expressions: []string{"app=web", "__tag=~.*:=~us"}, expect: []string{"name0;app=web;dc_primary=us-east", "name1;app=web;dc_backup=us-east;dc_primary=eu-west", "name3;app=web;region=us-east"}},
+		{expressions: []string{"app=web", "__tag=~na.e:=name2"}, expect: []string{"name2;app=web;dc_primary=eu-west"}},
+	}
+
+	for i, tc := range testCases {
+		query, err := tagquery.NewQueryFromStrings(tc.expressions, 0)
+		if err != nil {
+			t.Fatalf("TC %d: Unexpected error when parsing query: %s", i, err)
+		}
+
+		nodes, _ := index.FindByTag(context.Background(), 1, query)
+		var res []string
+		for _, node := range nodes {
+			res = append(res, node.Path)
+		}
+		sort.Strings(res)
+
+		if !reflect.DeepEqual(res, tc.expect) {
+			t.Fatalf("TC %d: Unexpected result.\nExpected: %+v\nGot: %+v", i, tc.expect, res)
+		}
+	}
+}
+
 func TestAutoCompleteTags(t *testing.T) {
 	withAndWithoutPartitonedIndex(testAutoCompleteTags)(t)
 }
@@ -794,6 +909,24 @@ func testAutoCompleteTagsWithQuery(t *testing.T) {
 	}
 }
 
+// without filters the query built by tagquery.NewAutoCompleteTagsQuery must find the same tags
+// as FindTags, which doesn't need a query
+func TestAutoCompleteTagsWithQueryWithoutFilters(t *testing.T) {
+	withAndWithoutPartitonedIndex(testAutoCompleteTagsWithQueryWithoutFilters)(t)
+}
+
+func testAutoCompleteTagsWithQueryWithoutFilters(t *testing.T) {
+	InitSmallIndex()
+	defer ix.Stop()
+
+	for i, prefix := range []string{"", "di", "x"} {
+		for _, limit := range []uint{2, 100} {
+			expRes := ix.FindTags(1, prefix, limit)
+			autoCompleteTagsWithQueryAndCompare(t, i, prefix, nil, limit, expRes)
+		}
+	}
+}
+
 func TestAutoCompleteTagsWithQueryWithMetaTagSupport(t *testing.T) {
 	reset := enableMetaTagSupport()
 	defer reset()
@@ -851,11 +984,15 @@ func testAutoCompleteTagsWithQueryWithMetaTagSupport(t *testing.T) {
 func autoCompleteTagsWithQueryAndCompare(t testing.TB, tcIdx int, prefix string, expr []string, limit uint, expRes []string) {
 	t.Helper()
 
-	query, err := tagquery.NewQueryFromStrings(expr, 0)
+	expressions, err := tagquery.ParseExpressions(expr)
 	if err != nil {
-		t.Fatalf("Error when instantiating query: %s", err)
+		t.Fatalf("TC %d: Error when parsing expressions: %s", tcIdx, err)
 	}
-	res := ix.FindTagsWithQuery(1, prefix, query, limit)
+	query, err := tagquery.NewAutoCompleteTagsQuery(prefix, expressions, limit)
+	if err != nil {
+		t.Fatalf("TC %d: Error when instantiating query: %s", tcIdx, err)
+	}
+	res, _ := ix.FindTagsWithQuery(context.Background(), 1, prefix, query, query.Limit)
 
 	if len(res) != len(expRes) {
 		t.Fatalf("TC %d: Wrong result, Expected:\n%s\nGot:\n%s\n", tcIdx, expRes, res)
@@ -1173,11 +1310,15 @@ func testAutoCompleteTagValuesWithQueryWithMetaTagSupport(t *testing.T) {
 func autoCompleteTagValuesWithQueryAndCompare(t testing.TB, tc int, tag, prefix string, expr []string, limit uint, expRes []string) {
 	t.Helper()
 
-	query, err := tagquery.NewQueryFromStrings(expr, 0)
+	expressions, err := tagquery.ParseExpressions(expr)
+	if err != nil {
+		t.Fatalf("TC %d: Unexpected error when parsing expressions: %s", tc, err)
+	}
+	query, err := tagquery.NewAutoCompleteValuesQuery(tag, prefix, expressions, limit)
 	if err != nil {
 		t.Fatalf("TC %d: Unexpected error when instantiating query: %s", tc, err)
 	}
-	res := ix.FindTagValuesWithQuery(1, tag, prefix, query, limit)
+	res, _ := ix.FindTagValuesWithQuery(context.Background(), 1, tag, prefix, query, query.Limit)
 
 	if len(res) != len(expRes) {
 		t.Fatalf("TC %d: Wrong result, Expected:\n%s\nGot:\n%s\n", tc, expRes, res)
@@ -1205,7 +1346,7 @@ func benchmarkTagDetailsWithoutFilter(b *testing.B) {
 
 	expectedCount := uint64(100000)
 	for n := 0; n < b.N; n++ {
-		val := ix.TagDetails(1, "metric", regexp.MustCompile(""))
+		val, _ := ix.TagDetails(context.Background(), 1, "metric", regexp.MustCompile(""))
 		if val["disk_ops"] != expectedCount {
 			b.Fatalf("Expected count %d, but got %d: %+v", expectedCount, val["disk_ops"], val)
 		}
@@ -1228,7 +1369,7 @@ func benchmarkTagDetailsWithFilter(b *testing.B) {
 
 	for n := 0; n < b.N; n++ {
 		q := n % len(filters)
-		val := ix.TagDetails(1, "metric", regexp.MustCompile(filters[q]))
+		val, _ := ix.TagDetails(context.Background(), 1, "metric", regexp.MustCompile(filters[q]))
 		if val["interrupt"] != expectedCounts[q] {
 			b.Fatalf("Expected count %d, but got %d: %+v", expectedCounts[q], val["interrupt"], val)
 		}
@@ -1457,7 +1598,7 @@ func ixFindByTag(b *testing.B, org uint32, q int) {
 	if err != nil {
 		panic(err)
 	}
-	series := ix.FindByTag(org, query)
+	series, _ := ix.FindByTag(context.Background(), org, query)
 	if len(series) != tagQueries[q].ExpectedResults {
 		for _, s := range series {
 			a, _ := ix.Get(s.Defs[0].Id)
@@ -1559,6 +1700,68 @@ func permutations(lst []string) [][]string {
 	return l
 }
 
+// the alternation of literals gets looked up value by value, while the equivalent pattern
+// with a character class has to be matched against all 1000 values of the tag "host".
+// the hosts 1001-1003 don't exist, so the cost of returning the results doesn't hide the
+// cost of selecting the values
+func BenchmarkTagQueryLiteralAlternatives(b *testing.B) {
+	type testCase struct {
+		expression      string
+		expectedResults int
+	}
+	for _, tc := range []testCase{
+		{"host=~(host901|host902|host903)$", 5040},
+		{"host=~host90[1-3]$", 5040},
+		{"host|=host901|host902|host903", 5040},
+		{"host=~(host1001|host1002|host1003)$", 0},
+		{"host=~host100[1-3]$", 0},
+	} {
+		tc := tc
+		b.Run(tc.expression, benchWithAndWithoutPartitonedIndex(func(b *testing.B) {
+			benchmarkTagQueryLiteralAlternatives(b, tc.expression, tc.expectedResults)
+		}))
+	}
+}
+
+func benchmarkTagQueryLiteralAlternatives(b *testing.B, expression string, expectedResults int) {
+	InitLargeIndex()
+	defer ix.Stop()
+
+	query, err := tagquery.NewQueryFromStrings([]string{expression}, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		series, _ := ix.FindByTag(context.Background(), 1, query)
+		if len(series) != expectedResults {
+			b.Fatalf("%s expected %d got %d results instead", expression, expectedResults, len(series))
+		}
+	}
+}
+
+// the initial expressions get the values of the tag "host" selected through
+// tagquery.ValueMatcher, before the ids of the matching values are collected
+func BenchmarkTagQueryValueMatcher(b *testing.B) {
+	type testCase struct {
+		expression      string
+		expectedResults int
+	}
+	for _, tc := range []testCase{
+		{"host^=host90", 18480},
+		{"host=~host9.*2$", 18480},
+		{"host=~host9[0-9]{3}$", 0},
+	} {
+		tc := tc
+		b.Run(tc.expression, benchWithAndWithoutPartitonedIndex(func(b *testing.B) {
+			benchmarkTagQueryLiteralAlternatives(b, tc.expression, tc.expectedResults)
+		}))
+	}
+}
+
 // since that's going through a lot of permutations it needs an increased
 // benchtime to be meaningful. f.e. on my laptop i'm using -benchtime=1m, which
 // is enough for it to go through all the 6! permutations
@@ -1584,7 +1787,7 @@ func benchmarkTagQueryFilterAndIntersect(b *testing.B) {
 		if err != nil {
 			b.Fatalf(err.Error())
 		}
-		series := ix.FindByTag(1, query)
+		series, _ := ix.FindByTag(context.Background(), 1, query)
 		if len(series) != q.ExpectedResults {
 			b.Fatalf("%+v expected %d got %d results instead", q.Expressions, q.ExpectedResults, len(series))
 		}
@@ -1616,7 +1819,7 @@ func benchmarkTagQueryFilterAndIntersectOnlyRegex(b *testing.B) {
 		if err != nil {
 			b.Fatalf(err.Error())
 		}
-		series := ix.FindByTag(1, query)
+		series, _ := ix.FindByTag(context.Background(), 1, query)
 		if len(series) != q.ExpectedResults {
 			b.Fatalf("%+v expected %d got %d results instead", q.Expressions, q.ExpectedResults, len(series))
 		}
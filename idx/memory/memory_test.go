@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"hash/fnv"
@@ -253,7 +254,7 @@ func testGetAddKey(t *testing.T) {
 			Convey("then findByTag", func() {
 				query, err := tagquery.NewQueryFromStrings([]string{"name!="}, 0)
 				So(err, ShouldBeNil)
-				nodes := ix.FindByTag(1, query)
+				nodes, _ := ix.FindByTag(context.Background(), 1, query)
 				defs := make([]idx.Archive, 0, len(nodes))
 				for i := range nodes {
 					defs = append(defs, nodes[i].Defs...)
@@ -508,19 +509,19 @@ func testDeleteTagged(t *testing.T) {
 		So(err, ShouldBeNil)
 		query, err := tagquery.NewQueryFromStrings(tags.Strings(), 0)
 		So(err, ShouldBeNil)
-		ids, err := ix.DeleteTagged(1, query)
+		ids, err := ix.DeleteTagged(context.Background(), 1, query)
 		So(err, ShouldBeNil)
 		So(ids, ShouldHaveLength, 1)
 		So(ids[0].Id.String(), ShouldEqual, org1Series[3].Id)
 		Convey("series should not be present in the metricDef index", func() {
 			query, err := tagquery.NewQueryFromStrings([]string{"series_id=3"}, 0)
 			So(err, ShouldBeNil)
-			nodes := ix.FindByTag(1, query)
+			nodes, _ := ix.FindByTag(context.Background(), 1, query)
 			So(nodes, ShouldHaveLength, 0)
 			Convey("but others should still be present", func() {
 				query, err := tagquery.NewQueryFromStrings([]string{"series_id=~[0-9]"}, 0)
 				So(err, ShouldBeNil)
-				nodes := ix.FindByTag(1, query)
+				nodes, _ := ix.FindByTag(context.Background(), 1, query)
 				So(err, ShouldBeNil)
 				So(nodes, ShouldHaveLength, 4)
 			})
@@ -802,15 +803,15 @@ func testPruneTaggedSeries(t *testing.T) {
 		So(pruned, ShouldHaveLength, 5)
 		query, err := tagquery.NewQueryFromStrings([]string{"name=~longterm\\.old.*", "series_id=~[0-4]"}, 0)
 		So(err, ShouldBeNil)
-		nodes := ix.FindByTag(1, query)
+		nodes, _ := ix.FindByTag(context.Background(), 1, query)
 		So(nodes, ShouldHaveLength, 0)
 		query, err = tagquery.NewQueryFromStrings([]string{"name=~longterm.*", "series_id=~[0-4]"}, 0)
 		So(err, ShouldBeNil)
-		nodes = ix.FindByTag(1, query)
+		nodes, _ = ix.FindByTag(context.Background(), 1, query)
 		So(nodes, ShouldHaveLength, 5)
 		query, err = tagquery.NewQueryFromStrings([]string{"name=~metric\\.never\\.exp.*", "series_id=~[0-4]"}, 0)
 		So(err, ShouldBeNil)
-		nodes = ix.FindByTag(1, query)
+		nodes, _ = ix.FindByTag(context.Background(), 1, query)
 		So(nodes, ShouldHaveLength, 5)
 	})
 
@@ -846,11 +847,11 @@ func testPruneTaggedSeries(t *testing.T) {
 			So(pruned, ShouldHaveLength, 4)
 			query, err := tagquery.NewQueryFromStrings([]string{"name=~longterm", "series_id=~[0-4]"}, 0)
 			So(err, ShouldBeNil)
-			nodes := ix.FindByTag(1, query)
+			nodes, _ := ix.FindByTag(context.Background(), 1, query)
 			So(nodes, ShouldHaveLength, 1)
 			query, err = tagquery.NewQueryFromStrings([]string{"name=~metric\\.never.*", "series_id=~[0-4]"}, 0)
 			So(err, ShouldBeNil)
-			nodes = ix.FindByTag(1, query)
+			nodes, _ = ix.FindByTag(context.Background(), 1, query)
 			So(nodes, ShouldHaveLength, 5)
 		})
 	})
@@ -917,7 +918,7 @@ func testPruneTaggedSeriesWithCollidingTagSets(t *testing.T) {
 	Convey("After pruning", t, func() {
 		query, err := tagquery.NewQueryFromStrings(findExpressions, 0)
 		So(err, ShouldBeNil)
-		nodes := ix.FindByTag(1, query)
+		nodes, _ := ix.FindByTag(context.Background(), 1, query)
 		So(nodes, ShouldHaveLength, 1)
 		defs := make([]idx.Archive, 0, len(nodes))
 		for i := range nodes {
@@ -935,7 +936,7 @@ func testPruneTaggedSeriesWithCollidingTagSets(t *testing.T) {
 	Convey("After pruning", t, func() {
 		query, err := tagquery.NewQueryFromStrings(findExpressions, 0)
 		So(err, ShouldBeNil)
-		nodes := ix.FindByTag(1, query)
+		nodes, _ := ix.FindByTag(context.Background(), 1, query)
 		So(nodes, ShouldHaveLength, 0)
 	})
 }
@@ -1153,6 +1154,41 @@ func TestUpsertingMetaRecordsIntoIndex(t *testing.T) {
 	}
 }
 
+func TestTagIndexEstimate(t *testing.T) {
+	index := make(TagIndex)
+	for i := 0; i < 10; i++ {
+		id := test.GetMKey(i)
+		index.addTagId("dc", "us-east", id)
+		index.addTagId("host", "web-"+strconv.Itoa(i), id)
+	}
+	index.addTagId("canary", "true", test.GetMKey(0))
+
+	var _ tagquery.CardinalityEstimator = index
+
+	type testCase struct {
+		key, value string
+		operator   tagquery.ExpressionOperator
+		expect     uint64
+	}
+
+	testCases := []testCase{
+		{key: "dc", value: "us-east", operator: tagquery.EQUAL, expect: 10},
+		{key: "host", value: "web-1", operator: tagquery.EQUAL, expect: 1},
+		{key: "host", value: "web-11", operator: tagquery.EQUAL, expect: 0},
+		{key: "host", value: "web-.*", operator: tagquery.MATCH, expect: 10},
+		{key: "dc", value: "us-", operator: tagquery.PREFIX, expect: 1},
+		{key: "canary", operator: tagquery.HAS_TAG, expect: 1},
+		{key: "__tag", value: "c.*", operator: tagquery.MATCH_TAG, expect: 3},
+		{key: "unknown", value: "a", operator: tagquery.NOT_EQUAL, expect: 0},
+	}
+
+	for _, tc := range testCases {
+		if res := index.Estimate(tc.key, tc.value, tc.operator); res != tc.expect {
+			t.Fatalf("Expected estimate of %s %s %q to be %d, got %d", tc.key, tc.operator, tc.value, tc.expect, res)
+		}
+	}
+}
+
 func TestMetricNameStartingWithTilde(t *testing.T) {
 	withAndWithoutPartitonedIndex(testMetricNameStartingWithTilde)(t)
 }
@@ -1190,7 +1226,7 @@ func testMetricNameStartingWithTilde(t *testing.T) {
 		t.Fatalf("Unexpected error when parsing query expression: %q", err)
 	}
 
-	findResult := ix.FindByTag(1, query)
+	findResult, _ := ix.FindByTag(context.Background(), 1, query)
 	if len(findResult) != 1 {
 		t.Fatalf("Expected 1 result, but got %d", len(findResult))
 	}
@@ -1199,7 +1235,7 @@ func testMetricNameStartingWithTilde(t *testing.T) {
 		t.Fatalf("Expected metric name to be %q, but it was %q", metricName, findResult[0].Path)
 	}
 
-	tagDetails := ix.TagDetails(1, "name", nil)
+	tagDetails, _ := ix.TagDetails(context.Background(), 1, "name", nil)
 	if len(tagDetails) != 1 {
 		t.Fatalf("Expected 1 result, but got %d", len(tagDetails))
 	}
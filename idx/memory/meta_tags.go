@@ -130,7 +130,7 @@ func (m *metaTagRecords) recordExistsAndIsEqual(record tagquery.MetaTagRecord) (
 		return id, false, false
 	}
 
-	return id, true, record.MetaTags.Equal(existingRecord.MetaTags)
+	return id, true, record.Equal(existingRecord)
 }
 
 // upsert inserts or updates a meta tag record according to the given specifications
@@ -551,53 +551,35 @@ func (m metaTagIndex) insertRecord(keyValue tagquery.Tag, id recordId) {
 // The caller, after receiving the result set, needs to be aware of whether the result set
 // is inverted and interpret it accordingly.
 func (m metaTagIndex) getMetaRecordIdsByExpression(expr tagquery.Expression, invertSetOfMetaRecords bool) []recordId {
-	if expr.OperatesOnTag() {
-		return m.getByTag(expr, invertSetOfMetaRecords)
-	}
-	return m.getByTagValue(expr, invertSetOfMetaRecords)
-}
-
-func (m metaTagIndex) getByTag(expr tagquery.Expression, invertSetOfMetaRecords bool) []recordId {
-	var res []recordId
-
-	for key := range m {
-
-		if invertSetOfMetaRecords {
-			if expr.Matches(key) {
-				continue
-			}
-		} else {
-			if !expr.Matches(key) {
-				continue
-			}
-		}
-
-		for _, ids := range m[key] {
-			res = append(res, ids...)
-		}
+	if !expr.OperatesOnTag() && expr.MatchesExactly() {
+		return m[expr.GetKey()][expr.GetValue()]
 	}
 
-	return res
-}
-
-func (m metaTagIndex) getByTagValue(expr tagquery.Expression, invertSetOfMetaRecords bool) []recordId {
-	if expr.MatchesExactly() {
-		return m[expr.GetKey()][expr.GetValue()]
+	// each meta tag gets evaluated on its own, so a record which assigns multiple meta tags
+	// can be part of the result set and also of the inverted one
+	filter := expr.GetMetaRecordFilter()
+	wanted := tagquery.Pass
+	if invertSetOfMetaRecords {
+		wanted = tagquery.Fail
 	}
 
 	var res []recordId
-	for value, ids := range m[expr.GetKey()] {
-		passes := expr.Matches(value)
-
-		if invertSetOfMetaRecords {
-			passes = !passes
+	metaTag := make(tagquery.Tags, 1)
+	collect := func(key string, values map[string][]recordId) {
+		for value, ids := range values {
+			metaTag[0] = tagquery.Tag{Key: key, Value: value}
+			if filter(metaTag) == wanted {
+				res = append(res, ids...)
+			}
 		}
+	}
 
-		if !passes {
-			continue
+	if expr.OperatesOnTag() {
+		for key, values := range m {
+			collect(key, values)
 		}
-
-		res = append(res, ids...)
+	} else {
+		collect(expr.GetKey(), m[expr.GetKey()])
 	}
 
 	return res
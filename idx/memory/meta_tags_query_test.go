@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"sort"
@@ -50,12 +51,12 @@ func getTestIndexWithMetaTags(t testing.TB, metaRecords []tagquery.MetaTagRecord
 func queryAndCompareResultsWithMetaTags(t *testing.T, idx *UnpartitionedMemoryIdx, expressions tagquery.Expressions, expectedData IdSet) {
 	t.Helper()
 
-	query, err := tagquery.NewQuery(expressions, 0)
+	query, err := tagquery.NewQuery(expressions, 0, 0)
 	if err != nil {
 		t.Fatalf("Unexpected error when instantiating query from expressions %q: %s", expressions, err)
 	}
 
-	res := idx.FindByTag(1, query)
+	res, _ := idx.FindByTag(context.Background(), 1, query)
 
 	// extract schema.MKeys from returned result
 	resData := make(IdSet, len(res))
@@ -181,6 +182,46 @@ func TestSimpleMetaTagQueryWithManyTypesOfExpression(t *testing.T) {
 	})
 }
 
+func TestMetaTagQueryWithDecisionMemo(t *testing.T) {
+	reset := enableMetaTagSupport()
+	defer reset()
+	originalDecisionMemoSize := tagQueryDecisionMemoSize
+	defer func() { tagQueryDecisionMemoSize = originalDecisionMemoSize }()
+
+	// the records share their expressions, so they share the memoized decisions
+	metaTagRecords := []tagquery.MetaTagRecord{
+		mustParseMetaTagRecord(t, []string{"metatag1=value1"}, []string{"tag1=~iterator[3-9]", "tag2!=~.*5"}),
+		mustParseMetaTagRecord(t, []string{"metatag1=value2"}, []string{"tag1=~iterator[3-9]", "tag2!=~.*7"}),
+		mustParseMetaTagRecord(t, []string{"metatag2=value1"}, []string{"tag2!=~.*5", "tag1=~iterator[4-9]"}),
+	}
+	idx, mkeys := getTestIndexWithMetaTags(t, metaTagRecords, 10, nil)
+
+	testCases := []struct {
+		expressions []string
+		expectData  IdSet
+	}{
+		{
+			expressions: []string{"metatag1=~value.*"},
+			expectData:  IdSet{mkeys[3]: struct{}{}, mkeys[4]: struct{}{}, mkeys[5]: struct{}{}, mkeys[6]: struct{}{}, mkeys[7]: struct{}{}, mkeys[8]: struct{}{}, mkeys[9]: struct{}{}},
+		}, {
+			expressions: []string{"metatag1=value1", "metatag2=value1"},
+			expectData:  IdSet{mkeys[5]: struct{}{}, mkeys[6]: struct{}{}, mkeys[7]: struct{}{}, mkeys[8]: struct{}{}, mkeys[9]: struct{}{}},
+		},
+	}
+
+	// a memo which is too small to hold all decisions must give the same results as a large one
+	for _, decisionMemoSize := range []int{0, 3, 100} {
+		tagQueryDecisionMemoSize = decisionMemoSize
+		for _, tc := range testCases {
+			expressions, err := tagquery.ParseExpressions(tc.expressions)
+			if err != nil {
+				t.Fatalf("Error when parsing expressions: %s", err)
+			}
+			queryAndCompareResultsWithMetaTags(t, idx, expressions, tc.expectData)
+		}
+	}
+}
+
 func TestMetaTagEnrichmentForQueryByMetricTag(t *testing.T) {
 	reset := enableMetaTagSupport()
 	defer reset()
@@ -200,12 +241,12 @@ func TestMetaTagEnrichmentForQueryByMetricTag(t *testing.T) {
 		t.Fatalf("Error when parsing expressions: %s", err)
 	}
 
-	query, err := tagquery.NewQuery(expressions, 0)
+	query, err := tagquery.NewQuery(expressions, 0, 0)
 	if err != nil {
 		t.Fatalf("Unexpected error when instantiating query from expressions %q: %s", expressions, err)
 	}
 
-	res := idx.FindByTag(1, query)
+	res, _ := idx.FindByTag(context.Background(), 1, query)
 
 	for _, node := range res {
 		for _, def := range node.Defs {
@@ -262,12 +303,12 @@ func TestMetaTagEnrichmentForQueryByMetaTag(t *testing.T) {
 		t.Fatalf("Error when parsing expressions: %s", err)
 	}
 
-	query, err := tagquery.NewQuery(expressions, 0)
+	query, err := tagquery.NewQuery(expressions, 0, 0)
 	if err != nil {
 		t.Fatalf("Unexpected error when instantiating query from expressions %q: %s", expressions, err)
 	}
 
-	res := idx.FindByTag(1, query)
+	res, _ := idx.FindByTag(context.Background(), 1, query)
 
 	for _, node := range res {
 		for _, def := range node.Defs {
@@ -332,12 +373,12 @@ func TestMetaTagRecordSwap(t *testing.T) {
 		t.Fatalf("Record 2 does not exist in mtr: %t/%t", exists, equal)
 	}
 
-	gotRecord1Ids := mti.getByTagValue(mustParseExpression(t, record1.MetaTags[0].Key+"="+record1.MetaTags[0].Value), false)
+	gotRecord1Ids := mti.getMetaRecordIdsByExpression(mustParseExpression(t, record1.MetaTags[0].Key+"="+record1.MetaTags[0].Value), false)
 	if !reflect.DeepEqual(gotRecord1Ids, []recordId{record1Id}) {
 		t.Fatalf("mti.getByTag returned unexpected record ids for meta tag %q of record 1. Got %+v, Expected %+v", record1.MetaTags[0], gotRecord1Ids, []recordId{record1Id})
 	}
 
-	gotRecord2Ids := mti.getByTagValue(mustParseExpression(t, record2.MetaTags[0].Key+"="+record2.MetaTags[0].Value), false)
+	gotRecord2Ids := mti.getMetaRecordIdsByExpression(mustParseExpression(t, record2.MetaTags[0].Key+"="+record2.MetaTags[0].Value), false)
 	if !reflect.DeepEqual(gotRecord2Ids, []recordId{record2Id}) {
 		t.Fatalf("mti.getByTag returned unexpected record ids for meta tag %q of record 2. Got %+v, Expected %+v", record2.MetaTags[0], gotRecord2Ids, []recordId{record2Id})
 	}
@@ -365,7 +406,7 @@ func TestMetaTagRecordSwap(t *testing.T) {
 		t.Fatalf("Record 1 does not exist in mtr: %t/%t", exists, equal)
 	}
 
-	gotRecord3Ids := mti.getByTagValue(mustParseExpression(t, record3.MetaTags[0].Key+"="+record3.MetaTags[0].Value), false)
+	gotRecord3Ids := mti.getMetaRecordIdsByExpression(mustParseExpression(t, record3.MetaTags[0].Key+"="+record3.MetaTags[0].Value), false)
 	if !reflect.DeepEqual(gotRecord3Ids, []recordId{record3Id}) {
 		t.Fatalf("mti.getByTag returned unexpected record ids for meta tag %q of record 3. Got %+v, Expected %+v", record3.MetaTags[0], gotRecord3Ids, []recordId{record3Id})
 	}
@@ -750,7 +791,7 @@ func benchmarkFindByMetaTag(b *testing.B, indexSize, metaRecordCount, expectedRe
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		res = index.FindByTag(1, queries[i%len(queries)])
+		res, _ = index.FindByTag(context.Background(), 1, queries[i%len(queries)])
 		if len(res) != expectedResCount {
 			b.Fatalf("Unexpected result. Expected %d items, got %d", expectedResCount, len(res))
 		}
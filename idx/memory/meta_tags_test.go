@@ -160,6 +160,40 @@ func TestUpdateExistingMetaTagRecord(t *testing.T) {
 	}
 }
 
+func TestUpdateEquivalentMetaTagRecord(t *testing.T) {
+	reset := enableMetaTagSupport()
+	defer reset()
+
+	// the second meta record replaces the first one because its tag queries are equivalent
+	records := generateMetaRecords(t,
+		[][]string{{"metaTag1=value1"}, {"metaTag1=value2"}},
+		[][]string{{"tag1=~a.*", "tag2=~b.*c"}, {"tag2=~(b).*(c)", "tag1=~^(?:a.*)"}},
+	)
+
+	metaTagRecords := newMetaTagRecords()
+	id, _, _, _, err := metaTagRecords.upsert(records[0])
+	if err != nil {
+		t.Fatalf("Unexpected error on meta tag record upsert: %q", err)
+	}
+
+	newId, record, oldId, oldRecord, err := metaTagRecords.upsert(records[1])
+	if err != nil {
+		t.Fatalf("Unexpected error on meta tag record upsert: %q", err)
+	}
+	if oldRecord == nil || !oldRecord.Equals(&records[0]) {
+		t.Fatalf("Expected the first record to get replaced, but the old record was %+v", oldRecord)
+	}
+	if oldId != id || newId != id {
+		t.Fatalf("Expected the record to keep its id %d, but the old id was %d and the new one %d", id, oldId, newId)
+	}
+	if len(metaTagRecords.records) != 1 {
+		t.Fatalf("Expected 1 meta tag record, but there were %d", len(metaTagRecords.records))
+	}
+	if stored := metaTagRecords.records[id]; !stored.Equals(record) {
+		t.Fatalf("Expected the stored record to be the second one, but it was %+v", stored)
+	}
+}
+
 // we mock the hashing algorithm implementation because we want to be able to
 // test a hash collision
 type mockHash struct {
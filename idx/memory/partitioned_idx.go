@@ -278,19 +278,22 @@ func (p *PartitionedMemoryIdx) Prune(oldest time.Time) ([]idx.Archive, error) {
 // where the LastUpdate time is >= from will be returned as results.
 // The returned results are not deduplicated and in certain cases it is possible
 // that duplicate entries will be returned.
-func (p *PartitionedMemoryIdx) FindByTag(orgId uint32, query tagquery.Query) []idx.Node {
-	g, _ := errgroup.WithContext(context.Background())
+func (p *PartitionedMemoryIdx) FindByTag(ctx context.Context, orgId uint32, query tagquery.Query) ([]idx.Node, error) {
+	g, _ := errgroup.WithContext(ctx)
 	result := make([][]idx.Node, len(p.Partition))
 	var i int
 	for _, m := range p.Partition {
 		pos, m := i, m
 		g.Go(func() error {
-			result[pos] = m.FindByTag(orgId, query)
-			return nil
+			var err error
+			result[pos], err = m.FindByTag(ctx, orgId, query)
+			return err
 		})
 		i++
 	}
-	g.Wait()
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
 	// get our total count, so we can allocate our response in one go.
 	items := 0
@@ -301,25 +304,27 @@ func (p *PartitionedMemoryIdx) FindByTag(orgId uint32, query tagquery.Query) []i
 	for _, r := range result {
 		response = append(response, r...)
 	}
-	return response
+	return response, nil
 }
 
-func (p *PartitionedMemoryIdx) FindTerms(orgID uint32, tags []string, query tagquery.Query) (uint32, map[string]map[string]uint32) {
-	g, _ := errgroup.WithContext(context.Background())
+func (p *PartitionedMemoryIdx) FindTerms(ctx context.Context, orgID uint32, tags []string, query tagquery.Query) (uint32, map[string]map[string]uint32, error) {
+	g, _ := errgroup.WithContext(ctx)
 	var total uint32
 	results := make([]map[string]map[string]uint32, len(p.Partition))
 	var i int
 	for _, m := range p.Partition {
 		pos, m := i, m
 		g.Go(func() error {
-			numSeries, terms := m.FindTerms(orgID, tags, query)
+			numSeries, terms, err := m.FindTerms(ctx, orgID, tags, query)
 			atomic.AddUint32(&total, numSeries)
 			results[pos] = terms
-			return nil
+			return err
 		})
 		i++
 	}
-	g.Wait()
+	if err := g.Wait(); err != nil {
+		return 0, nil, err
+	}
 
 	response := make(map[string]map[string]uint32)
 	for _, terms := range results {
@@ -333,7 +338,7 @@ func (p *PartitionedMemoryIdx) FindTerms(orgID uint32, tags []string, query tagq
 		}
 	}
 
-	return total, response
+	return total, response, nil
 }
 
 // Tags returns a list of all tag keys associated with the metrics of a given
@@ -360,19 +365,22 @@ func (p *PartitionedMemoryIdx) Tags(orgId uint32, filter *regexp.Regexp) []strin
 // the metric names in the returned map.
 // If the third parameter is not "" it will be used as a regular expression to filter
 // the values before accounting for them.
-func (p *PartitionedMemoryIdx) TagDetails(orgId uint32, key string, filter *regexp.Regexp) map[string]uint64 {
-	g, _ := errgroup.WithContext(context.Background())
+func (p *PartitionedMemoryIdx) TagDetails(ctx context.Context, orgId uint32, key string, filter *regexp.Regexp) (map[string]uint64, error) {
+	g, _ := errgroup.WithContext(ctx)
 	result := make([]map[string]uint64, len(p.Partition))
 	var i int
 	for _, m := range p.Partition {
 		pos, m := i, m
 		g.Go(func() error {
-			result[pos] = m.TagDetails(orgId, key, filter)
-			return nil
+			var err error
+			result[pos], err = m.TagDetails(ctx, orgId, key, filter)
+			return err
 		})
 		i++
 	}
-	g.Wait()
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
 	// merge our results into the unique set of tags
 	merged := map[string]uint64{}
@@ -382,7 +390,7 @@ func (p *PartitionedMemoryIdx) TagDetails(orgId uint32, key string, filter *rege
 		}
 	}
 
-	return merged
+	return merged, nil
 }
 
 // FindTags returns tags matching the specified conditions
@@ -416,25 +424,28 @@ func (p *PartitionedMemoryIdx) FindTags(orgId uint32, prefix string, limit uint)
 // limit:       the maximum number of results to return
 //
 // the results will always be sorted alphabetically for consistency
-func (p *PartitionedMemoryIdx) FindTagsWithQuery(orgId uint32, prefix string, query tagquery.Query, limit uint) []string {
-	g, _ := errgroup.WithContext(context.Background())
+func (p *PartitionedMemoryIdx) FindTagsWithQuery(ctx context.Context, orgId uint32, prefix string, query tagquery.Query, limit uint) ([]string, error) {
+	g, _ := errgroup.WithContext(ctx)
 	result := make([][]string, len(p.Partition))
 	var i int
 	for _, m := range p.Partition {
 		pos, m := i, m
 		g.Go(func() error {
-			result[pos] = m.FindTagsWithQuery(orgId, prefix, query, limit)
-			return nil
+			var err error
+			result[pos], err = m.FindTagsWithQuery(ctx, orgId, prefix, query, limit)
+			return err
 		})
 		i++
 	}
-	g.Wait()
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
 	response := mergePartitionStringResults(result)
 	if uint(len(response)) > limit {
-		return response[:limit]
+		return response[:limit], nil
 	}
-	return response
+	return response, nil
 }
 
 // FindTagValues generates a list of possible values that could
@@ -462,38 +473,41 @@ func (p *PartitionedMemoryIdx) FindTagValues(orgId uint32, tag, prefix string, l
 	return response
 }
 
-func (p *PartitionedMemoryIdx) FindTagValuesWithQuery(orgId uint32, tag, prefix string, query tagquery.Query, limit uint) []string {
-	g, _ := errgroup.WithContext(context.Background())
+func (p *PartitionedMemoryIdx) FindTagValuesWithQuery(ctx context.Context, orgId uint32, tag, prefix string, query tagquery.Query, limit uint) ([]string, error) {
+	g, _ := errgroup.WithContext(ctx)
 	result := make([][]string, len(p.Partition))
 	var i int
 	for _, m := range p.Partition {
 		pos, m := i, m
 		g.Go(func() error {
-			result[pos] = m.FindTagValuesWithQuery(orgId, tag, prefix, query, limit)
-			return nil
+			var err error
+			result[pos], err = m.FindTagValuesWithQuery(ctx, orgId, tag, prefix, query, limit)
+			return err
 		})
 		i++
 	}
-	g.Wait()
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
 	response := mergePartitionStringResults(result)
 	if uint(len(response)) > limit {
-		return response[:limit]
+		return response[:limit], nil
 	}
-	return response
+	return response, nil
 }
 
 // DeleteTagged deletes the specified series from the tag index and also the
 // DefById index.
-func (p *PartitionedMemoryIdx) DeleteTagged(orgId uint32, query tagquery.Query) ([]idx.Archive, error) {
-	g, _ := errgroup.WithContext(context.Background())
+func (p *PartitionedMemoryIdx) DeleteTagged(ctx context.Context, orgId uint32, query tagquery.Query) ([]idx.Archive, error) {
+	g, _ := errgroup.WithContext(ctx)
 	result := make([][]idx.Archive, len(p.Partition))
 	var i int
 	for _, m := range p.Partition {
 		pos, m := i, m
 		g.Go(func() error {
 			var err error
-			result[pos], err = m.DeleteTagged(orgId, query)
+			result[pos], err = m.DeleteTagged(ctx, orgId, query)
 			if err != nil {
 				return err
 			}
@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -29,21 +30,48 @@ type TagQueryContext struct {
 	metaTagRecords *metaTagRecords              // meta tag records keyed by their recordID
 	startWith      int                          // the expression index to start with
 	subQuery       bool                         // true if this is a subquery created from the expressions of a meta tag record
+	ctx            context.Context              // once it is done the filter workers stop filtering
+	budgetExceeded int32                        // set to 1 once the query has exceeded its regex budget
 }
 
 // NewTagQueryContext takes a tag query and wraps it into all the
-// context structs necessary to execute the query on the indexes
+// context structs necessary to execute the query on the indexes.
+// the query never stops early, so it is only meant for the queries which maintain the
+// index, like the ones of the meta tag records, which must see all matching metrics.
+// the queries of requests should use NewTagQueryContextWithContext
 func NewTagQueryContext(query tagquery.Query) TagQueryContext {
-	ctx := TagQueryContext{
+	return NewTagQueryContextWithContext(context.Background(), query)
+}
+
+// NewTagQueryContextWithContext is like NewTagQueryContext, but the query execution
+// stops early once the given context is done, f.e. because the client disconnected.
+// the result of a query which has been stopped is incomplete.
+// if tag-query-regex-budget is set and the context doesn't carry a budget yet, the query
+// gets a budget of its own, which its sub queries share, see Err
+func NewTagQueryContextWithContext(ctx context.Context, query tagquery.Query) TagQueryContext {
+	if tagQueryRegexBudget > 0 && tagquery.RegexBudgetFromContext(ctx) == nil {
+		ctx = tagquery.ContextWithRegexBudget(ctx, tagquery.NewRegexBudget(tagQueryRegexBudget))
+	}
+
+	return TagQueryContext{
 		query:     query,
 		startWith: -1,
+		ctx:       ctx,
 	}
+}
 
-	return ctx
+// Err returns tagquery.ErrRegexBudgetExceeded if the query, or one of its sub queries, has
+// exceeded its regex budget, which means that its result is incomplete. it must only get
+// called once the result channel of the query has been consumed
+func (q *TagQueryContext) Err() error {
+	if q.ctx == nil {
+		return nil
+	}
+	return tagquery.RegexBudgetFromContext(q.ctx).Err()
 }
 
 type expressionCost struct {
-	operatorCost  uint32
+	cost          uint32
 	cardinality   uint32
 	metaTag       bool
 	expressionIdx int
@@ -61,21 +89,30 @@ func (q *TagQueryContext) newerThanFrom(id schema.MKey) bool {
 	return atomic.LoadInt64(&md.LastUpdate) >= q.query.From
 }
 
+// idProperties takes a metric key, it returns the lastUpdate and interval
+// properties of the metric associated with that key.
+// if the key doesn't exist the returned bool is false
+func (q *TagQueryContext) idProperties(id schema.MKey) (int64, int, bool) {
+	md, ok := q.byId[id]
+	if !ok {
+		return 0, 0, false
+	}
+	return atomic.LoadInt64(&md.LastUpdate), md.Interval, true
+}
+
 func (q *TagQueryContext) evaluateExpressionCosts() []expressionCost {
 	costs := make([]expressionCost, len(q.query.Expressions))
 
 	for i, expr := range q.query.Expressions {
 		costs[i].expressionIdx = i
 
+		costs[i].cost = expr.GetCost()
+		costs[i].cardinality = uint32(q.index.Estimate(expr.GetKey(), expr.GetValue(), expr.GetOperator()))
+
 		if expr.OperatesOnTag() {
 			if expr.MatchesExactly() {
-				costs[i].operatorCost = expr.GetOperatorCost()
-				costs[i].cardinality = uint32(len(q.index[expr.GetKey()]))
 				_, costs[i].metaTag = q.metaTagIndex[expr.GetKey()]
 			} else {
-				costs[i].operatorCost = expr.GetOperatorCost()
-				costs[i].cardinality = uint32(len(q.index))
-
 				// if MetaTagIndex is disabled q.metaTagIndex is nil,
 				// so this will not loop at all
 				for tag := range q.metaTagIndex {
@@ -86,12 +123,18 @@ func (q *TagQueryContext) evaluateExpressionCosts() []expressionCost {
 			}
 		} else {
 			if expr.MatchesExactly() {
-				costs[i].operatorCost = expr.GetOperatorCost()
-				costs[i].cardinality = uint32(len(q.index[expr.GetKey()][expr.GetValue()]))
 				_, costs[i].metaTag = q.metaTagIndex[expr.GetKey()][expr.GetValue()]
+			} else if values, ok := literalAlternatives(expr); ok {
+				// the values get looked up directly, so only their ids count
+				var cardinality uint64
+				for _, value := range values {
+					cardinality += q.index.Estimate(expr.GetKey(), value, tagquery.EQUAL)
+					if _, ok := q.metaTagIndex[expr.GetKey()][value]; ok {
+						costs[i].metaTag = true
+					}
+				}
+				costs[i].cardinality = uint32(cardinality)
 			} else {
-				costs[i].operatorCost = expr.GetOperatorCost()
-				costs[i].cardinality = uint32(len(q.index[expr.GetKey()]))
 				_, costs[i].metaTag = q.metaTagIndex[expr.GetKey()]
 			}
 		}
@@ -107,10 +150,19 @@ func (q *TagQueryContext) evaluateExpressionCosts() []expressionCost {
 			return true
 		}
 
-		if costs[i].operatorCost == costs[j].operatorCost {
+		if costs[i].cost != costs[j].cost {
+			return costs[i].cost < costs[j].cost
+		}
+		if costs[i].cardinality != costs[j].cardinality {
 			return costs[i].cardinality < costs[j].cardinality
 		}
-		return costs[i].operatorCost < costs[j].operatorCost
+
+		// the order of the expressions must be deterministic
+		a, b := q.query.Expressions[costs[i].expressionIdx], q.query.Expressions[costs[j].expressionIdx]
+		if a.GetKey() != b.GetKey() {
+			return a.GetKey() < b.GetKey()
+		}
+		return a.GetValue() < b.GetValue()
 	})
 
 	return costs
@@ -119,27 +171,31 @@ func (q *TagQueryContext) evaluateExpressionCosts() []expressionCost {
 func (q *TagQueryContext) prepareExpressions() {
 	costs := q.evaluateExpressionCosts()
 
-	// the number of filters is equal to the number of expressions - 1 because one of the
-	// expressions will be chosen to be the one that we start with.
-	// we don't need the filter function, nor the default decision, of the expression which
-	// we start with.
+	// the expressions ordered by their cost, the expression which we start with is the
+	// first one that requires a non-empty value. we don't need the filter function, nor
+	// the default decision, of the expression which we start with.
 	// all the remaining expressions will be used as filter expressions, for which we need
 	// to obtain their filter functions and their default decisions.
-	filterExpressions := make([]tagquery.Expression, 0, len(q.query.Expressions)-1)
+	ordered := make(tagquery.Expressions, len(costs))
+	for i, cost := range costs {
+		ordered[i] = q.query.Expressions[cost.expressionIdx]
+	}
 
-	// Every tag query has at least one expression which requires a non-empty value according to:
-	// https://graphite.readthedocs.io/en/latest/tags.html#querying
-	// This rule is enforced by tagquery.NewQuery, here we trust that the queries which get passed
-	// into the index have already been validated
+	// Every tag query has at least one expression which requires a non-empty value,
+	// this rule is enforced by tagquery.NewQuery. here we trust that the queries which
+	// get passed into the index have already been validated
+	startWith, filterExpressions, err := ordered.PartitionOrdered()
+	if err != nil {
+		return
+	}
 	for _, cost := range costs {
-		if q.startWith < 0 && q.query.Expressions[cost.expressionIdx].RequiresNonEmptyValue() {
+		if q.query.Expressions[cost.expressionIdx] == startWith {
 			q.startWith = cost.expressionIdx
-		} else {
-			filterExpressions = append(filterExpressions, q.query.Expressions[cost.expressionIdx])
+			break
 		}
 	}
 
-	q.selector = newIdSelector(q.query.Expressions[q.startWith], q)
+	q.selector = newIdSelector(startWith, q)
 	if len(filterExpressions) > 0 {
 		q.filter = newIdFilter(filterExpressions, q)
 	}
@@ -150,11 +206,20 @@ func (q *TagQueryContext) testByFrom(def *idx.Archive) bool {
 	return q.query.From <= atomic.LoadInt64(&def.LastUpdate)
 }
 
+// filterBatchSize is the number of metrics which a filter worker collects before it
+// runs them through the filters
+const filterBatchSize = 128
+
 // filterIdsFromChan takes a channel of metric ids and runs them through the
 // required tests to decide whether a metric should be part of the final
 // result set or not
 // it returns the final result set via the given resCh parameter
+// once the context of the query is done it stops filtering, but it keeps
+// consuming the idCh to not block the routine which feeds it
 func (q *TagQueryContext) filterIdsFromChan(idCh, resCh chan schema.MKey) {
+	defer q.wg.Done()
+
+	batch := make([]tagquery.MetricDefinitionLike, 0, filterBatchSize)
 	for id := range idCh {
 		var def *idx.Archive
 		var ok bool
@@ -167,12 +232,49 @@ func (q *TagQueryContext) filterIdsFromChan(idCh, resCh chan schema.MKey) {
 			continue
 		}
 
-		if q.testByFrom(def) && q.filter.matches(id, schema.SanitizeNameAsTagValue(def.Name), def.Tags) {
-			resCh <- id
+		if !q.testByFrom(def) {
+			continue
 		}
+
+		batch = append(batch, tagquery.MetricDefinitionLike{Id: id, Name: schema.SanitizeNameAsTagValue(def.Name), Tags: def.Tags})
+		if len(batch) < filterBatchSize {
+			continue
+		}
+
+		if !q.filterBatch(batch, resCh) {
+			for range idCh {
+			}
+			return
+		}
+		batch = batch[:0]
 	}
 
-	q.wg.Done()
+	q.filterBatch(batch, resCh)
+}
+
+// filterBatch runs the given metrics through the filter and pushes the ids of the
+// ones which pass it into resCh. it returns false if the context of the query is done
+func (q *TagQueryContext) filterBatch(batch []tagquery.MetricDefinitionLike, resCh chan schema.MKey) bool {
+	decisions, err := q.filter.filterBatch(q.ctx, batch)
+	if err == tagquery.ErrRegexBudgetExceeded {
+		// only one of the workers gets to report it
+		if atomic.CompareAndSwapInt32(&q.budgetExceeded, 0, 1) {
+			statRegexBudgetExceeded.Inc()
+			log.Warnf("memory-idx: tag query %s exceeded its budget of %d regex evaluations, aborting it", q.query.Expressions.String(), tagQueryRegexBudget)
+		}
+		return false
+	}
+	if err != nil {
+		log.Debugf("memory-idx: stopped filtering tag query %s: %s", q.query.Expressions.String(), err)
+		return false
+	}
+
+	for i := range batch {
+		if decisions[i] == tagquery.Pass {
+			resCh <- batch[i].Id
+		}
+	}
+	return true
 }
 
 // RunNonBlocking executes the tag query on the given index and returns a list of ids
@@ -207,6 +309,26 @@ func (q *TagQueryContext) run(index TagIndex, byId map[schema.MKey]*idx.Archive,
 	q.byId = byId
 	q.metaTagIndex = mti
 	q.metaTagRecords = mtr
+	if q.ctx == nil {
+		// the context has not been instantiated via one of the constructors
+		q.ctx = context.Background()
+	}
+
+	// sub queries inherit the budget of their parent query via its context
+	if tagQueryRegexBudget > 0 && tagquery.RegexBudgetFromContext(q.ctx) == nil {
+		q.ctx = tagquery.ContextWithRegexBudget(q.ctx, tagquery.NewRegexBudget(tagQueryRegexBudget))
+	}
+
+	// sub queries inherit the decision memo of their parent query, see subQueryFromExpressions
+	if tagQueryDecisionMemoSize > 0 && q.query.DecisionMemo == nil && MetaTagSupport {
+		q.query.DecisionMemo = tagquery.NewDecisionMemo(tagQueryDecisionMemoSize)
+	}
+
+	// the query can never match anything, so we return an empty result without looking at the index
+	if q.query.Unsatisfiable() {
+		return
+	}
+
 	q.prepareExpressions()
 
 	// no initial expression has been chosen, returning empty result
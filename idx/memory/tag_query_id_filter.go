@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"sort"
 	"strings"
 
@@ -38,12 +39,22 @@ type expressionFilter struct {
 type idFilter struct {
 	ctx     *TagQueryContext
 	filters []expressionFilter
+
+	// decisionFilters and defaultDecisions hold the decide functions and the default
+	// decisions of the filters, they are used to filter batches of metrics
+	decisionFilters  tagquery.MetricDefinitionFilters
+	defaultDecisions []tagquery.FilterDecision
 }
 
 // newIdFilter takes a set of expressions and a tag query context, then it generates
 // various filter functions from the expressions which are going to be used to decide
 // whether a given metric matches the provided expressions
 func newIdFilter(expressions tagquery.Expressions, ctx *TagQueryContext) *idFilter {
+	// only the filter of a MATCH_NONE expression gets generated, because it fails every metric
+	if expr, ok := expressions.MatchNoneExpression(); ok {
+		expressions = tagquery.Expressions{expr}
+	}
+
 	res := idFilter{
 		ctx:     ctx,
 		filters: make([]expressionFilter, len(expressions)),
@@ -51,17 +62,33 @@ func newIdFilter(expressions tagquery.Expressions, ctx *TagQueryContext) *idFilt
 
 	useMetaTags := MetaTagSupport && ctx.metaTagIndex != nil && ctx.metaTagRecords != nil
 
+	// the filters of expressions on pseudo tags look at the properties of the metric definitions
+	// if the query has a regex budget its filters count their regex executions in it.
+	// if the query has a trace its filters get instrumented to collect their stats in it.
+	// the index keeps the tags of the metric definitions sorted, so the filters can rely on that
+	var budget *tagquery.RegexBudget
+	if ctx.ctx != nil {
+		budget = tagquery.RegexBudgetFromContext(ctx.ctx)
+	}
+	collector := ctx.query.Trace.NewStatsCollector(expressions)
+	testByMetricTags, defaultDecisions := expressions.GetMetricDefinitionFiltersForSortedTagsWithStats(ctx.index.idHasTag, ctx.idProperties, budget, collector)
+
 	for i, expr := range expressions {
 		res.filters[i] = expressionFilter{
 			expr:             expr,
-			testByMetricTags: expr.GetMetricDefinitionFilter(ctx.index.idHasTag),
-			defaultDecision:  expr.GetDefaultDecision(),
+			testByMetricTags: testByMetricTags[i],
+			defaultDecision:  defaultDecisions[i],
 		}
 
 		if !useMetaTags {
 			continue
 		}
 
+		// meta tags can't be assigned to pseudo tags so they don't need to be considered
+		if _, ok := expr.(tagquery.MetricPropertyExpression); ok {
+			continue
+		}
+
 		// this is a performacnce optimization:
 		// some expressions indicate that they'll likely result in a smaller result set
 		// if they get inverted.
@@ -91,7 +118,7 @@ func newIdFilter(expressions tagquery.Expressions, ctx *TagQueryContext) *idFilt
 		// to check whether a metric has one of the necessary meta tags associated
 		// with it.
 		optimizeForOnlyEqualOperators := !invertSetOfMetaRecords
-		var metaRecordFilters []tagquery.MetricDefinitionFilter
+		var metaRecordFilters tagquery.MetricDefinitionFilters
 		singleExprPerRecord := true
 		records := make([]tagquery.MetaTagRecord, 0, len(metaRecordIds))
 		for _, id := range metaRecordIds {
@@ -117,7 +144,8 @@ func newIdFilter(expressions tagquery.Expressions, ctx *TagQueryContext) *idFilt
 				}
 			}
 
-			metaRecordFilters = append(metaRecordFilters, record.GetMetricDefinitionFilter(ctx.index.idHasTag))
+			// the records which share expressions only evaluate them once per metric if the query has a decision memo
+			metaRecordFilters = append(metaRecordFilters, record.GetMetricDefinitionFilterWithMemo(ctx.index.idHasTag, ctx.query.DecisionMemo))
 		}
 
 		if optimizeForOnlyEqualOperators {
@@ -140,6 +168,13 @@ func newIdFilter(expressions tagquery.Expressions, ctx *TagQueryContext) *idFilt
 		}
 	}
 
+	res.decisionFilters = make(tagquery.MetricDefinitionFilters, len(res.filters))
+	res.defaultDecisions = make([]tagquery.FilterDecision, len(res.filters))
+	for i := range res.filters {
+		res.decisionFilters[i] = res.filters[i].decide
+		res.defaultDecisions[i] = res.filters[i].defaultDecision
+	}
+
 	return &res
 }
 
@@ -258,71 +293,47 @@ func sliceContainsElements(find, in []string) bool {
 	}
 }
 
-func metaRecordFilterInverted(metaRecordFilters []tagquery.MetricDefinitionFilter, defaultDecision tagquery.FilterDecision) tagquery.MetricDefinitionFilter {
+func metaRecordFilterInverted(metaRecordFilters tagquery.MetricDefinitionFilters, defaultDecision tagquery.FilterDecision) tagquery.MetricDefinitionFilter {
 	return func(id schema.MKey, name string, tags []string) tagquery.FilterDecision {
-		for _, metaRecordFilter := range metaRecordFilters {
-			decision := metaRecordFilter(id, name, tags)
-			if decision == tagquery.None {
-				decision = defaultDecision
-			}
-
-			if decision == tagquery.Fail {
-				return tagquery.Pass
-			}
+		// the metric passes if it fails any of the meta records
+		decision := metaRecordFilters.FilterAnd(id, name, tags)
+		if decision == tagquery.None {
+			decision = defaultDecision
 		}
 
+		if decision == tagquery.Fail {
+			return tagquery.Pass
+		}
 		return tagquery.Fail
 	}
 }
 
-func metaRecordFilterNormal(metaRecordFilters []tagquery.MetricDefinitionFilter, defaultDecision tagquery.FilterDecision) tagquery.MetricDefinitionFilter {
+func metaRecordFilterNormal(metaRecordFilters tagquery.MetricDefinitionFilters, defaultDecision tagquery.FilterDecision) tagquery.MetricDefinitionFilter {
 	return func(id schema.MKey, name string, tags []string) tagquery.FilterDecision {
-		for _, metaRecordFilter := range metaRecordFilters {
-			decision := metaRecordFilter(id, name, tags)
-			if decision == tagquery.None {
-				decision = defaultDecision
-			}
-
-			if decision == tagquery.Pass {
-				return tagquery.Pass
-			}
+		// the metric passes if it passes any of the meta records
+		decision := metaRecordFilters.FilterOr(id, name, tags)
+		if decision == tagquery.None {
+			decision = defaultDecision
 		}
-
-		return tagquery.Fail
+		return decision
 	}
 }
 
-// matches takes descriptive properties of a metric definition and runs them through all
-// filters required to come to a decision whether this metric definition should be part
-// of the result or not.
-// it uses the filter functions that have previously been generated when this instance
-// of idFilter was instantiated
-func (f *idFilter) matches(id schema.MKey, name string, tags []string) bool {
-	for i := range f.filters {
-		decision := f.filters[i].testByMetricTags(id, name, tags)
-
-		if decision == tagquery.Pass {
-			continue
-		}
-
-		if decision == tagquery.Fail {
-			return false
-		}
-
-		if f.filters[i].testByMetaTags != nil {
-			decision = f.filters[i].testByMetaTags(id, name, tags)
-		}
-
-		if decision == tagquery.None {
-			decision = f.filters[i].defaultDecision
-		}
-
-		if decision == tagquery.Pass {
-			continue
-		}
-
-		return false
+// decide runs the given metric through the filter based on the metric tag index, if that
+// doesn't come to a decision it runs it through the filter based on the meta tag index.
+// the default decision does not get applied
+func (e *expressionFilter) decide(id schema.MKey, name string, tags []string) tagquery.FilterDecision {
+	decision := e.testByMetricTags(id, name, tags)
+	if decision == tagquery.None && e.testByMetaTags != nil {
+		decision = e.testByMetaTags(id, name, tags)
 	}
+	return decision
+}
 
-	return true
+// filterBatch runs the given metrics through all filters required to come to a decision
+// whether they should be part of the result or not. the returned slice has one decision
+// per metric, the metrics with the decision Pass are part of the result.
+// once the given context is done it stops and returns the error of the context
+func (f *idFilter) filterBatch(ctx context.Context, defs []tagquery.MetricDefinitionLike) ([]tagquery.FilterDecision, error) {
+	return f.decisionFilters.FilterBatch(ctx, defs, f.defaultDecisions)
 }
@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"testing"
 
 	"github.com/grafana/metrictank/schema"
@@ -38,14 +39,25 @@ func filterAndCompareResults(t *testing.T, expressions tagquery.Expressions, met
 
 	filter := newIdFilter(expressions, ctx)
 
-	for _, md := range expectedFail {
-		if filter.matches(md.Id, md.Name, md.Tags) {
+	defs := make([]tagquery.MetricDefinitionLike, 0, len(expectedFail)+len(expectedMatch))
+	for _, mds := range [][]schema.MetricDefinition{expectedFail, expectedMatch} {
+		for _, md := range mds {
+			defs = append(defs, tagquery.MetricDefinitionLike{Id: md.Id, Name: md.Name, Tags: md.Tags})
+		}
+	}
+	decisions, err := filter.filterBatch(context.Background(), defs)
+	if err != nil {
+		t.Fatalf("Unexpected error when filtering: %s", err)
+	}
+
+	for i, md := range expectedFail {
+		if decisions[i] == tagquery.Pass {
 			t.Fatalf("Expected metric %+v to fail, but it did not", md)
 		}
 	}
 
-	for _, md := range expectedMatch {
-		if !filter.matches(md.Id, md.Name, md.Tags) {
+	for i, md := range expectedMatch {
+		if decisions[len(expectedFail)+i] != tagquery.Pass {
 			t.Fatalf("Expected metric %+v to match, but it did not", md)
 		}
 	}
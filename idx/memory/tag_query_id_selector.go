@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"strings"
 	"sync"
 
 	"github.com/grafana/metrictank/expr/tagquery"
@@ -140,11 +141,45 @@ func (i *idSelector) byTagValueFromMetricTagIndex() {
 		return
 	}
 
+	// if the expression is satisfied by a set of literal values we can look up each of
+	// them directly, instead of calling expr.Matches on each value of the key
+	if values, ok := literalAlternatives(i.expr); ok {
+		for _, value := range values {
+			for id := range i.ctx.index[i.expr.GetKey()][value] {
+				if i.ctx.query.From > 0 && !i.ctx.newerThanFrom(id) {
+					continue
+				}
+
+				select {
+				case <-i.stopCh:
+					return
+				case i.rawResCh <- id:
+				}
+			}
+		}
+
+		return
+	}
+
 	// look up all values of the given key and check for each of them if it
 	// matches the expression.
 	// if there's a match, push all ids of the value into the id chan
+	matchValue := i.expr.Matches
+	if valueMatcher, ok := i.expr.(tagquery.ValueMatcher); ok {
+		matchValue = valueMatcher.MatchValue
+		if valueMatcher.MatchAllValues() {
+			matchValue = nil
+		}
+	}
+
+	// values without the prefix of the pattern get skipped without evaluating the expression
+	prefix, exhaustive := indexablePrefix(i.expr)
+	if exhaustive {
+		matchValue = nil
+	}
+
 	for value, ids := range i.ctx.index[i.expr.GetKey()] {
-		if !i.expr.Matches(value) {
+		if !strings.HasPrefix(value, prefix) || (matchValue != nil && !matchValue(value)) {
 			continue
 		}
 
@@ -184,6 +219,21 @@ func (i *idSelector) byTagValueFromMetaTagIndex() {
 		return
 	}
 
+	if values, ok := literalAlternatives(i.expr); ok {
+		for _, value := range values {
+			for _, metaRecordId := range i.ctx.metaTagIndex[i.expr.GetKey()][value] {
+				select {
+				case <-i.stopCh:
+					return
+				default:
+				}
+				i.evaluateMetaRecord(metaRecordId)
+			}
+		}
+		return
+	}
+
+	prefix, exhaustive := indexablePrefix(i.expr)
 	for value, records := range i.ctx.metaTagIndex[i.expr.GetKey()] {
 		select {
 		case <-i.stopCh:
@@ -191,7 +241,7 @@ func (i *idSelector) byTagValueFromMetaTagIndex() {
 		default:
 		}
 
-		if !i.expr.Matches(value) {
+		if !strings.HasPrefix(value, prefix) || (!exhaustive && !i.expr.Matches(value)) {
 			continue
 		}
 
@@ -243,8 +293,9 @@ func (i *idSelector) byTagFromMetricTagIndex() {
 		return
 	}
 
+	prefix, exhaustive := indexablePrefix(i.expr)
 	for tag := range i.ctx.index {
-		if !i.expr.Matches(tag) {
+		if !strings.HasPrefix(tag, prefix) || (!exhaustive && !i.expr.Matches(tag)) {
 			continue
 		}
 
@@ -282,8 +333,9 @@ func (i *idSelector) byTagFromMetaTagIndex() {
 		return
 	}
 
+	prefix, exhaustive := indexablePrefix(i.expr)
 	for tag := range i.ctx.metaTagIndex {
-		if !i.expr.Matches(tag) {
+		if !strings.HasPrefix(tag, prefix) || (!exhaustive && !i.expr.Matches(tag)) {
 			continue
 		}
 
@@ -295,6 +347,25 @@ func (i *idSelector) byTagFromMetaTagIndex() {
 	}
 }
 
+// literalAlternatives returns the set of values which satisfy the given expression,
+// if it implements tagquery.LiteralAlternativesExpression and can be reduced to one
+func literalAlternatives(expr tagquery.Expression) ([]string, bool) {
+	if alternativesExpr, ok := expr.(tagquery.LiteralAlternativesExpression); ok {
+		return alternativesExpr.LiteralAlternatives()
+	}
+	return nil, false
+}
+
+// indexablePrefix returns the prefix which all values satisfying the given expression start with,
+// and whether every value with the prefix satisfies it. if the expression doesn't implement
+// tagquery.IndexablePrefixExpression the prefix is empty and all values need to be evaluated
+func indexablePrefix(expr tagquery.Expression) (string, bool) {
+	if prefixExpr, ok := expr.(tagquery.IndexablePrefixExpression); ok {
+		return prefixExpr.IndexablePrefix()
+	}
+	return "", false
+}
+
 // evaluateMetaRecord takes a meta record id, it then looks up the corresponding
 // meta record, builds a sub query from its expressions and executes the sub query
 func (i *idSelector) evaluateMetaRecord(id recordId) {
@@ -321,14 +392,19 @@ func (i *idSelector) evaluateMetaRecord(id recordId) {
 func (i *idSelector) subQueryFromExpressions(expressions tagquery.Expressions) (TagQueryContext, error) {
 	var queryCtx TagQueryContext
 
-	query, err := tagquery.NewQuery(expressions, i.ctx.query.From)
+	query, err := tagquery.NewQuery(expressions, i.ctx.query.From, i.ctx.query.To)
 	if err != nil {
 		// this means we've stored a meta record containing invalid queries
 		corruptIndex.Inc()
 		return queryCtx, err
 	}
 
-	queryCtx = NewTagQueryContext(query)
+	// the filters of sub queries get traced together with the ones of their parent query,
+	// and they share its decision memo
+	query.Trace = i.ctx.query.Trace
+	query.DecisionMemo = i.ctx.query.DecisionMemo
+
+	queryCtx = NewTagQueryContextWithContext(i.ctx.ctx, query)
 	queryCtx.subQuery = true
 
 	return queryCtx, nil
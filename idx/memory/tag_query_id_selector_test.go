@@ -308,3 +308,44 @@ func testSelectByMetaTagWhichRefersToItself(t *testing.T) {
 
 	selectAndCompareResults(t, query, metaRecords, expectedRes)
 }
+
+func TestSelectByIndexablePrefix(t *testing.T) {
+	_tagSupport := TagSupport
+	TagSupport = true
+	defer func() { TagSupport = _tagSupport }()
+	withAndWithoutPartitonedIndex(withAndWithoutMetaTagSupport(testSelectByIndexablePrefix))(t)
+}
+
+func testSelectByIndexablePrefix(t *testing.T) {
+	_, mds := getTestArchives(10)
+
+	type testCase struct {
+		expression string
+		expected   []int
+	}
+
+	testCases := []testCase{
+		// the prefix narrows the values down, the rest of the pattern still needs to be evaluated
+		{expression: "name=~some\\.id\\.of\\.a\\.metric\\.[4-5]$", expected: []int{4, 5}},
+		{expression: "tag1=~value[0-9]*[37]", expected: []int{3, 7}},
+		// the prefix is all there is to the pattern
+		{expression: "tag1=~value", expected: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{expression: "tag1=~other", expected: nil},
+		{expression: "__tag=~tag[2-9]", expected: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{expression: "__tag=~tag3", expected: nil},
+	}
+
+	for _, tc := range testCases {
+		expr, err := tagquery.ParseExpression(tc.expression)
+		if err != nil {
+			t.Fatalf("Failed to parse expression %q: %s", tc.expression, err)
+		}
+
+		expectedRes := make(IdSet)
+		for _, i := range tc.expected {
+			expectedRes[mds[i].Id] = struct{}{}
+		}
+
+		selectAndCompareResults(t, expr, nil, expectedRes)
+	}
+}
@@ -1,10 +1,12 @@
 package memory
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -59,6 +61,8 @@ func getTestIndex() (TagIndex, map[schema.MKey]*idx.Archive) {
 	byId := make(map[schema.MKey]*idx.Archive)
 
 	for i, d := range data {
+		// like the index does when adding metrics, the filters rely on the tags being sorted
+		sort.Strings(d.tags)
 		byId[d.id] = &idx.Archive{}
 		byId[d.id].Name = fmt.Sprintf("metric%d", i)
 		byId[d.id].Tags = d.tags
@@ -186,6 +190,37 @@ func TestQueryByTagWithUnequalEmpty(t *testing.T) {
 	queryAndCompareResults(t, NewTagQueryContext(q), expect)
 }
 
+func TestQueryByTagWithContradictingExpressions(t *testing.T) {
+	for _, expressions := range [][]string{
+		{"key1=value1", "key1!=value1"},
+		{"key1=value1", "key3!=", "key3="},
+		{"key1=value1", "key3=value3", "key3="},
+	} {
+		q, err := tagquery.NewQueryFromStrings(expressions, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		queryAndCompareResults(t, NewTagQueryContext(q), make(IdSet))
+	}
+}
+
+func TestQueryByTagWithMatchNoneExpression(t *testing.T) {
+	for _, expressions := range [][]string{
+		{"key1=value1", "key3!=~.*"},
+		{"key1=value1", "key2=~.*", "key4!=~^.*"},
+		{"name!=~.*", "key1=value1"},
+	} {
+		q, err := tagquery.NewQueryFromStrings(expressions, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !q.Unsatisfiable() {
+			t.Fatalf("Expected query %v to be unsatisfiable", expressions)
+		}
+		queryAndCompareResults(t, NewTagQueryContext(q), make(IdSet))
+	}
+}
+
 func TestQueryByTagNameEquals(t *testing.T) {
 	ids := getTestIDs()
 	q, _ := tagquery.NewQueryFromStrings([]string{"key1=value1", "key3=value3", "name=metric1"}, 0)
@@ -203,6 +238,24 @@ func TestQueryByTagNameRegex(t *testing.T) {
 	queryAndCompareResults(t, NewTagQueryContext(q), expect)
 }
 
+func TestQueryByTagWithTrace(t *testing.T) {
+	ids := getTestIDs()
+	q, _ := tagquery.NewQueryFromStrings([]string{"key1=value1", "key3=value3", "name=~metr"}, 0)
+	q.Trace = tagquery.NewQueryTrace()
+	expect := make(IdSet)
+	expect[ids[1]] = struct{}{}
+	expect[ids[3]] = struct{}{}
+	queryAndCompareResults(t, NewTagQueryContext(q), expect)
+
+	var evaluations uint64
+	for _, trace := range q.Trace.Expressions() {
+		evaluations += trace.Evaluations
+	}
+	if evaluations == 0 {
+		t.Fatalf("Expected the trace to have recorded the evaluations of the filters, got %+v", q.Trace.Expressions())
+	}
+}
+
 func TestQueryByTagFilterByTagMatchWithExpressionAndNameException(t *testing.T) {
 	ids := getTestIDs()
 	q, _ := tagquery.NewQueryFromStrings([]string{"__tag=~na", "key2=value2"}, 0)
@@ -457,7 +510,7 @@ TEST_CASES:
 			builder.WriteString(";")
 		}
 		t.Run(builder.String(), func(t *testing.T) {
-			query, err := tagquery.NewQuery(expressions, 0)
+			query, err := tagquery.NewQuery(expressions, 0, 0)
 			if err != nil {
 				t.Fatalf("Unexpected error when getting query from expressions %q: %q", expressions, err)
 			}
@@ -622,3 +675,205 @@ func TestExpressionSortingByCost(t *testing.T) {
 		}
 	}
 }
+
+func TestExpressionSortingByCostIsDeterministic(t *testing.T) {
+	query, err := tagquery.NewQueryFromStrings([]string{
+		"a=x",     // expected to be 2.
+		"b=~x",    // expected to be 4.
+		"b=~x.*y", // expected to be 5, the pattern is more complex
+		"c=x",     // expected to be 3, same cost and cardinality as "a=x"
+		"name=n",  // expected to be 1, the name is the most selective tag
+	}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error when instantiating query: %s", err)
+	}
+
+	expectedIdxPositions := []int{4, 0, 3, 1, 2}
+	for i := 0; i < 10; i++ {
+		queryCtx := NewTagQueryContext(query)
+		queryCtx.index = TagIndex{
+			"a":    {"x": {}},
+			"b":    {"x": {}},
+			"c":    {"x": {}},
+			"name": {"n": {}, "m": {}},
+		}
+
+		costs := queryCtx.evaluateExpressionCosts()
+		for i, expectedIdxPosition := range expectedIdxPositions {
+			if costs[i].expressionIdx != expectedIdxPosition {
+				t.Fatalf("Order of expressions is not as expected\nExpected:\n%+v\nGot:\n%+v\n", expectedIdxPositions, costs)
+			}
+		}
+	}
+}
+
+// regular expressions which match the empty value also match metrics without the tag,
+// so the query must not start with them even if they are the cheapest expression
+func TestInitialExpressionRequiresNonEmptyValue(t *testing.T) {
+	for _, expressions := range [][]string{
+		{"a=~x*", "b=~y+"},
+		{"a!=~.+", "b=~y+"},
+		{"a=~.*", "b=~y+"},
+		{"__tag=~x*", "b=~y+"},
+	} {
+		query, err := tagquery.NewQueryFromStrings(expressions, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error when instantiating query: %s", err)
+		}
+
+		queryCtx := NewTagQueryContext(query)
+		queryCtx.index = TagIndex{
+			"a": {"x": {}},
+			"b": {"y": {}, "yy": {}, "yyy": {}},
+		}
+		queryCtx.prepareExpressions()
+
+		if res := query.Expressions.Strings()[queryCtx.startWith]; res != "b=~y+" {
+			t.Fatalf("Expected query %+v to start with \"b=~y+\", got %q", expressions, res)
+		}
+	}
+}
+
+// getBatchTestIndex returns an index with the given number of metrics which all have
+// the tag dc=us-east and a unique value of the tag host
+func getBatchTestIndex(count int) (TagIndex, map[schema.MKey]*idx.Archive) {
+	tagIdx := make(TagIndex)
+	byId := make(map[schema.MKey]*idx.Archive)
+	for i := 0; i < count; i++ {
+		id := test.GetMKey(i)
+		byId[id] = &idx.Archive{}
+		byId[id].Name = fmt.Sprintf("metric%d", i)
+		byId[id].Tags = []string{"dc=us-east", "host=web-" + strconv.Itoa(i)}
+		for _, tag := range byId[id].Tags {
+			tagSplits := strings.Split(tag, "=")
+			tagIdx.addTagId(tagSplits[0], tagSplits[1], id)
+		}
+	}
+	return tagIdx, byId
+}
+
+// runBatchTestQuery runs a query which starts with dc=us-east and filters by a regex on host,
+// it returns the number of results. the pattern is not one which gets evaluated without running
+// the regular expression, so every metric costs one regex evaluation
+func runBatchTestQuery(t *testing.T, ctx context.Context, tagIdx TagIndex, byId map[schema.MKey]*idx.Archive) int {
+	query, err := tagquery.NewQueryFromStrings([]string{"dc=us-east", "host=~web-[0-9]*[0-9]"}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error when instantiating query: %s", err)
+	}
+
+	resCh := make(chan schema.MKey)
+	q := NewTagQueryContextWithContext(ctx, query)
+	q.RunNonBlocking(tagIdx, byId, nil, nil, resCh)
+	res := 0
+	for range resCh {
+		res++
+	}
+	return res
+}
+
+func TestQueryByTagWithContext(t *testing.T) {
+	// enough metrics to fill multiple batches of the filter workers and a partial one
+	count := 3*filterBatchSize*TagQueryWorkers + 5
+	tagIdx, byId := getBatchTestIndex(count)
+	run := func(ctx context.Context) int {
+		return runBatchTestQuery(t, ctx, tagIdx, byId)
+	}
+
+	if res := run(context.Background()); res != count {
+		t.Fatalf("Expected %d results, got %d", count, res)
+	}
+
+	// the query still terminates, but the filter workers don't let any metric pass
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if res := run(ctx); res != 0 {
+		t.Fatalf("Expected no results with a canceled context, got %d", res)
+	}
+}
+
+// the index passes the context of the request to the query
+// getBatchTestMemoryIdx returns an index with the same metrics as getBatchTestIndex
+func getBatchTestMemoryIdx(t *testing.T, count int) *UnpartitionedMemoryIdx {
+	ix := NewUnpartitionedMemoryIdx()
+	for i := 0; i < count; i++ {
+		md := schema.MetricData{Name: fmt.Sprintf("metric%d", i), OrgId: 1, Interval: 1, Time: 1}
+		md.Tags = []string{"dc=us-east", "host=web-" + strconv.Itoa(i)}
+		md.SetId()
+		mkey, err := schema.MKeyFromString(md.Id)
+		if err != nil {
+			t.Fatalf("Unexpected error when getting mkey from string %s: %s", md.Id, err)
+		}
+		ix.AddOrUpdate(mkey, &md, 1)
+	}
+	return ix
+}
+
+func TestFindByTagWithContext(t *testing.T) {
+	count := 3*filterBatchSize*TagQueryWorkers + 5
+	ix := getBatchTestMemoryIdx(t, count)
+
+	query, err := tagquery.NewQueryFromStrings([]string{"dc=us-east", "host=~web-[0-9]*[0-9]"}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error when instantiating query: %s", err)
+	}
+
+	res, err := ix.FindByTag(context.Background(), 1, query)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res) != count {
+		t.Fatalf("Expected %d results, got %d", count, len(res))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if res, _ := ix.FindByTag(ctx, 1, query); len(res) != 0 {
+		t.Fatalf("Expected no results with a canceled context, got %d", len(res))
+	}
+}
+
+func TestQueryByTagWithRegexBudget(t *testing.T) {
+	defer func(budget uint64) { tagQueryRegexBudget = budget }(tagQueryRegexBudget)
+
+	count := 10 * tagquery.FilterBatchCheckInterval * TagQueryWorkers
+	ix := getBatchTestMemoryIdx(t, count)
+	query, err := tagquery.NewQueryFromStrings([]string{"dc=us-east", "host=~web-[0-9]*[0-9]"}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error when instantiating query: %s", err)
+	}
+
+	tagQueryRegexBudget = uint64(count)
+	res, err := ix.FindByTag(context.Background(), 1, query)
+	if err != nil {
+		t.Fatalf("Unexpected error within the budget: %s", err)
+	}
+	if len(res) != count {
+		t.Fatalf("Expected %d results within the budget, got %d", count, len(res))
+	}
+
+	// every metric requires one regex evaluation of its host, so the filter workers stop
+	// early and the caller gets the error instead of an incomplete result
+	tagQueryRegexBudget = 10
+	exceededBefore := statRegexBudgetExceeded.Peek()
+	res, err = ix.FindByTag(context.Background(), 1, query)
+	if err != tagquery.ErrRegexBudgetExceeded {
+		t.Fatalf("Expected ErrRegexBudgetExceeded, got %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("Expected no results after exceeding the budget, got %d", len(res))
+	}
+	if exceeded := statRegexBudgetExceeded.Peek() - exceededBefore; exceeded != 1 {
+		t.Fatalf("Expected the exceeded budget to be counted once, got %d", exceeded)
+	}
+
+	if _, err := ix.FindTagValuesWithQuery(context.Background(), 1, "dc", "", query, 10); err != tagquery.ErrRegexBudgetExceeded {
+		t.Fatalf("Expected ErrRegexBudgetExceeded from FindTagValuesWithQuery, got %v", err)
+	}
+	if _, err := ix.DeleteTagged(context.Background(), 1, query); err != tagquery.ErrRegexBudgetExceeded {
+		t.Fatalf("Expected ErrRegexBudgetExceeded from DeleteTagged, got %v", err)
+	}
+	tagQueryRegexBudget = 0
+	if res, _ := ix.FindByTag(context.Background(), 1, query); len(res) != count {
+		t.Fatalf("Expected DeleteTagged to not delete anything after exceeding the budget, found %d of %d metrics", len(res), count)
+	}
+}